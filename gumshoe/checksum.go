@@ -0,0 +1,142 @@
+// Checksums for detecting corrupted segment and dimension table files.
+//
+// A checksum of each segment (as stored, after encoding and compression) is recorded in the metadata
+// alongside the interval, and each dimension table records the checksum of its file. Dimension tables are
+// verified as they are loaded. The segments of an interval are verified either when the DB is opened (if
+// RunConfig.VerifyChecksumsOnOpen is set) or else the first time the interval is read. An interval which
+// fails verification is excluded from queries. So that its data may still be recovered, it is otherwise
+// kept as it is: it is never rewritten, rolled up, or dropped (even past the retention period), and new rows
+// for it are written as a separate run.
+
+package gumshoe
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(b []byte) uint32 { return crc32.Checksum(b, checksumTable) }
+
+// A ChecksumError indicates that the contents of a file don't match the checksum recorded in the metadata.
+type ChecksumError struct {
+	Filename string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch in %s", e.Filename)
+}
+
+// VerifyFileChecksum checks the contents of filename against sum, the checksum recorded in the metadata for a
+// segment or dimension table file. It returns a *ChecksumError if they don't match.
+func VerifyFileChecksum(filename string, sum uint32) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if checksum(b) != sum {
+		return &ChecksumError{filename}
+	}
+	return nil
+}
+
+// Verify checks the segments of the interval (and of its runs) against their checksums and returns an error
+// if the interval is corrupted or cannot be read. The result is cached, so only the first call reads the
+// segments, unless the interval couldn't be read for another reason than corruption (see isCorruption): say,
+// because the process is out of file descriptors. Then the error is returned without being cached, and the
+// interval is verified again the next time. Intervals written before checksums were recorded can only be
+// checked for missing segment files.
+func (iv *Interval) Verify(s *Schema) error {
+	iv.verifyMu.Lock()
+	defer iv.verifyMu.Unlock()
+	if iv.verified {
+		return iv.verifyErr
+	}
+	err := iv.verifySegments(s)
+	for _, run := range iv.Runs {
+		if err != nil {
+			break
+		}
+		err = run.Verify(s)
+	}
+	if err != nil && !isCorruption(err) {
+		return err
+	}
+	iv.verified = true
+	iv.verifyErr = err
+	return err
+}
+
+func (iv *Interval) verifySegments(s *Schema) error {
+	hasChecksums := len(iv.Checksums) == len(iv.Segments)
+	for i, segment := range iv.Segments {
+		if err := segment.acquire(); err != nil {
+			return err
+		}
+		ok := !hasChecksums || checksum(segment.Bytes) == iv.Checksums[i]
+		segment.release()
+		if !ok {
+			return &ChecksumError{iv.SegmentFilename(s, i)}
+		}
+	}
+	return nil
+}
+
+// isCorruption reports whether err, returned by Verify, means that the interval is corrupted: either one of
+// its files doesn't match its checksum or it is missing.
+func isCorruption(err error) bool {
+	_, ok := err.(*ChecksumError)
+	return ok || os.IsNotExist(err)
+}
+
+// markCorrupted records that the interval is corrupted (e.g., because one of its dimension tables failed
+// verification).
+func (iv *Interval) markCorrupted(err error) {
+	iv.verifyMu.Lock()
+	defer iv.verifyMu.Unlock()
+	iv.verified = true
+	iv.verifyErr = err
+}
+
+// knownCorruption returns the error found by a previous call to Verify, if any, without verifying the
+// interval.
+func (iv *Interval) knownCorruption() error {
+	iv.verifyMu.Lock()
+	defer iv.verifyMu.Unlock()
+	return iv.verifyErr
+}
+
+// verifyIntervals verifies all the intervals of s, logging any which are corrupted.
+func (s *StaticTable) verifyIntervals() {
+	start := time.Now()
+	corrupted := 0
+	for _, interval := range s.Intervals.sorted() {
+		if err := interval.Verify(s.Schema); err != nil {
+			Log.Printf("Interval at %s is corrupted: %s", interval.Start, err)
+			corrupted++
+		}
+	}
+	Log.Printf("Verified %d intervals in %s (%d corrupted)", len(s.Intervals), time.Since(start), corrupted)
+}
+
+// A CorruptedInterval describes an interval which failed checksum verification.
+type CorruptedInterval struct {
+	Start time.Time
+	Error string
+}
+
+// CorruptedIntervals returns the intervals which are known to be corrupted, in order. Intervals which haven't
+// been read yet are not verified.
+func (s *StaticTable) CorruptedIntervals() []CorruptedInterval {
+	var corrupted []CorruptedInterval
+	for _, interval := range s.Intervals.sorted() {
+		if err := interval.knownCorruption(); err != nil {
+			corrupted = append(corrupted, CorruptedInterval{interval.Start, err.Error()})
+		}
+	}
+	return corrupted
+}
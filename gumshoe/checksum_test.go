@@ -0,0 +1,158 @@
+package gumshoe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func makeChecksumTestDB(t *testing.T) (db *DB, dir string) {
+	db = makeTestPersistentDB()
+	insertRows(db, []RowMap{
+		{"at": hour(0), "dim1": "a", "metric1": 1.0},
+		{"at": hour(1), "dim1": "b", "metric1": 2.0},
+	})
+	return db, db.Dir
+}
+
+// corruptFile flips the bits of the last byte of filename.
+func corruptFile(t *testing.T, filename string) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := ioutil.WriteFile(filename, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorruptedIntervalsAreExcludedFromQueries(t *testing.T) {
+	db, dir := makeChecksumTestDB(t)
+	defer os.RemoveAll(dir)
+	corruptedStart := time.Unix(int64(hour(1)), 0)
+	resp := db.MakeRequest()
+	filename := resp.StaticTable.Intervals[corruptedStart].SegmentFilename(db.Schema, 0)
+	resp.Done()
+	closeTestDB(db)
+	corruptFile(t, filename)
+
+	// Verification at open time.
+	schema := schemaFixture()
+	schema.DiskBacked = true
+	schema.Dir = dir
+	schema.VerifyChecksumsOnOpen = true
+	db, err := OpenDB(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := db.GetCorruptedIntervals()
+	Assert(t, len(corrupted), Equals, 1)
+	Assert(t, corrupted[0].Start.Equal(corruptedStart), IsTrue)
+	Assert(t, corrupted[0].Error, StringContains, "checksum mismatch")
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 1)
+
+	// Lazy verification.
+	db.VerifyChecksumsOnOpen = false
+	db = reopenTestDB(db)
+	Assert(t, len(db.GetCorruptedIntervals()), Equals, 0)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 1)
+	Assert(t, len(db.GetCorruptedIntervals()), Equals, 1)
+
+	// New data for the corrupted interval is kept in a separate run, and the corrupted segment stays on disk.
+	insertRow(db, RowMap{"at": hour(1), "dim1": "c", "metric1": 4.0})
+	Assert(t, len(db.GetCorruptedIntervals()), Equals, 1)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 1)
+	resp = db.MakeRequest()
+	Assert(t, len(resp.StaticTable.Intervals[corruptedStart].Runs), Equals, 1)
+	resp.Done()
+	_, err = os.Stat(filename)
+	Assert(t, err, IsNil)
+	closeTestDB(db)
+}
+
+func TestCorruptedIntervalsAreNotDropped(t *testing.T) {
+	db, dir := makeChecksumTestDB(t)
+	defer os.RemoveAll(dir)
+	corruptedStart := time.Unix(int64(hour(1)), 0)
+	resp := db.MakeRequest()
+	filename := resp.StaticTable.Intervals[corruptedStart].SegmentFilename(db.Schema, 0)
+	resp.Done()
+	corruptFile(t, filename)
+
+	// Neither the retention period nor a rollup (over both intervals) drops the corrupted interval.
+	db.Retention = time.Hour
+	db.FixedRetention = true
+	db.Rollups = []RollupPolicy{{After: time.Hour, IntervalDuration: 24 * time.Hour}}
+	db = reopenTestDB(db)
+	defer closeTestDB(db)
+	Assert(t, len(db.GetCorruptedIntervals()), Equals, 0)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, len(db.GetCorruptedIntervals()), Equals, 1)
+	resp = db.MakeRequest()
+	Assert(t, len(resp.StaticTable.Intervals), Equals, 1)
+	Assert(t, resp.StaticTable.Intervals[corruptedStart], NotNil)
+	resp.Done()
+	_, err := os.Stat(filename)
+	Assert(t, err, IsNil)
+
+	// The values used by the corrupted interval can't be known, so the dimension tables aren't compacted.
+	if err := db.CompactDimensionTables(); err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, db.GetDimensionTables()["dim1"], DeepEquals, []string{"a", "b"})
+}
+
+func TestCorruptedDimensionTablesAreDetected(t *testing.T) {
+	db, dir := makeChecksumTestDB(t)
+	defer os.RemoveAll(dir)
+	schema := db.Schema
+	closeTestDB(db)
+	files, err := filepath.Glob(filepath.Join(dir, "dimension.*.gob.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, len(files), Equals, 1)
+	corruptFile(t, files[0])
+
+	_, err = OpenDB(schema)
+	Assert(t, err, NotNil)
+	_, ok := err.(*ChecksumError)
+	Assert(t, ok, IsTrue)
+}
+
+func TestIntervalsWhichCannotBeReadAreNotMarkedCorrupted(t *testing.T) {
+	db, dir := makeChecksumTestDB(t)
+	defer os.RemoveAll(dir)
+	db = reopenTestDB(db)
+	defer closeTestDB(db)
+
+	// A directory in place of a segment file can be opened but not mapped.
+	filename := segmentFiles(t, dir)[0]
+	if err := os.Rename(filename, filename+".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filename, 0777); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.GetQueryResult(createQuery())
+	Assert(t, err, NotNil)
+	Assert(t, len(db.GetCorruptedIntervals()), Equals, 0)
+
+	// Once the segment can be read again, so can the interval.
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 3)
+}
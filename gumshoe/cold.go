@@ -0,0 +1,171 @@
+// Tiered storage (RunConfig.ColdDir).
+//
+// The intervals which ended more than ColdAfter ago are moved from Dir to ColdDir. With background
+// compaction, the moves are compactions done by the compaction goroutines, since ColdDir is usually on
+// another filesystem and a move copies all of an interval's files; otherwise each flush does them. Every run
+// records whether its files are in the cold tier, and SegmentFilename and DimensionTableFilename resolve to
+// the right directory, so loading, querying, and cleaning up intervals work the same for both tiers. New runs
+// (and rewrites of cold intervals) are always written to Dir and moved later.
+//
+// The copied files and ColdDir are synced before the new interval is returned, so that the metadata never
+// refers to cold files which may not have reached the disk; the files in Dir are deleted after the metadata
+// has been written.
+
+package gumshoe
+
+import (
+	"os"
+	"time"
+)
+
+// needsColdStorage reports whether interval has aged past ColdAfter and has runs which are not yet in
+// ColdDir.
+func (db *DB) needsColdStorage(interval *Interval) bool {
+	if !db.DiskBacked || db.ColdDir == "" || time.Since(interval.End) <= db.ColdAfter {
+		return false
+	}
+	return len(interval.hotRuns()) > 0
+}
+
+// hotRuns returns the runs of iv whose files are in Dir.
+func (iv *Interval) hotRuns() []*Interval {
+	var runs []*Interval
+	for _, run := range iv.AllRuns() {
+		if !run.Cold {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+// moveIntervalsToColdStorage replaces the intervals which have aged past ColdAfter with copies whose files
+// are in ColdDir. It returns the runs which were moved; their files in Dir should be cleaned up once the new
+// intervals are installed. An interval which cannot be moved is left in Dir (and retried by the next flush).
+// This is only used without background compaction.
+func (db *DB) moveIntervalsToColdStorage(intervals map[time.Time]*Interval) (moved []*Interval) {
+	for t, interval := range intervals {
+		if !db.needsColdStorage(interval) {
+			continue
+		}
+		coldInterval, err := db.moveIntervalToColdStorage(interval)
+		if err != nil {
+			Log.Printf("Error moving interval at %s to cold storage: %s", t, err)
+			continue
+		}
+		intervals[t] = coldInterval
+		moved = append(moved, interval.hotRuns()...)
+	}
+	if len(moved) > 0 {
+		Log.Printf("Flush: moved %d interval runs to cold storage", len(moved))
+	}
+	return moved
+}
+
+// moveIntervalToColdStorage copies the runs of interval which are not yet in ColdDir there and returns the
+// new interval. The files of the original runs are left in place.
+func (db *DB) moveIntervalToColdStorage(interval *Interval) (*Interval, error) {
+	var runs, copied []*Interval
+	for _, run := range interval.AllRuns() {
+		if run.Cold {
+			runs = append(runs, run)
+			continue
+		}
+		coldRun, err := db.copyRunToColdStorage(run)
+		if err != nil {
+			for _, coldRun := range copied {
+				db.cleanUpIntervalRun(coldRun)
+			}
+			return nil, err
+		}
+		runs = append(runs, coldRun)
+		copied = append(copied, coldRun)
+	}
+	if err := SyncFile(db.ColdDir); err != nil {
+		for _, coldRun := range copied {
+			db.cleanUpIntervalRun(coldRun)
+		}
+		return nil, err
+	}
+	result := runs[0].shallowCopy()
+	result.Runs = runs[1:]
+	return result, nil
+}
+
+// cleanUpColdCopy deletes the files which were copied to ColdDir for coldInterval, a copy of interval made
+// by moveIntervalToColdStorage which is not going to be used.
+func (db *DB) cleanUpColdCopy(interval, coldInterval *Interval) {
+	runs := interval.AllRuns()
+	for i, coldRun := range coldInterval.AllRuns() {
+		if !runs[i].Cold {
+			db.cleanUpIntervalRun(coldRun)
+		}
+	}
+}
+
+// copyRunToColdStorage copies the segment and dimension table files of the (hot) run to ColdDir and returns a
+// copy of run which uses them.
+func (db *DB) copyRunToColdStorage(run *Interval) (*Interval, error) {
+	coldRun := run.shallowCopy()
+	coldRun.Runs = nil
+	coldRun.Cold = true
+	coldRun.Segments = make([]*Segment, run.NumSegments)
+	for i := range coldRun.Segments {
+		coldRun.Segments[i] = db.fileSegment(coldRun.SegmentFilename(db.Schema, i))
+	}
+	if err := db.copyRunFiles(run, coldRun); err != nil {
+		// Remove whichever files were copied.
+		for i := 0; i < coldRun.NumSegments; i++ {
+			os.Remove(coldRun.SegmentFilename(db.Schema, i))
+		}
+		for i := range coldRun.DimensionTables {
+			os.Remove(coldRun.DimensionTableFilename(db.Schema, i))
+		}
+		return nil, err
+	}
+	return coldRun, nil
+}
+
+func (db *DB) copyRunFiles(run, coldRun *Interval) error {
+	for i, dimTable := range run.DimensionTables {
+		if dimTable == nil {
+			continue
+		}
+		filename := coldRun.DimensionTableFilename(db.Schema, i)
+		err := linkOrCopyFile(run.DimensionTableFilename(db.Schema, i), filename)
+		if os.IsNotExist(err) {
+			// Tables added by a schema change may never have been written.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := SyncFile(filename); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < run.NumSegments; i++ {
+		filename := coldRun.SegmentFilename(db.Schema, i)
+		if err := linkOrCopyFile(run.SegmentFilename(db.Schema, i), filename); err != nil {
+			return err
+		}
+		if err := SyncFile(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hotCopy returns a copy of iv (and its runs) with none of the runs marked as cold, for describing a copy of
+// the interval's files in Dir.
+func (iv *Interval) hotCopy() *Interval {
+	var runs []*Interval
+	for _, run := range iv.Runs {
+		hotRun := run.shallowCopy()
+		hotRun.Cold = false
+		runs = append(runs, hotRun)
+	}
+	result := iv.shallowCopy()
+	result.Cold = false
+	result.Runs = runs
+	return result
+}
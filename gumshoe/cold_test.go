@@ -0,0 +1,75 @@
+package gumshoe
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestOldIntervalsAreMovedToColdStorage(t *testing.T) {
+	for _, intervalDimensionTables := range []bool{false, true} {
+		// With background compaction, the compaction goroutines move the intervals instead of the flushes.
+		for _, compactionParallelism := range []int{0, 1} {
+			testOldIntervalsAreMovedToColdStorage(t, intervalDimensionTables, compactionParallelism)
+		}
+	}
+}
+
+func testOldIntervalsAreMovedToColdStorage(t *testing.T, intervalDimensionTables bool,
+	compactionParallelism int) {
+	db := makeTestPersistentDB(func(schema *Schema) {
+		schema.ColdDir = filepath.Join(schema.Dir, "cold")
+		schema.ColdAfter = 3 * 24 * time.Hour
+		schema.IntervalDimensionTables = intervalDimensionTables
+		schema.CompactionParallelism = compactionParallelism
+	})
+	dir := db.Dir
+	defer os.RemoveAll(dir)
+	coldDir := db.ColdDir
+
+	now := time.Now().Truncate(time.Hour)
+	old := float64(now.Add(-10 * 24 * time.Hour).Unix())
+	recent := float64(now.Unix())
+	insertRows(db, []RowMap{
+		{"at": old, "dim1": "a", "metric1": 1.0},
+		{"at": recent, "dim1": "b", "metric1": 2.0},
+	})
+	waitForCompactions(t, db)
+	Assert(t, len(segmentFiles(t, dir)), Equals, 1)
+	Assert(t, len(segmentFiles(t, coldDir)), Equals, 1)
+
+	// New rows for a cold interval are written to Dir and then moved.
+	insertRow(db, RowMap{"at": old, "dim1": "c", "metric1": 4.0})
+	waitForCompactions(t, db)
+	Assert(t, len(segmentFiles(t, dir)), Equals, 1)
+	Assert(t, len(segmentFiles(t, coldDir)), Equals, 1)
+
+	expected := []UnpackedRow{
+		{RowMap: RowMap{"at": old, "dim1": "a", "metric1": 1.0}, Count: 1},
+		{RowMap: RowMap{"at": old, "dim1": "c", "metric1": 4.0}, Count: 1},
+		{RowMap: RowMap{"at": recent, "dim1": "b", "metric1": 2.0}, Count: 1},
+	}
+	Assert(t, db.GetDebugRows(), util.DeepConvertibleEquals, expected)
+	results := runQuery(db, createQuery())
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 7)
+
+	db = reopenTestDB(db)
+	Assert(t, db.GetDebugRows(), util.DeepConvertibleEquals, expected)
+	Assert(t, db.GetCorruptedIntervals(), IsNil)
+
+	// A snapshot has all its files in one directory.
+	snapshotDir := filepath.Join(dir, "snapshot")
+	Assert(t, db.Snapshot(snapshotDir), IsNil)
+	closeTestDB(db)
+	snapshot, err := OpenDBDir(snapshotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, snapshot.GetDebugRows(), util.DeepConvertibleEquals, expected)
+	closeTestDB(snapshot)
+}
@@ -0,0 +1,434 @@
+// Background compaction (RunConfig.CompactionParallelism).
+//
+// Without background compaction, all the work of merging intervals happens inside flush on the inserter
+// goroutine. With it, a pool of compaction goroutines takes over the work which doesn't involve new rows:
+// merging the runs of intervals which have too many runs or whose segments are badly fragmented (see
+// interval_runs.go), rolling up groups of static intervals which have aged past a rollup policy, and moving
+// old intervals to cold storage (see cold.go).
+//
+// The inserter goroutine schedules the compactions (after each flush and periodically), reserving a
+// generation for each new interval so that it cannot collide with anything written by a flush in the
+// meantime. A compaction goroutine writes out the new interval and hands the result back to the inserter,
+// which swaps it into a new StaticTable through the flushes channel just like a flush does. If the intervals
+// being replaced have changed in the meantime (say, a flush combined them with new rows), the result is
+// abandoned instead. The compaction doesn't hold a request on the StaticTable, which would make every flush
+// wait for it; instead, the files of an interval which is dropped while a compaction is reading it are only
+// cleaned up once the compaction is done with it.
+
+package gumshoe
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// compactionCheckInterval is how often the inserter looks for intervals to compact (in addition to after
+// every flush).
+const compactionCheckInterval = 10 * time.Second
+
+// compactionFragmentation is the factor by which the number of segments in an interval with several runs
+// may exceed the number needed to hold its rows before the runs are merged.
+const compactionFragmentation = 2
+
+type compactionKind int
+
+const (
+	compactionMergeRuns compactionKind = iota
+	compactionRollup
+	compactionMoveToColdStorage
+)
+
+func (k compactionKind) String() string {
+	switch k {
+	case compactionMergeRuns:
+		return "merge"
+	case compactionRollup:
+		return "rollup"
+	case compactionMoveToColdStorage:
+		return "cold storage move"
+	}
+	panic("unknown compaction kind")
+}
+
+// A compactionTask describes a set of static intervals which are to be replaced by a single new interval.
+type compactionTask struct {
+	Kind       compactionKind
+	Start      time.Time   // The start of the new interval
+	Sources    IntervalMap // The intervals to be replaced
+	Generation int         // The generation of the new interval (unused by moves, which keep the generations)
+	Group      *rollupGroup
+
+	mu       sync.Mutex
+	done     bool        // Whether the compaction is done reading Sources
+	obsolete []*Interval // Sources which were dropped from the StaticTable before the compaction was done
+}
+
+// deferCleanUp records that interval, one of the sources of t, is no longer used by the StaticTable, so that
+// it is cleaned up once the compaction is done reading it. It returns false if that is already the case.
+func (t *compactionTask) deferCleanUp(interval *Interval) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return false
+	}
+	t.obsolete = append(t.obsolete, interval)
+	return true
+}
+
+// sourcesDropped reports whether any of the sources of t has been dropped from the StaticTable.
+func (t *compactionTask) sourcesDropped() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.obsolete) > 0
+}
+
+// finishReading marks the compaction as done reading its sources and returns the ones which must now be
+// cleaned up.
+func (t *compactionTask) finishReading() []*Interval {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done = true
+	return t.obsolete
+}
+
+type compactionResult struct {
+	Task     *compactionTask
+	Interval *Interval // Nil if the task was abandoned or failed
+	Err      error
+}
+
+// CompactionStats counts the background compactions of a DB.
+type CompactionStats struct {
+	Queued    int64 // Scheduled but not yet started
+	Running   int64 // Started but not yet swapped in
+	Completed int64
+	Failed    int64
+	Abandoned int64 // Thrown away because the intervals changed while they were being compacted
+}
+
+type compactor struct {
+	tasks   chan *compactionTask
+	results chan *compactionResult
+	// inFlight maps the start times of the intervals being compacted and of the intervals being written to
+	// their tasks. It is owned by the inserter goroutine.
+	inFlight map[time.Time]*compactionTask
+	stats    CompactionStats // Accessed atomically
+	workers  sync.WaitGroup  // The running compaction goroutines
+}
+
+func newCompactor(parallelism int) *compactor {
+	return &compactor{
+		tasks:    make(chan *compactionTask, parallelism),
+		results:  make(chan *compactionResult),
+		inFlight: make(map[time.Time]*compactionTask),
+	}
+}
+
+// nextGeneration returns the generation to use for a new interval starting at start which replaces
+// intervals. It is greater than the generations of all their runs, of the current static interval at the
+// same start time (if any), and of any interval being written by a compaction at the same start time.
+func (db *DB) nextGeneration(start time.Time, intervals ...*Interval) int {
+	generation := 0
+	// The current interval may be dropped without being one of the replaced intervals (say, by a re-import),
+	// but its files are only deleted after the new interval has been written.
+	if interval, ok := db.StaticTable.Intervals[start]; ok {
+		generation = interval.nextGeneration()
+	}
+	if db.compactor != nil {
+		if task, ok := db.compactor.inFlight[start]; ok && task.Generation >= generation {
+			generation = task.Generation + 1
+		}
+	}
+	for _, interval := range intervals {
+		if interval.nextGeneration() > generation {
+			generation = interval.nextGeneration()
+		}
+	}
+	return generation
+}
+
+// scheduleCompactions queues as many compactions as will fit in the compaction queue. This should only be
+// called by the inserter goroutine.
+func (db *DB) scheduleCompactions() {
+	c := db.compactor
+	for _, task := range db.findCompactions() {
+		atomic.AddInt64(&c.stats.Queued, 1)
+		select {
+		case c.tasks <- task:
+		default:
+			atomic.AddInt64(&c.stats.Queued, -1)
+			return
+		}
+		c.inFlight[task.Start] = task
+		for key := range task.Sources {
+			c.inFlight[key] = task
+		}
+	}
+}
+
+// findCompactions returns the compactions which should be done, most important first: pending rollups, then
+// merges of the intervals with the most runs, and then moves to cold storage. Intervals which are already
+// being compacted, which are known to be corrupted, or which have new rows waiting in the MemTable are left
+// alone.
+func (db *DB) findCompactions() []*compactionTask {
+	available := func(key time.Time) bool {
+		if _, ok := db.compactor.inFlight[key]; ok {
+			return false
+		}
+		if _, ok := db.memTable.Intervals[key]; ok {
+			return false
+		}
+		interval, ok := db.StaticTable.Intervals[key]
+		return !ok || interval.knownCorruption() == nil
+	}
+
+	staticKeys := make([]time.Time, 0, len(db.StaticTable.Intervals))
+	for t := range db.StaticTable.Intervals {
+		staticKeys = append(staticKeys, t)
+	}
+	sort.Sort(times(staticKeys))
+
+	var tasks []*compactionTask
+	groups, _, remainingKeys := db.rollupGroups(nil, staticKeys)
+	var groupStarts []time.Time
+	for start := range groups {
+		groupStarts = append(groupStarts, start)
+	}
+	sort.Sort(times(groupStarts))
+groupLoop:
+	for _, start := range groupStarts {
+		group := groups[start]
+		if group.rolledUp(db.StaticTable.Intervals) || !available(start) {
+			continue
+		}
+		sources := make(IntervalMap)
+		var intervals []*Interval
+		for _, key := range group.StaticKeys {
+			if !available(key) {
+				continue groupLoop
+			}
+			sources[key] = db.StaticTable.Intervals[key]
+			intervals = append(intervals, sources[key])
+		}
+		tasks = append(tasks, &compactionTask{
+			Kind:       compactionRollup,
+			Start:      start,
+			Sources:    sources,
+			Generation: db.nextGeneration(start, intervals...),
+			Group:      group,
+		})
+	}
+
+	var merges []*compactionTask
+	for _, key := range remainingKeys {
+		interval := db.StaticTable.Intervals[key]
+		if !db.needsMerge(interval) || !available(key) {
+			continue
+		}
+		merges = append(merges, &compactionTask{
+			Kind:       compactionMergeRuns,
+			Start:      key,
+			Sources:    IntervalMap{key: interval},
+			Generation: db.nextGeneration(key, interval),
+		})
+	}
+	sort.Stable(byRuns(merges))
+	tasks = append(tasks, merges...)
+
+	// Intervals which are being merged are moved once that is done.
+	for _, key := range remainingKeys {
+		interval := db.StaticTable.Intervals[key]
+		if !db.needsColdStorage(interval) || db.needsMerge(interval) || !available(key) {
+			continue
+		}
+		tasks = append(tasks, &compactionTask{
+			Kind:    compactionMoveToColdStorage,
+			Start:   key,
+			Sources: IntervalMap{key: interval},
+		})
+	}
+	return tasks
+}
+
+// needsMerge reports whether interval has more runs than allowed or has several runs whose segments are
+// much more numerous than necessary.
+func (db *DB) needsMerge(interval *Interval) bool {
+	if len(interval.Runs) == 0 {
+		return false
+	}
+	runs := interval.AllRuns()
+	if len(runs) > db.MaxIntervalRuns {
+		return true
+	}
+	segments, rows := 0, 0
+	for _, run := range runs {
+		segments += run.NumSegments
+		rows += run.NumRows
+	}
+	rowsPerSegment := db.SegmentSize / db.RowSize
+	minSegments := (rows + rowsPerSegment - 1) / rowsPerSegment
+	return segments > compactionFragmentation*minSegments
+}
+
+// byRuns orders merge tasks by decreasing number of runs.
+type byRuns []*compactionTask
+
+func (b byRuns) Len() int { return len(b) }
+func (b byRuns) Less(i, j int) bool {
+	return len(b[i].Sources[b[i].Start].Runs) > len(b[j].Sources[b[j].Start].Runs)
+}
+func (b byRuns) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+// RunCompactionWorker does queued compactions until the DB is shut down. The caller must have added it to
+// db.compactor.workers.
+func (db *DB) RunCompactionWorker() {
+	c := db.compactor
+	defer c.workers.Done()
+	for {
+		select {
+		case <-db.shutdown:
+			return
+		case task := <-c.tasks:
+			// Counted as running first so that the task is never seen as neither queued nor running.
+			atomic.AddInt64(&c.stats.Running, 1)
+			atomic.AddInt64(&c.stats.Queued, -1)
+			result := db.compact(task)
+			for _, interval := range task.finishReading() {
+				db.cleanUpInterval(interval)
+			}
+			select {
+			case c.results <- result:
+			case <-db.shutdown:
+				db.discardCompaction(result)
+				return
+			}
+		}
+	}
+}
+
+// compact writes out the new interval for task. If any of the intervals to be replaced is no longer part of
+// the current StaticTable (or is corrupted), the task is abandoned and the result has a nil Interval and
+// error.
+func (db *DB) compact(task *compactionTask) *compactionResult {
+	result := &compactionResult{Task: task}
+	if task.sourcesDropped() {
+		return result
+	}
+	for _, interval := range task.Sources {
+		if err := interval.Verify(db.Schema); err != nil {
+			return result
+		}
+	}
+
+	start := time.Now()
+	switch task.Kind {
+	case compactionMergeRuns:
+		result.Interval, result.Err = db.writeMergedInterval(task.Sources[task.Start], nil, task.Generation)
+	case compactionRollup:
+		result.Interval, result.Err = db.writeRollupInterval(task.Group, task.Sources, nil, task.Generation)
+	case compactionMoveToColdStorage:
+		result.Interval, result.Err = db.moveIntervalToColdStorage(task.Sources[task.Start])
+	}
+	if result.Err != nil {
+		result.Err = fmt.Errorf("cannot write %s of interval at %s: %s", task.Kind, task.Start, result.Err)
+		return result
+	}
+	Log.Printf("Compaction (%s) of %d intervals at %s written in %s",
+		task.Kind, len(task.Sources), task.Start, time.Since(start))
+	return result
+}
+
+// finishCompaction swaps the interval written by a compaction into a new StaticTable, unless the intervals it
+// replaces have changed in the meantime. This should only be called by the inserter goroutine.
+func (db *DB) finishCompaction(result *compactionResult) error {
+	c := db.compactor
+	task := result.Task
+	delete(c.inFlight, task.Start)
+	for key := range task.Sources {
+		delete(c.inFlight, key)
+	}
+	defer atomic.AddInt64(&c.stats.Running, -1)
+
+	if result.Err != nil {
+		atomic.AddInt64(&c.stats.Failed, 1)
+		return result.Err
+	}
+	current := result.Interval != nil
+	for key, interval := range task.Sources {
+		if db.StaticTable.Intervals[key] != interval {
+			current = false
+		}
+		// New rows for a rolled-up interval may refer to its old interval dimension tables.
+		_, pending := db.memTable.Intervals[key]
+		if pending && task.Kind == compactionRollup && db.IntervalDimensionTables {
+			current = false
+		}
+	}
+	if !current {
+		atomic.AddInt64(&c.stats.Abandoned, 1)
+		db.discardCompaction(result)
+		return nil
+	}
+
+	staticTable := NewStaticTable(db.Schema)
+	staticTable.DimensionTables = db.StaticTable.DimensionTables
+	staticTable.InsertLogSeq = db.StaticTable.InsertLogSeq
+	staticTable.Intervals = make(IntervalMap)
+	var intervalsForCleanup, runsForCleanup []*Interval
+	for t, interval := range db.StaticTable.Intervals {
+		if _, ok := task.Sources[t]; !ok {
+			staticTable.Intervals[t] = interval
+			continue
+		}
+		if task.Kind == compactionMoveToColdStorage {
+			// The runs which were already cold are part of the new interval.
+			runsForCleanup = append(runsForCleanup, interval.hotRuns()...)
+		} else {
+			intervalsForCleanup = append(intervalsForCleanup, interval)
+		}
+	}
+	staticTable.Intervals[task.Start] = result.Interval
+	db.installStaticTable(staticTable)
+	atomic.AddInt64(&c.stats.Completed, 1)
+	if db.DiskBacked {
+		if err := db.writeMetadataFile(); err != nil {
+			return fmt.Errorf("error writing metadata: %s", err)
+		}
+		db.cleanUpOldIntervals(intervalsForCleanup)
+		for _, run := range runsForCleanup {
+			db.cleanUpIntervalRun(run)
+		}
+	}
+	return nil
+}
+
+// discardCompaction deletes the files written by a compaction whose result is not going to be used.
+func (db *DB) discardCompaction(result *compactionResult) {
+	if result.Interval == nil {
+		return
+	}
+	task := result.Task
+	if task.Kind == compactionMoveToColdStorage {
+		db.cleanUpColdCopy(task.Sources[task.Start], result.Interval)
+		return
+	}
+	db.cleanUpInterval(result.Interval)
+}
+
+// GetCompactionStats returns the counts of the DB's background compactions.
+func (db *DB) GetCompactionStats() CompactionStats {
+	if db.compactor == nil {
+		return CompactionStats{}
+	}
+	s := &db.compactor.stats
+	return CompactionStats{
+		Queued:    atomic.LoadInt64(&s.Queued),
+		Running:   atomic.LoadInt64(&s.Running),
+		Completed: atomic.LoadInt64(&s.Completed),
+		Failed:    atomic.LoadInt64(&s.Failed),
+		Abandoned: atomic.LoadInt64(&s.Abandoned),
+	}
+}
@@ -0,0 +1,119 @@
+package gumshoe
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+// waitForCompactions waits until db has no queued or running compactions.
+func waitForCompactions(t *testing.T, db *DB) CompactionStats {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := db.GetCompactionStats()
+		if stats.Queued == 0 && stats.Running == 0 {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("compactions did not finish: %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRunsAreMergedInTheBackground(t *testing.T) {
+	db := makeTestDB(func(schema *Schema) {
+		schema.IncrementalFlush = true
+		schema.MaxIntervalRuns = 2
+		schema.CompactionParallelism = 2
+	})
+	defer closeTestDB(db)
+
+	insertRow(db, RowMap{"at": hour(0), "dim1": "a", "metric1": 1.0})
+	insertRow(db, RowMap{"at": hour(0), "dim1": "b", "metric1": 2.0})
+	Assert(t, waitForCompactions(t, db), Equals, CompactionStats{})
+	Assert(t, intervalRunCounts(db), DeepEquals, map[time.Time]int{time.Unix(0, 0): 2})
+
+	insertRow(db, RowMap{"at": hour(0), "dim1": "a", "metric1": 4.0})
+	Assert(t, waitForCompactions(t, db), Equals, CompactionStats{Completed: 1})
+	Assert(t, intervalRunCounts(db), DeepEquals, map[time.Time]int{time.Unix(0, 0): 1})
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": hour(0), "dim1": "a", "metric1": 5}, Count: 2},
+		{RowMap: RowMap{"at": hour(0), "dim1": "b", "metric1": 2}, Count: 1},
+	})
+}
+
+func TestIntervalsAreRolledUpInTheBackground(t *testing.T) {
+	db := makeTestDB(func(schema *Schema) {
+		schema.CompactionParallelism = 1
+		schema.IntervalDimensionTables = true
+	})
+	defer closeTestDB(db)
+
+	day := time.Now().Add(-5 * 24 * time.Hour).Truncate(24 * time.Hour)
+	at := func(hours int) float64 { return float64(day.Add(time.Duration(hours) * time.Hour).Unix()) }
+	insertRows(db, []RowMap{
+		{"at": at(1), "dim1": "a", "metric1": 1.0},
+		{"at": at(2), "dim1": "b", "metric1": 2.0},
+		{"at": at(3), "dim1": "a", "metric1": 4.0},
+	})
+	Assert(t, len(db.GetDebugRows()), Equals, 3)
+
+	// The intervals become eligible for a rollup once the policy is added.
+	db.Rollups = []RollupPolicy{{After: 48 * time.Hour, IntervalDuration: 24 * time.Hour}}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, waitForCompactions(t, db), Equals, CompactionStats{Completed: 1})
+	dayStart := float64(day.Unix())
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": dayStart, "dim1": "a", "metric1": 5}, Count: 2},
+		{RowMap: RowMap{"at": dayStart, "dim1": "b", "metric1": 2}, Count: 1},
+	})
+
+	// New rows for the day are combined with the rolled-up interval during the flush.
+	insertRow(db, RowMap{"at": at(4), "dim1": "c", "metric1": 8.0})
+	Assert(t, waitForCompactions(t, db), Equals, CompactionStats{Completed: 1})
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": dayStart, "dim1": "a", "metric1": 5}, Count: 2},
+		{RowMap: RowMap{"at": dayStart, "dim1": "b", "metric1": 2}, Count: 1},
+		{RowMap: RowMap{"at": dayStart, "dim1": "c", "metric1": 8}, Count: 1},
+	})
+}
+
+func TestIntervalsBeingCompactedAreCleanedUpByTheCompaction(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	insertRow(db, RowMap{"at": hour(0), "dim1": "a", "metric1": 1.0})
+	resp := db.MakeRequest()
+	interval := resp.StaticTable.Intervals[time.Unix(0, 0)]
+	resp.Done()
+	oldFiles := segmentFiles(t, db.Dir)
+
+	// Pretend that a compaction is reading the interval when a flush replaces it.
+	db.compactor = newCompactor(1)
+	task := &compactionTask{Start: interval.Start, Sources: IntervalMap{interval.Start: interval}}
+	db.compactor.inFlight[interval.Start] = task
+	insertRow(db, RowMap{"at": hour(0), "dim1": "b", "metric1": 2.0})
+	for _, file := range oldFiles {
+		_, err := os.Stat(file)
+		Assert(t, err, IsNil)
+	}
+
+	// The compaction cleans it up once it's done.
+	for _, interval := range task.finishReading() {
+		db.cleanUpInterval(interval)
+	}
+	for _, file := range oldFiles {
+		_, err := os.Stat(file)
+		Assert(t, os.IsNotExist(err), IsTrue)
+	}
+	Assert(t, len(segmentFiles(t, db.Dir)), Equals, 1)
+
+	db.compactor = nil
+	closeTestDB(db)
+}
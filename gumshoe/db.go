@@ -23,12 +23,17 @@ type DB struct {
 
 	StaticTable *StaticTable // Owned by the request goroutine
 	memTable    *MemTable    // Owned by the inserter goroutine
+	insertLog   *insertLog   // Owned by the inserter goroutine (nil unless disk-backed)
 
 	shutdown chan struct{} // To tell goroutines to exit by closing
 
-	// The inserter reads from these two chans.
-	inserts      chan *InsertRequest
-	flushSignals chan chan error
+	// The inserter reads from these chans.
+	inserts                    chan *InsertRequest
+	flushSignals               chan chan error
+	dimensionCompactionSignals chan chan error
+	runCompactionSignals       chan chan error
+	deletes                    chan *deleteRequest
+	replacements               chan *replaceRequest
 
 	// The request goroutine reads from these two chans.
 	requests chan *Request
@@ -37,6 +42,13 @@ type DB struct {
 	// A fixed-size worker pool for running query scans.
 	scanRequests chan *scanRequest
 
+	compactor *compactor // Nil unless compactions are done in the background
+
+	// uncompactableDimensionTableSizes records, for each string column (by index) whose dimension table was
+	// automatically compacted without freeing any values, the size of the table at the time. The table isn't
+	// compacted automatically again until it grows beyond that size. Owned by the inserter goroutine.
+	uncompactableDimensionTableSizes map[int]int
+
 	latestTimestampLock *sync.Mutex
 	// Latest inserted row timestamp.
 	latestTimestamp time.Time
@@ -74,7 +86,13 @@ func openDBDir(dir string, schema *Schema) (*DB, error) {
 	}
 	if schema != nil {
 		if err := db.Schema.Equivalent(schema); err != nil {
-			return nil, err
+			// Additive changes can be made without rewriting the DB.
+			if err := schema.checkEvolution(db.Schema); err != nil {
+				return nil, err
+			}
+			Log.Printf("Opening DB in %s with an extended schema; existing intervals will be converted as they "+
+				"are read", dir)
+			db.StaticTable.evolveSchema(db.Schema, schema)
 		}
 		// We need to use the given Schema because the on-disk one has a blank RunConfig.
 		db.Schema = schema
@@ -91,7 +109,8 @@ func openDBDir(dir string, schema *Schema) (*DB, error) {
 }
 
 // NewDB creates a fresh DB. If it is disk-backed, the directory (schema.Dir) must not contain any existing DB
-// files (*.json or *.dat).
+// files (*.json or *.dat). An insertion log left behind by a DB which crashed before its first flush is
+// replayed into the new DB.
 func NewDB(schema *Schema) (*DB, error) {
 	if !schema.DiskBacked {
 		db := &DB{
@@ -104,19 +123,8 @@ func NewDB(schema *Schema) (*DB, error) {
 		return db, nil
 	}
 
-	if err := os.Mkdir(schema.Dir, 0755); err != nil {
-		if !os.IsExist(err) {
-			return nil, err
-		}
-		for _, glob := range []string{"*.json", "*.dat"} {
-			matches, err := filepath.Glob(filepath.Join(schema.Dir, glob))
-			if err != nil {
-				return nil, err
-			}
-			if len(matches) > 0 {
-				return nil, fmt.Errorf("directory %s may already have a gumshoeDB database", schema.Dir)
-			}
-		}
+	if err := makeDBDir(schema.Dir); err != nil {
+		return nil, err
 	}
 	db := &DB{
 		Schema:      schema,
@@ -128,26 +136,76 @@ func NewDB(schema *Schema) (*DB, error) {
 	return db, nil
 }
 
+// makeDBDir creates dir for a new DB. If dir already exists, it must not contain any DB files (*.json or
+// *.dat).
+func makeDBDir(dir string) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if !os.IsExist(err) {
+			return err
+		}
+		for _, glob := range []string{"*.json", "*.dat"} {
+			matches, err := filepath.Glob(filepath.Join(dir, glob))
+			if err != nil {
+				return err
+			}
+			if len(matches) > 0 {
+				return fmt.Errorf("directory %s may already have a gumshoeDB database", dir)
+			}
+		}
+	}
+	return nil
+}
+
 func (db *DB) initialize() error {
+	if err := db.Schema.checkRollupPolicies(); err != nil {
+		return err
+	}
+	if err := db.Schema.checkSortKey(); err != nil {
+		return err
+	}
 	if db.DiskBacked {
 		if err := db.addFlock(); err != nil {
 			return err
 		}
+		if db.ColdDir != "" {
+			if err := os.MkdirAll(db.ColdDir, 0755); err != nil {
+				db.removeFlock()
+				return err
+			}
+		}
 	}
 
 	db.Schema.Initialize()
 	db.memTable = NewMemTable(db.Schema)
+	db.latestTimestampLock = new(sync.Mutex)
+	db.uncompactableDimensionTableSizes = make(map[int]int)
+	if db.DiskBacked {
+		if err := db.replayInsertLog(); err != nil {
+			db.removeFlock()
+			return err
+		}
+	}
 	db.shutdown = make(chan struct{})
 	db.inserts = make(chan *InsertRequest)
 	db.flushSignals = make(chan chan error)
+	db.dimensionCompactionSignals = make(chan chan error)
+	db.runCompactionSignals = make(chan chan error)
+	db.deletes = make(chan *deleteRequest)
+	db.replacements = make(chan *replaceRequest)
 	db.requests = make(chan *Request)
 	db.flushes = make(chan *FlushInfo)
 	db.scanRequests = make(chan *scanRequest)
-	db.latestTimestampLock = new(sync.Mutex)
 
 	for i := 0; i < db.Schema.QueryParallelism; i++ {
 		go db.RunQueryWorker()
 	}
+	if db.Schema.CompactionParallelism > 0 {
+		db.compactor = newCompactor(db.Schema.CompactionParallelism)
+		for i := 0; i < db.Schema.CompactionParallelism; i++ {
+			db.compactor.workers.Add(1)
+			go db.RunCompactionWorker()
+		}
+	}
 	go db.HandleRequests()
 	go db.HandleInserts()
 	return nil
@@ -160,19 +218,54 @@ func (db *DB) Flush() error {
 	return <-errCh
 }
 
-// Close triggers a flush, waits for it to complete, and then shuts down the DB's goroutines. The DB may not
-// be used again after calling Close.
+// Close triggers a flush, waits for it to complete, and then shuts down the DB's goroutines. Any compaction
+// goroutines are waited for, so that no files are being written once the DB directory is unlocked. The DB
+// may not be used again after calling Close.
 func (db *DB) Close() error {
 	if err := db.Flush(); err != nil {
 		return err
 	}
 	close(db.shutdown)
+	if db.compactor != nil {
+		db.compactor.workers.Wait()
+	}
 	if db.DiskBacked {
+		if err := db.insertLog.close(); err != nil {
+			return err
+		}
 		return db.removeFlock()
 	}
 	return nil
 }
 
+// replayInsertLog opens the DB's insertion log and re-inserts any rows it contains into the memtable. This
+// must be called before the inserter goroutine is started.
+func (db *DB) replayInsertLog() error {
+	insertLog, err := openInsertLog(db.Dir)
+	if err != nil {
+		return err
+	}
+	replayed := 0
+	records, err := insertLog.replay(db.StaticTable.InsertLogSeq, func(rows []UnpackedRow) error {
+		// The original insertion may have failed partway through; if so, replaying it fails in the same place
+		// and leaves the memtable in the same state.
+		if err := db.insertIntoMemTable(rows); err != nil {
+			Log.Println("Error replaying insertion log record (this error was returned to the inserter):", err)
+		}
+		replayed += len(rows)
+		return nil
+	})
+	if err != nil {
+		insertLog.close()
+		return fmt.Errorf("error replaying insertion log: %s", err)
+	}
+	if records > 0 {
+		Log.Printf("Replayed %d rows from %d insertion log records", replayed, records)
+	}
+	db.insertLog = insertLog
+	return nil
+}
+
 func (db *DB) addFlock() error {
 	f, err := os.Open(db.Dir)
 	if err != nil {
@@ -233,7 +326,7 @@ func (db *DB) InsertUnpacked(rows []UnpackedRow) error {
 }
 
 // Insert adds some rows into the database. It returns (and stops) on the first error encountered. Note that
-// the data is only in the memtable (not necessarily on disk) when Insert returns.
+// the data is only in the memtable and the insertion log (not yet in the segment files) when Insert returns.
 func (db *DB) Insert(rows []RowMap) error {
 	unpacked := make([]UnpackedRow, len(rows))
 	for i, row := range rows {
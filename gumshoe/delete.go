@@ -0,0 +1,189 @@
+package gumshoe
+
+import (
+	"fmt"
+	"time"
+)
+
+// A TimeRange is a range of row timestamps: Start is inclusive and End is exclusive. A zero Start or End
+// leaves the range unbounded on that side.
+type TimeRange struct {
+	Start, End time.Time
+}
+
+// checkTimeRangeCoversIntervals checks that r is aligned to the interval duration and that it covers each
+// static interval (including rolled-up ones) either entirely or not at all, so that the rows of an interval
+// are all inside r or all outside it. verb says what is being done with r, for the error messages.
+func (db *DB) checkTimeRangeCoversIntervals(r TimeRange, verb string) error {
+	for _, t := range []time.Time{r.Start, r.End} {
+		if !t.IsZero() && !t.Equal(t.Truncate(db.IntervalDuration)) {
+			return fmt.Errorf("the time range to %s must be aligned to the interval duration (%s)",
+				verb, db.IntervalDuration)
+		}
+	}
+	for _, interval := range db.StaticTable.Intervals {
+		overlaps := interval.End.After(r.Start) && (r.End.IsZero() || interval.Start.Before(r.End))
+		contained := !interval.Start.Before(r.Start) && (r.End.IsZero() || !interval.End.After(r.End))
+		if overlaps && !contained {
+			return fmt.Errorf("the time range to %s only covers part of the interval from %s to %s",
+				verb, interval.Start, interval.End)
+		}
+	}
+	return nil
+}
+
+type deleteRequest struct {
+	Filters   []QueryFilter
+	TimeRange TimeRange
+	Resp      chan deleteResponse
+}
+
+type deleteResponse struct {
+	Rows int
+	Err  error
+}
+
+// Delete removes all the rows which match every one of filters (which are the same as a query's filters) and
+// whose timestamps fall within timeRange. It returns the number of inserted rows which were deleted (that
+// is, the sum of the counts of the deleted rows). Each bound of timeRange (if set) must be aligned to the
+// interval duration, and the range must not cover only part of any rolled-up interval.
+//
+// Pending inserts are flushed first so that the deletion applies to them as well. Only the intervals which
+// contain matching rows are rewritten; any that are left empty are dropped. A failure while flushing or
+// rewriting intervals is returned as a *WriteError.
+func (db *DB) Delete(filters []QueryFilter, timeRange TimeRange) (int, error) {
+	req := &deleteRequest{Filters: filters, TimeRange: timeRange, Resp: make(chan deleteResponse)}
+	db.deletes <- req
+	resp := <-req.Resp
+	return resp.Rows, resp.Err
+}
+
+// deleteRows carries out a deleteRequest. This should only be called by the inserter goroutine.
+func (db *DB) deleteRows(req *deleteRequest) (int, error) {
+	start := time.Now()
+	query := &Query{Filters: append([]QueryFilter(nil), req.Filters...)}
+	if !req.TimeRange.Start.IsZero() {
+		query.Filters = append(query.Filters, QueryFilter{
+			Type:   FilterGreaterThenOrEqual,
+			Column: db.TimestampColumn.Name,
+			Value:  float64(req.TimeRange.Start.Unix()),
+		})
+	}
+	if !req.TimeRange.End.IsZero() {
+		query.Filters = append(query.Filters, QueryFilter{
+			Type:   FilterLessThan,
+			Column: db.TimestampColumn.Name,
+			Value:  float64(req.TimeRange.End.Unix()),
+		})
+	}
+	// Check the request before flushing so that an invalid request doesn't have any effect.
+	if err := db.checkTimeRangeCoversIntervals(req.TimeRange, "delete"); err != nil {
+		return 0, err
+	}
+	if _, err := db.StaticTable.makeScanParams(query); err != nil {
+		return 0, err
+	}
+	if err := db.flush(false); err != nil {
+		return 0, &WriteError{err}
+	}
+	// The flush may have rolled up some intervals.
+	if err := db.checkTimeRangeCoversIntervals(req.TimeRange, "delete"); err != nil {
+		return 0, err
+	}
+	params, err := db.StaticTable.makeScanParams(query)
+	if err != nil {
+		return 0, err
+	}
+
+	intervals := make(map[time.Time]*Interval)
+	var intervalsForCleanup []*Interval
+	deleted := 0
+	for t, interval := range db.StaticTable.Intervals {
+		intervals[t] = interval
+		if !params.AllTimestampFilterFuncsMatch(t) {
+			continue
+		}
+		if err := interval.Verify(db.Schema); err != nil {
+			if !isCorruption(err) {
+				return 0, fmt.Errorf("cannot read interval at %s: %s", t, err)
+			}
+			Log.Printf("Delete: leaving corrupted interval at %s alone: %s", t, err)
+			continue
+		}
+		matches := db.makeRowMatcher(params.filterFuncsForInterval(interval))
+
+		// Find out whether there's anything to delete before rewriting the interval.
+		matchedRows, totalRows, matchedCount := 0, 0, 0
+		for _, run := range interval.AllRuns() {
+			cursor := run.cursor(db.Schema)
+			for {
+				key, val, count, more := cursor.Next()
+				if !more {
+					break
+				}
+				totalRows++
+				if matches(key, val) {
+					matchedRows++
+					matchedCount += count
+				}
+			}
+			if err := cursor.Err(); err != nil {
+				return 0, fmt.Errorf("cannot read interval at %s: %s", t, err)
+			}
+		}
+		if matchedRows == 0 {
+			continue
+		}
+		deleted += matchedCount
+		intervalsForCleanup = append(intervalsForCleanup, interval)
+		if matchedRows == totalRows {
+			delete(intervals, t)
+			continue
+		}
+		keep := func(dimensions DimensionBytes, metrics MetricBytes) bool {
+			return !matches(dimensions, metrics)
+		}
+		// With interval dimension tables, the values which are no longer referenced are dropped from the new
+		// interval's tables.
+		newInterval, err := db.writeTransformedInterval(interval.AllRuns(), nil, interval.Start, interval.End,
+			db.nextGeneration(t, interval), keep, nil, nil)
+		if err != nil {
+			return 0, &WriteError{fmt.Errorf("cannot rewrite interval: %s", err)}
+		}
+		intervals[t] = newInterval
+	}
+	if len(intervalsForCleanup) == 0 {
+		return 0, nil
+	}
+
+	staticTable := NewStaticTable(db.Schema)
+	staticTable.Intervals = intervals
+	staticTable.DimensionTables = db.StaticTable.DimensionTables
+	staticTable.InsertLogSeq = db.StaticTable.InsertLogSeq
+	db.installStaticTable(staticTable)
+	if db.DiskBacked {
+		if err := db.writeMetadataFile(); err != nil {
+			return 0, &WriteError{fmt.Errorf("error writing metadata: %s", err)}
+		}
+		db.cleanUpOldIntervals(intervalsForCleanup)
+	}
+	Log.Printf("Deleted %d rows from %d intervals in %s",
+		deleted, len(intervalsForCleanup), time.Since(start))
+	return deleted, nil
+}
+
+// makeRowMatcher returns a function which reports whether the row with the given dimensions and metrics (as
+// returned by an intervalCursor) passes all of filterFuncs.
+func (db *DB) makeRowMatcher(filterFuncs []filterFunc) func(DimensionBytes, MetricBytes) bool {
+	row := make(RowBytes, db.RowSize)
+	return func(dimensions DimensionBytes, metrics MetricBytes) bool {
+		copy(row[db.DimensionStartOffset:], dimensions)
+		copy(row[db.MetricStartOffset:], metrics)
+		for _, f := range filterFuncs {
+			if !f(row) {
+				return false
+			}
+		}
+		return true
+	}
+}
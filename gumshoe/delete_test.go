@@ -0,0 +1,137 @@
+package gumshoe
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestDeleteRemovesMatchingRowsWithinTimeRange(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+
+	insertRows(db, []RowMap{
+		{"at": hour(0), "dim1": "a", "metric1": 1.0},
+		{"at": hour(0), "dim1": "a", "metric1": 2.0},
+		{"at": hour(0), "dim1": "b", "metric1": 4.0},
+		{"at": hour(1), "dim1": "a", "metric1": 8.0},
+		{"at": hour(2), "dim1": "a", "metric1": 16.0},
+	})
+	// Pending rows are deleted as well.
+	if err := db.Insert([]RowMap{{"at": hour(1), "dim1": "a", "metric1": 32.0}}); err != nil {
+		t.Fatal(err)
+	}
+
+	hour0 := time.Unix(int64(hour(0)), 0)
+	hour2 := time.Unix(int64(hour(2)), 0)
+	deleted, err := db.Delete([]QueryFilter{{FilterEqual, "dim1", "a"}}, TimeRange{Start: hour0, End: hour2})
+	Assert(t, err, IsNil)
+	Assert(t, deleted, Equals, 4)
+
+	// The interval at hour 1 had no other rows, so it is dropped entirely.
+	expected := []UnpackedRow{
+		{RowMap: RowMap{"at": hour(0), "dim1": "b", "metric1": 4}, Count: 1},
+		{RowMap: RowMap{"at": hour(2), "dim1": "a", "metric1": 16}, Count: 1},
+	}
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, expected)
+	Assert(t, intervalRunCounts(db), DeepEquals, map[time.Time]int{hour0: 1, hour2: 1})
+	Assert(t, len(segmentFiles(t, db.Dir)), Equals, 2)
+
+	// Nothing matches now.
+	deleted, err = db.Delete([]QueryFilter{{FilterEqual, "dim1", "a"}}, TimeRange{End: hour2})
+	Assert(t, err, IsNil)
+	Assert(t, deleted, Equals, 0)
+
+	db = reopenTestDB(db)
+	defer closeTestDB(db)
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, expected)
+}
+
+func TestDeleteRejectsInvalidFilters(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+
+	insertRow(db, RowMap{"at": hour(0), "dim1": "a", "metric1": 1.0})
+	_, err := db.Delete([]QueryFilter{{FilterEqual, "bogus", "a"}}, TimeRange{})
+	Assert(t, err, NotNil)
+	Assert(t, len(db.GetDebugRows()), Equals, 1)
+}
+
+func TestDeleteRejectsUnalignedTimeRanges(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+
+	insertRows(db, []RowMap{
+		{"at": hour(0), "dim1": "a", "metric1": 1.0},
+		{"at": hour(1), "dim1": "a", "metric1": 2.0},
+	})
+	hour0 := time.Unix(int64(hour(0)), 0)
+	hour1 := time.Unix(int64(hour(1)), 0)
+	for _, timeRange := range []TimeRange{
+		{Start: hour0.Add(time.Minute)},
+		{End: hour1.Add(time.Minute)},
+		{Start: hour0, End: hour1.Add(-time.Minute)},
+	} {
+		_, err := db.Delete(nil, timeRange)
+		Assert(t, err, NotNil)
+		_, isWriteError := err.(*WriteError)
+		Assert(t, isWriteError, IsFalse)
+	}
+	Assert(t, len(db.GetDebugRows()), Equals, 2)
+}
+
+func TestDeleteFromRolledUpIntervals(t *testing.T) {
+	db := makeRollupTestDB()
+	defer closeTestDB(db)
+
+	day := time.Now().Add(-5 * 24 * time.Hour).Truncate(24 * time.Hour)
+	at := func(hours int) float64 { return float64(day.Add(time.Duration(hours) * time.Hour).Unix()) }
+	insertRows(db, []RowMap{
+		{"at": at(1), "dim1": "a", "dim2": 1.0, "metric1": 1.0},
+		{"at": at(2), "dim1": "b", "dim2": 2.0, "metric1": 2.0},
+		{"at": at(25), "dim1": "a", "dim2": 3.0, "metric1": 4.0},
+	})
+
+	// The range is aligned to the interval duration (an hour) but only covers part of the rolled-up day.
+	_, err := db.Delete(nil, TimeRange{Start: day, End: day.Add(2 * time.Hour)})
+	Assert(t, err, NotNil)
+	_, err = db.Delete(nil, TimeRange{Start: day.Add(time.Hour)})
+	Assert(t, err, NotNil)
+	Assert(t, len(db.GetDebugRows()), Equals, 3)
+
+	deleted, err := db.Delete([]QueryFilter{{FilterEqual, "dim1", "a"}},
+		TimeRange{Start: day, End: day.Add(24 * time.Hour)})
+	Assert(t, err, IsNil)
+	Assert(t, deleted, Equals, 1)
+	dayStart := float64(day.Unix())
+	nextDayStart := float64(day.Add(24 * time.Hour).Unix())
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": dayStart, "dim1": "b", "dim2": nil, "metric1": uint32(2)}, Count: 1},
+		{RowMap: RowMap{"at": nextDayStart, "dim1": "a", "dim2": nil, "metric1": uint32(4)}, Count: 1},
+	})
+}
+
+func TestDeleteWithIntervalDimensionTables(t *testing.T) {
+	db := makeIntervalDimensionTablesTestDB()
+	defer closeTestDB(db)
+
+	insertRows(db, []RowMap{
+		{"at": hour(0), "dim1": "a", "metric1": 1.0},
+		{"at": hour(0), "dim1": "b", "metric1": 2.0},
+		{"at": hour(0), "dim1": "c", "metric1": 4.0},
+		{"at": hour(1), "dim1": "c", "metric1": 8.0},
+	})
+	deleted, err := db.Delete([]QueryFilter{{FilterIn, "dim1", []interface{}{"a", "c"}}}, TimeRange{})
+	Assert(t, err, IsNil)
+	Assert(t, deleted, Equals, 3)
+
+	// Values which are no longer used are dropped from the interval's dimension tables.
+	Assert(t, intervalDimensionValues(db), DeepEquals, map[time.Time][]string{time.Unix(0, 0): {"b"}})
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": hour(0), "dim1": "b", "metric1": 2}, Count: 1},
+	})
+}
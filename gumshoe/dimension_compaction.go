@@ -0,0 +1,171 @@
+package gumshoe
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// Dimension tables only ever grow as new values are inserted, even after all the rows using some values have
+// expired. Compaction rebuilds the dimension tables of string columns from just the values referenced by the
+// current intervals, rewriting every interval to use the new indexes. It happens during a flush, either
+// automatically when a dimension table nears the maximum size allowed by its column type or on demand (see
+// CompactDimensionTables).
+
+// dimensionTableCompactionThreshold is the fraction of a string column type's maximum value which its
+// dimension table may fill before it is automatically compacted.
+const dimensionTableCompactionThreshold = 0.9
+
+// CompactDimensionTables triggers a flush which also compacts all the dimension tables, and waits for it to
+// complete.
+func (db *DB) CompactDimensionTables() error {
+	errCh := make(chan error)
+	db.dimensionCompactionSignals <- errCh
+	return <-errCh
+}
+
+// dimensionColumnsToCompact returns the indexes of the string dimension columns whose tables (in dimTables)
+// should be compacted. If force is true, this is all of the string columns. Otherwise, a nearly full table
+// is skipped if the last automatic compaction couldn't shrink it and it hasn't grown since.
+func (db *DB) dimensionColumnsToCompact(dimTables []*DimensionTable, force bool) []int {
+	// Interval dimension tables are dropped along with their intervals, so they never need compaction.
+	if db.IntervalDimensionTables {
+		return nil
+	}
+	var indexes []int
+	for i, col := range db.DimensionColumns {
+		if !col.String {
+			continue
+		}
+		size := len(dimTables[i].Values)
+		if force {
+			indexes = append(indexes, i)
+			continue
+		}
+		if float64(size) <= dimensionTableCompactionThreshold*typeMaxes[col.Type] {
+			continue
+		}
+		if lastSize, ok := db.uncompactableDimensionTableSizes[i]; ok && size <= lastSize {
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// recordDimensionCompaction notes which of the dimension tables of columns were shrunk by a compaction
+// (which replaced oldDimTables with newDimTables) for the sake of dimensionColumnsToCompact.
+func (db *DB) recordDimensionCompaction(columns []int, oldDimTables, newDimTables []*DimensionTable) {
+	for _, i := range columns {
+		if newDimTables[i] == oldDimTables[i] {
+			db.uncompactableDimensionTableSizes[i] = len(oldDimTables[i].Values)
+		} else {
+			delete(db.uncompactableDimensionTableSizes, i)
+		}
+	}
+}
+
+// compactDimensionTables rebuilds the dimension tables of the given columns to only contain values referenced
+// by intervals. It returns the new intervals and dimension tables as well as the intervals and dimension
+// tables that they replace. If no values can be removed, intervals and dimTables are returned unchanged.
+func (db *DB) compactDimensionTables(columns []int, intervals map[time.Time]*Interval,
+	dimTables []*DimensionTable) (newIntervals map[time.Time]*Interval, newDimTables []*DimensionTable,
+	oldIntervals []*Interval, oldDimTables []indexedDimensionTable, err error) {
+
+	start := time.Now()
+
+	// The rows of a corrupted interval can't be read (to find the values they use) or rewritten (to use the
+	// new indexes), so while there is one, no values can be dropped.
+	for _, interval := range intervals {
+		if err := interval.Verify(db.Schema); err != nil {
+			Log.Printf("Not compacting dimension tables: the interval at %s is corrupted: %s",
+				interval.Start, err)
+			return intervals, dimTables, nil, nil, nil
+		}
+	}
+
+	// Find all the referenced values.
+	referenced := make(map[int][]bool)
+	for _, i := range columns {
+		referenced[i] = make([]bool, len(dimTables[i].Values))
+	}
+	for _, interval := range intervals {
+		for _, run := range interval.AllRuns() {
+			cursor := run.cursor(db.Schema)
+			for {
+				key, _, _, more := cursor.Next()
+				if !more {
+					break
+				}
+				dimensions := DimensionBytes(key)
+				for _, i := range columns {
+					if !dimensions.IsNil(i) {
+						referenced[i][db.dimensionIndex(dimensions, i)] = true
+					}
+				}
+			}
+			if err := cursor.Err(); err != nil {
+				return nil, nil, nil, nil, err
+			}
+		}
+	}
+
+	// Build the new tables, keeping the referenced values in their existing order.
+	newDimTables = make([]*DimensionTable, len(dimTables))
+	copy(newDimTables, dimTables)
+	remappings := make(map[int][]uint32)
+	for _, i := range columns {
+		var values []string
+		remapping := make([]uint32, len(dimTables[i].Values))
+		for j, value := range dimTables[i].Values {
+			if referenced[i][j] {
+				remapping[j] = uint32(len(values))
+				values = append(values, value)
+			}
+		}
+		if len(values) == len(dimTables[i].Values) {
+			continue
+		}
+		Log.Printf("Compacting dimension table for %s: %d values to %d",
+			db.DimensionColumns[i].Name, len(dimTables[i].Values), len(values))
+		remappings[i] = remapping
+		newDimTables[i] = newDimensionTable(dimTables[i].Generation+1, values)
+		oldDimTables = append(oldDimTables, indexedDimensionTable{dimTables[i], i})
+		if db.DiskBacked {
+			if err := newDimTables[i].Store(db.Schema, i); err != nil {
+				return nil, nil, nil, nil, fmt.Errorf("error storing dimension table: %s", err)
+			}
+		}
+	}
+	if len(remappings) == 0 {
+		return intervals, dimTables, nil, nil, nil
+	}
+
+	// Rewrite all the intervals with the new indexes.
+	remap := func(dimensions DimensionBytes) {
+		for i, remapping := range remappings {
+			if !dimensions.IsNil(i) {
+				index := remapping[db.dimensionIndex(dimensions, i)]
+				setRowValue(unsafe.Pointer(&dimensions[db.DimensionOffsets[i]]), db.DimensionColumns[i].Type,
+					float64(index))
+			}
+		}
+	}
+	newIntervals = make(map[time.Time]*Interval)
+	for t, interval := range intervals {
+		newInterval, err := db.writeTransformedInterval(interval.AllRuns(), nil, interval.Start, interval.End,
+			db.nextGeneration(t, interval), nil, remap, nil)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("cannot rewrite interval: %s", err)
+		}
+		newIntervals[t] = newInterval
+		oldIntervals = append(oldIntervals, interval)
+	}
+	Log.Printf("Dimension table compaction rewrote %d intervals in %s", len(newIntervals), time.Since(start))
+	return newIntervals, newDimTables, oldIntervals, oldDimTables, nil
+}
+
+// dimensionIndex reads the dimension table index stored in the (non-nil) string column i of dimensions.
+func (s *Schema) dimensionIndex(dimensions DimensionBytes, i int) int {
+	return int(cellFloat64(unsafe.Pointer(&dimensions[s.DimensionOffsets[i]]), s.DimensionColumns[i].Type))
+}
@@ -0,0 +1,99 @@
+package gumshoe
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestCompactDimensionTablesOnDemand(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	db.Retention = 24 * time.Hour
+	start := Time(time.Now())
+
+	insertRows(db, []RowMap{
+		{"at": start.hoursBack(36), "dim1": "old", "metric1": 1.0},
+		{"at": start.hoursBack(12), "dim1": "a", "metric1": 1.0},
+		{"at": start.hoursBack(1), "dim1": "b", "metric1": 1.0},
+	})
+	db.FixedRetention = true
+	insertRows(db, []RowMap{{"at": start.hoursBack(1), "dim1": "c", "metric1": 1.0}})
+	Assert(t, db.GetDimensionTables()["dim1"], DeepEquals, []string{"old", "a", "b", "c"})
+
+	if err := db.CompactDimensionTables(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []UnpackedRow{
+		{RowMap: RowMap{"at": start.hoursBack(12), "dim1": "a", "metric1": uint32(1)}, Count: 1},
+		{RowMap: RowMap{"at": start.hoursBack(1), "dim1": "b", "metric1": uint32(1)}, Count: 1},
+		{RowMap: RowMap{"at": start.hoursBack(1), "dim1": "c", "metric1": uint32(1)}, Count: 1},
+	}
+	Assert(t, db.GetDimensionTables()["dim1"], DeepEquals, []string{"a", "b", "c"})
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, truncateRowTimestamps(expected))
+
+	db = reopenTestDB(db)
+	defer closeTestDB(db)
+	Assert(t, db.GetDimensionTables()["dim1"], DeepEquals, []string{"a", "b", "c"})
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, truncateRowTimestamps(expected))
+	insertRow(db, RowMap{"at": start.hoursBack(1), "dim1": "a", "metric1": 1.0})
+	Assert(t, db.GetDimensionTables()["dim1"], DeepEquals, []string{"a", "b", "c"})
+}
+
+func TestDimensionTablesAreCompactedWhenNearlyFull(t *testing.T) {
+	db := makeTestDB(func(schema *Schema) {
+		schema.DimensionColumns = []DimensionColumn{makeDimensionColumn("dim1", "uint8", true)}
+		schema.Retention = 24 * time.Hour
+	})
+	defer closeTestDB(db)
+	start := Time(time.Now())
+
+	var rows []RowMap
+	for i := 0; i < 250; i++ {
+		rows = append(rows, RowMap{"at": start.hoursBack(36), "dim1": strconv.Itoa(i), "metric1": 1.0})
+	}
+	insertRows(db, rows)
+	Assert(t, len(db.GetDimensionTables()["dim1"]), Equals, 250)
+
+	// Once the old rows expire, the next flush drops their values.
+	db.FixedRetention = true
+	insertRow(db, RowMap{"at": start.hoursBack(1), "dim1": "new", "metric1": 1.0})
+	Assert(t, db.GetDimensionTables()["dim1"], DeepEquals, []string{"new"})
+	insertRow(db, RowMap{"at": start.hoursBack(1), "dim1": "newer", "metric1": 1.0})
+	Assert(t, db.GetDimensionTables()["dim1"], DeepEquals, []string{"new", "newer"})
+}
+
+func TestFullDimensionTablesAreNotCompactedAgainUntilTheyGrow(t *testing.T) {
+	db := makeTestDB(func(schema *Schema) {
+		schema.DimensionColumns = []DimensionColumn{makeDimensionColumn("dim1", "uint8", true)}
+	})
+	defer closeTestDB(db)
+
+	// Every value is referenced, so compaction can't free anything.
+	var rows []RowMap
+	for i := 0; i < 240; i++ {
+		rows = append(rows, RowMap{"at": 0.0, "dim1": strconv.Itoa(i), "metric1": 1.0})
+	}
+	insertRows(db, rows)
+	Assert(t, db.uncompactableDimensionTableSizes, DeepEquals, map[int]int{0: 240})
+	Assert(t, db.dimensionColumnsToCompact(db.StaticTable.DimensionTables, false), IsNil)
+	Assert(t, db.dimensionColumnsToCompact(db.StaticTable.DimensionTables, true), DeepEquals, []int{0})
+
+	insertRow(db, RowMap{"at": 0.0, "dim1": "new", "metric1": 1.0})
+	Assert(t, db.uncompactableDimensionTableSizes, DeepEquals, map[int]int{0: 241})
+	Assert(t, len(db.GetDimensionTables()["dim1"]), Equals, 241)
+}
+
+// truncateRowTimestamps truncates the timestamps of rows to the start of their (hour-long) intervals.
+func truncateRowTimestamps(rows []UnpackedRow) []UnpackedRow {
+	for _, row := range rows {
+		at := int64(row.RowMap["at"].(float64))
+		row.RowMap["at"] = float64(time.Unix(at, 0).Truncate(time.Hour).Unix())
+	}
+	return rows
+}
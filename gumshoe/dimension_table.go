@@ -1,9 +1,11 @@
 package gumshoe
 
 import (
+	"bytes"
 	"compress/gzip"
 	"encoding/gob"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 )
@@ -11,6 +13,7 @@ import (
 type DimensionTable struct {
 	Generation   int
 	Size         int               // Tracked for sanity checking when dimension table is loaded from disk
+	Checksum     uint32            `json:",omitempty"` // Of the stored file (zero if none was recorded)
 	Values       []string          `json:"-"`
 	ValueToIndex map[string]uint32 `json:"-"`
 }
@@ -63,16 +66,20 @@ func (t *DimensionTable) Filename(s *Schema, index int) string {
 // Load reads a dimension table file identified by the schema directory, this dimension table's index, and the
 // table generation and loads it into t. t.Values and t.ValuesToIndex are overwritten. The size is checked
 // against t.Size.
-func (t *DimensionTable) Load(s *Schema, index int) (err error) {
+func (t *DimensionTable) Load(s *Schema, index int) error {
+	return t.load(t.Filename(s, index), s.DimensionColumns[index].Name)
+}
+
+func (t *DimensionTable) load(filename, name string) (err error) {
 	defer func() {
 		if err == nil && len(t.Values) != t.Size {
 			err = fmt.Errorf("dimension table %q has size %d but was loaded with %d values",
-				s.DimensionColumns[index].Name, t.Size, len(t.Values))
+				name, t.Size, len(t.Values))
 		}
 	}()
 
 	t.ValueToIndex = make(map[string]uint32)
-	f, err := os.Open(t.Filename(s, index))
+	b, err := ioutil.ReadFile(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
 			t.Values = nil
@@ -80,8 +87,10 @@ func (t *DimensionTable) Load(s *Schema, index int) (err error) {
 		}
 		return err
 	}
-	defer f.Close()
-	gz, err := gzip.NewReader(f)
+	if t.Checksum != 0 && checksum(b) != t.Checksum {
+		return &ChecksumError{filename}
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
@@ -99,13 +108,19 @@ func (t *DimensionTable) Load(s *Schema, index int) (err error) {
 // Store writes this dimension table to a new file identified by the schema directory, the provided dimension
 // table index, and the table generation. It is an error if the file already exists.
 func (t *DimensionTable) Store(s *Schema, index int) error {
-	f, err := os.OpenFile(t.Filename(s, index), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
+	return t.store(t.Filename(s, index))
+}
+
+func (t *DimensionTable) store(filename string) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	encoder := gob.NewEncoder(gz)
+	if err := encoder.Encode(t.Values); err != nil {
 		return err
 	}
-	defer f.Close()
-	gz := gzip.NewWriter(f)
-	defer gz.Close()
-	encoder := gob.NewEncoder(gz)
-	return encoder.Encode(t.Values)
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	t.Checksum = checksum(buf.Bytes())
+	return ioutil.WriteFile(filename, buf.Bytes(), 0666)
 }
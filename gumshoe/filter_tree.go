@@ -0,0 +1,96 @@
+// Compound filters: filters combining others with and, or, and not (see QueryFilter).
+//
+// The timestamp of every row of an interval is the interval's start, so the filters on the timestamp column
+// within a compound filter are decided for a whole interval at once. A compiled filter tree is specialized to
+// each interval it's used with, which either settles it for every row of the interval -- in particular, an
+// interval can still be skipped if the tree is false for it -- or leaves a filterFunc on the other columns.
+
+package gumshoe
+
+// A filterTree is a compiled compound filter. Given the timestamp of an interval, it returns either a
+// filterFunc for the interval's rows or (if f is nil) the result of the filter for all of them.
+type filterTree func(timestamp uint32) (f filterFunc, result bool)
+
+func (s *StaticTable) makeFilterTree(filter QueryFilter) (filterTree, error) {
+	if filter.IsCompound() {
+		children, err := filter.children()
+		if err != nil {
+			return nil, err
+		}
+		if filter.Type != FilterNot {
+			return s.makeFilterTreeJunction(children, filter.Type == FilterOr)
+		}
+		child, err := s.makeFilterTree(children[0])
+		if err != nil {
+			return nil, err
+		}
+		return func(timestamp uint32) (filterFunc, bool) {
+			f, result := child(timestamp)
+			if f == nil {
+				return nil, !result
+			}
+			return func(row RowBytes) bool { return !f(row) }, false
+		}, nil
+	}
+	if filter.Column == s.TimestampColumn.Name {
+		timestampFilter, err := s.makeTimestampFilterFunc(filter)
+		if err != nil {
+			return nil, err
+		}
+		return func(timestamp uint32) (filterFunc, bool) { return nil, timestampFilter(timestamp) }, nil
+	}
+	f, err := s.makeColumnFilterFunc(filter)
+	if err != nil {
+		return nil, err
+	}
+	return func(uint32) (filterFunc, bool) { return f, false }, nil
+}
+
+// makeFilterTreeJunction compiles the or (if isOr is set) or the and of filters. An empty or is false and an
+// empty and is true.
+func (s *StaticTable) makeFilterTreeJunction(filters []QueryFilter, isOr bool) (filterTree, error) {
+	children := make([]filterTree, len(filters))
+	for i, filter := range filters {
+		child, err := s.makeFilterTree(filter)
+		if err != nil {
+			return nil, err
+		}
+		children[i] = child
+	}
+	return func(timestamp uint32) (filterFunc, bool) {
+		var funcs []filterFunc
+		for _, child := range children {
+			f, result := child(timestamp)
+			if f != nil {
+				funcs = append(funcs, f)
+			} else if result == isOr {
+				// true decides an or; false decides an and.
+				return nil, isOr
+			}
+		}
+		switch len(funcs) {
+		case 0:
+			return nil, !isOr
+		case 1:
+			return funcs[0], false
+		}
+		if isOr {
+			return func(row RowBytes) bool {
+				for _, f := range funcs {
+					if f(row) {
+						return true
+					}
+				}
+				return false
+			}, false
+		}
+		return func(row RowBytes) bool {
+			for _, f := range funcs {
+				if !f(row) {
+					return false
+				}
+			}
+			return true
+		}, false
+	}, nil
+}
@@ -16,11 +16,14 @@ import (
 //
 // If db.FixedRetention is set, then flush will discard old intervals while constructing the new StaticTable.
 //
+// If compactDimensions is set, or if any dimension table is nearly full, then flush also compacts the
+// dimension tables (see compactDimensionTables).
+//
 // If the result error is not nil, the state of database may not be well-defined and a user should clean up
 // any extraneous segment files not referenced by the metadata. (Note the new metadata is written at the end,
 // atomically, so it should be used as the source of truth for which segments should be used and which
 // discarded. 'gumtool clean' can perform this task.)
-func (db *DB) flush() error {
+func (db *DB) flush(compactDimensions bool) error {
 	start := time.Now()
 	defer func() {
 		Log.Printf("Flush completed in %s", time.Since(start))
@@ -43,15 +46,54 @@ func (db *DB) flush() error {
 	// If we're using a fixed retention, drop old intervals.
 	if db.FixedRetention {
 		var outdatedStaticKeys, outdatedMemKeys []time.Time
-		outdatedStaticKeys, staticKeys = db.partitionIntervalStartsByRetention(staticKeys)
+		outdatedStaticKeys, staticKeys = db.partitionStaticIntervalsByRetention(staticKeys)
 		outdatedMemKeys, memKeys = db.partitionIntervalStartsByRetention(memKeys)
 		Log.Printf("Flush: ignoring %d mem intervals and %d static intervals out of retention",
 			len(outdatedMemKeys), len(outdatedStaticKeys))
 
 		for _, key := range outdatedStaticKeys {
-			intervalsForCleanup = append(intervalsForCleanup, db.StaticTable.Intervals[key])
+			interval := db.StaticTable.Intervals[key]
+			if err := interval.Verify(db.Schema); err != nil {
+				Log.Printf("Flush: keeping corrupted interval at %s past the retention period: %s", key, err)
+				staticKeys = append(staticKeys, key)
+				continue
+			}
+			intervalsForCleanup = append(intervalsForCleanup, interval)
+		}
+		sort.Sort(times(staticKeys))
+	}
+	if db.IntervalDimensionTables {
+		db.resolveMemIntervalDimensionTables(memKeys)
+	}
+
+	// Drop the static intervals which are overwritten by a re-import (see replace.go); the new rows are then
+	// written out as if the intervals had never existed.
+	if len(db.memTable.Replaced) > 0 {
+		var keptStaticKeys []time.Time
+		for _, key := range staticKeys {
+			if !db.memTable.Replaced[key] {
+				keptStaticKeys = append(keptStaticKeys, key)
+				continue
+			}
+			interval := db.StaticTable.Intervals[key]
+			if err := interval.Verify(db.Schema); err != nil {
+				// The new rows are added to the corrupted interval as a run instead (see combineIntervals).
+				Log.Printf("Flush: not replacing corrupted interval at %s: %s", key, err)
+				keptStaticKeys = append(keptStaticKeys, key)
+				continue
+			}
+			intervalsForCleanup = append(intervalsForCleanup, interval)
 		}
+		Log.Printf("Flush: replacing %d static intervals", len(staticKeys)-len(keptStaticKeys))
+		staticKeys = keptStaticKeys
 	}
+
+	// Roll up old intervals into coarser ones according to the rollup policies.
+	rolledUpIntervals, cleanup, memKeys, staticKeys, err := db.rollUpIntervals(memKeys, staticKeys)
+	if err != nil {
+		return fmt.Errorf("error rolling up intervals: %s", err)
+	}
+	intervalsForCleanup = append(intervalsForCleanup, cleanup...)
 	Log.Printf("Flushing %d mem intervals into %d static intervals", len(memKeys), len(staticKeys))
 
 	// Walk the keys together to produce the new static intervals.
@@ -60,6 +102,7 @@ func (db *DB) flush() error {
 		return fmt.Errorf("error combining mem+static intervals: %s", err)
 	}
 	intervalsForCleanup = append(intervalsForCleanup, cleanup...)
+	mergeIntervalMaps(intervals, rolledUpIntervals)
 	Log.Printf("Flushing %d total intervals and cleaning up %d obsolete or out-of-retention intervals",
 		len(intervals), len(intervalsForCleanup))
 
@@ -69,25 +112,46 @@ func (db *DB) flush() error {
 		return fmt.Errorf("cannot combine dimension tables: %s", err)
 	}
 
+	// Drop unreferenced values from the dimension tables if necessary.
+	if columns := db.dimensionColumnsToCompact(newDimTables, compactDimensions); len(columns) > 0 {
+		compactedIntervals, compactedDimTables, cleanup, staleDimTables, err :=
+			db.compactDimensionTables(columns, intervals, newDimTables)
+		if err != nil {
+			return fmt.Errorf("cannot compact dimension tables: %s", err)
+		}
+		db.recordDimensionCompaction(columns, newDimTables, compactedDimTables)
+		intervals = compactedIntervals
+		newDimTables = compactedDimTables
+		intervalsForCleanup = append(intervalsForCleanup, cleanup...)
+		// These may be the static tables or tables that were just written.
+		oldDimTables = append(oldDimTables, staleDimTables...)
+	}
+
+	// Move old intervals to the cold storage directory, if there is one. With background compaction, the
+	// compaction goroutines do this instead.
+	var movedRuns []*Interval
+	if db.compactor == nil {
+		movedRuns = db.moveIntervalsToColdStorage(intervals)
+	}
+
 	// Make the new StaticTable.
 	newStaticTable := NewStaticTable(db.Schema)
 	newStaticTable.Intervals = intervals
 	newStaticTable.DimensionTables = newDimTables
-
-	// Create the FlushInfo and send it over to the request handling goroutine which will make the swap and then
-	// return a chan to wait on all requests currently running on the old StaticTable.
-	allRequestsFinishedChan := make(chan chan struct{})
-	db.flushes <- &FlushInfo{NewStaticTable: newStaticTable, AllRequestsFinishedChan: allRequestsFinishedChan}
-	allRequestsFinished := <-allRequestsFinishedChan
-
-	// Wait for all requests on the old StaticTable to be done.
-	<-allRequestsFinished
+	if db.DiskBacked {
+		newStaticTable.InsertLogSeq = db.insertLog.seq
+	}
+	db.installStaticTable(newStaticTable)
 
 	if db.DiskBacked {
 		// Write out the metadata.
 		if err := db.writeMetadataFile(); err != nil {
 			return fmt.Errorf("error writing metadata: %s", err)
 		}
+		// Everything in the insertion log is now part of the persisted StaticTable.
+		if err := db.insertLog.truncate(); err != nil {
+			return fmt.Errorf("error truncating insertion log: %s", err)
+		}
 
 		// Clean up any now-unused intervals and dimension tables (only associated with previous StaticTable).
 		for _, dimTable := range oldDimTables {
@@ -96,6 +160,9 @@ func (db *DB) flush() error {
 			}
 		}
 		db.cleanUpOldIntervals(intervalsForCleanup)
+		for _, run := range movedRuns {
+			db.cleanUpIntervalRun(run)
+		}
 	}
 
 	// Replace the MemTable with a fresh, empty one.
@@ -103,11 +170,25 @@ func (db *DB) flush() error {
 	return nil
 }
 
+// installStaticTable replaces the current StaticTable with staticTable and waits for all the requests using
+// the old one to finish. This should only be called by the insertion goroutine.
+func (db *DB) installStaticTable(staticTable *StaticTable) {
+	// Create the FlushInfo and send it over to the request handling goroutine which will make the swap and then
+	// return a chan to wait on all requests currently running on the old StaticTable.
+	allRequestsFinishedChan := make(chan chan struct{})
+	db.flushes <- &FlushInfo{NewStaticTable: staticTable, AllRequestsFinishedChan: allRequestsFinishedChan}
+	allRequestsFinished := <-allRequestsFinishedChan
+
+	// Wait for all requests on the old StaticTable to be done.
+	<-allRequestsFinished
+}
+
 const intervalWriterParallelism = 8
 
 type intervalWriterResponse struct {
 	key      time.Time
 	interval *Interval
+	replaced *Interval // A static interval which is no longer used, if any
 	err      error
 }
 
@@ -147,6 +228,9 @@ func (db *DB) combineSortedMemStaticIntervals(memKeys, staticKeys []time.Time) (
 				continue
 			}
 			intervals[response.key] = response.interval
+			if response.replaced != nil {
+				intervalsForCleanup = append(intervalsForCleanup, response.replaced)
+			}
 		}
 		done <- err
 	}()
@@ -160,52 +244,35 @@ func (db *DB) combineSortedMemStaticIntervals(memKeys, staticKeys []time.Time) (
 			// We reuse this interval directly; the data hasn't changed.
 			numStaticIntervals++
 			intervalWriterRequests <- func() *intervalWriterResponse {
-				return &intervalWriterResponse{staticKey, db.StaticTable.Intervals[staticKey], nil}
+				return &intervalWriterResponse{staticKey, db.StaticTable.Intervals[staticKey], nil, nil}
 			}
 			staticKeys = staticKeys[1:]
 		case memKey.Before(staticKey):
 			numMemIntervals++
-			intervalWriterRequests <- func() *intervalWriterResponse {
-				iv, err := db.WriteMemInterval(db.memTable.Intervals[memKey])
-				if err != nil {
-					err = fmt.Errorf("cannot write mem interval: %s", err)
-				}
-				return &intervalWriterResponse{memKey, iv, err}
-			}
+			intervalWriterRequests <- func() *intervalWriterResponse { return db.writeNewMemInterval(memKey) }
 			memKeys = memKeys[1:]
 		default: // equal
 			numCombinedIntervals++
 			staticInterval := db.StaticTable.Intervals[staticKey]
 			memInterval := db.memTable.Intervals[memKey]
 			intervalWriterRequests <- func() *intervalWriterResponse {
-				iv, err := db.WriteCombinedInterval(memInterval, staticInterval)
-				if err != nil {
-					err = fmt.Errorf("cannot write combined interval: %s", err)
-				}
-				return &intervalWriterResponse{staticKey, iv, err}
+				return db.combineIntervals(staticKey, staticInterval, memInterval)
 			}
 			staticKeys = staticKeys[1:]
 			memKeys = memKeys[1:]
-			intervalsForCleanup = append(intervalsForCleanup, staticInterval)
 		}
 	}
 	for _, staticKey := range staticKeys {
 		numStaticIntervals++
 		key := staticKey
 		intervalWriterRequests <- func() *intervalWriterResponse {
-			return &intervalWriterResponse{key, db.StaticTable.Intervals[key], nil}
+			return &intervalWriterResponse{key, db.StaticTable.Intervals[key], nil, nil}
 		}
 	}
 	for _, memKey := range memKeys {
 		numMemIntervals++
 		key := memKey
-		intervalWriterRequests <- func() *intervalWriterResponse {
-			iv, err := db.WriteMemInterval(db.memTable.Intervals[key])
-			if err != nil {
-				err = fmt.Errorf("cannot write mem interval: %s", err)
-			}
-			return &intervalWriterResponse{key, iv, err}
-		}
+		intervalWriterRequests <- func() *intervalWriterResponse { return db.writeNewMemInterval(key) }
 	}
 
 	close(intervalWriterRequests)
@@ -221,6 +288,69 @@ func (db *DB) combineSortedMemStaticIntervals(memKeys, staticKeys []time.Time) (
 	return intervals, intervalsForCleanup, nil
 }
 
+// writeNewMemInterval writes out the mem interval at key, which has no static interval to be combined with.
+func (db *DB) writeNewMemInterval(key time.Time) *intervalWriterResponse {
+	memInterval := db.memTable.Intervals[key]
+	var iv *Interval
+	var err error
+	if db.memTable.Replaced[key] && db.IntervalDimensionTables {
+		// The mem interval's dimension tables start with the values of the interval it replaces; rewriting
+		// the rows through new tables leaves out the values which are no longer used.
+		iv, err = db.writeTransformedInterval(nil, []*MemInterval{memInterval}, memInterval.Start,
+			memInterval.End, db.nextGeneration(key), nil, nil, nil)
+	} else {
+		iv, err = db.writeMemInterval(memInterval, db.nextGeneration(key))
+	}
+	if err != nil {
+		err = fmt.Errorf("cannot write mem interval: %s", err)
+	}
+	return &intervalWriterResponse{key, iv, nil, err}
+}
+
+// combineIntervals adds the rows of memInterval to staticInterval, either by appending them as a new run
+// (with incremental flushes) or by rewriting the interval.
+//
+// A corrupted interval is never rewritten (or cleaned up), so that its data may still be recovered. The new
+// rows are appended to it as a run, and are excluded from queries along with the rest of the interval.
+func (db *DB) combineIntervals(key time.Time, staticInterval *Interval,
+	memInterval *MemInterval) *intervalWriterResponse {
+
+	if verifyErr := staticInterval.Verify(db.Schema); verifyErr != nil {
+		if !isCorruption(verifyErr) {
+			err := fmt.Errorf("cannot read interval at %s: %s", staticInterval.Start, verifyErr)
+			return &intervalWriterResponse{key, nil, nil, err}
+		}
+		Log.Printf("Flush: adding new rows to corrupted interval at %s as a separate run: %s",
+			staticInterval.Start, verifyErr)
+		run, err := db.writeMemInterval(memInterval, db.nextGeneration(key, staticInterval))
+		if err != nil {
+			return &intervalWriterResponse{key, nil, nil, fmt.Errorf("cannot write interval run: %s", err)}
+		}
+		interval := staticInterval.withRun(run)
+		interval.markCorrupted(verifyErr)
+		return &intervalWriterResponse{key, interval, nil, nil}
+	}
+	if db.IncrementalFlush {
+		run, err := db.writeMemInterval(memInterval, db.nextGeneration(key, staticInterval))
+		if err != nil {
+			return &intervalWriterResponse{key, nil, nil, fmt.Errorf("cannot write interval run: %s", err)}
+		}
+		// The existing runs are still used, so nothing is cleaned up.
+		return &intervalWriterResponse{key, staticInterval.withRun(run), nil, nil}
+	}
+	var iv *Interval
+	var err error
+	if len(staticInterval.Runs) > 0 {
+		iv, err = db.writeMergedInterval(staticInterval, memInterval, db.nextGeneration(key, staticInterval))
+	} else {
+		iv, err = db.WriteCombinedInterval(memInterval, staticInterval)
+	}
+	if err != nil {
+		err = fmt.Errorf("cannot write combined interval: %s", err)
+	}
+	return &intervalWriterResponse{key, iv, staticInterval, err}
+}
+
 // combineDimensionTables returns a combined set of dimension tables
 // appropriate for the schema from the memtable and static table's dimension tables.
 // Any dimensions in which the memtable has no new entries are reused from the static table.
@@ -262,12 +392,15 @@ type indexedDimensionTable struct {
 
 // writeMetadataFile serializes db to JSON and atomically writes it to disk by using an intermediate tempfile
 // and moving it into place.
-func (db *DB) writeMetadataFile() error {
+func (db *DB) writeMetadataFile() error { return writeMetadata(db.Dir, db) }
+
+// writeMetadata writes the metadata of db to dir (which need not be db's own directory).
+func writeMetadata(dir string, db *DB) error {
 	b, err := json.MarshalIndent(db, "", "  ")
 	if err != nil {
 		return fmt.Errorf("error marshalling metadata JSON: %s", err)
 	}
-	filename := filepath.Join(db.Dir, MetadataFilename)
+	filename := filepath.Join(dir, MetadataFilename)
 	tmpFilename := filename + ".tmp"
 	if err := ioutil.WriteFile(tmpFilename, b, 0666); err != nil {
 		return err
@@ -275,20 +408,48 @@ func (db *DB) writeMetadataFile() error {
 	return os.Rename(tmpFilename, filename)
 }
 
+// cleanUpOldIntervals deletes the files of intervals which are no longer part of the StaticTable. An interval
+// which a background compaction is still reading is left for the compaction to clean up once it is done. This
+// should only be called by the inserter goroutine.
 func (db *DB) cleanUpOldIntervals(intervals []*Interval) {
 	for _, interval := range intervals {
-		// Unmap, close, and delete all the segment files
-		for i, segment := range interval.Segments {
-			if err := segment.Bytes.Unmap(); err != nil {
-				Log.Println("cleanup error unmapping segment file:", err)
-			}
-			if err := segment.File.Close(); err != nil {
-				Log.Println("cleanup error closing segment file:", err)
-			}
-			if err := os.Remove(interval.SegmentFilename(db.Schema, i)); err != nil {
-				Log.Println("cleanup error deleting segment file:", err)
+		if db.compactor != nil {
+			task, ok := db.compactor.inFlight[interval.Start]
+			if ok && task.Sources[interval.Start] == interval && task.deferCleanUp(interval) {
+				continue
 			}
 		}
+		db.cleanUpInterval(interval)
+	}
+}
+
+// cleanUpInterval deletes the files of all the runs of interval.
+func (db *DB) cleanUpInterval(interval *Interval) {
+	for _, run := range interval.AllRuns() {
+		db.cleanUpIntervalRun(run)
+	}
+}
+
+// cleanUpIntervalRun unmaps, closes, and deletes all the files of a single run of an interval.
+func (db *DB) cleanUpIntervalRun(interval *Interval) {
+	// Unmap, close, and delete all the segment files
+	for i, segment := range interval.Segments {
+		if err := segment.close(); err != nil {
+			Log.Println("cleanup error unmapping segment file:", err)
+		}
+		if err := os.Remove(interval.SegmentFilename(db.Schema, i)); err != nil {
+			Log.Println("cleanup error deleting segment file:", err)
+		}
+	}
+	for i, dimTable := range interval.DimensionTables {
+		if dimTable == nil {
+			continue
+		}
+		// Tables added by a schema change may never have been written.
+		err := os.Remove(interval.DimensionTableFilename(db.Schema, i))
+		if err != nil && !os.IsNotExist(err) {
+			Log.Println("cleanup error deleting interval dimension table file:", err)
+		}
 	}
 }
 
@@ -303,6 +464,19 @@ func (db *DB) partitionIntervalStartsByRetention(keys []time.Time) (outdated, cu
 	return outdated, current
 }
 
+// partitionStaticIntervalsByRetention is like partitionIntervalStartsByRetention, but uses the end of each
+// static interval (rolled-up intervals may be longer than IntervalDuration).
+func (db *DB) partitionStaticIntervalsByRetention(keys []time.Time) (outdated, current []time.Time) {
+	for _, key := range keys {
+		if time.Since(db.StaticTable.Intervals[key].End) > db.Retention {
+			outdated = append(outdated, key)
+		} else {
+			current = append(current, key)
+		}
+	}
+	return outdated, current
+}
+
 type times []time.Time
 
 func (t times) Len() int           { return len(t) }
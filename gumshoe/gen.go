@@ -36,6 +36,15 @@ var filters = []FilterType{
 	{"FilterLessThan", "<", "<"},
 	{"FilterLessThanOrEqual", "<=", "<="},
 	{"FilterIn", "in", ""},
+	// String pattern filters (see makeDimensionFilterFuncPattern)
+	{"FilterPrefix", "prefix", ""},
+	{"FilterSuffix", "suffix", ""},
+	{"FilterContains", "contains", ""},
+	{"FilterRegex", "regex", ""},
+	// Compound filters (see filter_tree.go)
+	{"FilterAnd", "and", ""},
+	{"FilterOr", "or", ""},
+	{"FilterNot", "not", ""},
 }
 
 type Type struct {
@@ -118,10 +127,13 @@ type Type int
 
 const ( {{range .Types}}
 {{.GumshoeTypeName}} Type = iota{{end}}
+// TypeHyperLogLog is the type of metric columns holding a HyperLogLog sketch (see hyperloglog.go).
+TypeHyperLogLog
 )
 
 var typeWidths = []int{ {{range .Types}}
 {{.GumshoeTypeName}}: int(unsafe.Sizeof({{.GoName}}(0))),{{end}}
+TypeHyperLogLog: hllRegisters,
 }
 
 var typeMaxes = []float64{ {{range .Types}}
@@ -130,17 +142,21 @@ var typeMaxes = []float64{ {{range .Types}}
 
 var typeNames = []string{ {{range .Types}}
 {{.GumshoeTypeName}}: "{{.GoName}}",{{end}}
+TypeHyperLogLog: "hyperloglog",
 }
 
 var NameToType = map[string]Type{ {{range .Types}}
 "{{.GoName}}": {{.GumshoeTypeName}},{{end}}
+"hyperloglog": TypeHyperLogLog,
 }
 
 var TypeToBigType = []Type{ {{range .Types}}
 {{.GumshoeTypeName}}: {{.GumshoeBigTypeName}},{{end}}
+TypeHyperLogLog: TypeHyperLogLog,
 }
 
-// add adds other to m (only m is modified).
+// add combines other into m (only m is modified) using the merge function of each column: the values are
+// summed, or the smaller or larger value is kept. HyperLogLog sketches are always merged.
 func (m MetricBytes) add(s *Schema, other MetricBytes) {
 	p1 := uintptr(unsafe.Pointer(&m[0]))
 	p2 := uintptr(unsafe.Pointer(&other[0]))
@@ -150,7 +166,21 @@ func (m MetricBytes) add(s *Schema, other MetricBytes) {
 		col2 := unsafe.Pointer(p2 + offset)
 		switch column.Type { {{range .Types}}
 		case {{.GumshoeTypeName}}:
-			*(*{{.GoName}})(col1) = *(*{{.GoName}})(col1) + (*(*{{.GoName}})(col2)){{end}}
+			v1, v2 := (*{{.GoName}})(col1), *(*{{.GoName}})(col2)
+			switch column.Merge {
+			case MergeSum:
+				*v1 += v2
+			case MergeMin:
+				if v2 < *v1 {
+					*v1 = v2
+				}
+			case MergeMax:
+				if v2 > *v1 {
+					*v1 = v2
+				}
+			}{{end}}
+		case TypeHyperLogLog:
+			HyperLogLog(m[offset:]).Merge(HyperLogLog(other[offset:]))
 		}
 	}
 }
@@ -188,6 +218,28 @@ func sumUntyped(u1, u2 Untyped, typ Type) Untyped {
 	panic("unexpected type")
 }
 
+func minUntyped(u1, u2 Untyped, typ Type) Untyped {
+	switch typ { {{range .Types}}
+	case {{.GumshoeTypeName}}:
+		if u2.({{.GoName}}) < u1.({{.GoName}}) {
+			return u2
+		}
+		return u1{{end}}
+	}
+	panic("unexpected type")
+}
+
+func maxUntyped(u1, u2 Untyped, typ Type) Untyped {
+	switch typ { {{range .Types}}
+	case {{.GumshoeTypeName}}:
+		if u2.({{.GoName}}) > u1.({{.GoName}}) {
+			return u2
+		}
+		return u1{{end}}
+	}
+	panic("unexpected type")
+}
+
 // Query helper functions
 
 type FilterType int
@@ -216,6 +268,36 @@ func makeSumFuncGen(typ Type) func(offset int) sumFunc {
 	panic("unreached")
 }
 
+func makeMinFuncGen(typ Type) func(offset int) sumFunc {
+	{{range .Types}}
+	if typ == {{.GumshoeTypeName}} {
+		return func(offset int) sumFunc {
+			return func(min UntypedBytes, metrics MetricBytes) {
+				value := {{.BigTypeName}}(*(*{{.GoName}})(unsafe.Pointer(&metrics[offset])))
+				if p := (*{{.BigTypeName}})(unsafe.Pointer(&min[0])); value < *p {
+					*p = value
+				}
+			}
+		}
+	}{{end}}
+	panic("unreached")
+}
+
+func makeMaxFuncGen(typ Type) func(offset int) sumFunc {
+	{{range .Types}}
+	if typ == {{.GumshoeTypeName}} {
+		return func(offset int) sumFunc {
+			return func(max UntypedBytes, metrics MetricBytes) {
+				value := {{.BigTypeName}}(*(*{{.GoName}})(unsafe.Pointer(&metrics[offset])))
+				if p := (*{{.BigTypeName}})(unsafe.Pointer(&max[0])); value > *p {
+					*p = value
+				}
+			}
+		}
+	}{{end}}
+	panic("unreached")
+}
+
 func makeGetDimensionValueFuncGen(typ Type) func(cell unsafe.Pointer) Untyped {
 	{{range .Types}}
 	if typ == {{.GumshoeTypeName}} {
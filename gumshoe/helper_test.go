@@ -12,8 +12,13 @@ func schemaFixture() *Schema {
 	}
 }
 
-func makeTestDB() *DB {
-	db, err := NewDB(schemaFixture())
+// makeTestDB creates an in-memory DB. Each of configure is applied to the schema before the DB is created.
+func makeTestDB(configure ...func(*Schema)) *DB {
+	schema := schemaFixture()
+	for _, f := range configure {
+		f(schema)
+	}
+	db, err := NewDB(schema)
 	if err != nil {
 		panic(err)
 	}
@@ -51,7 +56,7 @@ func insertRow(db *DB, row RowMap) { insertRows(db, []RowMap{row}) }
 func hour(n int) float64 { return float64(n * 60 * 60) }
 
 func makeColumn(name, typeString string) Column {
-	return Column(makeMetricColumn(name, typeString))
+	return makeMetricColumn(name, typeString).Column
 }
 
 func makeMetricColumn(name, typeString string) MetricColumn {
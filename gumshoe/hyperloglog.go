@@ -0,0 +1,131 @@
+// HyperLogLog metric columns, for approximate distinct counts.
+//
+// A HyperLogLog column holds a sketch of the set of values inserted into it: hllRegisters one-byte registers,
+// each of which records the longest run of leading zeros among the hashes of the values assigned to it.
+// Sketches are merged by taking the maximum of each register, so they collapse along with their rows just as
+// other metrics are summed. The "cardinality" aggregate estimates the number of distinct values from the
+// merged sketch, with a standard error of about 1.04/sqrt(hllRegisters) (3%).
+
+package gumshoe
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"strconv"
+)
+
+const (
+	hllPrecision = 10
+	hllRegisters = 1 << hllPrecision
+
+	// hllJSONKey is the key of the JSON object holding a serialized sketch.
+	hllJSONKey = "hyperloglog"
+)
+
+// A HyperLogLog is a sketch of a set of values. It is encoded in JSON as {"hyperloglog": <base64 registers>}.
+type HyperLogLog []byte
+
+// NewHyperLogLog returns a sketch of the empty set.
+func NewHyperLogLog() HyperLogLog { return make(HyperLogLog, hllRegisters) }
+
+// Add adds value to the set.
+func (h HyperLogLog) Add(value string) {
+	hash := hllHash(value)
+	index := hash >> (64 - hllPrecision)
+	// The remaining bits, with a sentinel bit to bound the run of zeros.
+	rest := hash<<hllPrecision | 1<<(hllPrecision-1)
+	if rank := byte(bits.LeadingZeros64(rest) + 1); rank > h[index] {
+		h[index] = rank
+	}
+}
+
+// Merge adds the values of the set sketched by other to h (only h is modified).
+func (h HyperLogLog) Merge(other HyperLogLog) {
+	for i := 0; i < hllRegisters; i++ {
+		if other[i] > h[i] {
+			h[i] = other[i]
+		}
+	}
+}
+
+// Estimate returns the estimated number of distinct values in the set.
+func (h HyperLogLog) Estimate() uint64 {
+	m := float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, register := range h[:hllRegisters] {
+		sum += math.Ldexp(1, -int(register))
+		if register == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	// Small sets are estimated more accurately by counting the empty registers.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+func (h HyperLogLog) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string][]byte{hllJSONKey: h})
+}
+
+// ParseHyperLogLog converts a sketch in its JSON form (decoded into an interface{}, as in a RowMap) back into
+// a HyperLogLog.
+func ParseHyperLogLog(value Untyped) (HyperLogLog, error) {
+	if h, ok := value.(HyperLogLog); ok {
+		return h, nil
+	}
+	object, _ := value.(map[string]interface{})
+	encoded, ok := object[hllJSONKey].(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a HyperLogLog sketch; got %v", value)
+	}
+	registers, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("bad HyperLogLog sketch: %s", err)
+	}
+	if len(registers) != hllRegisters {
+		return nil, fmt.Errorf("bad HyperLogLog sketch: expected %d registers; got %d",
+			hllRegisters, len(registers))
+	}
+	return HyperLogLog(registers), nil
+}
+
+// addValue adds an inserted value of a HyperLogLog column to h. A string or number is added to the set and a
+// sketch (say, exported from another DB) is merged in.
+func (h HyperLogLog) addValue(value Untyped) error {
+	switch v := value.(type) {
+	case nil:
+	case string:
+		h.Add(v)
+	case float64:
+		h.Add(strconv.FormatFloat(v, 'g', -1, 64))
+	default:
+		sketch, err := ParseHyperLogLog(value)
+		if err != nil {
+			return err
+		}
+		h.Merge(sketch)
+	}
+	return nil
+}
+
+func hllHash(value string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	x := hash.Sum64()
+	// FNV doesn't mix the high bits well for short values, so finish with the MurmurHash3 finalizer.
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
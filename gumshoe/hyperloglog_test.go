@@ -0,0 +1,85 @@
+package gumshoe
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestHyperLogLogEstimates(t *testing.T) {
+	h1 := NewHyperLogLog()
+	h2 := NewHyperLogLog()
+	for i := 0; i < 20000; i++ {
+		h1.Add(strconv.Itoa(i))
+		h1.Add(strconv.Itoa(i)) // Duplicates don't count
+		h2.Add(strconv.Itoa(i + 10000))
+	}
+	checkEstimate := func(h HyperLogLog, expected float64) {
+		if math.Abs(float64(h.Estimate())-expected) > 0.1*expected {
+			t.Errorf("got estimate %d; expected about %v", h.Estimate(), expected)
+		}
+	}
+	checkEstimate(h1, 20000)
+	h1.Merge(h2)
+	checkEstimate(h1, 30000)
+
+	// Sketches survive a round trip through JSON.
+	b, err := json.Marshal(h1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	h3, err := ParseHyperLogLog(decoded)
+	Assert(t, err, IsNil)
+	Assert(t, h3, DeepEquals, h1)
+}
+
+func TestCardinalityAggregates(t *testing.T) {
+	db := makeTestDB(func(schema *Schema) {
+		schema.SegmentSize = 1 << 16
+		schema.MetricColumns = append(schema.MetricColumns, makeMetricColumn("users", "hyperloglog"))
+	})
+	defer closeTestDB(db)
+
+	sketch := NewHyperLogLog()
+	sketch.Add("dave")
+	sketch.Add("erin")
+	var sketchJSON interface{}
+	b, _ := json.Marshal(sketch)
+	json.Unmarshal(b, &sketchJSON)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 1.0, "users": "alice"},
+		{"at": 0.0, "dim1": "a", "metric1": 1.0, "users": "bob"},
+		{"at": 0.0, "dim1": "a", "metric1": 1.0, "users": "alice"},
+		{"at": 0.0, "dim1": "b", "metric1": 1.0, "users": "carol"},
+		{"at": 0.0, "dim1": "b", "metric1": 1.0},
+		{"at": hour(1), "dim1": "b", "metric1": 1.0, "users": sketchJSON},
+	})
+
+	query := &Query{
+		Aggregates: []QueryAggregate{{Type: AggregateCardinality, Column: "users", Name: "users"}},
+	}
+	results := runQuery(db, query)
+	Assert(t, results[0]["users"], util.DeepConvertibleEquals, 5)
+
+	query.Groupings = []QueryGrouping{{Column: "dim1", Name: "dim1"}}
+	results = runQuery(db, query)
+	Assert(t, results, util.DeepEqualsUnordered, []RowMap{
+		{"dim1": "a", "users": 2, "rowCount": 3},
+		{"dim1": "b", "users": 3, "rowCount": 3},
+	})
+
+	_, err := db.GetQueryResult(&Query{Aggregates: []QueryAggregate{{Type: AggregateSum, Column: "users"}}})
+	Assert(t, err, NotNil)
+	query = &Query{Aggregates: []QueryAggregate{{Type: AggregateCardinality, Column: "metric1"}}}
+	_, err = db.GetQueryResult(query)
+	Assert(t, err, NotNil)
+}
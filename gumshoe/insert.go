@@ -1,7 +1,7 @@
 package gumshoe
 
 import (
-	"bytes"
+	"fmt"
 	"time"
 
 	"github.com/philc/gumshoedb/internal/b"
@@ -14,6 +14,17 @@ type insertionRow struct {
 }
 
 func (db *DB) HandleInserts() {
+	// Without background compaction, intervals only need periodic attention when they accumulate runs.
+	var compactionChecks <-chan time.Time
+	var compactionResults <-chan *compactionResult
+	if db.compactor != nil || db.IncrementalFlush {
+		ticker := time.NewTicker(compactionCheckInterval)
+		defer ticker.Stop()
+		compactionChecks = ticker.C
+	}
+	if db.compactor != nil {
+		compactionResults = db.compactor.results
+	}
 	for {
 		select {
 		case <-db.shutdown:
@@ -21,14 +32,61 @@ func (db *DB) HandleInserts() {
 		case insert := <-db.inserts:
 			insert.Err <- db.insertRows(insert.Rows)
 		case errCh := <-db.flushSignals:
-			errCh <- db.flush()
+			err := db.flush(false)
+			db.checkCompactions()
+			errCh <- err
+		case errCh := <-db.dimensionCompactionSignals:
+			err := db.flush(true)
+			db.checkCompactions()
+			errCh <- err
+		case errCh := <-db.runCompactionSignals:
+			errCh <- db.compactRuns(2)
+		case req := <-db.deletes:
+			rows, err := db.deleteRows(req)
+			db.checkCompactions()
+			req.Resp <- deleteResponse{Rows: rows, Err: err}
+		case req := <-db.replacements:
+			err := db.replaceRows(req)
+			db.checkCompactions()
+			req.Err <- err
+		case <-compactionChecks:
+			db.checkCompactions()
+		case result := <-compactionResults:
+			if err := db.finishCompaction(result); err != nil {
+				Log.Println("Compaction error:", err)
+			}
+			db.checkCompactions()
+		}
+	}
+}
+
+// checkCompactions schedules background compactions or, if there are no compaction goroutines, merges the
+// runs of intervals with too many runs directly.
+func (db *DB) checkCompactions() {
+	if db.compactor != nil {
+		db.scheduleCompactions()
+		return
+	}
+	if db.IncrementalFlush {
+		if err := db.compactRuns(db.MaxIntervalRuns + 1); err != nil {
+			Log.Println("Error merging interval runs:", err)
 		}
 	}
 }
 
-// insertRows puts each row into the memtable, combining with other rows if possible. This should only be
-// called by the insertion goroutine.
+// insertRows records rows in the insertion log (for disk-backed DBs) and then puts them into the memtable.
+// This should only be called by the insertion goroutine.
 func (db *DB) insertRows(rows []UnpackedRow) error {
+	if db.insertLog != nil {
+		if err := db.insertLog.append(rows); err != nil {
+			return fmt.Errorf("cannot write to insertion log: %s", err)
+		}
+	}
+	return db.insertIntoMemTable(rows)
+}
+
+// insertIntoMemTable puts each row into the memtable, combining with other rows if possible.
+func (db *DB) insertIntoMemTable(rows []UnpackedRow) error {
 	Log.Printf("Inserting %d rows", len(rows))
 	insertedRows := 0
 	droppedOldRows := 0
@@ -37,44 +95,53 @@ func (db *DB) insertRows(rows []UnpackedRow) error {
 		if err != nil {
 			return err
 		}
-		db.latestTimestampLock.Lock()
-		if row.Timestamp.After(db.latestTimestamp) {
-			db.latestTimestamp = row.Timestamp
-		}
-		db.latestTimestampLock.Unlock()
-		timestamp := row.Timestamp.Truncate(db.IntervalDuration)
-		// Drop the row if it's out of retention
-		if db.FixedRetention && db.intervalStartOutOfRetention(timestamp) {
+		if db.insertSerializedRow(row, unpackedRow.Count) {
+			insertedRows++
+		} else {
 			droppedOldRows++
-			continue
 		}
+	}
+	Log.Printf("Inserted %d rows succesfully; dropped %d out-of-retention rows", insertedRows, droppedOldRows)
+	return nil
+}
 
-		interval, ok := db.memTable.Intervals[timestamp]
-		if !ok {
-			interval = &MemInterval{
-				Start: timestamp,
-				End:   timestamp.Add(db.IntervalDuration),
-				// Make a B+tree with bytes.Compare (lexicographical) as the key comparison function.
-				Tree: b.TreeNew(bytes.Compare),
-			}
-			db.memTable.Intervals[timestamp] = interval
+// insertSerializedRow puts a single serialized row (with the given count) into the memtable. It returns
+// false if the row was dropped because it is out of retention.
+func (db *DB) insertSerializedRow(row *insertionRow, count int) bool {
+	db.latestTimestampLock.Lock()
+	if row.Timestamp.After(db.latestTimestamp) {
+		db.latestTimestamp = row.Timestamp
+	}
+	db.latestTimestampLock.Unlock()
+	timestamp := row.Timestamp.Truncate(db.IntervalDuration)
+	// Drop the row if it's out of retention
+	if db.FixedRetention && db.intervalStartOutOfRetention(timestamp) {
+		return false
+	}
+
+	interval, ok := db.memTable.Intervals[timestamp]
+	if !ok {
+		interval = &MemInterval{
+			Start: timestamp,
+			End:   timestamp.Add(db.IntervalDuration),
+			// Make a B+tree ordered by the schema's key order (lexicographical, unless there's a sort key).
+			Tree: b.TreeNew(db.keyCompareFunc()),
 		}
-		value, ok := interval.Tree.Get([]byte(row.Dimensions))
-		if ok {
-			// This key already exists in the tree. Add the metrics; bump the count.
-			MetricBytes(value.Metric).add(db.Schema, row.Metrics)
-			value.Count += unpackedRow.Count
-		} else {
-			value = b.MetricWithCount{
-				Count:  unpackedRow.Count,
-				Metric: []byte(row.Metrics),
-			}
+		db.memTable.Intervals[timestamp] = interval
+	}
+	value, ok := interval.Tree.Get([]byte(row.Dimensions))
+	if ok {
+		// This key already exists in the tree. Add the metrics; bump the count.
+		MetricBytes(value.Metric).add(db.Schema, row.Metrics)
+		value.Count += count
+	} else {
+		value = b.MetricWithCount{
+			Count:  count,
+			Metric: []byte(row.Metrics),
 		}
-		interval.Tree.Set([]byte(row.Dimensions), value)
-		insertedRows++
 	}
-	Log.Printf("Inserted %d rows succesfully; dropped %d out-of-retention rows", insertedRows, droppedOldRows)
-	return nil
+	interval.Tree.Set([]byte(row.Dimensions), value)
+	return true
 }
 
 func (db *DB) intervalStartOutOfRetention(timestamp time.Time) bool {
@@ -0,0 +1,141 @@
+package gumshoe
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const InsertLogFilename = "insertion.log"
+
+// An insertLog is an append-only file in the DB directory holding every batch of rows inserted since the last
+// flush. It is replayed into the memtable when the DB is opened (so that a crash doesn't lose the contents of
+// the memtable) and truncated once a flush has successfully written out the metadata.
+//
+// Each batch is written as a record:
+//
+//	length (uint32) | crc32 of seq and payload (uint32) | seq (uint64) | payload (JSON-encoded []UnpackedRow)
+//
+// If the process dies partway through writing a record, the torn record at the end of the log is detected by
+// the length/checksum and discarded during replay.
+//
+// Record sequence numbers keep increasing across truncations. Each StaticTable records the sequence number of
+// the last record whose rows it contains (InsertLogSeq), so if the process dies after a flush has written
+// the metadata but before the log is truncated, the flushed records are skipped instead of replayed twice.
+//
+// Records are written but not fsynced, so the log protects against process crashes but not against the
+// machine losing power.
+type insertLog struct {
+	f   *os.File
+	seq uint64 // The sequence number of the last record written
+}
+
+const insertLogHeaderSize = 16
+
+func openInsertLog(dir string) (*insertLog, error) {
+	f, err := os.OpenFile(filepath.Join(dir, InsertLogFilename), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &insertLog{f: f}, nil
+}
+
+// append writes rows to the end of the log as a single record.
+func (l *insertLog) append(rows []UnpackedRow) error {
+	payload, err := json.Marshal(rows)
+	if err != nil {
+		return err
+	}
+	l.seq++
+	record := make([]byte, insertLogHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint64(record[8:16], l.seq)
+	copy(record[insertLogHeaderSize:], payload)
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+	_, err = l.f.Write(record)
+	return err
+}
+
+// replay reads every intact record from the start of the log and calls fn with the rows of each one whose
+// sequence number is greater than flushedSeq (the others were already flushed). A torn or corrupt record ends
+// the replay; it (and anything after it) is truncated away so that subsequent appends follow the last good
+// record. After replay, the log is positioned for appending.
+func (l *insertLog) replay(flushedSeq uint64, fn func(rows []UnpackedRow) error) (records int, err error) {
+	l.seq = flushedSeq
+	stat, err := l.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := l.f.Seek(0, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+	var offset int64
+	header := make([]byte, insertLogHeaderSize)
+	for {
+		if _, err := io.ReadFull(l.f, header); err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				break
+			}
+			return records, err
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+		seq := binary.LittleEndian.Uint64(header[8:16])
+		// The length of a torn header may be garbage, so don't allocate more than the rest of the file.
+		if int64(length) > stat.Size()-offset-insertLogHeaderSize {
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(l.f, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return records, err
+		}
+		if crc32.Update(crc32.ChecksumIEEE(header[8:16]), crc32.IEEETable, payload) != checksum {
+			break
+		}
+		offset += insertLogHeaderSize + int64(length)
+		if seq > l.seq {
+			l.seq = seq
+		}
+		if seq <= flushedSeq {
+			continue
+		}
+		var rows []UnpackedRow
+		if err := json.Unmarshal(payload, &rows); err != nil {
+			return records, fmt.Errorf("cannot decode insertion log record at offset %d: %s",
+				offset-insertLogHeaderSize-int64(length), err)
+		}
+		if err := fn(rows); err != nil {
+			return records, err
+		}
+		records++
+	}
+
+	Log.Printf("Discarding a torn record at the end of the insertion log (offset %d)", offset)
+	if err := l.f.Truncate(offset); err != nil {
+		return records, err
+	}
+	_, err = l.f.Seek(offset, os.SEEK_SET)
+	return records, err
+}
+
+// truncate discards the contents of the log. This should be called after the rows it contains have been
+// durably flushed. The sequence numbers of subsequent records continue from the last one.
+func (l *insertLog) truncate() error {
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := l.f.Seek(0, os.SEEK_SET)
+	return err
+}
+
+func (l *insertLog) close() error { return l.f.Close() }
@@ -0,0 +1,189 @@
+package gumshoe
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+// crashTestDB abandons db without flushing, as if the process had died.
+func crashTestDB(db *DB) {
+	close(db.shutdown)
+	db.insertLog.close()
+	db.removeFlock()
+}
+
+func TestInsertionLogIsReplayedAfterCrash(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+
+	insertRow(db, RowMap{"at": 0.0, "dim1": "a", "metric1": 1.0})
+	// These rows are only in the memtable and the insertion log.
+	rows := []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 2.0},
+		{"at": 0.0, "dim1": "b", "metric1": 4.0},
+	}
+	if err := db.Insert(rows); err != nil {
+		t.Fatal(err)
+	}
+	crashTestDB(db)
+
+	db, err := OpenDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": 0.0, "dim1": "a", "metric1": 3}, Count: 2},
+		{RowMap: RowMap{"at": 0.0, "dim1": "b", "metric1": 4}, Count: 1},
+	})
+}
+
+func TestInsertionLogIsTruncatedAfterFlush(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	defer closeTestDB(db)
+
+	filename := filepath.Join(db.Dir, InsertLogFilename)
+	if err := db.Insert([]RowMap{{"at": 0.0, "dim1": "a", "metric1": 1.0}}); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, stat.Size() > 0, IsTrue)
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	stat, err = os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, stat.Size(), Equals, int64(0))
+}
+
+func TestTornInsertionLogRecordIsDiscarded(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+
+	if err := db.Insert([]RowMap{{"at": 0.0, "dim1": "a", "metric1": 1.0}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert([]RowMap{{"at": 0.0, "dim1": "b", "metric1": 1.0}}); err != nil {
+		t.Fatal(err)
+	}
+	crashTestDB(db)
+
+	// Chop a few bytes off the end of the second record.
+	filename := filepath.Join(db.Dir, InsertLogFilename)
+	stat, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filename, stat.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": 0.0, "dim1": "a", "metric1": 1}, Count: 1},
+	})
+}
+
+func TestFlushedInsertionLogRecordsAreNotReplayed(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+
+	if err := db.Insert([]RowMap{{"at": 0.0, "dim1": "a", "metric1": 1.0}}); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(db.Dir, InsertLogFilename)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Put the flushed record back, as if the process had died after writing the metadata but before
+	// truncating the log.
+	if err := ioutil.WriteFile(filename, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.insertLog.f.Seek(0, os.SEEK_END); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert([]RowMap{{"at": 0.0, "dim1": "b", "metric1": 1.0}}); err != nil {
+		t.Fatal(err)
+	}
+	crashTestDB(db)
+
+	db, err = OpenDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": 0.0, "dim1": "a", "metric1": 1}, Count: 1},
+		{RowMap: RowMap{"at": 0.0, "dim1": "b", "metric1": 1}, Count: 1},
+	})
+}
+
+func TestInsertionLogRecordWithTornLengthIsDiscarded(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+
+	if err := db.Insert([]RowMap{{"at": 0.0, "dim1": "a", "metric1": 1.0}}); err != nil {
+		t.Fatal(err)
+	}
+	crashTestDB(db)
+
+	// Append a header claiming a 4 GB payload.
+	filename := filepath.Join(db.Dir, InsertLogFilename)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, insertLogHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], math.MaxUint32)
+	if _, err := f.Write(header); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": 0.0, "dim1": "a", "metric1": 1}, Count: 1},
+	})
+}
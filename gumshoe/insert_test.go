@@ -123,6 +123,27 @@ func TestInsertAndReadNilValues(t *testing.T) {
 	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{{rows[0], 1}, {rows[1], 1}})
 }
 
+func TestInsertMergesMetricsWithTheirMergeFuncs(t *testing.T) {
+	db := makeTestDB(func(schema *Schema) {
+		minColumn := makeMetricColumn("first", "int16")
+		minColumn.Merge = MergeMin
+		maxColumn := makeMetricColumn("peak", "float32")
+		maxColumn.Merge = MergeMax
+		schema.MetricColumns = append(schema.MetricColumns, minColumn, maxColumn)
+	})
+	defer closeTestDB(db)
+
+	// The first two rows collapse in the memtable; the third is merged with the stored row by the flush.
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 1.0, "first": 5.0, "peak": 2.5},
+		{"at": 0.0, "dim1": "a", "metric1": 1.0, "first": -3.0, "peak": 1.5},
+	})
+	insertRow(db, RowMap{"at": 0.0, "dim1": "a", "metric1": 1.0, "first": 4.0, "peak": 7.0})
+	Assert(t, db.GetDebugRows(), util.DeepConvertibleEquals, []UnpackedRow{
+		{RowMap: RowMap{"at": 0.0, "dim1": "a", "metric1": 3, "first": -3, "peak": 7}, Count: 3},
+	})
+}
+
 func TestInsertOverflow(t *testing.T) {
 	schema := schemaFixture()
 	schema.DimensionColumns = []DimensionColumn{makeDimensionColumn("dim1", "uint8", true)}
@@ -161,7 +182,9 @@ func TestInsertDropsRowsOutOfRetention(t *testing.T) {
 	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{{rows[0], 1}})
 }
 
-func makeTestPersistentDB() *DB {
+// makeTestPersistentDB creates a disk-backed DB in a new temporary directory. Each of configure is applied to
+// the schema (after its Dir is set) before the DB is created.
+func makeTestPersistentDB(configure ...func(*Schema)) *DB {
 	tempDir, err := ioutil.TempDir("", "gumshoe-persistence-test")
 	if err != nil {
 		panic(err)
@@ -169,6 +192,9 @@ func makeTestPersistentDB() *DB {
 	schema := schemaFixture()
 	schema.DiskBacked = true
 	schema.Dir = tempDir
+	for _, f := range configure {
+		f(schema)
+	}
 	db, err := NewDB(schema)
 	if err != nil {
 		panic(err)
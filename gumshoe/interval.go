@@ -2,22 +2,32 @@ package gumshoe
 
 import (
 	"bytes"
+	"container/list"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 	"unsafe"
 
+	"github.com/philc/gumshoedb/internal/b"
 	mmap "github.com/philc/gumshoedb/internal/github.com/edsrzf/mmap-go"
 )
 
 // A Segment is an immutable chunk of memory that is part of the data in an interval. It may be backed by a
-// memory-mapped file.
+// memory-mapped file, which is mapped on demand (see segment_files.go); the segment must be acquired while
+// its Bytes are used.
 type Segment struct {
-	File  *os.File // Nil if this segment is not backed by a file
-	Bytes mmap.MMap
+	File  *os.File  // Nil if this segment is not backed by a file or the file is not mapped
+	Bytes mmap.MMap // Nil if the segment's file is not mapped
+
+	filename string        // The backing file, if any
+	cache    *segmentCache // Nil if this segment is not backed by a file
+	refs     int           // The number of readers which have acquired the segment (protected by cache.mu)
+	elem     *list.Element // The segment's entry in cache.unused, if it is there
 }
 
 type Interval struct {
@@ -27,6 +37,29 @@ type Interval struct {
 	Segments    []*Segment `json:"-"`
 	NumSegments int        // Maintained separately for JSON encoding
 	NumRows     int
+	// LogicalRows is the sum of the counts of the rows (that is, the number of inserted rows they represent).
+	// It is zero for intervals written before it was recorded.
+	LogicalRows int `json:",omitempty"`
+	// ZoneMaps has a zone map for each segment. It is empty for intervals written before zone maps existed.
+	ZoneMaps []*ZoneMap `json:",omitempty"`
+	// DimensionTables holds the interval's own dimension tables if the schema has IntervalDimensionTables set.
+	// As with StaticTable.DimensionTables, non-string columns are nil.
+	DimensionTables []*DimensionTable `json:",omitempty"`
+	// Checksums has a checksum of each (encoded) segment. It is empty for intervals written before checksums
+	// existed.
+	Checksums []uint32 `json:",omitempty"`
+	// Schema is the schema the interval was written with if it predates an additive change to the DB's schema
+	// (see Schema.checkEvolution). Its rows are converted to the current layout as they are read.
+	Schema *Schema `json:",omitempty"`
+	// Runs holds the runs appended to the interval by incremental flushes (see interval_runs.go). The
+	// interval itself is the first run.
+	Runs []*Interval `json:",omitempty"`
+	// Cold indicates that the files of the interval have been moved to the schema's ColdDir (see cold.go).
+	Cold bool `json:",omitempty"`
+
+	verifyMu  sync.Mutex // Protects verified and verifyErr (see Verify)
+	verified  bool
+	verifyErr error
 }
 
 // An intervalCursor holds the necessary state to iterate through all the keys of an Interval, in order,
@@ -38,6 +71,10 @@ type intervalCursor struct {
 	Interval     *Interval
 	SegmentIndex int
 	Offset       int
+	rows         []byte   // The decoded rows of the current segment
+	segment      *Segment // The current segment, which is acquired until the cursor moves past it
+	buf          segmentBuffer
+	err          error // The error which stopped the iteration, if any
 }
 
 func (iv *Interval) cursor(s *Schema) *intervalCursor {
@@ -48,34 +85,55 @@ func (iv *Interval) cursor(s *Schema) *intervalCursor {
 }
 
 // Next reads forward throught the Interval and returns the next key/val pair with count. ok indicates whether
-// iteration should stop.
+// iteration should stop. The returned key and val are only valid until the following call to Next. If a
+// segment cannot be read, the iteration stops and Err returns the error.
 func (ic *intervalCursor) Next() (key, val []byte, count int, more bool) {
-	if ic.SegmentIndex >= len(ic.Interval.Segments) {
-		return nil, nil, 0, false
-	}
-	segment := ic.Interval.Segments[ic.SegmentIndex]
-	if ic.Offset >= len(segment.Bytes) {
-		ic.Offset = 0
+	for ic.rows == nil || ic.Offset >= len(ic.rows) {
+		if ic.segment != nil {
+			ic.segment.release()
+			ic.segment = nil
+		}
+		if ic.SegmentIndex >= len(ic.Interval.Segments) {
+			return nil, nil, 0, false
+		}
+		segment := ic.Interval.Segments[ic.SegmentIndex]
+		if err := segment.acquire(); err != nil {
+			ic.err = err
+			return nil, nil, 0, false
+		}
+		rows, err := ic.layoutSegmentRows(ic.Interval.Schema, segment, ic.allRowFields(), &ic.buf)
+		if err != nil {
+			segment.release()
+			ic.err = err
+			return nil, nil, 0, false
+		}
+		ic.segment = segment
+		ic.rows = rows
 		ic.SegmentIndex++
-		return ic.Next()
+		ic.Offset = 0
 	}
 
-	key = segment.Bytes[ic.Offset+ic.DimensionStartOffset : ic.Offset+ic.MetricStartOffset]
-	val = segment.Bytes[ic.Offset+ic.MetricStartOffset : ic.Offset+ic.RowSize]
-	count = int(*(*uint32)(unsafe.Pointer(&segment.Bytes[ic.Offset])))
+	key = ic.rows[ic.Offset+ic.DimensionStartOffset : ic.Offset+ic.MetricStartOffset]
+	val = ic.rows[ic.Offset+ic.MetricStartOffset : ic.Offset+ic.RowSize]
+	count = int(*(*uint32)(unsafe.Pointer(&ic.rows[ic.Offset])))
 	ic.Offset += ic.RowSize
 	return key, val, count, true
 }
 
+// Err returns the error which stopped the iteration, if any.
+func (ic *intervalCursor) Err() error { return ic.err }
+
 // A writeOnlyInterval is a fresh interval corresponding with write-only segment files which is being filled
 // in. After it has been fully written it may be converted to an immutable read-only Interval by calling
 // freeze.
+//
+// Rows are accumulated in memory (in the row format) until a segment is full, and then the segment is
+// encoded in the schema's segment format and written out.
 type writeOnlyInterval struct {
 	Interval
-	DiskBacked     bool
-	CurSegment     io.Writer
-	CurSegmentSize int
-	buffers        []*bytes.Buffer // Used if !DiskBacked
+	DiskBacked bool
+	CurSegment *bytes.Buffer
+	segments   [][]byte // Used if !DiskBacked
 }
 
 func newWriteOnlyInterval(diskBacked bool, generation int, start, end time.Time) *writeOnlyInterval {
@@ -89,112 +147,105 @@ func newWriteOnlyInterval(diskBacked bool, generation int, start, end time.Time)
 	}
 }
 
-func (iv *writeOnlyInterval) writeKeyValCount(key, val []byte, count uint32) error {
+func (iv *writeOnlyInterval) writeKeyValCount(key, val []byte, count uint32) {
 	countBytes := make([]byte, countColumnWidth)
 	*(*uint32)(unsafe.Pointer(&countBytes[0])) = count
-	if _, err := iv.CurSegment.Write(countBytes); err != nil {
-		return err
-	}
-	if _, err := iv.CurSegment.Write(key); err != nil {
-		return err
-	}
-	if _, err := iv.CurSegment.Write(val); err != nil {
-		return err
-	}
+	iv.CurSegment.Write(countBytes)
+	iv.CurSegment.Write(key)
+	iv.CurSegment.Write(val)
 	iv.NumRows++
-	return nil
+	iv.LogicalRows += int(count)
 }
 
 // appendRow appends a new row with count to interval. (It writes multiple rows if the count is too large to
 // represent directly). Rows must be inserted in increasing key (dimension) order, with one call for each row
 // of a given key.
 func (iv *writeOnlyInterval) appendRow(s *Schema, dimensions, metrics []byte, count int) error {
-	if iv.CurSegmentSize+s.RowSize > s.SegmentSize {
-		if err := iv.closeCurrentSegment(); err != nil {
+	if iv.CurSegment != nil && iv.CurSegment.Len()+s.RowSize > s.SegmentSize {
+		if err := iv.closeCurrentSegment(s); err != nil {
 			return err
 		}
-		iv.CurSegmentSize = 0
-		iv.CurSegment = nil
 	}
 
 	if iv.CurSegment == nil {
-		if err := iv.openFreshSegment(s); err != nil {
-			return err
-		}
+		iv.CurSegment = new(bytes.Buffer)
 	}
 	if count > math.MaxUint32 {
 		panic("count greater than MaxUint32 is unrepresentable with uint32 for column count")
 	}
-	iv.CurSegmentSize += s.RowSize
-	return iv.writeKeyValCount(dimensions, metrics, uint32(count))
+	iv.writeKeyValCount(dimensions, metrics, uint32(count))
+	return nil
 }
 
-// freeze opens segment files as readonly mmaps and returns an immutable *Interval. iv should not be used
-// after calling freeze.
+// freeze sets up the segments (backed by their files, if any) and returns an immutable *Interval. iv should
+// not be used after calling freeze.
 func (iv *writeOnlyInterval) freeze(s *Schema) (*Interval, error) {
-	if err := iv.closeCurrentSegment(); err != nil {
+	if err := iv.closeCurrentSegment(s); err != nil {
 		return nil, err
 	}
+	if iv.DiskBacked {
+		if err := iv.storeDimensionTables(s); err != nil {
+			return nil, err
+		}
+	}
 
 	iv.Segments = make([]*Segment, iv.NumSegments)
 	for i := 0; i < iv.NumSegments; i++ {
 		if !iv.DiskBacked {
-			iv.Segments[i] = &Segment{Bytes: iv.buffers[i].Bytes()}
+			iv.Segments[i] = &Segment{Bytes: iv.segments[i]}
 			continue
 		}
-		filename := iv.SegmentFilename(s, i)
-		f, err := os.Open(filename)
-		if err != nil {
-			return nil, err
-		}
-		mapped, err := mmap.Map(f, mmap.RDONLY, 0)
-		if err != nil {
-			return nil, err
-		}
-		iv.Segments[i] = &Segment{File: f, Bytes: mapped}
+		iv.Segments[i] = s.fileSegment(iv.SegmentFilename(s, i))
 	}
 	return &iv.Interval, nil
 }
 
-func (iv *writeOnlyInterval) openFreshSegment(s *Schema) error {
+// closeCurrentSegment encodes the current segment and writes it out (if there is a current segment).
+func (iv *writeOnlyInterval) closeCurrentSegment(s *Schema) error {
+	if iv.CurSegment == nil {
+		return nil
+	}
+	iv.ZoneMaps = append(iv.ZoneMaps, s.makeZoneMap(iv.CurSegment.Bytes()))
+	encoded := s.encodeSegment(iv.CurSegment.Bytes())
+	iv.Checksums = append(iv.Checksums, checksum(encoded))
+	iv.CurSegment = nil
 	defer func() { iv.NumSegments++ }()
 
 	if !iv.DiskBacked {
-		iv.CurSegment = new(bytes.Buffer)
+		iv.segments = append(iv.segments, encoded)
 		return nil
 	}
-
-	filename := iv.SegmentFilename(s, iv.NumSegments)
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		return err
-	}
-	iv.CurSegment = f
-	return nil
-}
-
-func (iv *writeOnlyInterval) closeCurrentSegment() error {
-	if iv.DiskBacked {
-		return iv.CurSegment.(*os.File).Close()
-	}
-	iv.buffers = append(iv.buffers, iv.CurSegment.(*bytes.Buffer))
-	return nil
+	return ioutil.WriteFile(iv.SegmentFilename(s, iv.NumSegments), encoded, 0666)
 }
 
 func (iv *Interval) SegmentFilename(s *Schema, segmentIndex int) string {
 	name := fmt.Sprintf("interval.%d.generation%04d.segment%04d.dat",
 		iv.Start.Unix(), iv.Generation, segmentIndex)
-	return filepath.Join(s.Dir, name)
+	return filepath.Join(iv.dir(s), name)
+}
+
+// dir returns the directory holding the files of iv: the schema's ColdDir if iv has been moved to cold
+// storage and Dir otherwise. A DB opened without a ColdDir reads every interval from Dir.
+func (iv *Interval) dir(s *Schema) string {
+	if iv.Cold && s.ColdDir != "" {
+		return s.ColdDir
+	}
+	return s.Dir
 }
 
 // WriteMemInterval writes out the data in memInterval to a fresh Interval with generation 0. Note that no
 // interval with this start time should exist.
 func (s *Schema) WriteMemInterval(memInterval *MemInterval) (*Interval, error) {
+	return s.writeMemInterval(memInterval, 0)
+}
+
+func (s *Schema) writeMemInterval(memInterval *MemInterval, generation int) (*Interval, error) {
 	cursor, err := memInterval.Tree.SeekFirst()
 	if err != nil {
 		return nil, err
 	}
-	interval := newWriteOnlyInterval(s.DiskBacked, 0, memInterval.Start, memInterval.End)
+	interval := newWriteOnlyInterval(s.DiskBacked, generation, memInterval.Start, memInterval.End)
+	interval.DimensionTables = memInterval.DimensionTables
 	for {
 		key, val, err := cursor.Next()
 		if err != nil {
@@ -210,6 +261,101 @@ func (s *Schema) WriteMemInterval(memInterval *MemInterval) (*Interval, error) {
 	return interval.freeze(s)
 }
 
+// writeTransformedInterval combines the rows of the given static and mem intervals into a fresh Interval
+// spanning [start, end) with the given generation. Rows for which keep (if it is not nil) returns false are
+// left out. Each remaining row's dimensions are passed through transform (which modifies them in place, and
+// may be nil) first; rows whose transformed dimensions are equal are collapsed together.
+//
+// With interval dimension tables, if dimTables is non-nil then the string values of all the rows are already
+// indexes into dimTables, which become the new interval's tables.
+func (s *Schema) writeTransformedInterval(staticIntervals []*Interval, memIntervals []*MemInterval,
+	start, end time.Time, generation int, keep func(DimensionBytes, MetricBytes) bool,
+	transform func(DimensionBytes), dimTables []*DimensionTable) (*Interval, error) {
+
+	// Because transforming the dimensions may change the key order, the rows are re-sorted by putting them all
+	// in a tree.
+	memInterval := &MemInterval{
+		Start: start,
+		End:   end,
+		Tree:  b.TreeNew(s.keyCompareFunc()),
+	}
+	// With interval dimension tables, the values of all the source intervals are translated into a new set of
+	// tables (after the transform, so any dropped values are not included).
+	var merger *dimensionTableMerger
+	if s.IntervalDimensionTables {
+		if dimTables != nil {
+			memInterval.DimensionTables = dimTables
+		} else {
+			merger = newDimensionTableMerger(s)
+			memInterval.DimensionTables = merger.Tables
+		}
+	}
+	addRow := func(key, val []byte, count int, dimTables []*DimensionTable) error {
+		if keep != nil && !keep(key, val) {
+			return nil
+		}
+		dimensions := make(DimensionBytes, len(key))
+		copy(dimensions, key)
+		if transform != nil {
+			transform(dimensions)
+		}
+		if merger != nil {
+			if err := merger.translate(dimensions, dimTables); err != nil {
+				return err
+			}
+		}
+		value, ok := memInterval.Tree.Get(dimensions)
+		if ok {
+			MetricBytes(value.Metric).add(s, val)
+			value.Count += count
+		} else {
+			metrics := make([]byte, len(val))
+			copy(metrics, val)
+			value = b.MetricWithCount{Count: count, Metric: metrics}
+		}
+		memInterval.Tree.Set(dimensions, value)
+		return nil
+	}
+
+	for _, interval := range staticIntervals {
+		cursor := interval.cursor(s)
+		for {
+			key, val, count, more := cursor.Next()
+			if !more {
+				break
+			}
+			if err := addRow(key, val, count, interval.DimensionTables); err != nil {
+				return nil, err
+			}
+		}
+		if err := cursor.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, interval := range memIntervals {
+		cursor, err := interval.Tree.SeekFirst()
+		if err != nil {
+			if err == io.EOF {
+				continue
+			}
+			return nil, err
+		}
+		for {
+			key, val, err := cursor.Next()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			if err := addRow(key, val.Metric, val.Count, interval.DimensionTables); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s.writeMemInterval(memInterval, generation)
+}
+
 // WriteCombinedInterval writes out the combined data from memInterval and staticInterval to a fresh Interval
 // with generation staticInterval.Generation+1.
 func (s *Schema) WriteCombinedInterval(memInterval *MemInterval,
@@ -228,6 +374,8 @@ func (s *Schema) WriteCombinedInterval(memInterval *MemInterval,
 	staticCursor := staticInterval.cursor(s)
 	interval := newWriteOnlyInterval(s.DiskBacked, staticInterval.Generation+1,
 		memInterval.Start, memInterval.End)
+	// The mem interval's dimension tables (if any) already include the static interval's values.
+	interval.DimensionTables = memInterval.DimensionTables
 
 	// Do an initial read from both mem and static, then loop and compare, advancing one or both (a classic
 	// merge).
@@ -247,8 +395,9 @@ func (s *Schema) WriteCombinedInterval(memInterval *MemInterval,
 
 	var numMemRows, numStaticRows, numCombinedRows int
 
+	compare := s.keyCompareFunc()
 	for moreMemKeys && moreStaticKeys {
-		cmp := bytes.Compare(memKey, staticKey)
+		cmp := compare(memKey, staticKey)
 		var advanceMem, advanceStatic bool
 		switch {
 		case cmp < 0:
@@ -322,6 +471,9 @@ func (s *Schema) WriteCombinedInterval(memInterval *MemInterval,
 			}
 		}
 	}
+	if err := staticCursor.Err(); err != nil {
+		return nil, err
+	}
 
 	totalSourceMemRows := numMemRows + numCombinedRows
 	totalSourceStaticRows := numStaticRows + numCombinedRows
@@ -0,0 +1,161 @@
+// Support for per-interval dimension tables (Schema.IntervalDimensionTables).
+//
+// With interval dimension tables, each interval carries its own dimension table for each string column, so
+// the strings of an interval are dropped along with it and an interval's files are self-contained. The
+// MemTable keeps the new values for each interval separately; as with the global tables, their indexes are
+// offset by the size of the corresponding static interval's tables so that the two can be combined by simple
+// concatenation when flushing. Queries compile their filters separately for each interval and translate
+// grouped string values before combining results across intervals.
+
+package gumshoe
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+	"unsafe"
+)
+
+// DimensionTableFilename returns the filename for the interval's dimension table for the column at index.
+func (iv *Interval) DimensionTableFilename(s *Schema, index int) string {
+	name := fmt.Sprintf("dimension.index%d.interval%d.generation%04d.gob.gz",
+		index, iv.Start.Unix(), iv.Generation)
+	return filepath.Join(iv.dir(s), name)
+}
+
+func (iv *Interval) loadDimensionTables(s *Schema) error {
+	for i, dimTable := range iv.DimensionTables {
+		if dimTable == nil {
+			continue
+		}
+		if err := dimTable.load(iv.DimensionTableFilename(s, i), s.DimensionColumns[i].Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (iv *writeOnlyInterval) storeDimensionTables(s *Schema) error {
+	for i, dimTable := range iv.DimensionTables {
+		if dimTable == nil {
+			continue
+		}
+		if err := dimTable.store(iv.DimensionTableFilename(s, i)); err != nil {
+			return fmt.Errorf("error storing interval dimension table: %s", err)
+		}
+	}
+	return nil
+}
+
+// DimensionTablesForInterval returns the dimension tables used by the rows of interval.
+func (s *StaticTable) DimensionTablesForInterval(interval *Interval) []*DimensionTable {
+	if s.IntervalDimensionTables {
+		return interval.latestDimensionTables()
+	}
+	return s.DimensionTables
+}
+
+// intervalView returns a StaticTable with no intervals which uses the dimension tables of interval. Queries
+// are compiled against it for each interval.
+func (s *StaticTable) intervalView(interval *Interval) *StaticTable {
+	return &StaticTable{
+		Schema:          s.Schema,
+		DimensionTables: interval.latestDimensionTables(),
+		scanRequests:    s.scanRequests,
+	}
+}
+
+// insertionDimensionTables returns the static and mem dimension tables to use for a row being inserted into
+// the interval starting at timestamp. This should only be called from the inserter goroutine.
+func (db *DB) insertionDimensionTables(timestamp time.Time) (static, mem []*DimensionTable) {
+	if !db.IntervalDimensionTables {
+		return db.StaticTable.DimensionTables, db.memTable.DimensionTables
+	}
+	mem, ok := db.memTable.IntervalDimensionTables[timestamp]
+	if !ok {
+		mem = NewDimensionTablesForSchema(db.Schema)
+		db.memTable.IntervalDimensionTables[timestamp] = mem
+	}
+	if interval, ok := db.StaticTable.Intervals[timestamp]; ok {
+		return interval.latestDimensionTables(), mem
+	}
+	return NewDimensionTablesForSchema(db.Schema), mem
+}
+
+// resolveMemIntervalDimensionTables fills in the dimension tables of the given mem intervals by appending the
+// MemTable's new values for each interval to the values of the corresponding static interval.
+func (db *DB) resolveMemIntervalDimensionTables(memKeys []time.Time) {
+	for _, key := range memKeys {
+		var staticTables []*DimensionTable
+		if interval, ok := db.StaticTable.Intervals[key]; ok {
+			staticTables = interval.latestDimensionTables()
+		}
+		memTables := db.memTable.IntervalDimensionTables[key]
+		tables := make([]*DimensionTable, len(db.DimensionColumns))
+		for i, col := range db.DimensionColumns {
+			if !col.String {
+				continue
+			}
+			var values []string
+			if staticTables != nil {
+				values = append(values, staticTables[i].Values...)
+			}
+			if memTables != nil {
+				values = append(values, memTables[i].Values...)
+			}
+			tables[i] = newDimensionTable(0, values)
+		}
+		db.memTable.Intervals[key].DimensionTables = tables
+	}
+}
+
+// A dimensionTableMerger builds a set of interval dimension tables from the values of other tables.
+type dimensionTableMerger struct {
+	*Schema
+	Tables []*DimensionTable
+}
+
+func newDimensionTableMerger(s *Schema) *dimensionTableMerger {
+	return &dimensionTableMerger{Schema: s, Tables: NewDimensionTablesForSchema(s)}
+}
+
+// translate rewrites the string values in dimensions, which are indexes into dimTables, to be indexes into
+// m.Tables (adding new values as necessary).
+func (m *dimensionTableMerger) translate(dimensions DimensionBytes, dimTables []*DimensionTable) error {
+	for i, col := range m.DimensionColumns {
+		if !col.String || dimensions.IsNil(i) {
+			continue
+		}
+		value := dimTables[i].Values[m.dimensionIndex(dimensions, i)]
+		index, _ := m.Tables[i].GetAndMaybeSet(value)
+		if float64(index) > typeMaxes[col.Type] {
+			return fmt.Errorf("combining values for dimension %s overflows the dimension table", col.Name)
+		}
+		setRowValue(unsafe.Pointer(&dimensions[m.DimensionOffsets[i]]), col.Type, float64(index))
+	}
+	return nil
+}
+
+// allDimensionTableValues returns, for each string column, the distinct values in all the intervals'
+// dimension tables.
+func (s *StaticTable) allDimensionTableValues() [][]string {
+	values := make([][]string, len(s.DimensionColumns))
+	seen := make([]map[string]bool, len(s.DimensionColumns))
+	for i := range seen {
+		seen[i] = make(map[string]bool)
+	}
+	for _, interval := range s.Intervals.sorted() {
+		for i, dimTable := range interval.latestDimensionTables() {
+			if dimTable == nil {
+				continue
+			}
+			for _, value := range dimTable.Values {
+				if !seen[i][value] {
+					seen[i][value] = true
+					values[i] = append(values[i], value)
+				}
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,156 @@
+package gumshoe
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func makeIntervalDimensionTablesTestDB() *DB {
+	return makeTestDB(func(schema *Schema) { schema.IntervalDimensionTables = true })
+}
+
+func intervalDimensionValues(db *DB) map[time.Time][]string {
+	resp := db.MakeRequest()
+	defer resp.Done()
+	values := make(map[time.Time][]string)
+	for t, interval := range resp.StaticTable.Intervals {
+		values[t] = interval.DimensionTables[0].Values
+	}
+	return values
+}
+
+func TestIntervalsHaveTheirOwnDimensionTables(t *testing.T) {
+	db := makeIntervalDimensionTablesTestDB()
+	defer closeTestDB(db)
+
+	insertRows(db, []RowMap{
+		{"at": hour(0), "dim1": "a", "metric1": 1.0},
+		{"at": hour(0), "dim1": "b", "metric1": 2.0},
+		{"at": hour(1), "dim1": "c", "metric1": 4.0},
+	})
+	// New and existing values are combined with the existing interval tables.
+	insertRows(db, []RowMap{
+		{"at": hour(1), "dim1": "b", "metric1": 8.0},
+		{"at": hour(1), "dim1": "c", "metric1": 16.0},
+		{"at": hour(1), "dim1": nil, "metric1": 32.0},
+	})
+
+	Assert(t, intervalDimensionValues(db), DeepEquals, map[time.Time][]string{
+		time.Unix(0, 0):              {"a", "b"},
+		time.Unix(int64(hour(1)), 0): {"c", "b"},
+	})
+	Assert(t, db.GetDimensionTables()["dim1"], DeepEquals, []string{"a", "b", "c"})
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": hour(0), "dim1": "a", "metric1": 1}, Count: 1},
+		{RowMap: RowMap{"at": hour(0), "dim1": "b", "metric1": 2}, Count: 1},
+		{RowMap: RowMap{"at": hour(1), "dim1": "c", "metric1": 20}, Count: 2},
+		{RowMap: RowMap{"at": hour(1), "dim1": "b", "metric1": 8}, Count: 1},
+		{RowMap: RowMap{"at": hour(1), "dim1": nil, "metric1": 32}, Count: 1},
+	})
+
+	// Filters are translated for each interval.
+	for _, testCase := range []struct {
+		filter  QueryFilter
+		metric1 int
+	}{
+		{QueryFilter{FilterEqual, "dim1", "b"}, 10},
+		{QueryFilter{FilterEqual, "dim1", "c"}, 20},
+		{QueryFilter{FilterNotEqual, "dim1", "a"}, 62},
+		{QueryFilter{FilterIn, "dim1", []interface{}{"a", "c", nil}}, 53},
+		{QueryFilter{FilterEqual, "dim1", "z"}, 0},
+	} {
+		query := createQuery()
+		query.Filters = []QueryFilter{testCase.filter}
+		Assert(t, runQuery(db, query)[0]["metric1"], util.DeepConvertibleEquals, testCase.metric1)
+	}
+
+	// Grouped values are combined by string value across intervals.
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	Assert(t, runQuery(db, query), util.DeepEqualsUnordered, []RowMap{
+		{"dim1": "a", "metric1": 1, "rowCount": 1},
+		{"dim1": "b", "metric1": 10, "rowCount": 2},
+		{"dim1": "c", "metric1": 20, "rowCount": 2},
+		{"dim1": nil, "metric1": 32, "rowCount": 1},
+	})
+}
+
+func TestIntervalDimensionTablesHoldManyValues(t *testing.T) {
+	db := makeTestDB(func(schema *Schema) {
+		schema.DimensionColumns = []DimensionColumn{makeDimensionColumn("dim1", "uint8", true)}
+		schema.IntervalDimensionTables = true
+	})
+	defer closeTestDB(db)
+
+	// Together, these would overflow a single uint8 dimension table.
+	var rows []RowMap
+	for i := 0; i < 400; i++ {
+		rows = append(rows, RowMap{"at": hour(i / 200), "dim1": strconv.Itoa(i), "metric1": 1.0})
+	}
+	insertRows(db, rows)
+	Assert(t, len(db.GetDimensionTables()["dim1"]), Equals, 400)
+
+	query := createQuery()
+	query.Filters = []QueryFilter{{FilterIn, "dim1", []interface{}{"5", "399"}}}
+	Assert(t, runQuery(db, query)[0]["metric1"], util.DeepConvertibleEquals, 2)
+}
+
+func TestIntervalDimensionTablesArePersisted(t *testing.T) {
+	db := makeTestPersistentDB(func(schema *Schema) {
+		schema.IntervalDimensionTables = true
+		schema.Retention = 24 * time.Hour
+	})
+	defer os.RemoveAll(db.Dir)
+	start := Time(time.Now())
+
+	insertRows(db, []RowMap{
+		{"at": start.hoursBack(36), "dim1": "old", "metric1": 1.0},
+		{"at": start.hoursBack(1), "dim1": "new", "metric1": 1.0},
+	})
+	db = reopenTestDB(db)
+	Assert(t, db.GetDimensionTables()["dim1"], DeepEquals, []string{"old", "new"})
+
+	// The old interval's values disappear along with it.
+	db.FixedRetention = true
+	insertRow(db, RowMap{"at": start.hoursBack(1), "dim1": "newer", "metric1": 1.0})
+	Assert(t, db.GetDimensionTables()["dim1"], DeepEquals, []string{"new", "newer"})
+	files, err := filepath.Glob(filepath.Join(db.Dir, "dimension.*.gob.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, len(files), Equals, 1)
+
+	db = reopenTestDB(db)
+	defer closeTestDB(db)
+	query := createQuery()
+	query.Filters = []QueryFilter{{FilterEqual, "dim1", "newer"}}
+	Assert(t, runQuery(db, query)[0]["metric1"], util.DeepConvertibleEquals, 1)
+}
+
+func TestRollupsMergeIntervalDimensionTables(t *testing.T) {
+	db := makeTestDB(func(schema *Schema) {
+		schema.IntervalDimensionTables = true
+		schema.Rollups = []RollupPolicy{{After: 48 * time.Hour, IntervalDuration: 24 * time.Hour}}
+	})
+	defer closeTestDB(db)
+
+	day := time.Now().Add(-5 * 24 * time.Hour).Truncate(24 * time.Hour)
+	at := func(hours int) float64 { return float64(day.Add(time.Duration(hours) * time.Hour).Unix()) }
+	insertRows(db, []RowMap{
+		{"at": at(1), "dim1": "a", "metric1": 1.0},
+		{"at": at(2), "dim1": "b", "metric1": 2.0},
+		{"at": at(3), "dim1": "a", "metric1": 4.0},
+	})
+	Assert(t, intervalDimensionValues(db)[day], util.DeepEqualsUnordered, []string{"a", "b"})
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": float64(day.Unix()), "dim1": "a", "metric1": 5}, Count: 2},
+		{RowMap: RowMap{"at": float64(day.Unix()), "dim1": "b", "metric1": 2}, Count: 1},
+	})
+}
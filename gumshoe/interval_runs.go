@@ -0,0 +1,131 @@
+// Support for incremental flushes (RunConfig.IncrementalFlush).
+//
+// Normally, a flush merges the new rows for an interval with all of the interval's existing rows and rewrites
+// the whole interval. With incremental flushes, the new rows are instead written out as a separate sorted
+// *run* which is appended to the interval (Interval.Runs); the existing segments are left untouched. Rows
+// with the same dimensions may appear in several runs, which is fine for queries because they aggregate over
+// all the runs of each interval anyway. Periodically, intervals with too many runs are merged back into a
+// single run by the inserter goroutine (see compactRuns).
+//
+// Each run is itself an Interval with its own generation, segments, zone maps, and checksums. With interval
+// dimension tables, each run also stores its own tables, which extend those of the previous runs; the tables
+// of the latest run are therefore valid for all the rows of the interval.
+
+package gumshoe
+
+import (
+	"fmt"
+	"time"
+)
+
+// AllRuns returns iv (the first run) followed by the runs appended to it.
+func (iv *Interval) AllRuns() []*Interval {
+	return append([]*Interval{iv}, iv.Runs...)
+}
+
+// latestRun returns the most recently written run of iv.
+func (iv *Interval) latestRun() *Interval {
+	if len(iv.Runs) == 0 {
+		return iv
+	}
+	return iv.Runs[len(iv.Runs)-1]
+}
+
+// latestDimensionTables returns the interval dimension tables which apply to all the runs of iv.
+func (iv *Interval) latestDimensionTables() []*DimensionTable {
+	return iv.latestRun().DimensionTables
+}
+
+// nextGeneration returns a generation for a run or a rewrite of iv that doesn't collide with any of its runs.
+func (iv *Interval) nextGeneration() int {
+	return iv.latestRun().Generation + 1
+}
+
+// withRun returns a new Interval which has the runs of iv followed by run.
+func (iv *Interval) withRun(run *Interval) *Interval {
+	runs := make([]*Interval, len(iv.Runs), len(iv.Runs)+1)
+	copy(runs, iv.Runs)
+	result := iv.shallowCopy()
+	result.Runs = append(runs, run)
+	return result
+}
+
+// shallowCopy returns a new Interval with the same fields as iv (sharing its segments and runs).
+func (iv *Interval) shallowCopy() *Interval {
+	return &Interval{
+		Generation:      iv.Generation,
+		Start:           iv.Start,
+		End:             iv.End,
+		Segments:        iv.Segments,
+		NumSegments:     iv.NumSegments,
+		NumRows:         iv.NumRows,
+		LogicalRows:     iv.LogicalRows,
+		ZoneMaps:        iv.ZoneMaps,
+		DimensionTables: iv.DimensionTables,
+		Checksums:       iv.Checksums,
+		Schema:          iv.Schema,
+		Runs:            iv.Runs,
+		Cold:            iv.Cold,
+	}
+}
+
+// writeMergedInterval writes out the rows of all the runs of interval, together with the rows of memInterval
+// (if it is not nil), as a single new run with the given generation.
+func (db *DB) writeMergedInterval(interval *Interval, memInterval *MemInterval,
+	generation int) (*Interval, error) {
+
+	// The rows of all the runs (and the mem interval) index into the latest dimension tables (or the mem
+	// interval's, which extend them).
+	dimTables := interval.latestDimensionTables()
+	var memIntervals []*MemInterval
+	if memInterval != nil {
+		memIntervals = append(memIntervals, memInterval)
+		dimTables = memInterval.DimensionTables
+	}
+	return db.writeTransformedInterval(interval.AllRuns(), memIntervals, interval.Start, interval.End,
+		generation, nil, nil, dimTables)
+}
+
+// CompactRuns merges the runs of every interval which has more than one run.
+func (db *DB) CompactRuns() error {
+	errCh := make(chan error)
+	db.runCompactionSignals <- errCh
+	return <-errCh
+}
+
+// compactRuns merges the runs of each interval with at least minRuns runs (counting the interval itself) and
+// installs a new StaticTable with the merged intervals. This should only be called by the inserter goroutine.
+func (db *DB) compactRuns(minRuns int) error {
+	start := time.Now()
+	intervals := make(map[time.Time]*Interval)
+	var intervalsForCleanup []*Interval
+	for t, interval := range db.StaticTable.Intervals {
+		if len(interval.Runs)+1 < minRuns || interval.Verify(db.Schema) != nil {
+			intervals[t] = interval
+			continue
+		}
+		merged, err := db.writeMergedInterval(interval, nil, db.nextGeneration(t, interval))
+		if err != nil {
+			return fmt.Errorf("cannot merge interval runs: %s", err)
+		}
+		intervals[t] = merged
+		intervalsForCleanup = append(intervalsForCleanup, interval)
+	}
+	if len(intervalsForCleanup) == 0 {
+		return nil
+	}
+
+	staticTable := NewStaticTable(db.Schema)
+	staticTable.Intervals = intervals
+	staticTable.DimensionTables = db.StaticTable.DimensionTables
+	staticTable.InsertLogSeq = db.StaticTable.InsertLogSeq
+	db.installStaticTable(staticTable)
+	if db.DiskBacked {
+		if err := db.writeMetadataFile(); err != nil {
+			return fmt.Errorf("error writing metadata: %s", err)
+		}
+		db.cleanUpOldIntervals(intervalsForCleanup)
+	}
+	Log.Printf("Merged the runs of %d intervals in %s", len(intervalsForCleanup), time.Since(start))
+	return nil
+}
@@ -0,0 +1,123 @@
+package gumshoe
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func intervalRunCounts(db *DB) map[time.Time]int {
+	resp := db.MakeRequest()
+	defer resp.Done()
+	counts := make(map[time.Time]int)
+	for t, interval := range resp.StaticTable.Intervals {
+		counts[t] = len(interval.AllRuns())
+	}
+	return counts
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "interval.*.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestIncrementalFlushesAppendRuns(t *testing.T) {
+	for _, intervalDimensionTables := range []bool{false, true} {
+		db := makeTestPersistentDB(func(schema *Schema) {
+			schema.IntervalDimensionTables = intervalDimensionTables
+			schema.IncrementalFlush = true
+		})
+		dir := db.Dir
+		defer os.RemoveAll(dir)
+
+		insertRows(db, []RowMap{
+			{"at": hour(0), "dim1": "a", "metric1": 1.0},
+			{"at": hour(1), "dim1": "b", "metric1": 2.0},
+		})
+		firstFiles := segmentFiles(t, dir)
+		insertRows(db, []RowMap{
+			{"at": hour(0), "dim1": "b", "metric1": 4.0},
+			{"at": hour(0), "dim1": "a", "metric1": 8.0},
+		})
+
+		// The existing segments are left alone and the new rows are in a second run.
+		hour0 := time.Unix(0, 0)
+		hour1 := time.Unix(int64(hour(1)), 0)
+		Assert(t, intervalRunCounts(db), DeepEquals, map[time.Time]int{hour0: 2, hour1: 1})
+		files := segmentFiles(t, dir)
+		Assert(t, len(files), Equals, 3)
+		for _, filename := range firstFiles {
+			_, err := os.Stat(filename)
+			Assert(t, err, IsNil)
+		}
+
+		expectedRows := []UnpackedRow{
+			{RowMap: RowMap{"at": hour(0), "dim1": "a", "metric1": 1}, Count: 1},
+			{RowMap: RowMap{"at": hour(0), "dim1": "a", "metric1": 8}, Count: 1},
+			{RowMap: RowMap{"at": hour(0), "dim1": "b", "metric1": 4}, Count: 1},
+			{RowMap: RowMap{"at": hour(1), "dim1": "b", "metric1": 2}, Count: 1},
+		}
+		expectedGroups := []RowMap{
+			{"dim1": "a", "metric1": 9, "rowCount": 2},
+			{"dim1": "b", "metric1": 6, "rowCount": 2},
+		}
+		grouping := QueryGrouping{TimeTruncationNone, "dim1", "dim1"}
+		Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, expectedRows)
+		Assert(t, runWithGroupBy(db, grouping), util.DeepEqualsUnordered, expectedGroups)
+		Assert(t, runWithFilter(db, QueryFilter{FilterEqual, "dim1", "a"})[0]["metric1"],
+			util.DeepConvertibleEquals, 9)
+
+		// The runs are persisted.
+		db = reopenTestDB(db)
+		Assert(t, intervalRunCounts(db), DeepEquals, map[time.Time]int{hour0: 2, hour1: 1})
+		Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, expectedRows)
+
+		// Pending rows must still be valid after the runs are merged.
+		if err := db.Insert([]RowMap{{"at": hour(0), "dim1": "c", "metric1": 16.0}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CompactRuns(); err != nil {
+			t.Fatal(err)
+		}
+		Assert(t, intervalRunCounts(db), DeepEquals, map[time.Time]int{hour0: 1, hour1: 1})
+		Assert(t, len(segmentFiles(t, dir)), Equals, 2)
+		Assert(t, runWithGroupBy(db, grouping), util.DeepEqualsUnordered, expectedGroups)
+
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		Assert(t, intervalRunCounts(db), DeepEquals, map[time.Time]int{hour0: 2, hour1: 1})
+		Assert(t, runWithGroupBy(db, grouping), util.DeepEqualsUnordered, []RowMap{
+			{"dim1": "a", "metric1": 9, "rowCount": 2},
+			{"dim1": "b", "metric1": 6, "rowCount": 2},
+			{"dim1": "c", "metric1": 16, "rowCount": 1},
+		})
+		closeTestDB(db)
+	}
+}
+
+func TestIntervalsWithRunsAreMergedWhenFlushingNormally(t *testing.T) {
+	db := makeTestDB(func(schema *Schema) {
+		schema.IncrementalFlush = true
+	})
+	defer closeTestDB(db)
+
+	insertRow(db, RowMap{"at": hour(0), "dim1": "a", "metric1": 1.0})
+	insertRow(db, RowMap{"at": hour(0), "dim1": "a", "metric1": 2.0})
+	Assert(t, intervalRunCounts(db), DeepEquals, map[time.Time]int{time.Unix(0, 0): 2})
+
+	db.IncrementalFlush = false
+	insertRow(db, RowMap{"at": hour(0), "dim1": "a", "metric1": 4.0})
+	Assert(t, intervalRunCounts(db), DeepEquals, map[time.Time]int{time.Unix(0, 0): 1})
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": hour(0), "dim1": "a", "metric1": 7}, Count: 3},
+	})
+}
@@ -10,18 +10,29 @@ type MemInterval struct {
 	Start time.Time // Inclusive
 	End   time.Time // Exclusive
 	*b.Tree
+	// DimensionTables is only used with interval dimension tables. It is filled in at flush time with the
+	// combined values of the static interval's and the MemTable's tables for this interval.
+	DimensionTables []*DimensionTable
 }
 
 type MemTable struct {
 	*Schema
 	Intervals       map[time.Time]*MemInterval
 	DimensionTables []*DimensionTable
+	// IntervalDimensionTables holds the new dimension values for each interval if the schema has
+	// IntervalDimensionTables set (in which case DimensionTables is unused).
+	IntervalDimensionTables map[time.Time][]*DimensionTable
+	// Replaced holds the start times of the intervals whose static data is to be replaced, rather than added
+	// to, by the MemTable's rows at the next flush (see replace.go).
+	Replaced map[time.Time]bool
 }
 
 func NewMemTable(schema *Schema) *MemTable {
 	return &MemTable{
-		Schema:          schema,
-		Intervals:       make(map[time.Time]*MemInterval),
-		DimensionTables: NewDimensionTablesForSchema(schema),
+		Schema:                  schema,
+		Intervals:               make(map[time.Time]*MemInterval),
+		DimensionTables:         NewDimensionTablesForSchema(schema),
+		IntervalDimensionTables: make(map[time.Time][]*DimensionTable),
+		Replaced:                make(map[time.Time]bool),
 	}
 }
@@ -22,6 +22,13 @@ type Query struct {
 	Aggregates []QueryAggregate
 	Groupings  []QueryGrouping
 	Filters    []QueryFilter
+	// Having filters the results by the values of aggregates (or groupings, or rowCount), named by the
+	// Column of each filter.
+	Having []QueryFilter `json:",omitempty"`
+	// OrderBy sorts the results by the values of aggregates or groupings (or rowCount), and Limit (if
+	// positive) gives the maximum number of results.
+	OrderBy []QueryOrdering `json:",omitempty"`
+	Limit   int             `json:",omitempty"`
 }
 
 func (q *Query) String() string {
@@ -49,12 +56,100 @@ type QueryGrouping struct {
 	Name          string
 }
 
+type QueryOrdering struct {
+	Name       string // The name of an aggregate or grouping, or "rowCount"
+	Descending bool   `json:",omitempty"`
+}
+
+// A QueryFilter is either a comparison of a column with a value or a compound filter: the and or the or of
+// a list of filters (Value is a []QueryFilter), or the negation of a filter (Value is a QueryFilter). In
+// JSON, compound filters are written as {"and": [...]}, {"or": [...]}, and {"not": {...}}.
 type QueryFilter struct {
 	Type   FilterType
 	Column string
 	Value  Untyped
 }
 
+// IsCompound reports whether f combines other filters.
+func (f QueryFilter) IsCompound() bool {
+	return f.Type == FilterAnd || f.Type == FilterOr || f.Type == FilterNot
+}
+
+// children returns the filters combined by f, a compound filter.
+func (f QueryFilter) children() ([]QueryFilter, error) {
+	switch f.Type {
+	case FilterAnd, FilterOr:
+		if filters, ok := f.Value.([]QueryFilter); ok {
+			return filters, nil
+		}
+	case FilterNot:
+		if filter, ok := f.Value.(QueryFilter); ok {
+			return []QueryFilter{filter}, nil
+		}
+	}
+	return nil, fmt.Errorf("bad value for a compound (%s) filter: %v", filterTypeToName[f.Type], f.Value)
+}
+
+// Leaves returns the filters on columns within f (just f itself, if it isn't compound).
+func (f QueryFilter) Leaves() []QueryFilter {
+	if !f.IsCompound() {
+		return []QueryFilter{f}
+	}
+	// An invalid compound filter has no leaves (it's rejected when the query is run).
+	children, _ := f.children()
+	var leaves []QueryFilter
+	for _, child := range children {
+		leaves = append(leaves, child.Leaves()...)
+	}
+	return leaves
+}
+
+func (f QueryFilter) MarshalJSON() ([]byte, error) {
+	if f.IsCompound() {
+		return json.Marshal(map[string]interface{}{filterTypeToName[f.Type]: f.Value})
+	}
+	return json.Marshal(struct {
+		Type   FilterType
+		Column string
+		Value  Untyped
+	}{f.Type, f.Column, f.Value})
+}
+
+func (f *QueryFilter) UnmarshalJSON(b []byte) error {
+	var filter struct {
+		Type   FilterType
+		Column string
+		Value  Untyped
+		And    []QueryFilter
+		Or     []QueryFilter
+		Not    *QueryFilter
+	}
+	if err := json.Unmarshal(b, &filter); err != nil {
+		return err
+	}
+	if filter.Type == FilterAnd || filter.Type == FilterOr || filter.Type == FilterNot {
+		return fmt.Errorf("invalid filter: %q (write compound filters as {\"and\": [...]} and so on)", b)
+	}
+	*f = QueryFilter{Type: filter.Type, Column: filter.Column, Value: filter.Value}
+	compound := 0
+	if filter.And != nil {
+		*f = QueryFilter{Type: FilterAnd, Value: filter.And}
+		compound++
+	}
+	if filter.Or != nil {
+		*f = QueryFilter{Type: FilterOr, Value: filter.Or}
+		compound++
+	}
+	if filter.Not != nil {
+		*f = QueryFilter{Type: FilterNot, Value: *filter.Not}
+		compound++
+	}
+	if compound > 1 || (compound == 1 && filter.Column != "") {
+		return fmt.Errorf("invalid filter: %q (a compound filter has just one of and, or, and not)", b)
+	}
+	return nil
+}
+
 func (a *QueryAggregate) UnmarshalJSON(b []byte) error {
 	var agg struct {
 		Type   AggregateType
@@ -99,11 +194,33 @@ func (g *QueryGrouping) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+func (o *QueryOrdering) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*o = QueryOrdering{}
+		return json.Unmarshal(b, &o.Name)
+	}
+	var ordering struct {
+		Name       string
+		Descending bool
+	}
+	if err := json.Unmarshal(b, &ordering); err != nil {
+		return fmt.Errorf("invalid ordering: %q (%s)", b, err)
+	}
+	*o = QueryOrdering(ordering)
+	return nil
+}
+
 type AggregateType int
 
 const (
 	AggregateSum AggregateType = iota
 	AggregateAvg
+	AggregateMin
+	AggregateMax
+	AggregateCardinality // The estimated number of distinct values of a HyperLogLog column
+	// AggregateSketch gives the merged HyperLogLog sketch itself, so that the router can merge the results
+	// of a cardinality aggregate from many shards.
+	AggregateSketch
 )
 
 func (t AggregateType) MarshalJSON() ([]byte, error) {
@@ -112,6 +229,14 @@ func (t AggregateType) MarshalJSON() ([]byte, error) {
 		return []byte(`"sum"`), nil
 	case AggregateAvg:
 		return []byte(`"average"`), nil
+	case AggregateMin:
+		return []byte(`"min"`), nil
+	case AggregateMax:
+		return []byte(`"max"`), nil
+	case AggregateCardinality:
+		return []byte(`"cardinality"`), nil
+	case AggregateSketch:
+		return []byte(`"sketch"`), nil
 	default:
 		panic("bad type")
 	}
@@ -127,6 +252,14 @@ func (t *AggregateType) UnmarshalJSON(b []byte) error {
 		*t = AggregateSum
 	case "average":
 		*t = AggregateAvg
+	case "min":
+		*t = AggregateMin
+	case "max":
+		*t = AggregateMax
+	case "cardinality":
+		*t = AggregateCardinality
+	case "sketch":
+		*t = AggregateSketch
 	default:
 		return fmt.Errorf("bad aggregate type: %q", name)
 	}
@@ -37,3 +37,43 @@ func TestParseQueryDefaultNames(t *testing.T) {
 	Assert(t, query.Groupings[1].Column, Equals, "dim2")
 	Assert(t, query.Groupings[1].Name, Equals, "dim2")
 }
+
+func TestParseQueryOrdering(t *testing.T) {
+	const queryString = `
+		{
+	   "aggregates": [{"type": "sum", "column": "metric1"}],
+	   "groupings": ["dim1"],
+	   "orderBy": [{"name": "metric1", "descending": true}, "dim1"],
+	   "limit": 10
+		}`
+	query, err := ParseJSONQuery(strings.NewReader(queryString))
+	Assert(t, err, IsNil)
+
+	Assert(t, query.OrderBy, DeepEquals, []QueryOrdering{{"metric1", true}, {"dim1", false}})
+	Assert(t, query.Limit, Equals, 10)
+}
+
+func TestParseQueryCompoundFilters(t *testing.T) {
+	const queryString = `
+		{
+	   "aggregates": [{"type": "sum", "column": "metric1"}],
+	   "filters": [{"or": [{"type": "=", "column": "dim1", "value": "a"},
+	                       {"not": {"type": "<", "column": "metric1", "value": 2}}]}]
+		}`
+	query, err := ParseJSONQuery(strings.NewReader(queryString))
+	Assert(t, err, IsNil)
+
+	expected := QueryFilter{FilterOr, "", []QueryFilter{
+		{FilterEqual, "dim1", "a"},
+		{FilterNot, "", QueryFilter{FilterLessThan, "metric1", 2.0}},
+	}}
+	Assert(t, query.Filters[0], DeepEquals, expected)
+
+	// Compound filters survive a round trip through JSON (as when the router sends queries to the shards).
+	query, err = ParseJSONQuery(strings.NewReader(query.String()))
+	Assert(t, err, IsNil)
+	Assert(t, query.Filters[0], DeepEquals, expected)
+
+	_, err = ParseJSONQuery(strings.NewReader(`{"filters": [{"or": [], "not": {}}]}`))
+	Assert(t, err, NotNil)
+}
@@ -3,8 +3,12 @@
 package gumshoe
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 	"unsafe"
@@ -17,24 +21,37 @@ type UntypedBytes []byte
 func (u UntypedBytes) Pointer() unsafe.Pointer { return unsafe.Pointer(&u[0]) }
 
 type rowAggregate struct {
-	GroupByValue Untyped
-	Sums         []Untyped // Corresponds to query.Aggregates
-	Count        uint32
+	GroupByValues []Untyped // Corresponds to query.Groupings
+	Sums          []Untyped // Corresponds to query.Aggregates
+	Count         uint32
 }
 
 type scanParams struct {
 	TimestampFilterFuncs []timestampFilterFunc
 	FilterFuncs          []filterFunc
+	FilterTrees          []filterTree // The compound filters (see filter_tree.go)
+	ZoneFilterFuncs      []zoneFilterFunc
+	SortKeyBounds        []*sortKeyBound
 	SumColumns           []MetricColumn
 	SumFuncs             []sumFunc
-	Grouping             *groupingParams
+	AggregateTypes       []AggregateType   // Corresponds to SumColumns
+	Groupings            []*groupingParams // Corresponds to query.Groupings
+	Ordering             *rowOrdering      // nil if the results are neither ordered nor limited
+	Fields               []rowField        // The parts of each row read by the scan
+	// Layout is the schema the scanned interval was written with, if it is older than the current one.
+	Layout *Schema
+	// With interval dimension tables, the filters are compiled separately for each interval.
+	IntervalParams map[*Interval]*scanParams
 }
 
-// groupingParams contains all configuration needed to perform the user's group by query.
+// groupingParams contains all configuration needed to group by one of the columns of the user's query.
 type groupingParams struct {
 	OnTimestampColumn bool
 	ColumnIndex       int
 	TransformFunc     transformFunc
+	// DimensionValues is set when grouping on a string column using interval dimension tables. The group keys
+	// are then the string values themselves rather than dimension table indexes.
+	DimensionValues []string
 }
 
 type (
@@ -47,6 +64,8 @@ type (
 // TODO(caleb): Wherever we use falseFilterFunc, we can optimize by immediately returning an empty result.
 var falseFilterFunc = func(RowBytes) bool { return false }
 
+var trueFilterFunc = func(RowBytes) bool { return true }
+
 func (p *scanParams) AllTimestampFilterFuncsMatch(intervalTimestamp time.Time) bool {
 	timestamp := uint32(intervalTimestamp.Unix())
 	for _, f := range p.TimestampFilterFuncs {
@@ -54,33 +73,137 @@ func (p *scanParams) AllTimestampFilterFuncsMatch(intervalTimestamp time.Time) b
 			return false
 		}
 	}
+	for _, tree := range p.FilterTrees {
+		if f, result := tree(timestamp); f == nil && !result {
+			return false
+		}
+	}
 	return true
 }
 
+// forInterval returns the scanParams to use for scanning run (one of the runs of interval).
+func (p *scanParams) forInterval(interval, run *Interval) *scanParams {
+	params := p
+	if intervalParams, ok := p.IntervalParams[interval]; ok {
+		params = intervalParams
+	}
+	if run.Schema != nil || len(params.FilterTrees) > 0 {
+		specialized := *params
+		specialized.Layout = run.Schema
+		specialized.FilterFuncs = params.filterFuncsForInterval(interval)
+		params = &specialized
+	}
+	return params
+}
+
+// filterFuncsForInterval returns the filterFuncs for the rows of interval, including those of the filter
+// trees.
+func (p *scanParams) filterFuncsForInterval(interval *Interval) []filterFunc {
+	params := p
+	if intervalParams, ok := p.IntervalParams[interval]; ok {
+		params = intervalParams
+	}
+	filterFuncs := params.FilterFuncs
+	if len(params.FilterTrees) > 0 {
+		filterFuncs = append([]filterFunc(nil), filterFuncs...)
+		timestamp := uint32(interval.Start.Unix())
+		for _, tree := range params.FilterTrees {
+			switch f, result := tree(timestamp); {
+			case f != nil:
+				filterFuncs = append(filterFuncs, f)
+			case !result:
+				filterFuncs = append(filterFuncs, falseFilterFunc)
+			}
+		}
+	}
+	return filterFuncs
+}
+
+// segmentsToScan returns the segments of interval which may contain rows matching the filters, according to
+// their zone maps.
+func (p *scanParams) segmentsToScan(interval *Interval) []*Segment {
+	if len(p.ZoneFilterFuncs) == 0 || len(interval.ZoneMaps) != len(interval.Segments) {
+		return interval.Segments
+	}
+	var segments []*Segment
+segmentLoop:
+	for i, segment := range interval.Segments {
+		for _, f := range p.ZoneFilterFuncs {
+			if !f(interval.ZoneMaps[i]) {
+				continue segmentLoop
+			}
+		}
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
 // InvokeQuery runs query on a StaticTable. It returns a slice of aggregated row results.
 func (s *StaticTable) InvokeQuery(query *Query) ([]RowMap, error) {
 	Log.Println("Running query:", query)
+	params, err := s.makeScanParams(query)
+	if err != nil {
+		return nil, err
+	}
+
+	Log.Printf("Query: %d groupings, %d timestamp filter funcs, %d sum columns, %d filter funcs",
+		len(params.Groupings), len(params.TimestampFilterFuncs), len(params.SumColumns), len(params.FilterFuncs))
+
+	start := time.Now()
+	rows, stats, err := s.scan(params)
+	if err != nil {
+		return nil, err
+	}
+	Log.Printf("Query: scan completed in %s; %d intervals skipped; %d intervals scanned; "+
+		"%d corrupted intervals skipped; %d segments skipped; %d rows scanned",
+		time.Since(start), stats.Get(statIntervalsSkipped), stats.Get(statIntervalsScanned),
+		stats.Get(statIntervalsCorrupted), stats.Get(statSegmentsSkipped), stats.Get(statRowsScanned))
+
+	return s.postProcessScanRows(rows, query, params.Groupings), nil
+}
+
+// makeScanParams validates query and compiles it into the scanParams used to run it.
+func (s *StaticTable) makeScanParams(query *Query) (*scanParams, error) {
+	// Keep track of the columns the query touches; with columnar segments, only these are read.
+	var dimensionIndexes, metricIndexes []int
+
 	sumColumns := make([]MetricColumn, len(query.Aggregates))
 	sumFuncs := make([]sumFunc, len(query.Aggregates))
+	aggregateTypes := make([]AggregateType, len(query.Aggregates))
 	for i, aggregate := range query.Aggregates {
 		index, ok := s.MetricNameToIndex[aggregate.Column]
 		if !ok {
 			return nil, fmt.Errorf("%s (selected for aggregation) is not a valid metric column name",
 				aggregate.Column)
 		}
+		isSketch := s.MetricColumns[index].Type == TypeHyperLogLog
+		switch aggregate.Type {
+		case AggregateCardinality, AggregateSketch:
+			if !isSketch {
+				return nil, fmt.Errorf("%s is not a hyperloglog column, so it has no cardinality",
+					aggregate.Column)
+			}
+		default:
+			if isSketch {
+				return nil, fmt.Errorf("%s is a hyperloglog column; it only supports cardinality aggregates",
+					aggregate.Column)
+			}
+		}
 		sumFuncs[i] = s.makeSumFunc(aggregate, index)
 		sumColumns[i] = s.MetricColumns[index]
+		aggregateTypes[i] = aggregate.Type
+		metricIndexes = append(metricIndexes, index)
 	}
 
-	// NOTE(philc): For now, only support one level of grouping. We intend to support multiple levels.
-	// TODO(caleb): Remove this check once we actually support > 1 grouping.
-	if len(query.Groupings) > 1 {
-		return nil, fmt.Errorf("more than 1 grouping is not supported at the moment")
-	}
-	var grouping *groupingParams
-	if len(query.Groupings) > 0 {
-		grouping = new(groupingParams)
-		groupingOptions := query.Groupings[0]
+	var groupings []*groupingParams
+	groupingNames := make(map[string]bool)
+	for _, groupingOptions := range query.Groupings {
+		if groupingNames[groupingOptions.Name] {
+			return nil, fmt.Errorf("more than one grouping is named %q", groupingOptions.Name)
+		}
+		groupingNames[groupingOptions.Name] = true
+		grouping := new(groupingParams)
+		groupings = append(groupings, grouping)
 
 		var groupingColumn Column
 		if groupingOptions.Column == s.TimestampColumn.Name {
@@ -94,6 +217,10 @@ func (s *StaticTable) InvokeQuery(query *Query) ([]RowMap, error) {
 			}
 			grouping.ColumnIndex = index
 			groupingColumn = s.DimensionColumns[index].Column
+			dimensionIndexes = append(dimensionIndexes, index)
+			if s.IntervalDimensionTables && s.DimensionColumns[index].String {
+				grouping.DimensionValues = s.DimensionTables[index].Values
+			}
 		}
 
 		if groupingOptions.TimeTransform != TimeTruncationNone {
@@ -105,9 +232,33 @@ func (s *StaticTable) InvokeQuery(query *Query) ([]RowMap, error) {
 		}
 	}
 
+	ordering, err := s.makeRowOrdering(query, groupings)
+	if err != nil {
+		return nil, err
+	}
+
 	var timestampFilterFuncs []timestampFilterFunc
 	var filterFuncs []filterFunc
+	var filterTrees []filterTree
+	var zoneFilterFuncs []zoneFilterFunc
 	for _, queryFilter := range query.Filters {
+		for _, leaf := range queryFilter.Leaves() {
+			if index, ok := s.DimensionNameToIndex[leaf.Column]; ok {
+				dimensionIndexes = append(dimensionIndexes, index)
+			} else if index, ok := s.MetricNameToIndex[leaf.Column]; ok {
+				metricIndexes = append(metricIndexes, index)
+			}
+		}
+
+		if queryFilter.IsCompound() {
+			tree, err := s.makeFilterTree(queryFilter)
+			if err != nil {
+				return nil, err
+			}
+			filterTrees = append(filterTrees, tree)
+			continue
+		}
+
 		if queryFilter.Column == s.TimestampColumn.Name {
 			filter, err := s.makeTimestampFilterFunc(queryFilter)
 			if err != nil {
@@ -117,39 +268,43 @@ func (s *StaticTable) InvokeQuery(query *Query) ([]RowMap, error) {
 			continue
 		}
 
-		var err error
-		var filter filterFunc
-		if index, ok := s.DimensionNameToIndex[queryFilter.Column]; ok {
-			filter, err = s.makeDimensionFilterFunc(queryFilter, index)
-		} else if index, ok := s.MetricNameToIndex[queryFilter.Column]; ok {
-			filter, err = s.makeMetricFilterFunc(queryFilter, index)
-		} else {
-			return nil, fmt.Errorf("%q (in a filter) is not a recognized column", queryFilter.Column)
-		}
+		filter, err := s.makeColumnFilterFunc(queryFilter)
 		if err != nil {
 			return nil, err
 		}
 		filterFuncs = append(filterFuncs, filter)
+		if zoneFilter := s.makeZoneFilterFunc(queryFilter); zoneFilter != nil {
+			zoneFilterFuncs = append(zoneFilterFuncs, zoneFilter)
+		}
 	}
 
 	params := &scanParams{
 		TimestampFilterFuncs: timestampFilterFuncs,
 		FilterFuncs:          filterFuncs,
+		FilterTrees:          filterTrees,
+		ZoneFilterFuncs:      zoneFilterFuncs,
+		SortKeyBounds:        s.makeSortKeyBounds(query.Filters),
 		SumColumns:           sumColumns,
 		SumFuncs:             sumFuncs,
-		Grouping:             grouping,
+		AggregateTypes:       aggregateTypes,
+		Groupings:            groupings,
+		Ordering:             ordering,
+		Fields:               s.rowFieldsForColumns(dimensionIndexes, metricIndexes),
 	}
-
-	Log.Printf("Query: grouping=%t, %d timestamp filter funcs, %d sum columns, %d filter funcs",
-		grouping != nil, len(timestampFilterFuncs), len(sumColumns), len(filterFuncs))
-
-	start := time.Now()
-	rows, stats := s.scan(params)
-	Log.Printf("Query: scan completed in %s; %d intervals skipped; %d intervals scanned; %d rows scanned",
-		time.Since(start), stats.Get(statIntervalsSkipped), stats.Get(statIntervalsScanned),
-		stats.Get(statRowsScanned))
-
-	return s.postProcessScanRows(rows, query, grouping), nil
+	if s.IntervalDimensionTables {
+		params.IntervalParams = make(map[*Interval]*scanParams)
+		for timestamp, interval := range s.Intervals {
+			if !params.AllTimestampFilterFuncsMatch(timestamp) {
+				continue
+			}
+			intervalParams, err := s.intervalView(interval).makeScanParams(query)
+			if err != nil {
+				return nil, err
+			}
+			params.IntervalParams[interval] = intervalParams
+		}
+	}
+	return params, nil
 }
 
 type scanPartial struct {
@@ -160,39 +315,103 @@ type scanPartial struct {
 func makeScanPartial(params *scanParams) *scanPartial {
 	partial := &scanPartial{Sums: make([]UntypedBytes, len(params.SumColumns))}
 	for i, col := range params.SumColumns {
-		partial.Sums[i] = make(UntypedBytes, typeWidths[TypeToBigType[col.Type]])
+		typ := TypeToBigType[col.Type]
+		partial.Sums[i] = make(UntypedBytes, typeWidths[typ])
+		switch params.AggregateTypes[i] {
+		case AggregateMin, AggregateMax:
+			initExtreme(partial.Sums[i], typ, params.AggregateTypes[i] == AggregateMax)
+		}
 	}
 	return partial
 }
 
-func combineScanPartials(results []*scanPartial, params *scanParams, groupByValue Untyped) *rowAggregate {
+// initExtreme sets the min or max accumulator value (of type typ, which is a big type) to the value which is
+// replaced by any other.
+func initExtreme(value UntypedBytes, typ Type, max bool) {
+	p := value.Pointer()
+	switch typ {
+	case TypeUint64:
+		if max {
+			*(*uint64)(p) = 0
+		} else {
+			*(*uint64)(p) = math.MaxUint64
+		}
+	case TypeInt64:
+		if max {
+			*(*int64)(p) = math.MinInt64
+		} else {
+			*(*int64)(p) = math.MaxInt64
+		}
+	case TypeFloat64:
+		if max {
+			*(*float64)(p) = math.Inf(-1)
+		} else {
+			*(*float64)(p) = math.Inf(1)
+		}
+	}
+}
+
+func combineScanPartials(results []*scanPartial, params *scanParams, groupByValues []Untyped) *rowAggregate {
 	result := &rowAggregate{
-		GroupByValue: groupByValue,
-		Sums:         make([]Untyped, len(params.SumColumns)),
+		GroupByValues: groupByValues,
+		Sums:          make([]Untyped, len(params.SumColumns)),
 	}
 	for i, col := range params.SumColumns {
-		result.Sums[i] = untypedZero(TypeToBigType[col.Type])
+		if col.Type == TypeHyperLogLog {
+			result.Sums[i] = NewHyperLogLog()
+			continue
+		}
+		switch params.AggregateTypes[i] {
+		case AggregateMin, AggregateMax:
+			// The min or max is nil unless there are rows.
+		default:
+			result.Sums[i] = untypedZero(TypeToBigType[col.Type])
+		}
 	}
 	for _, partial := range results {
 		for i, col := range params.SumColumns {
+			if col.Type == TypeHyperLogLog {
+				result.Sums[i].(HyperLogLog).Merge(HyperLogLog(partial.Sums[i]))
+				continue
+			}
 			typ := TypeToBigType[col.Type]
 			partialSum := NumericCellValue(partial.Sums[i].Pointer(), typ)
-			result.Sums[i] = sumUntyped(result.Sums[i], partialSum, typ)
+			switch params.AggregateTypes[i] {
+			case AggregateMin, AggregateMax:
+				switch {
+				case partial.Count == 0:
+					// No rows (only the initial value)
+				case result.Sums[i] == nil:
+					result.Sums[i] = partialSum
+				case params.AggregateTypes[i] == AggregateMin:
+					result.Sums[i] = minUntyped(result.Sums[i], partialSum, typ)
+				default:
+					result.Sums[i] = maxUntyped(result.Sums[i], partialSum, typ)
+				}
+			default:
+				result.Sums[i] = sumUntyped(result.Sums[i], partialSum, typ)
+			}
 		}
 		result.Count += partial.Count
 	}
 	return result
 }
 
+// A scanResult is the partial for the segments of one scanRequest, or the error which stopped the scan.
+type scanResult struct {
+	partial interface{}
+	err     error
+}
+
 type scanRequest struct {
-	scanFunc  func(*scanStats, *scanParams, time.Time, *Interval) interface{}
-	partialCh chan interface{}
-	wg        *sync.WaitGroup
+	scanFunc func(*scanStats, *scanParams, time.Time, []*Segment) (interface{}, error)
+	resultCh chan *scanResult
+	wg       *sync.WaitGroup
 
 	stats     *scanStats
 	params    *scanParams
 	timestamp time.Time
-	interval  *Interval
+	segments  []*Segment
 }
 
 func (db *DB) RunQueryWorker() {
@@ -201,24 +420,29 @@ func (db *DB) RunQueryWorker() {
 		case <-db.shutdown:
 			return
 		case r := <-db.scanRequests:
-			r.partialCh <- r.scanFunc(r.stats, r.params, r.timestamp, r.interval)
+			partial, err := r.scanFunc(r.stats, r.params, r.timestamp, r.segments)
+			if err != nil {
+				err = fmt.Errorf("cannot read interval at %s: %s", r.timestamp, err)
+			}
+			r.resultCh <- &scanResult{partial, err}
 			r.wg.Done()
 		}
 	}
 }
 
-func (s *StaticTable) scan(params *scanParams) ([]*rowAggregate, *scanStats) {
+// scan runs the scan described by params over every interval. If any segment cannot be read, the scan fails.
+func (s *StaticTable) scan(params *scanParams) ([]*rowAggregate, *scanStats, error) {
 	var (
-		stats     = newScanStats()
-		partialCh = make(chan interface{})
-		wg        sync.WaitGroup
+		stats    = newScanStats()
+		resultCh = make(chan *scanResult)
+		wg       sync.WaitGroup
 
-		scanFunc    func(*scanStats, *scanParams, time.Time, *Interval) interface{}
+		scanFunc    func(*scanStats, *scanParams, time.Time, []*Segment) (interface{}, error)
 		combineFunc func(partials []interface{}, params *scanParams) []*rowAggregate
 	)
 
 	switch {
-	case params.Grouping == nil:
+	case len(params.Groupings) == 0:
 		scanFunc = s.scanSimple
 		combineFunc = combineSimple
 	case s.useSliceGrouping(params):
@@ -235,69 +459,143 @@ func (s *StaticTable) scan(params *scanParams) ([]*rowAggregate, *scanStats) {
 				stats.Inc(statIntervalsSkipped)
 				continue
 			}
+			// Corrupted intervals are left out of the results entirely; an interval which can't be read for
+			// another reason fails the query.
+			if err := interval.Verify(s.Schema); err != nil {
+				if !isCorruption(err) {
+					resultCh <- &scanResult{err: fmt.Errorf("cannot read interval at %s: %s", timestamp, err)}
+					continue
+				}
+				stats.Inc(statIntervalsCorrupted)
+				continue
+			}
 			stats.Inc(statIntervalsScanned)
-			wg.Add(1)
-			s.scanRequests <- &scanRequest{
-				scanFunc:  scanFunc,
-				partialCh: partialCh,
-				wg:        &wg,
-				stats:     stats,
-				params:    params,
-				timestamp: timestamp,
-				interval:  interval,
+			// Each run is scanned separately; their partials are combined like those of separate intervals.
+			for _, run := range interval.AllRuns() {
+				runParams := params.forInterval(interval, run)
+				// Even if every segment is skipped, the interval is still "scanned" (this matters when grouping
+				// by timestamp).
+				segments := runParams.segmentsToScan(run)
+				stats.Add(statSegmentsSkipped, len(run.Segments)-len(segments))
+				wg.Add(1)
+				s.scanRequests <- &scanRequest{
+					scanFunc:  scanFunc,
+					resultCh:  resultCh,
+					wg:        &wg,
+					stats:     stats,
+					params:    runParams,
+					timestamp: timestamp,
+					segments:  segments,
+				}
 			}
 		}
 		wg.Wait()
-		close(partialCh)
+		close(resultCh)
 	}()
 
-	var partials []interface{}
-	for partial := range partialCh {
-		partials = append(partials, partial)
+	var (
+		partials []interface{}
+		err      error
+	)
+	for result := range resultCh {
+		if result.err != nil {
+			if err == nil {
+				err = result.err
+			}
+			continue
+		}
+		partials = append(partials, result.partial)
+	}
+	if err != nil {
+		return nil, stats, err
 	}
 
-	return combineFunc(partials, params), stats
+	return combineFunc(partials, params), stats, nil
 }
 
-// sliceGroupingSizeLimit is the cardinality of string dimension
-// beyond which we use a map, rather than a slice, for grouping.
+// sliceGroupingSizeLimit is the number of groups (the product of the number of values, including nil, of each
+// grouping column) beyond which we use a map, rather than a slice, for grouping.
 // It's a var rather than a const so tests can adjust it.
 // This value was chosen as:
 //   500k * 8 bytes / pointer = 4MB max slice allocation per partial.
 var sliceGroupingSizeLimit int = 500e3
 
 func (s *StaticTable) useSliceGrouping(params *scanParams) bool {
-	// TODO(caleb): We should be able to use slice groupings here.
-	// It requires a two-phase grouping:
-	// - Scan using a slice to group on the un-transformed dimension value
-	// - Collapse into the final result by grouping on the transformed values
-	if params.Grouping.TransformFunc != nil {
-		return false
-	}
-	// TODO(caleb): We should definitely be able to use a slice for timestamp grouping.
-	if params.Grouping.OnTimestampColumn {
-		return false
-	}
-	groupingColumn := s.DimensionColumns[params.Grouping.ColumnIndex]
-	if groupingColumn.Width <= 2 {
-		return true
+	_, _, ok := s.sliceGroupingSizes(params)
+	return ok
+}
+
+// sliceGroupingSizes returns the number of non-nil values of each grouping column, and the smallest of them,
+// if the groupings are small enough to group using a slice with an entry for every combination of values.
+func (s *StaticTable) sliceGroupingSizes(params *scanParams) (sizes, mins []int, ok bool) {
+	numGroups := 1
+	for _, grouping := range params.Groupings {
+		// TODO(caleb): We should be able to use slice groupings here.
+		// It requires a two-phase grouping:
+		// - Scan using a slice to group on the un-transformed dimension value
+		// - Collapse into the final result by grouping on the transformed values
+		if grouping.TransformFunc != nil {
+			return nil, nil, false
+		}
+		// TODO(caleb): We should definitely be able to use a slice for timestamp grouping.
+		if grouping.OnTimestampColumn {
+			return nil, nil, false
+		}
+		groupingColumn := s.DimensionColumns[grouping.ColumnIndex]
+		var size, min int
+		switch {
+		case groupingColumn.String && s.IntervalDimensionTables:
+			// String values must be grouped by value, not index, when each interval has its own dimension
+			// tables.
+			return nil, nil, false
+		case groupingColumn.String:
+			size = s.DimensionTables[grouping.ColumnIndex].Size
+		case groupingColumn.Width <= 2:
+			size = 1 << uint(8*groupingColumn.Width)
+			switch groupingColumn.Type {
+			case TypeInt8:
+				min = math.MinInt8
+			case TypeInt16:
+				min = math.MinInt16
+			}
+		default:
+			return nil, nil, false
+		}
+		numGroups *= size + 1
+		if numGroups > sliceGroupingSizeLimit {
+			return nil, nil, false
+		}
+		sizes = append(sizes, size)
+		mins = append(mins, min)
 	}
-	return groupingColumn.String &&
-		s.DimensionTables[params.Grouping.ColumnIndex].Size <= sliceGroupingSizeLimit
+	return sizes, mins, true
 }
 
-func (s *StaticTable) scanSimple(stats *scanStats, params *scanParams, _ time.Time, interval *Interval) interface{} {
+func (s *StaticTable) scanSimple(stats *scanStats, params *scanParams, _ time.Time,
+	segments []*Segment) (interface{}, error) {
+
 	var (
 		filterFuncs = params.FilterFuncs
 		sumFuncs    = params.SumFuncs
 		partial     = makeScanPartial(params)
 	)
-	for _, segment := range interval.Segments {
-		stats.Add(statRowsScanned, len(segment.Bytes)/s.RowSize)
+	buf := segmentBufferPool.Get().(*segmentBuffer)
+	defer segmentBufferPool.Put(buf)
+	for _, segment := range segments {
+		if err := segment.acquire(); err != nil {
+			return nil, err
+		}
+		rows, err := s.layoutSegmentRows(params.Layout, segment, params.Fields, buf)
+		if err != nil {
+			segment.release()
+			return nil, err
+		}
+		rows = s.sortKeyRange(rows, params.SortKeyBounds)
+		stats.Add(statRowsScanned, len(rows)/s.RowSize)
 
 	rowLoop:
-		for i := 0; i < len(segment.Bytes); i += s.RowSize {
-			row := RowBytes(segment.Bytes[i : i+s.RowSize])
+		for i := 0; i < len(rows); i += s.RowSize {
+			row := RowBytes(rows[i : i+s.RowSize])
 
 			// Run each filter to see if we should skip this row.
 			for _, filter := range filterFuncs {
@@ -314,8 +612,9 @@ func (s *StaticTable) scanSimple(stats *scanStats, params *scanParams, _ time.Ti
 
 			partial.Count += row.count(s.Schema)
 		}
+		segment.release()
 	}
-	return partial
+	return partial, nil
 }
 
 func combineSimple(partials []interface{}, params *scanParams) []*rowAggregate {
@@ -323,55 +622,76 @@ func combineSimple(partials []interface{}, params *scanParams) []*rowAggregate {
 	for i, p := range partials {
 		ps[i] = p.(*scanPartial)
 	}
-	return []*rowAggregate{combineScanPartials(ps, params, nil)}
+	collector := newRowCollector(params.Ordering)
+	collector.add(combineScanPartials(ps, params, nil))
+	return collector.results()
 }
 
+// sliceGroupPartials holds a partial for each combination of grouping values. The index of a combination is
+// the sum of the slot of each value times the stride of its column, where the slot of a value v is v-min+1
+// (slot 0 is for nil), min is the smallest value of the column (negative for signed columns), and the stride
+// of a column is the product of the numbers of slots of the preceding columns.
 type sliceGroupPartials struct {
-	slicePartials []*scanPartial
-	nilPartial    *scanPartial
+	partials []*scanPartial
+	sizes    []int // The number of non-nil values of each grouping column
+	mins     []int // The smallest value of each grouping column
 }
 
-func (s *StaticTable) scanSliceGrouping(stats *scanStats, params *scanParams, _ time.Time, interval *Interval) interface{} {
-	groupingColumn := s.DimensionColumns[params.Grouping.ColumnIndex]
-	width := groupingColumn.Width
-	var sliceGroupSize int
-	switch {
-	case groupingColumn.String:
-		sliceGroupSize = s.DimensionTables[params.Grouping.ColumnIndex].Size
-	case width <= 2:
-		sliceGroupSize = 1 << uint(8*width)
-	default:
-		panic("trying to use slice grouping for wide (>2 byte), non-string column")
+func (s *StaticTable) scanSliceGrouping(stats *scanStats, params *scanParams, _ time.Time,
+	segments []*Segment) (interface{}, error) {
+
+	sizes, mins, ok := s.sliceGroupingSizes(params)
+	if !ok {
+		panic("trying to use slice grouping for groupings which require a map")
 	}
 
-	// Sanity checks.
-	if params.Grouping.OnTimestampColumn {
-		panic("using slices for timestamp column group is unhandled")
+	type sliceGroupColumn struct {
+		nilOffset                  int
+		nilMask                    byte
+		valueOffset                int
+		getDimensionValueAsIntFunc func(cell unsafe.Pointer) int
+		min                        int
+		stride                     int
 	}
-	if params.Grouping.TransformFunc != nil {
-		panic("using slices for grouping with transform func")
+	columns := make([]sliceGroupColumn, len(params.Groupings))
+	numGroups := 1
+	for j, grouping := range params.Groupings {
+		i := grouping.ColumnIndex
+		columns[j] = sliceGroupColumn{
+			nilOffset:                  s.DimensionStartOffset + i>>3,
+			nilMask:                    byte(1) << byte(i&7),
+			valueOffset:                s.DimensionStartOffset + s.DimensionOffsets[i],
+			getDimensionValueAsIntFunc: makeGetDimensionValueAsIntFuncGen(s.DimensionColumns[i].Type),
+			min:                        mins[j],
+			stride:                     numGroups,
+		}
+		numGroups *= sizes[j] + 1
 	}
 
 	var (
-		i                          = params.Grouping.ColumnIndex
-		nilOffset                  = s.DimensionStartOffset + i>>3
-		nilMask                    = byte(1) << byte(i&7)
-		valueOffset                = s.DimensionStartOffset + s.DimensionOffsets[i]
-		getDimensionValueAsIntFunc = makeGetDimensionValueAsIntFuncGen(groupingColumn.Type)
-		filterFuncs                = params.FilterFuncs
-		sumFuncs                   = params.SumFuncs
-
-		slicePartials   = make([]*scanPartial, sliceGroupSize)
-		nilGroupPartial *scanPartial
-		partial         *scanPartial // The current partial at each iteration
+		filterFuncs   = params.FilterFuncs
+		sumFuncs      = params.SumFuncs
+		slicePartials = make([]*scanPartial, numGroups)
+		partial       *scanPartial // The current partial at each iteration
 	)
 
-	for _, segment := range interval.Segments {
-		stats.Add(statRowsScanned, len(segment.Bytes)/s.RowSize)
+	buf := segmentBufferPool.Get().(*segmentBuffer)
+	defer segmentBufferPool.Put(buf)
+	for _, segment := range segments {
+		if err := segment.acquire(); err != nil {
+			return nil, err
+		}
+		rows, err := s.layoutSegmentRows(params.Layout, segment, params.Fields, buf)
+		if err != nil {
+			segment.release()
+			return nil, err
+		}
+		rows = s.sortKeyRange(rows, params.SortKeyBounds)
+		stats.Add(statRowsScanned, len(rows)/s.RowSize)
 
 	rowLoop:
-		for i := 0; i < len(segment.Bytes); i += s.RowSize {
-			row := RowBytes(segment.Bytes[i : i+s.RowSize])
+		for i := 0; i < len(rows); i += s.RowSize {
+			row := RowBytes(rows[i : i+s.RowSize])
 
 			// Run each filter to see if we should skip this row.
 			for _, filter := range filterFuncs {
@@ -381,21 +701,18 @@ func (s *StaticTable) scanSliceGrouping(stats *scanStats, params *scanParams, _
 			}
 
 			// Grouping
-			if row[nilOffset]&nilMask > 0 {
-				partial = nilGroupPartial
-				if partial == nil {
-					partial = makeScanPartial(params)
-					nilGroupPartial = partial
-				}
-			} else {
-				cell := unsafe.Pointer(&row[valueOffset])
-				index := getDimensionValueAsIntFunc(cell)
-				partial = slicePartials[index]
-				if partial == nil {
-					partial = makeScanPartial(params)
-					slicePartials[index] = partial
+			index := 0
+			for _, column := range columns {
+				if row[column.nilOffset]&column.nilMask == 0 {
+					cell := unsafe.Pointer(&row[column.valueOffset])
+					index += (column.getDimensionValueAsIntFunc(cell) - column.min + 1) * column.stride
 				}
 			}
+			partial = slicePartials[index]
+			if partial == nil {
+				partial = makeScanPartial(params)
+				slicePartials[index] = partial
+			}
 
 			// Sum each aggregate metric.
 			metrics := MetricBytes(row[s.MetricStartOffset:])
@@ -405,9 +722,10 @@ func (s *StaticTable) scanSliceGrouping(stats *scanStats, params *scanParams, _
 
 			partial.Count += row.count(s.Schema)
 		}
+		segment.release()
 	}
 
-	return &sliceGroupPartials{slicePartials, nilGroupPartial}
+	return &sliceGroupPartials{slicePartials, sizes, mins}, nil
 }
 
 func combineSliceGrouping(boxedPartials []interface{}, params *scanParams) []*rowAggregate {
@@ -416,83 +734,121 @@ func combineSliceGrouping(boxedPartials []interface{}, params *scanParams) []*ro
 		partials[i] = p.(*sliceGroupPartials)
 	}
 
-	var results []*rowAggregate
-
-	var nilGroupPartials []*scanPartial
-	for _, slicePartials := range partials {
-		if slicePartials.nilPartial != nil {
-			nilGroupPartials = append(nilGroupPartials, slicePartials.nilPartial)
-		}
-	}
-	if len(nilGroupPartials) > 0 {
-		results = append(results, combineScanPartials(nilGroupPartials, params, nil))
+	collector := newRowCollector(params.Ordering)
+	if len(partials) == 0 {
+		return collector.results()
 	}
-
-	if len(partials) > 0 {
-		sliceGroupSize := len(partials[0].slicePartials)
-		for i := 0; i < sliceGroupSize; i++ {
-			var singleIndexPartials []*scanPartial
-			for _, slicePartials := range partials {
-				if partial := slicePartials.slicePartials[i]; partial != nil {
-					singleIndexPartials = append(singleIndexPartials, partial)
-				}
+	sizes, mins := partials[0].sizes, partials[0].mins
+	for i := range partials[0].partials {
+		var singleIndexPartials []*scanPartial
+		for _, slicePartials := range partials {
+			if partial := slicePartials.partials[i]; partial != nil {
+				singleIndexPartials = append(singleIndexPartials, partial)
 			}
-			if len(singleIndexPartials) > 0 {
-				results = append(results, combineScanPartials(singleIndexPartials, params, i))
+		}
+		if len(singleIndexPartials) == 0 {
+			continue
+		}
+		// Decode the grouping values from the index.
+		groupByValues := make([]Untyped, len(sizes))
+		index := i
+		for j, size := range sizes {
+			if slot := index % (size + 1); slot > 0 {
+				groupByValues[j] = slot - 1 + mins[j]
 			}
+			index /= size + 1
 		}
+		collector.add(combineScanPartials(singleIndexPartials, params, groupByValues))
 	}
-	return results
+	return collector.results()
 }
 
-func (s *StaticTable) scanMapGrouping(stats *scanStats, params *scanParams, timestamp time.Time, interval *Interval) interface{} {
-	var groupingColumn Column
-	if params.Grouping.OnTimestampColumn {
-		groupingColumn = s.TimestampColumn
-	} else {
-		groupingColumn = s.DimensionColumns[params.Grouping.ColumnIndex].Column
-	}
+// A mapGroupPartial is the partial for one combination of grouping values.
+type mapGroupPartial struct {
+	*scanPartial
+	GroupByValues []Untyped
+}
 
-	var (
-		nilOffset, valueOffset int
-		nilMask                byte
-		groupOnTimestampColumn = params.Grouping.OnTimestampColumn
-		transformFunc          = params.Grouping.TransformFunc
-	)
-	if !groupOnTimestampColumn {
-		i := params.Grouping.ColumnIndex
-		nilOffset = s.DimensionStartOffset + i>>3
-		nilMask = 1 << byte(i&7)
-		valueOffset = s.DimensionStartOffset + s.DimensionOffsets[i]
+// scanMapGrouping groups rows using a map keyed by an encoding of their grouping values (see appendGroupKey).
+func (s *StaticTable) scanMapGrouping(stats *scanStats, params *scanParams, timestamp time.Time,
+	segments []*Segment) (interface{}, error) {
+
+	// groupValueFuncs gives the value of each grouping for a row.
+	groupValueFuncs := make([]func(row RowBytes) Untyped, len(params.Groupings))
+	onlyTimestampGroupings := true
+	for j, grouping := range params.Groupings {
+		transformFunc := grouping.TransformFunc
+
+		// If we're grouping on the timestamp column, do that work out here.
+		if grouping.OnTimestampColumn {
+			groupTimestamp := uint32(timestamp.Unix())
+			var value Untyped = groupTimestamp
+			if transformFunc != nil {
+				value = transformFunc(unsafe.Pointer(&groupTimestamp))
+			}
+			groupValueFuncs[j] = func(RowBytes) Untyped { return value }
+			continue
+		}
+		onlyTimestampGroupings = false
+
+		var (
+			i                     = grouping.ColumnIndex
+			nilOffset             = s.DimensionStartOffset + i>>3
+			nilMask               = byte(1) << byte(i&7)
+			valueOffset           = s.DimensionStartOffset + s.DimensionOffsets[i]
+			getDimensionValueFunc = makeGetDimensionValueFuncGen(s.DimensionColumns[i].Type)
+			dimensionValues       = grouping.DimensionValues
+		)
+		groupValueFuncs[j] = func(row RowBytes) Untyped {
+			if row[nilOffset]&nilMask > 0 {
+				return nil
+			}
+			cell := unsafe.Pointer(&row[valueOffset])
+			switch {
+			case transformFunc != nil:
+				return transformFunc(cell)
+			case dimensionValues != nil:
+				return dimensionValues[UntypedToInt(getDimensionValueFunc(cell))]
+			default:
+				return getDimensionValueFunc(cell)
+			}
+		}
 	}
-	var (
-		getDimensionValueFunc = makeGetDimensionValueFuncGen(groupingColumn.Type)
-		filterFuncs           = params.FilterFuncs
-		sumFuncs              = params.SumFuncs
 
-		mapPartials = make(map[Untyped]*scanPartial)
-		partial     *scanPartial
-		key         Untyped
+	var (
+		filterFuncs   = params.FilterFuncs
+		sumFuncs      = params.SumFuncs
+		mapPartials   = make(map[string]*mapGroupPartial)
+		groupByValues = make([]Untyped, len(params.Groupings))
+		key           []byte
 	)
 
-	// If we're grouping on the timestamp column, do that work out here.
-	if groupOnTimestampColumn {
-		groupTimestamp := uint32(timestamp.Unix())
-		if transformFunc == nil {
-			key = groupTimestamp
-		} else {
-			key = transformFunc(unsafe.Pointer(&groupTimestamp))
+	// An interval is a group of its own when grouping only by timestamp, even if no rows match.
+	if onlyTimestampGroupings {
+		for j, f := range groupValueFuncs {
+			groupByValues[j] = f(nil)
+			key = appendGroupKey(key, groupByValues[j])
 		}
-		partial = makeScanPartial(params)
-		mapPartials[key] = partial
+		mapPartials[string(key)] = &mapGroupPartial{makeScanPartial(params), groupByValues}
 	}
 
-	for _, segment := range interval.Segments {
-		stats.Add(statRowsScanned, len(segment.Bytes)/s.RowSize)
+	buf := segmentBufferPool.Get().(*segmentBuffer)
+	defer segmentBufferPool.Put(buf)
+	for _, segment := range segments {
+		if err := segment.acquire(); err != nil {
+			return nil, err
+		}
+		rows, err := s.layoutSegmentRows(params.Layout, segment, params.Fields, buf)
+		if err != nil {
+			segment.release()
+			return nil, err
+		}
+		rows = s.sortKeyRange(rows, params.SortKeyBounds)
+		stats.Add(statRowsScanned, len(rows)/s.RowSize)
 
 	rowLoop:
-		for i := 0; i < len(segment.Bytes); i += s.RowSize {
-			row := RowBytes(segment.Bytes[i : i+s.RowSize])
+		for i := 0; i < len(rows); i += s.RowSize {
+			row := RowBytes(rows[i : i+s.RowSize])
 
 			// Run each filter to see if we should skip this row.
 			for _, filter := range filterFuncs {
@@ -502,22 +858,17 @@ func (s *StaticTable) scanMapGrouping(stats *scanStats, params *scanParams, time
 			}
 
 			// Perform grouping.
-			if !groupOnTimestampColumn {
-				if row[nilOffset]&nilMask > 0 {
-					key = nil // just to be explicit about things
-				} else {
-					cell := unsafe.Pointer(&row[valueOffset])
-					if transformFunc != nil {
-						key = transformFunc(cell)
-					} else {
-						key = getDimensionValueFunc(cell)
-					}
-				}
-				partial = mapPartials[key]
-				if partial == nil {
-					partial = makeScanPartial(params)
-					mapPartials[key] = partial
-				}
+			key = key[:0]
+			for j, f := range groupValueFuncs {
+				groupByValues[j] = f(row)
+				key = appendGroupKey(key, groupByValues[j])
+			}
+			partial := mapPartials[string(key)]
+			if partial == nil {
+				values := make([]Untyped, len(groupByValues))
+				copy(values, groupByValues)
+				partial = &mapGroupPartial{makeScanPartial(params), values}
+				mapPartials[string(key)] = partial
 			}
 
 			// Sum each aggregate metric.
@@ -528,40 +879,83 @@ func (s *StaticTable) scanMapGrouping(stats *scanStats, params *scanParams, time
 
 			partial.Count += row.count(s.Schema)
 		}
+		segment.release()
 	}
 
-	return mapPartials
+	return mapPartials, nil
+}
+
+// appendGroupKey appends an encoding of the grouping value v to key. The values of a grouping column all have
+// the same type, so the encoding only needs to distinguish them from each other and from nil.
+func appendGroupKey(key []byte, v Untyped) []byte {
+	var bits uint64
+	switch v := v.(type) {
+	case nil:
+		return append(key, 0)
+	case string:
+		key = append(key, 1)
+		key = binary.AppendUvarint(key, uint64(len(v)))
+		return append(key, v...)
+	case uint8:
+		bits = uint64(v)
+	case int8:
+		bits = uint64(v)
+	case uint16:
+		bits = uint64(v)
+	case int16:
+		bits = uint64(v)
+	case uint32:
+		bits = uint64(v)
+	case int32:
+		bits = uint64(v)
+	case uint64:
+		bits = v
+	case int64:
+		bits = uint64(v)
+	case int:
+		bits = uint64(v)
+	case float32:
+		bits = uint64(math.Float32bits(v))
+	case float64:
+		bits = math.Float64bits(v)
+	default:
+		panic(fmt.Sprintf("unexpected grouping value type %T", v))
+	}
+	key = append(key, 1)
+	return binary.LittleEndian.AppendUint64(key, bits)
 }
 
 func combineMapGrouping(boxedPartials []interface{}, params *scanParams) []*rowAggregate {
-	mapPartials := make([]map[Untyped]*scanPartial, len(boxedPartials))
+	mapPartials := make([]map[string]*mapGroupPartial, len(boxedPartials))
 	for i, p := range boxedPartials {
-		mapPartials[i] = p.(map[Untyped]*scanPartial)
+		mapPartials[i] = p.(map[string]*mapGroupPartial)
 	}
 
-	allKeys := make(map[Untyped]struct{})
+	allKeys := make(map[string][]Untyped)
 	for _, mapPartial := range mapPartials {
-		for k := range mapPartial {
-			allKeys[k] = struct{}{}
+		for k, partial := range mapPartial {
+			allKeys[k] = partial.GroupByValues
 		}
 	}
 
-	var results []*rowAggregate
-	for k := range allKeys {
+	collector := newRowCollector(params.Ordering)
+	for k, groupByValues := range allKeys {
 		var partials []*scanPartial
 		for _, mapPartial := range mapPartials {
 			if partial := mapPartial[k]; partial != nil {
-				partials = append(partials, partial)
+				partials = append(partials, partial.scanPartial)
 			}
 		}
 		if len(partials) > 0 {
-			results = append(results, combineScanPartials(partials, params, k))
+			collector.add(combineScanPartials(partials, params, groupByValues))
 		}
 	}
-	return results
+	return collector.results()
 }
 
-func (s *StaticTable) postProcessScanRows(aggregates []*rowAggregate, query *Query, grouping *groupingParams) []RowMap {
+func (s *StaticTable) postProcessScanRows(aggregates []*rowAggregate, query *Query,
+	groupings []*groupingParams) []RowMap {
+
 	rows := make([]RowMap, len(aggregates))
 	for i, aggregate := range aggregates {
 		row := make(RowMap)
@@ -571,18 +965,16 @@ func (s *StaticTable) postProcessScanRows(aggregates []*rowAggregate, query *Que
 				row[queryAggregate.Name] = aggregate.Sums[i]
 			case AggregateAvg:
 				row[queryAggregate.Name] = UntypedToFloat64(aggregate.Sums[i]) / float64(aggregate.Count)
+			case AggregateMin, AggregateMax:
+				row[queryAggregate.Name] = aggregate.Sums[i]
+			case AggregateCardinality:
+				row[queryAggregate.Name] = aggregate.Sums[i].(HyperLogLog).Estimate()
+			case AggregateSketch:
+				row[queryAggregate.Name] = aggregate.Sums[i]
 			}
 		}
-		if grouping != nil {
-			var value Untyped = aggregate.GroupByValue
-			if aggregate.GroupByValue != nil && !grouping.OnTimestampColumn {
-				col := s.DimensionColumns[grouping.ColumnIndex]
-				if col.String {
-					dimensionIndex := UntypedToInt(aggregate.GroupByValue)
-					value = s.DimensionTables[grouping.ColumnIndex].Values[dimensionIndex]
-				}
-			}
-			row[query.Groupings[0].Name] = value
+		for j, grouping := range groupings {
+			row[query.Groupings[j].Name] = s.groupByValue(grouping, aggregate.GroupByValues[j])
 		}
 		row["rowCount"] = aggregate.Count
 		rows[i] = row
@@ -590,9 +982,34 @@ func (s *StaticTable) postProcessScanRows(aggregates []*rowAggregate, query *Que
 	return rows
 }
 
+// groupByValue returns the result value of a grouping from its value while scanning (translating dimension
+// table indexes to strings).
+func (s *StaticTable) groupByValue(grouping *groupingParams, value Untyped) Untyped {
+	if value == nil || grouping.OnTimestampColumn {
+		return value
+	}
+	col := s.DimensionColumns[grouping.ColumnIndex]
+	// With interval dimension tables, the value was already translated while scanning.
+	if col.String && !s.IntervalDimensionTables {
+		return s.DimensionTables[grouping.ColumnIndex].Values[UntypedToInt(value)]
+	}
+	return value
+}
+
 func (s *StaticTable) makeSumFunc(aggregate QueryAggregate, index int) sumFunc {
 	col := s.MetricColumns[index]
 	offset := s.MetricOffsets[index]
+	if col.Type == TypeHyperLogLog {
+		return func(sum UntypedBytes, metrics MetricBytes) {
+			HyperLogLog(sum).Merge(HyperLogLog(metrics[offset:]))
+		}
+	}
+	switch aggregate.Type {
+	case AggregateMin:
+		return makeMinFuncGen(col.Type)(offset)
+	case AggregateMax:
+		return makeMaxFuncGen(col.Type)(offset)
+	}
 	return makeSumFuncGen(col.Type)(offset)
 }
 
@@ -621,6 +1038,9 @@ func (s *StaticTable) makeTimestampFilterFunc(filter QueryFilter) (timestampFilt
 	if filter.Type == FilterIn {
 		return s.makeTimestampFilterFuncIn(filter)
 	}
+	if isPatternFilter(filter.Type) {
+		return nil, fmt.Errorf("cannot use a %s filter on the timestamp column", filterTypeToName[filter.Type])
+	}
 
 	value, ok := filter.Value.(float64)
 	if !ok {
@@ -653,10 +1073,24 @@ func (s *StaticTable) makeTimestampFilterFuncIn(filter QueryFilter) (timestampFi
 	}, nil
 }
 
+// makeColumnFilterFunc compiles a filter on a dimension or metric column.
+func (s *StaticTable) makeColumnFilterFunc(filter QueryFilter) (filterFunc, error) {
+	if index, ok := s.DimensionNameToIndex[filter.Column]; ok {
+		return s.makeDimensionFilterFunc(filter, index)
+	}
+	if index, ok := s.MetricNameToIndex[filter.Column]; ok {
+		return s.makeMetricFilterFunc(filter, index)
+	}
+	return nil, fmt.Errorf("%q (in a filter) is not a recognized column", filter.Column)
+}
+
 func (s *StaticTable) makeDimensionFilterFunc(filter QueryFilter, index int) (filterFunc, error) {
 	if filter.Type == FilterIn {
 		return s.makeDimensionFilterFuncIn(filter, index)
 	}
+	if isPatternFilter(filter.Type) {
+		return s.makeDimensionFilterFuncPattern(filter, index)
+	}
 
 	col := s.DimensionColumns[index]
 	mask := byte(1) << byte(index&7)
@@ -687,6 +1121,10 @@ func (s *StaticTable) makeDimensionFilterFunc(filter QueryFilter, index int) (fi
 		}
 		dimIndex, ok := s.DimensionTables[index].Get(str)
 		if !ok {
+			// No row has this value, so every row (including those with nil values) is != to it.
+			if filter.Type == FilterNotEqual {
+				return trueFilterFunc, nil
+			}
 			return falseFilterFunc, nil
 		}
 		value = dimIndex
@@ -761,7 +1199,69 @@ func (s *StaticTable) makeDimensionFilterFuncIn(filter QueryFilter, index int) (
 	return filterGenFunc(values, acceptNil, nilOffset, mask, valueOffset), nil
 }
 
+// isPatternFilter reports whether t is one of the filters matching the values of string columns against a
+// pattern.
+func isPatternFilter(t FilterType) bool {
+	switch t {
+	case FilterPrefix, FilterSuffix, FilterContains, FilterRegex:
+		return true
+	}
+	return false
+}
+
+// makeDimensionFilterFuncPattern compiles a prefix, suffix, contains, or regex filter on a string column. The
+// pattern is matched once against each value in the dimension table, and then rows are filtered by the
+// dimension table indexes of the matching values as with 'in' filters. Nil values never match.
+func (s *StaticTable) makeDimensionFilterFuncPattern(filter QueryFilter, index int) (filterFunc, error) {
+	col := s.DimensionColumns[index]
+	name := filterTypeToName[filter.Type]
+	if !col.String {
+		return nil, fmt.Errorf("%s filters only apply to string columns; %q is not one", name, col.Name)
+	}
+	pattern, ok := filter.Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("need a string value for a %s filter on %q; got %v", name, col.Name,
+			filter.Value)
+	}
+	var matches func(value string) bool
+	switch filter.Type {
+	case FilterPrefix:
+		matches = func(value string) bool { return strings.HasPrefix(value, pattern) }
+	case FilterSuffix:
+		matches = func(value string) bool { return strings.HasSuffix(value, pattern) }
+	case FilterContains:
+		matches = func(value string) bool { return strings.Contains(value, pattern) }
+	case FilterRegex:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad regex for filtering %q: %s", col.Name, err)
+		}
+		matches = re.MatchString
+	}
+
+	var dimIndices []uint32
+	for i, value := range s.DimensionTables[index].Values {
+		if matches(value) {
+			dimIndices = append(dimIndices, uint32(i))
+		}
+	}
+	if len(dimIndices) == 0 {
+		return falseFilterFunc, nil
+	}
+	mask := byte(1) << byte(index&7)
+	nilOffset := s.DimensionStartOffset + index>>3
+	valueOffset := s.DimensionStartOffset + s.DimensionOffsets[index]
+	return makeDimensionFilterFuncInGen(col.Type, true)(dimIndices, false, nilOffset, mask, valueOffset), nil
+}
+
 func (s *StaticTable) makeMetricFilterFunc(filter QueryFilter, index int) (filterFunc, error) {
+	if s.MetricColumns[index].Type == TypeHyperLogLog {
+		return nil, fmt.Errorf("cannot filter on %s, a hyperloglog column", filter.Column)
+	}
+	if isPatternFilter(filter.Type) {
+		return nil, fmt.Errorf("cannot use a %s filter on %s, a metric column", filterTypeToName[filter.Type],
+			filter.Column)
+	}
 	if filter.Type == FilterIn {
 		return s.makeMetricFilterFuncIn(filter, index)
 	}
@@ -803,6 +1303,8 @@ type scanStat int
 const (
 	statIntervalsSkipped scanStat = iota
 	statIntervalsScanned
+	statIntervalsCorrupted
+	statSegmentsSkipped
 	statRowsScanned
 )
 
@@ -820,7 +1322,7 @@ func newScanStats() *scanStats {
 
 func (s *scanStats) Add(key scanStat, delta int) {
 	s.Lock()
-	s.m[key]++
+	s.m[key] += delta
 	s.Unlock()
 }
 
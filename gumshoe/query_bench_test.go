@@ -17,12 +17,32 @@ const (
 	BenchmarkColumns = 42
 )
 
-var benchmarkDB *DB
+type benchmarkLayout struct {
+	format      SegmentFormat
+	compression SegmentCompression
+}
+
+var (
+	benchmarkDB  *DB
+	benchmarkDBs = make(map[benchmarkLayout]*DB) // Set up once for each layout
+)
+
+// setup uses uncompressed row segments, the default layout.
+func setup(b *testing.B) { setupLayout(b, SegmentFormatRow, SegmentCompressionNone) }
+
+// setupCompressed uses row segments compressed with deflate, so that only the cost of decompression differs
+// from setup.
+func setupCompressed(b *testing.B) { setupLayout(b, SegmentFormatRow, SegmentCompressionDeflate) }
 
-func setup(b *testing.B) {
-	if benchmarkDB == nil {
-		benchmarkDB = setUpDB()
+// setupColumns uses uncompressed column segments.
+func setupColumns(b *testing.B) { setupLayout(b, SegmentFormatColumn, SegmentCompressionNone) }
+
+func setupLayout(b *testing.B, format SegmentFormat, compression SegmentCompression) {
+	layout := benchmarkLayout{format, compression}
+	if benchmarkDBs[layout] == nil {
+		benchmarkDBs[layout] = setUpDB(format, compression)
 	}
+	benchmarkDB = benchmarkDBs[layout]
 	b.SetBytes(int64(BenchmarkRows * benchmarkDB.RowSize))
 }
 
@@ -37,6 +57,22 @@ func mustGetBenchmarkQueryResult(query *Query) []RowMap {
 // A query which only sums aggregates.
 func BenchmarkAggregateQuery(b *testing.B) {
 	setup(b)
+	benchmarkAggregateQuery(b)
+}
+
+// The same as BenchmarkAggregateQuery, but each scanned segment must be decompressed.
+func BenchmarkAggregateQueryCompressed(b *testing.B) {
+	setupCompressed(b)
+	benchmarkAggregateQuery(b)
+}
+
+// The same as BenchmarkAggregateQuery, but only the queried columns of each segment are decoded.
+func BenchmarkAggregateQueryColumns(b *testing.B) {
+	setupColumns(b)
+	benchmarkAggregateQuery(b)
+}
+
+func benchmarkAggregateQuery(b *testing.B) {
 	query := createBenchmarkQuery(nil, nil)
 	var results []RowMap
 	b.ResetTimer()
@@ -51,6 +87,22 @@ func BenchmarkAggregateQuery(b *testing.B) {
 // A query which filters rows by a single, simple filter function.
 func BenchmarkFilterQuery(b *testing.B) {
 	setup(b)
+	benchmarkFilterQuery(b)
+}
+
+// The same as BenchmarkFilterQuery, but each scanned segment must be decompressed.
+func BenchmarkFilterQueryCompressed(b *testing.B) {
+	setupCompressed(b)
+	benchmarkFilterQuery(b)
+}
+
+// The same as BenchmarkFilterQuery, but only the queried columns of each segment are decoded.
+func BenchmarkFilterQueryColumns(b *testing.B) {
+	setupColumns(b)
+	benchmarkFilterQuery(b)
+}
+
+func benchmarkFilterQuery(b *testing.B) {
 	// Metric 2 cycles between 0 and 1, so this will filter out 1/2 the columns.
 	query := createBenchmarkQuery(nil, []QueryFilter{{FilterGreaterThan, "metric002", 0.0}})
 	b.ResetTimer()
@@ -110,7 +162,7 @@ func createBenchmarkQueryAggregates(columns []string) []QueryAggregate {
 }
 
 // setUpDB creates a test DB to represent a realistic schema.
-func setUpDB() *DB {
+func setUpDB(format SegmentFormat, compression SegmentCompression) *DB {
 	dimensions := []DimensionColumn{
 		makeDimensionColumn("dim1", "uint32", false),
 		makeDimensionColumn("dim2", "uint32", false),
@@ -127,6 +179,8 @@ func setUpDB() *DB {
 	schema.MetricColumns = metrics
 	schema.TimestampColumn = makeColumn("at", "uint32")
 	schema.SegmentSize = 1 << 24
+	schema.SegmentFormat = format
+	schema.SegmentCompression = compression
 
 	db, err := NewDB(schema)
 	if err != nil {
@@ -0,0 +1,333 @@
+// Filtering, ordering and limiting query results (Query.Having, Query.OrderBy and Query.Limit).
+//
+// The combined rows of a scan are filtered and ranked as they are produced. With a limit, only the best
+// Limit rows seen so far are kept, in a heap with the worst of them on top, so a top-N query over millions of
+// groups only needs memory for N of them. The having filters are applied first, so the limit counts only the
+// rows which pass them.
+
+package gumshoe
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// rowOrdering is the compiled form of a query's Having, OrderBy and Limit.
+type rowOrdering struct {
+	having     []func(row *rowAggregate) bool    // Corresponds to query.Having
+	keyFuncs   []func(row *rowAggregate) Untyped // Corresponds to query.OrderBy
+	descending []bool
+	limit      int
+}
+
+// makeRowOrdering compiles the having filters, ordering, and limit of query, whose groupings are compiled as
+// groupings. It returns nil if the results are neither filtered, ordered, nor limited.
+func (s *StaticTable) makeRowOrdering(query *Query, groupings []*groupingParams) (*rowOrdering, error) {
+	if query.Limit < 0 {
+		return nil, fmt.Errorf("bad limit: %d", query.Limit)
+	}
+	if len(query.Having) == 0 && len(query.OrderBy) == 0 && query.Limit == 0 {
+		return nil, nil
+	}
+	ordering := &rowOrdering{limit: query.Limit}
+	for _, filter := range query.Having {
+		valueFunc, err := s.makeResultValueFunc(query, groupings, filter.Column)
+		if err != nil {
+			return nil, fmt.Errorf("bad having filter: %s", err)
+		}
+		if err := validateHavingFilter(filter); err != nil {
+			return nil, err
+		}
+		filter := filter
+		ordering.having = append(ordering.having, func(row *rowAggregate) bool {
+			return havingFilterMatches(filter, valueFunc(row))
+		})
+	}
+	for _, queryOrdering := range query.OrderBy {
+		keyFunc, err := s.makeResultValueFunc(query, groupings, queryOrdering.Name)
+		if err != nil {
+			return nil, fmt.Errorf("bad ordering: %s", err)
+		}
+		ordering.keyFuncs = append(ordering.keyFuncs, keyFunc)
+		ordering.descending = append(ordering.descending, queryOrdering.Descending)
+	}
+	return ordering, nil
+}
+
+// makeResultValueFunc returns a function giving the value of the aggregate or grouping called name for a
+// row. The values are the same as those of the final results.
+func (s *StaticTable) makeResultValueFunc(query *Query, groupings []*groupingParams,
+	name string) (func(*rowAggregate) Untyped, error) {
+
+	for i, aggregate := range query.Aggregates {
+		if aggregate.Name != name {
+			continue
+		}
+		switch aggregate.Type {
+		case AggregateAvg:
+			return func(row *rowAggregate) Untyped {
+				return UntypedToFloat64(row.Sums[i]) / float64(row.Count)
+			}, nil
+		case AggregateCardinality, AggregateSketch:
+			return func(row *rowAggregate) Untyped { return row.Sums[i].(HyperLogLog).Estimate() }, nil
+		}
+		return func(row *rowAggregate) Untyped { return row.Sums[i] }, nil
+	}
+	for j, grouping := range query.Groupings {
+		if grouping.Name == name {
+			return func(row *rowAggregate) Untyped {
+				return s.groupByValue(groupings[j], row.GroupByValues[j])
+			}, nil
+		}
+	}
+	if name == "rowCount" {
+		return func(row *rowAggregate) Untyped { return row.Count }, nil
+	}
+	return nil, fmt.Errorf("%q is not the name of an aggregate or grouping", name)
+}
+
+// validateHavingFilter checks that the value of a having filter can be compared with the results.
+func validateHavingFilter(filter QueryFilter) error {
+	if filter.IsCompound() {
+		return errors.New("having filters cannot be compound")
+	}
+	if isPatternFilter(filter.Type) {
+		return fmt.Errorf("%s filters cannot be used as having filters", filterTypeToName[filter.Type])
+	}
+	values := []interface{}{filter.Value}
+	if filter.Type == FilterIn {
+		var ok bool
+		if values, ok = filter.Value.([]interface{}); !ok {
+			return fmt.Errorf("the value of an 'in' having filter must be a list; got %v", filter.Value)
+		}
+	}
+	for _, value := range values {
+		if _, ok := value.(string); !ok && !isNumber(value) {
+			return fmt.Errorf("bad having filter value for %q: %v", filter.Column, value)
+		}
+	}
+	return nil
+}
+
+// havingFilterMatches reports whether a result value passes a having filter. As in SQL, a nil value (say, the
+// minimum of a column which is nil in every row of the group) matches no filter.
+func havingFilterMatches(filter QueryFilter, value Untyped) bool {
+	if value == nil {
+		return false
+	}
+	if filter.Type == FilterIn {
+		for _, v := range filter.Value.([]interface{}) {
+			if canCompare(value, v) && compareUntyped(value, v) == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	if !canCompare(value, filter.Value) {
+		return filter.Type == FilterNotEqual
+	}
+	c := compareUntyped(value, filter.Value)
+	switch filter.Type {
+	case FilterEqual:
+		return c == 0
+	case FilterNotEqual:
+		return c != 0
+	case FilterGreaterThan:
+		return c > 0
+	case FilterGreaterThenOrEqual:
+		return c >= 0
+	case FilterLessThan:
+		return c < 0
+	case FilterLessThanOrEqual:
+		return c <= 0
+	}
+	panic("unexpected filter type")
+}
+
+// FilterRowMaps returns the query results which pass all the having filters (as the DB filters the results
+// of queries with a Having list).
+func FilterRowMaps(rows []RowMap, having []QueryFilter) []RowMap {
+	if len(having) == 0 {
+		return rows
+	}
+	var filtered []RowMap
+rowLoop:
+	for _, row := range rows {
+		for _, filter := range having {
+			if !havingFilterMatches(filter, row[filter.Column]) {
+				continue rowLoop
+			}
+		}
+		filtered = append(filtered, row)
+	}
+	return filtered
+}
+
+type rankedRow struct {
+	row  *rowAggregate
+	keys []Untyped
+}
+
+// compare returns a negative number if r1 comes before r2 in the ordering, a positive number if it comes
+// after, and 0 if they are tied.
+func (o *rowOrdering) compare(r1, r2 *rankedRow) int {
+	for i, descending := range o.descending {
+		c := compareUntyped(r1.keys[i], r2.keys[i])
+		if descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// A rowCollector gathers the combined rows of a scan which pass the having filters, in order and up to the
+// limit if the query has them.
+type rowCollector struct {
+	ordering *rowOrdering
+	rows     []*rankedRow // A heap (worst row first) while collecting with both an ordering and a limit
+}
+
+func newRowCollector(ordering *rowOrdering) *rowCollector {
+	return &rowCollector{ordering: ordering}
+}
+
+func (c *rowCollector) add(row *rowAggregate) {
+	o := c.ordering
+	if o == nil {
+		c.rows = append(c.rows, &rankedRow{row: row})
+		return
+	}
+	for _, f := range o.having {
+		if !f(row) {
+			return
+		}
+	}
+	ranked := &rankedRow{row: row, keys: make([]Untyped, len(o.keyFuncs))}
+	for i, f := range o.keyFuncs {
+		ranked.keys[i] = f(row)
+	}
+	switch {
+	case o.limit == 0 || len(c.rows) < o.limit:
+		c.rows = append(c.rows, ranked)
+		if o.limit > 0 && len(c.rows) == o.limit && len(o.keyFuncs) > 0 {
+			heap.Init(c)
+		}
+	case len(o.keyFuncs) > 0 && o.compare(ranked, c.rows[0]) < 0:
+		c.rows[0] = ranked
+		heap.Fix(c, 0)
+	}
+}
+
+// results returns the collected rows in order.
+func (c *rowCollector) results() []*rowAggregate {
+	if c.ordering != nil && len(c.ordering.keyFuncs) > 0 {
+		sort.SliceStable(c.rows, func(i, j int) bool { return c.ordering.compare(c.rows[i], c.rows[j]) < 0 })
+	}
+	results := make([]*rowAggregate, len(c.rows))
+	for i, ranked := range c.rows {
+		results[i] = ranked.row
+	}
+	return results
+}
+
+// heap.Interface, with the worst row first.
+func (c *rowCollector) Len() int           { return len(c.rows) }
+func (c *rowCollector) Less(i, j int) bool { return c.ordering.compare(c.rows[i], c.rows[j]) > 0 }
+func (c *rowCollector) Swap(i, j int)      { c.rows[i], c.rows[j] = c.rows[j], c.rows[i] }
+func (c *rowCollector) Push(x interface{}) { c.rows = append(c.rows, x.(*rankedRow)) }
+
+func (c *rowCollector) Pop() interface{} {
+	last := c.rows[len(c.rows)-1]
+	c.rows = c.rows[:len(c.rows)-1]
+	return last
+}
+
+// SortRowMaps sorts query results by orderBy (as the DB does for queries with an ordering).
+func SortRowMaps(rows []RowMap, orderBy []QueryOrdering) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, ordering := range orderBy {
+			c := compareUntyped(rows[i][ordering.Name], rows[j][ordering.Name])
+			if ordering.Descending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// compareUntyped compares two values of the same column (strings or numbers, either of which may be nil). It
+// returns a negative number, 0, or a positive number if u1 is less than, equal to, or greater than u2. nil is
+// less than any other value.
+func compareUntyped(u1, u2 Untyped) int {
+	switch {
+	case u1 == nil && u2 == nil:
+		return 0
+	case u1 == nil:
+		return -1
+	case u2 == nil:
+		return 1
+	}
+	if s1, ok := u1.(string); ok {
+		return strings.Compare(s1, u2.(string))
+	}
+	v1, v2 := reflect.ValueOf(u1), reflect.ValueOf(u2)
+	switch {
+	case isIntKind(v1.Kind()) && isIntKind(v2.Kind()):
+		x, y := v1.Int(), v2.Int()
+		return comparison(x < y, x > y)
+	case isUintKind(v1.Kind()) && isUintKind(v2.Kind()):
+		x, y := v1.Uint(), v2.Uint()
+		return comparison(x < y, x > y)
+	}
+	x, y := UntypedToFloat64(u1), UntypedToFloat64(u2)
+	return comparison(x < y, x > y)
+}
+
+func comparison(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+// canCompare reports whether two values can be compared by compareUntyped: they are both strings or both
+// numbers.
+func canCompare(u1, u2 Untyped) bool {
+	_, isString1 := u1.(string)
+	_, isString2 := u2.(string)
+	return isString1 == isString2
+}
+
+func isNumber(u Untyped) bool {
+	k := reflect.ValueOf(u).Kind()
+	return isIntKind(k) || isUintKind(k) || k == reflect.Float32 || k == reflect.Float64
+}
+
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isUintKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
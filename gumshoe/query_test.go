@@ -2,6 +2,7 @@ package gumshoe
 
 import (
 	"testing"
+	"time"
 
 	"github.com/philc/gumshoedb/internal/util"
 
@@ -81,6 +82,46 @@ func TestQuerySums(t *testing.T) {
 	})
 }
 
+func TestQueryMinAndMax(t *testing.T) {
+	db := makeTestDB(func(schema *Schema) {
+		schema.MetricColumns = append(schema.MetricColumns, makeMetricColumn("metric2", "int8"))
+	})
+	defer closeTestDB(db)
+
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "string1", "metric1": 1.0, "metric2": -1.0},
+		{"at": 0.0, "dim1": "string2", "metric1": 2.0, "metric2": 5.0},
+		{"at": hour(1), "dim1": "string2", "metric1": 7.0, "metric2": -4.0},
+	})
+
+	query := &Query{
+		Aggregates: []QueryAggregate{
+			{Type: AggregateMax, Column: "metric1", Name: "max1"},
+			{Type: AggregateMin, Column: "metric2", Name: "min2"},
+			{Type: AggregateMax, Column: "metric2", Name: "max2"},
+		},
+	}
+	results := runQuery(db, query)
+	Assert(t, results, util.DeepConvertibleEquals, []RowMap{
+		{"max1": 7, "min2": -4, "max2": 5, "rowCount": 3},
+	})
+
+	query.Groupings = []QueryGrouping{{Column: "dim1", Name: "dim1"}}
+	results = runQuery(db, query)
+	Assert(t, results, util.DeepEqualsUnordered, []RowMap{
+		{"dim1": "string1", "max1": 1, "min2": -1, "max2": -1, "rowCount": 1},
+		{"dim1": "string2", "max1": 7, "min2": -4, "max2": 5, "rowCount": 2},
+	})
+
+	// With no matching rows, there is no min or max.
+	query.Groupings = nil
+	query.Filters = []QueryFilter{{FilterEqual, "dim1", "none"}}
+	results = runQuery(db, query)
+	Assert(t, results, util.DeepConvertibleEquals, []RowMap{
+		{"max1": nil, "min2": nil, "max2": nil, "rowCount": 0},
+	})
+}
+
 func TestQueryFiltersRowsUsingEqualsFilter(t *testing.T) {
 	db := createTestDBForFilterTests()
 	defer closeTestDB(db)
@@ -156,6 +197,93 @@ func TestQueryFiltersRowsUsingIn(t *testing.T) {
 	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 0)
 }
 
+func TestQueryFiltersRowsUsingPatterns(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "/docs/intro", "metric1": 1.0},
+		{"at": 0.0, "dim1": "/docs/api/query", "metric1": 2.0},
+		{"at": 0.0, "dim1": "/blog/docs", "metric1": 4.0},
+		{"at": 0.0, "dim1": nil, "metric1": 8.0},
+	})
+
+	results := runWithFilter(db, QueryFilter{FilterPrefix, "dim1", "/docs/"})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 3)
+	results = runWithFilter(db, QueryFilter{FilterSuffix, "dim1", "/docs"})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 4)
+	results = runWithFilter(db, QueryFilter{FilterContains, "dim1", "docs"})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 7)
+	results = runWithFilter(db, QueryFilter{FilterRegex, "dim1", "^/docs/[a-z]+$"})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 1)
+
+	// These match zero rows.
+	results = runWithFilter(db, QueryFilter{FilterPrefix, "dim1", "/about"})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 0)
+	// Nil values match no pattern.
+	results = runWithFilter(db, QueryFilter{FilterNot, "", QueryFilter{FilterContains, "dim1", ""}})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 8)
+
+	for _, filter := range []QueryFilter{
+		{FilterRegex, "dim1", "("},
+		{FilterPrefix, "dim1", 1.0},
+		{FilterPrefix, "metric1", "1"},
+		{FilterContains, "at", "1"},
+	} {
+		_, err := db.GetQueryResult(&Query{Filters: []QueryFilter{filter}})
+		Assert(t, err, NotNil)
+	}
+}
+
+func TestQueryFiltersRowsUsingCompoundFilters(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 1.0},
+		{"at": 0.0, "dim1": "b", "metric1": 2.0},
+		{"at": hour(1), "dim1": "a", "metric1": 4.0},
+		{"at": hour(1), "dim1": "c", "metric1": 8.0},
+	})
+	or := func(filters ...QueryFilter) QueryFilter { return QueryFilter{FilterOr, "", filters} }
+	and := func(filters ...QueryFilter) QueryFilter { return QueryFilter{FilterAnd, "", filters} }
+	not := func(filter QueryFilter) QueryFilter { return QueryFilter{FilterNot, "", filter} }
+
+	results := runWithFilter(db, or(QueryFilter{FilterEqual, "dim1", "b"},
+		QueryFilter{FilterGreaterThan, "metric1", 4.0}))
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 10)
+
+	results = runWithFilter(db, not(QueryFilter{FilterIn, "dim1", inList("a", "c")}))
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 2)
+
+	results = runWithFilter(db, or(
+		and(QueryFilter{FilterEqual, "at", 0.0}, QueryFilter{FilterEqual, "dim1", "a"}),
+		not(QueryFilter{FilterLessThan, "metric1", 8.0}),
+	))
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 9)
+
+	results = runWithFilter(db, or())
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 0)
+
+	// Intervals ruled out by the timestamp filters within a compound filter are skipped.
+	query := createQuery()
+	query.Filters = []QueryFilter{
+		or(QueryFilter{FilterEqual, "at", 0.0}, QueryFilter{FilterEqual, "at", 10.0}),
+	}
+	params, err := db.StaticTable.makeScanParams(query)
+	Assert(t, err, IsNil)
+	Assert(t, params.AllTimestampFilterFuncsMatch(time.Unix(0, 0)), IsTrue)
+	Assert(t, params.AllTimestampFilterFuncsMatch(time.Unix(int64(hour(1)), 0)), IsFalse)
+	query.Filters = []QueryFilter{
+		or(QueryFilter{FilterEqual, "at", 0.0}, QueryFilter{FilterEqual, "dim1", "c"}),
+	}
+	params, err = db.StaticTable.makeScanParams(query)
+	Assert(t, err, IsNil)
+	Assert(t, params.AllTimestampFilterFuncsMatch(time.Unix(int64(hour(1)), 0)), IsTrue)
+	Assert(t, runQuery(db, query)[0]["metric1"], util.DeepConvertibleEquals, 11)
+
+	_, err = db.GetQueryResult(&Query{Filters: []QueryFilter{not(QueryFilter{FilterEqual, "bogus", 1.0})}})
+	Assert(t, err, NotNil)
+}
+
 func TestQueryGroupingByAStringColumn(t *testing.T) {
 	db := makeTestDB()
 	defer closeTestDB(db)
@@ -269,8 +397,190 @@ func TestQueryGroupByWithNilValuesSmallDimensionColumn(t *testing.T) {
 	})
 }
 
+func TestQueryGroupByMultipleColumns(t *testing.T) {
+	limit := sliceGroupingSizeLimit
+	defer func() {
+		sliceGroupingSizeLimit = limit
+	}()
+
+	db := makeTestDB(func(schema *Schema) {
+		schema.DimensionColumns = append(schema.DimensionColumns, makeDimensionColumn("dim2", "uint8", false))
+	})
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "dim2": 1.0, "metric1": 1.0},
+		{"at": hour(1), "dim1": "a", "dim2": 1.0, "metric1": 2.0},
+		{"at": 0.0, "dim1": "a", "dim2": 2.0, "metric1": 4.0},
+		{"at": hour(1), "dim1": "b", "dim2": 1.0, "metric1": 8.0},
+		{"at": 0.0, "dim1": nil, "dim2": 1.0, "metric1": 16.0},
+		{"at": 0.0, "dim1": "b", "dim2": nil, "metric1": 32.0},
+	})
+
+	// Check both the slice and map groupings.
+	for _, sliceGroupingSizeLimit = range []int{limit, 0} {
+		query := createQuery()
+		query.Groupings = []QueryGrouping{{Column: "dim1", Name: "dim1"}, {Column: "dim2", Name: "dim2"}}
+		Assert(t, runQuery(db, query), util.DeepEqualsUnordered, []RowMap{
+			{"dim1": "a", "dim2": 1, "metric1": 3, "rowCount": 2},
+			{"dim1": "a", "dim2": 2, "metric1": 4, "rowCount": 1},
+			{"dim1": "b", "dim2": 1, "metric1": 8, "rowCount": 1},
+			{"dim1": nil, "dim2": 1, "metric1": 16, "rowCount": 1},
+			{"dim1": "b", "dim2": nil, "metric1": 32, "rowCount": 1},
+		})
+	}
+
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationHour, "at", "hour"}, {Column: "dim1", Name: "dim1"}}
+	query.Filters = []QueryFilter{{FilterEqual, "dim2", 1.0}}
+	Assert(t, runQuery(db, query), util.DeepEqualsUnordered, []RowMap{
+		{"hour": 0, "dim1": "a", "metric1": 1, "rowCount": 1},
+		{"hour": 0, "dim1": nil, "metric1": 16, "rowCount": 1},
+		{"hour": hour(1), "dim1": "a", "metric1": 2, "rowCount": 1},
+		{"hour": hour(1), "dim1": "b", "metric1": 8, "rowCount": 1},
+	})
+
+	query.Groupings = []QueryGrouping{{Column: "dim1", Name: "x"}, {Column: "dim2", Name: "x"}}
+	_, err := db.GetQueryResult(query)
+	Assert(t, err, NotNil)
+}
+
+func TestQueryGroupBySignedColumns(t *testing.T) {
+	limit := sliceGroupingSizeLimit
+	defer func() {
+		sliceGroupingSizeLimit = limit
+	}()
+
+	db := makeTestDB(func(schema *Schema) {
+		schema.DimensionColumns = []DimensionColumn{
+			makeDimensionColumn("a", "int8", false),
+			makeDimensionColumn("b", "uint8", false),
+			makeDimensionColumn("c", "int16", false),
+		}
+	})
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "a": -5.0, "b": 1.0, "c": -300.0, "metric1": 1.0},
+		{"at": 0.0, "a": -128.0, "b": 0.0, "c": 32767.0, "metric1": 2.0},
+		{"at": 0.0, "a": 127.0, "b": 255.0, "c": -32768.0, "metric1": 4.0},
+		{"at": 0.0, "a": nil, "b": 1.0, "c": 0.0, "metric1": 8.0},
+	})
+
+	// Check both the slice and map groupings.
+	for _, sliceGroupingSizeLimit = range []int{limit, 0} {
+		query := createQuery()
+		query.Groupings = []QueryGrouping{{Column: "a", Name: "a"}, {Column: "b", Name: "b"}}
+		Assert(t, runQuery(db, query), util.DeepEqualsUnordered, []RowMap{
+			{"a": -5, "b": 1, "metric1": 1, "rowCount": 1},
+			{"a": -128, "b": 0, "metric1": 2, "rowCount": 1},
+			{"a": 127, "b": 255, "metric1": 4, "rowCount": 1},
+			{"a": nil, "b": 1, "metric1": 8, "rowCount": 1},
+		})
+
+		query.Groupings = []QueryGrouping{{Column: "c", Name: "c"}}
+		Assert(t, runQuery(db, query), util.DeepEqualsUnordered, []RowMap{
+			{"c": -300, "metric1": 1, "rowCount": 1},
+			{"c": 32767, "metric1": 2, "rowCount": 1},
+			{"c": -32768, "metric1": 4, "rowCount": 1},
+			{"c": 0, "metric1": 8, "rowCount": 1},
+		})
+	}
+}
+
 // Even though a column may be a relatively narrow type, the sum is a larger "big type" as appropriate. For
 // instance, uint8s are summed in a uint64.
+func TestQueryOrderByAndLimit(t *testing.T) {
+	limit := sliceGroupingSizeLimit
+	defer func() {
+		sliceGroupingSizeLimit = limit
+	}()
+
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 1.0},
+		{"at": 0.0, "dim1": "b", "metric1": 8.0},
+		{"at": 0.0, "dim1": "b", "metric1": 2.0},
+		{"at": 0.0, "dim1": "c", "metric1": 4.0},
+		{"at": 0.0, "dim1": "d", "metric1": 16.0},
+		{"at": 0.0, "dim1": nil, "metric1": 3.0},
+	})
+
+	// Check both the slice and map groupings.
+	for _, sliceGroupingSizeLimit = range []int{limit, 0} {
+		query := createQuery()
+		query.Groupings = []QueryGrouping{{Column: "dim1", Name: "dim1"}}
+		query.OrderBy = []QueryOrdering{{Name: "metric1", Descending: true}}
+		query.Limit = 3
+		Assert(t, runQuery(db, query), util.DeepConvertibleEquals, []RowMap{
+			{"dim1": "d", "metric1": 16, "rowCount": 1},
+			{"dim1": "b", "metric1": 10, "rowCount": 2},
+			{"dim1": "c", "metric1": 4, "rowCount": 1},
+		})
+
+		query.OrderBy = []QueryOrdering{{Name: "dim1"}}
+		query.Limit = 0
+		results := runQuery(db, query)
+		Assert(t, len(results), Equals, 5)
+		for i, dim1 := range []Untyped{nil, "a", "b", "c", "d"} {
+			Assert(t, results[i]["dim1"], Equals, dim1)
+		}
+
+		query.OrderBy = []QueryOrdering{{Name: "rowCount", Descending: true}}
+		query.Limit = 1
+		Assert(t, runQuery(db, query), util.DeepConvertibleEquals, []RowMap{
+			{"dim1": "b", "metric1": 10, "rowCount": 2},
+		})
+	}
+
+	query := createQuery()
+	query.OrderBy = []QueryOrdering{{Name: "dim1"}}
+	_, err := db.GetQueryResult(query)
+	Assert(t, err, NotNil)
+	query = createQuery()
+	query.Limit = -1
+	_, err = db.GetQueryResult(query)
+	Assert(t, err, NotNil)
+}
+
+func TestQueryHaving(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 1.0},
+		{"at": 0.0, "dim1": "b", "metric1": 8.0},
+		{"at": 0.0, "dim1": "b", "metric1": 2.0},
+		{"at": 0.0, "dim1": "c", "metric1": 4.0},
+		{"at": 0.0, "dim1": "d", "metric1": 16.0},
+	})
+
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{Column: "dim1", Name: "dim1"}}
+	query.Having = []QueryFilter{{FilterGreaterThan, "metric1", 3.0}}
+	Assert(t, runQuery(db, query), util.DeepEqualsUnordered, []RowMap{
+		{"dim1": "b", "metric1": 10, "rowCount": 2},
+		{"dim1": "c", "metric1": 4, "rowCount": 1},
+		{"dim1": "d", "metric1": 16, "rowCount": 1},
+	})
+
+	query.Having = append(query.Having, QueryFilter{FilterIn, "dim1", []interface{}{"a", "c", "d"}})
+	query.OrderBy = []QueryOrdering{{Name: "metric1"}}
+	query.Limit = 1
+	// The limit applies to the results which pass the filters.
+	Assert(t, runQuery(db, query), util.DeepConvertibleEquals, []RowMap{
+		{"dim1": "c", "metric1": 4, "rowCount": 1},
+	})
+
+	query = createQuery()
+	query.Having = []QueryFilter{{FilterLessThan, "rowCount", 5.0}}
+	Assert(t, len(runQuery(db, query)), Equals, 0)
+	query.Having = []QueryFilter{{FilterLessThan, "dim1", 5.0}}
+	_, err := db.GetQueryResult(query)
+	Assert(t, err, NotNil)
+	query.Having = []QueryFilter{{FilterIn, "metric1", 5.0}}
+	_, err = db.GetQueryResult(query)
+	Assert(t, err, NotNil)
+}
+
 func TestQuerySumsOverflowIndividualColumnTypes(t *testing.T) {
 	db := makeTestDB()
 	defer closeTestDB(db)
@@ -0,0 +1,98 @@
+// Replacing intervals from a batch re-import.
+//
+// Inserted rows are always added to the data already in the DB: metrics are summed into existing rows with
+// the same dimensions. When the upstream data for some intervals is corrected, the intervals must instead be
+// overwritten. Replace takes a batch of rows which are the complete new contents of a range of intervals. The
+// rows are put into the MemTable (after discarding any pending rows for those intervals) and the intervals
+// are marked as replaced, so that the flush which immediately follows drops the old static intervals and
+// writes the new rows out on their own. The new intervals are swapped into the StaticTable together with the
+// rest of the flush, so queries see either all of the old data or all of the new.
+
+package gumshoe
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A WriteError is returned by Replace and Delete when a valid request failed while its changes were being
+// written out (for instance, because the disk is full). As with an error from Flush, the state of the DB is
+// not well-defined afterwards. Any other error means that the request was rejected without any effect.
+type WriteError struct {
+	Err error
+}
+
+func (e *WriteError) Error() string { return e.Err.Error() }
+
+type replaceRequest struct {
+	TimeRange TimeRange
+	Rows      []UnpackedRow
+	Err       chan error
+}
+
+// Replace makes rows the complete contents of the intervals in timeRange, discarding all their existing
+// rows (including pending inserts). The time range must be bounded and aligned to the interval duration, and
+// every row must fall within it. Intervals in the range for which there are no rows are dropped.
+//
+// Replace flushes the DB and returns once the new intervals have replaced the old ones. (The rows are not
+// written to the insertion log, since they are persisted by the flush.) A failure of the flush is returned
+// as a *WriteError.
+func (db *DB) Replace(timeRange TimeRange, rows []RowMap) error {
+	unpacked := make([]UnpackedRow, len(rows))
+	for i, row := range rows {
+		unpacked[i] = UnpackedRow{row, 1}
+	}
+	req := &replaceRequest{TimeRange: timeRange, Rows: unpacked, Err: make(chan error)}
+	db.replacements <- req
+	return <-req.Err
+}
+
+// replaceRows carries out a replaceRequest. This should only be called by the inserter goroutine.
+func (db *DB) replaceRows(req *replaceRequest) error {
+	start, end := req.TimeRange.Start, req.TimeRange.End
+	if start.IsZero() || end.IsZero() || !start.Before(end) {
+		return errors.New("replacing intervals requires a bounded time range")
+	}
+	if err := db.checkTimeRangeCoversIntervals(req.TimeRange, "replace"); err != nil {
+		return err
+	}
+
+	// Check all the rows before touching the MemTable so that a bad row doesn't leave a partial replacement.
+	rows := make([]*insertionRow, len(req.Rows))
+	for i, unpackedRow := range req.Rows {
+		row, err := db.serializeRowMap(unpackedRow.RowMap)
+		if err != nil {
+			return err
+		}
+		if row.Timestamp.Before(start) || !row.Timestamp.Before(end) {
+			return fmt.Errorf("row timestamp %s is outside the time range being replaced", row.Timestamp)
+		}
+		rows[i] = row
+	}
+
+	inRange := func(t time.Time) bool { return !t.Before(start) && t.Before(end) }
+	for t := range db.memTable.Intervals {
+		if inRange(t) {
+			delete(db.memTable.Intervals, t)
+		}
+	}
+	for t := range db.StaticTable.Intervals {
+		if inRange(t) {
+			db.memTable.Replaced[t] = true
+		}
+	}
+	for i, row := range rows {
+		db.insertSerializedRow(row, req.Rows[i].Count)
+	}
+	for t := range db.memTable.Intervals {
+		if inRange(t) {
+			db.memTable.Replaced[t] = true
+		}
+	}
+	Log.Printf("Replacing the intervals from %s to %s with %d rows", start, end, len(rows))
+	if err := db.flush(false); err != nil {
+		return &WriteError{err}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package gumshoe
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestReplaceOverwritesIntervals(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+
+	insertRows(db, []RowMap{
+		{"at": hour(0), "dim1": "a", "metric1": 1.0},
+		{"at": hour(1), "dim1": "a", "metric1": 2.0},
+		{"at": hour(1), "dim1": "b", "metric1": 4.0},
+		{"at": hour(2), "dim1": "a", "metric1": 8.0},
+		{"at": hour(3), "dim1": "a", "metric1": 16.0},
+	})
+	// Pending rows for the replaced intervals are discarded.
+	if err := db.Insert([]RowMap{{"at": hour(1), "dim1": "c", "metric1": 32.0}}); err != nil {
+		t.Fatal(err)
+	}
+
+	timeRange := TimeRange{Start: time.Unix(int64(hour(1)), 0), End: time.Unix(int64(hour(3)), 0)}
+	err := db.Replace(timeRange, []RowMap{
+		{"at": hour(1), "dim1": "a", "metric1": 64.0},
+		{"at": hour(1), "dim1": "a", "metric1": 128.0},
+	})
+	Assert(t, err, IsNil)
+	// The interval at hour 2 got no new rows, so it is gone.
+	expected := []UnpackedRow{
+		{RowMap: RowMap{"at": hour(0), "dim1": "a", "metric1": 1}, Count: 1},
+		{RowMap: RowMap{"at": hour(1), "dim1": "a", "metric1": 192}, Count: 2},
+		{RowMap: RowMap{"at": hour(3), "dim1": "a", "metric1": 16}, Count: 1},
+	}
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, expected)
+	Assert(t, len(segmentFiles(t, db.Dir)), Equals, 3)
+
+	// Later inserts are added to the new data as usual.
+	insertRow(db, RowMap{"at": hour(1), "dim1": "a", "metric1": 256.0})
+	expected[1] = UnpackedRow{RowMap: RowMap{"at": hour(1), "dim1": "a", "metric1": 448}, Count: 3}
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, expected)
+
+	db = reopenTestDB(db)
+	defer closeTestDB(db)
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, expected)
+}
+
+func TestReplaceRejectsBadRequests(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+
+	insertRow(db, RowMap{"at": hour(0), "dim1": "a", "metric1": 1.0})
+	hour0 := time.Unix(int64(hour(0)), 0)
+	hour1 := time.Unix(int64(hour(1)), 0)
+	for _, timeRange := range []TimeRange{
+		{Start: hour0},
+		{Start: hour1, End: hour0},
+		{Start: hour0, End: hour1.Add(time.Minute)},
+	} {
+		Assert(t, db.Replace(timeRange, nil), NotNil)
+	}
+	// Rows outside the range
+	Assert(t, db.Replace(TimeRange{hour1, hour1.Add(time.Hour)}, []RowMap{{"at": hour(0)}}), NotNil)
+	// Bad rows
+	Assert(t, db.Replace(TimeRange{hour0, hour1}, []RowMap{{"at": hour(0), "bogus": 1.0}}), NotNil)
+
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": hour(0), "dim1": "a", "metric1": 1}, Count: 1},
+	})
+}
+
+func TestReplaceWithIntervalDimensionTables(t *testing.T) {
+	db := makeIntervalDimensionTablesTestDB()
+	defer closeTestDB(db)
+
+	insertRows(db, []RowMap{
+		{"at": hour(0), "dim1": "a", "metric1": 1.0},
+		{"at": hour(0), "dim1": "b", "metric1": 2.0},
+	})
+	err := db.Replace(TimeRange{time.Unix(0, 0), time.Unix(int64(hour(1)), 0)}, []RowMap{
+		{"at": hour(0), "dim1": "c", "metric1": 4.0},
+		{"at": hour(0), "dim1": "b", "metric1": 8.0},
+	})
+	Assert(t, err, IsNil)
+	Assert(t, intervalDimensionValues(db), DeepEquals, map[time.Time][]string{time.Unix(0, 0): {"b", "c"}})
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": hour(0), "dim1": "b", "metric1": 8}, Count: 1},
+		{RowMap: RowMap{"at": hour(0), "dim1": "c", "metric1": 4}, Count: 1},
+	})
+}
@@ -36,9 +36,18 @@ func (db *DB) GetDimensionTables() map[string][]string {
 	resp := db.MakeRequest()
 	defer resp.Done()
 
+	var values [][]string
+	if db.IntervalDimensionTables {
+		values = resp.StaticTable.allDimensionTableValues()
+	}
 	results := make(map[string][]string)
 	for i, col := range db.DimensionColumns {
-		if col.String {
+		if !col.String {
+			continue
+		}
+		if db.IntervalDimensionTables {
+			results[col.Name] = values[i]
+		} else {
 			results[col.Name] = resp.StaticTable.DimensionTables[i].Values
 		}
 	}
@@ -63,6 +72,13 @@ func (db *DB) GetOldestIntervalTimestamp() time.Time {
 	return oldest
 }
 
+// GetCorruptedIntervals returns the intervals known to have failed checksum verification.
+func (db *DB) GetCorruptedIntervals() []CorruptedInterval {
+	resp := db.MakeRequest()
+	defer resp.Done()
+	return resp.StaticTable.CorruptedIntervals()
+}
+
 func (db *DB) GetDebugStats() *StaticTableStats {
 	resp := db.MakeRequest()
 	defer resp.Done()
@@ -84,15 +100,26 @@ func (db *DB) GetDebugRows() []UnpackedRow {
 
 	var results []UnpackedRow
 	for _, interval := range resp.StaticTable.Intervals.sorted() {
-		for _, segment := range interval.Segments {
-			for i := 0; i < len(segment.Bytes); i += db.RowSize {
-				row := RowBytes(segment.Bytes[i : i+db.RowSize])
-				unpacked := db.DeserializeRow(row)
-				// The RowMap doesn't have an attached timestamp column yet.
-				unpacked.RowMap[db.TimestampColumn.Name] = uint32(interval.Start.Unix())
-				results = append(results, unpacked)
-				if len(results) == max {
-					return results
+		if interval.Verify(db.Schema) != nil {
+			continue
+		}
+		dimTables := resp.StaticTable.DimensionTablesForInterval(interval)
+		for _, run := range interval.AllRuns() {
+			for _, segment := range run.Segments {
+				rows, err := db.IntervalSegmentRows(run, segment)
+				if err != nil {
+					Log.Printf("Debug rows: cannot read segment of interval at %s: %s", interval.Start, err)
+					continue
+				}
+				for i := 0; i < len(rows); i += db.RowSize {
+					row := RowBytes(rows[i : i+db.RowSize])
+					unpacked := db.deserializeRow(row, dimTables)
+					// The RowMap doesn't have an attached timestamp column yet.
+					unpacked.RowMap[db.TimestampColumn.Name] = uint32(interval.Start.Unix())
+					results = append(results, unpacked)
+					if len(results) == max {
+						return results
+					}
 				}
 			}
 		}
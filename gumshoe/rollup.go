@@ -0,0 +1,220 @@
+package gumshoe
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A RollupPolicy describes how old intervals are merged into coarser ones to save space. During a flush,
+// intervals are grouped into buckets of the policy's IntervalDuration (aligned to multiples of that duration
+// since the zero time, like time.Truncate) and once an entire bucket is older than After, its intervals are
+// rolled up into a single interval spanning the bucket.
+//
+// Rolled-up rows keep only the start of their interval as their timestamp, so timestamp filters and groupings
+// only see that granularity for old data. DropDimensions lists dimension columns which are set to nil in
+// rolled-up rows, which allows many more rows to be collapsed together.
+type RollupPolicy struct {
+	After            time.Duration
+	IntervalDuration time.Duration
+	DropDimensions   []string
+}
+
+// checkRollupPolicies validates s.Rollups. The policies must be given in order of increasing After and
+// IntervalDuration, and each duration must be a multiple of the previous one (and of the schema's
+// IntervalDuration).
+func (s *Schema) checkRollupPolicies() error {
+	dimensions := make(map[string]bool)
+	for _, col := range s.DimensionColumns {
+		dimensions[col.Name] = true
+	}
+	prevAfter := time.Duration(0)
+	prevDuration := s.IntervalDuration
+	for _, policy := range s.Rollups {
+		if policy.After <= prevAfter {
+			return fmt.Errorf("rollup policies must have increasing 'after' durations (got %s)", policy.After)
+		}
+		if policy.IntervalDuration <= prevDuration || policy.IntervalDuration%prevDuration != 0 {
+			return fmt.Errorf("rollup interval duration %s is not a larger multiple of %s",
+				policy.IntervalDuration, prevDuration)
+		}
+		for _, name := range policy.DropDimensions {
+			if !dimensions[name] {
+				return fmt.Errorf("rollup policy drops %q, which is not a dimension column", name)
+			}
+		}
+		prevAfter = policy.After
+		prevDuration = policy.IntervalDuration
+	}
+	return nil
+}
+
+// rollupTarget returns the bounds of the interval into which data starting at t should be rolled up, along
+// with the dimensions to drop. If no rollup policy applies, ok is false.
+func (db *DB) rollupTarget(t time.Time) (start, end time.Time, dropDimensions []int, ok bool) {
+	for _, policy := range db.Rollups {
+		bucketStart := t.Truncate(policy.IntervalDuration)
+		bucketEnd := bucketStart.Add(policy.IntervalDuration)
+		if time.Since(bucketEnd) <= policy.After {
+			break
+		}
+		start, end, ok = bucketStart, bucketEnd, true
+		// Dimensions dropped by finer policies stay dropped.
+		for _, name := range policy.DropDimensions {
+			dropDimensions = append(dropDimensions, db.DimensionNameToIndex[name])
+		}
+	}
+	return start, end, dropDimensions, ok
+}
+
+type rollupGroup struct {
+	Start, End     time.Time
+	DropDimensions []int
+	MemKeys        []time.Time
+	StaticKeys     []time.Time
+}
+
+// rollupGroups groups the given (sorted) mem and static interval keys according to the rollup policies. It
+// returns the groups, keyed by their start times, and the remaining (sorted) keys which are not part of any
+// rollup.
+func (db *DB) rollupGroups(memKeys, staticKeys []time.Time) (groups map[time.Time]*rollupGroup,
+	remainingMemKeys, remainingStaticKeys []time.Time) {
+
+	groups = make(map[time.Time]*rollupGroup)
+	getGroup := func(t time.Time) *rollupGroup {
+		start, end, dropDimensions, ok := db.rollupTarget(t)
+		if !ok {
+			return nil
+		}
+		group, ok := groups[start]
+		if !ok {
+			group = &rollupGroup{Start: start, End: end, DropDimensions: dropDimensions}
+			groups[start] = group
+		}
+		return group
+	}
+	for _, key := range memKeys {
+		if group := getGroup(key); group != nil {
+			group.MemKeys = append(group.MemKeys, key)
+		} else {
+			remainingMemKeys = append(remainingMemKeys, key)
+		}
+	}
+	for _, key := range staticKeys {
+		if group := getGroup(key); group != nil {
+			group.StaticKeys = append(group.StaticKeys, key)
+		} else {
+			remainingStaticKeys = append(remainingStaticKeys, key)
+		}
+	}
+	return groups, remainingMemKeys, remainingStaticKeys
+}
+
+// rolledUp reports whether group consists of a single static interval in intervals which already spans the
+// group.
+func (g *rollupGroup) rolledUp(intervals IntervalMap) bool {
+	if len(g.MemKeys) > 0 || len(g.StaticKeys) != 1 {
+		return false
+	}
+	interval := intervals[g.StaticKeys[0]]
+	return interval.Start.Equal(g.Start) && interval.End.Equal(g.End)
+}
+
+// verify returns an error if any of the static intervals of g (taken from intervals) is corrupted.
+func (g *rollupGroup) verify(s *Schema, intervals IntervalMap) error {
+	for _, key := range g.StaticKeys {
+		if err := intervals[key].Verify(s); err != nil {
+			return fmt.Errorf("interval at %s is corrupted: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// rollUpIntervals finds the mem and static intervals which should be rolled up according to the rollup
+// policies and writes out the rolled-up intervals. It returns the new intervals, the static intervals which
+// they replace, and the remaining (sorted) mem and static keys which are not part of any rollup.
+//
+// With background compaction, groups of only static intervals are left for the compactor (see
+// compaction.go), so their keys are returned with the remaining static keys.
+func (db *DB) rollUpIntervals(memKeys, staticKeys []time.Time) (intervals map[time.Time]*Interval,
+	intervalsForCleanup []*Interval, remainingMemKeys, remainingStaticKeys []time.Time, err error) {
+
+	var groups map[time.Time]*rollupGroup
+	groups, remainingMemKeys, remainingStaticKeys = db.rollupGroups(memKeys, staticKeys)
+	intervals = make(map[time.Time]*Interval)
+	for start, group := range groups {
+		if group.rolledUp(db.StaticTable.Intervals) {
+			intervals[start] = db.StaticTable.Intervals[group.StaticKeys[0]]
+			continue
+		}
+		// A group with a corrupted interval isn't rolled up, so that the corrupted interval is kept as it is.
+		if err := group.verify(db.Schema, db.StaticTable.Intervals); err != nil {
+			Log.Printf("Flush: not rolling up intervals at %s: %s", start, err)
+			remainingMemKeys = append(remainingMemKeys, group.MemKeys...)
+			remainingStaticKeys = append(remainingStaticKeys, group.StaticKeys...)
+			continue
+		}
+		if len(group.MemKeys) == 0 && db.CompactionParallelism > 0 {
+			remainingStaticKeys = append(remainingStaticKeys, group.StaticKeys...)
+			continue
+		}
+		var groupIntervals []*Interval
+		for _, key := range group.StaticKeys {
+			groupIntervals = append(groupIntervals, db.StaticTable.Intervals[key])
+		}
+		generation := db.nextGeneration(group.Start, groupIntervals...)
+		interval, err := db.writeRollupInterval(group, db.StaticTable.Intervals, db.memTable.Intervals,
+			generation)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("cannot write rolled-up interval: %s", err)
+		}
+		intervals[start] = interval
+		for _, key := range group.StaticKeys {
+			intervalsForCleanup = append(intervalsForCleanup, db.StaticTable.Intervals[key])
+		}
+	}
+	if len(intervals) > 0 {
+		Log.Printf("Flush: rolled up %d intervals", len(intervals))
+	}
+	sort.Sort(times(remainingMemKeys))
+	sort.Sort(times(remainingStaticKeys))
+	return intervals, intervalsForCleanup, remainingMemKeys, remainingStaticKeys, nil
+}
+
+// writeRollupInterval combines the rows of all the intervals in group (dropping dimensions as necessary),
+// which are taken from staticIntervals and memIntervals, and writes them to a new interval with the given
+// generation.
+func (db *DB) writeRollupInterval(group *rollupGroup, staticIntervals IntervalMap,
+	memIntervals map[time.Time]*MemInterval, generation int) (*Interval, error) {
+
+	var runs []*Interval
+	for _, key := range group.StaticKeys {
+		interval := staticIntervals[key]
+		if err := interval.Verify(db.Schema); err != nil {
+			return nil, fmt.Errorf("cannot roll up corrupted interval at %s: %s", interval.Start, err)
+		}
+		runs = append(runs, interval.AllRuns()...)
+	}
+	var groupMemIntervals []*MemInterval
+	for _, key := range group.MemKeys {
+		groupMemIntervals = append(groupMemIntervals, memIntervals[key])
+	}
+	dropDimensions := func(dimensions DimensionBytes) {
+		for _, index := range group.DropDimensions {
+			dimensions.setNil(index)
+			offset := db.DimensionOffsets[index]
+			for i := offset; i < offset+db.DimensionColumns[index].Width; i++ {
+				dimensions[i] = 0
+			}
+		}
+	}
+	return db.writeTransformedInterval(runs, groupMemIntervals, group.Start, group.End, generation,
+		nil, dropDimensions, nil)
+}
+
+// mergeIntervalMaps adds the intervals from src to dst.
+func mergeIntervalMaps(dst, src map[time.Time]*Interval) {
+	for t, interval := range src {
+		dst[t] = interval
+	}
+}
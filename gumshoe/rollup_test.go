@@ -0,0 +1,79 @@
+package gumshoe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func makeRollupTestDB() *DB {
+	return makeTestDB(func(schema *Schema) {
+		schema.DimensionColumns = append(schema.DimensionColumns, makeDimensionColumn("dim2", "uint16", false))
+		schema.Rollups = []RollupPolicy{
+			{After: 48 * time.Hour, IntervalDuration: 24 * time.Hour, DropDimensions: []string{"dim2"}},
+		}
+	})
+}
+
+func TestOldIntervalsAreRolledUp(t *testing.T) {
+	db := makeRollupTestDB()
+	defer closeTestDB(db)
+
+	day := time.Now().Add(-5 * 24 * time.Hour).Truncate(24 * time.Hour)
+	at := func(hours int) float64 { return float64(day.Add(time.Duration(hours) * time.Hour).Unix()) }
+	recent := float64(time.Now().Unix())
+
+	insertRows(db, []RowMap{
+		{"at": at(1), "dim1": "a", "dim2": 1.0, "metric1": 1.0},
+		{"at": at(2), "dim1": "a", "dim2": 2.0, "metric1": 2.0},
+		{"at": at(3), "dim1": "b", "dim2": 3.0, "metric1": 4.0},
+		{"at": recent, "dim1": "a", "dim2": 1.0, "metric1": 8.0},
+	})
+	// More rows for the same day are merged into the rolled-up interval.
+	insertRows(db, []RowMap{{"at": at(23), "dim1": "b", "dim2": 5.0, "metric1": 16.0}})
+
+	dayStart := float64(day.Unix())
+	recentStart := float64(time.Unix(int64(recent), 0).Truncate(time.Hour).Unix())
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": dayStart, "dim1": "a", "dim2": nil, "metric1": uint32(3)}, Count: 2},
+		{RowMap: RowMap{"at": dayStart, "dim1": "b", "dim2": nil, "metric1": uint32(20)}, Count: 2},
+		{RowMap: RowMap{"at": recentStart, "dim1": "a", "dim2": uint16(1), "metric1": uint32(8)}, Count: 1},
+	})
+
+	resp := db.MakeRequest()
+	Assert(t, len(resp.StaticTable.Intervals), Equals, 2)
+	for _, interval := range resp.StaticTable.Intervals {
+		if interval.Start.Equal(day) {
+			Assert(t, interval.End, Equals, day.Add(24*time.Hour))
+			Assert(t, interval.Generation, Equals, 1)
+		}
+	}
+	resp.Done()
+
+	// Queries work across intervals of both granularities.
+	query := createQuery()
+	Assert(t, runQuery(db, query)[0]["metric1"], util.DeepConvertibleEquals, 31)
+	query.Filters = []QueryFilter{{FilterEqual, "dim1", "b"}}
+	Assert(t, runQuery(db, query)[0]["metric1"], util.DeepConvertibleEquals, 20)
+	query.Filters = []QueryFilter{{FilterLessThan, "at", recentStart}}
+	Assert(t, runQuery(db, query)[0]["metric1"], util.DeepConvertibleEquals, 23)
+}
+
+func TestRollupPoliciesAreValidated(t *testing.T) {
+	for _, rollups := range [][]RollupPolicy{
+		{{After: time.Hour, IntervalDuration: 90 * time.Minute}},
+		{{After: time.Hour, IntervalDuration: 24 * time.Hour, DropDimensions: []string{"foo"}}},
+		{
+			{After: 48 * time.Hour, IntervalDuration: 24 * time.Hour},
+			{After: 24 * time.Hour, IntervalDuration: 48 * time.Hour},
+		},
+	} {
+		schema := schemaFixture()
+		schema.Rollups = rollups
+		_, err := NewDB(schema)
+		Assert(t, err, NotNil)
+	}
+}
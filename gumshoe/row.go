@@ -10,7 +10,7 @@ import (
 	"unsafe"
 )
 
-// Untyped is some gumshoeDB value (numeric or string).
+// Untyped is some gumshoeDB value (numeric, string, or HyperLogLog).
 type Untyped interface{}
 
 // A RowMap is the unpacked form of a gumshoeDB row with an implicit count of 1.
@@ -76,7 +76,11 @@ func (d DimensionBytes) IsNil(index int) bool { return d[index>>3]&(1<<byte(inde
 // count retrieves a row's count (the number of collapsed logical rows).
 func (r RowBytes) count(s *Schema) uint32 { return *(*uint32)(unsafe.Pointer(&r[0])) }
 
-func (db *DB) setDimensionValue(dimensions DimensionBytes, index int, value Untyped) error {
+// setDimensionValue sets the value of dimension column index for a row in the interval starting at
+// intervalStart.
+func (db *DB) setDimensionValue(dimensions DimensionBytes, index int, value Untyped,
+	intervalStart time.Time) error {
+
 	column := db.DimensionColumns[index]
 
 	if value == nil {
@@ -89,12 +93,13 @@ func (db *DB) setDimensionValue(dimensions DimensionBytes, index int, value Unty
 		if !ok {
 			return fmt.Errorf("expected string value for dimension %s", column.Name)
 		}
-		dimValueIndex, ok := db.StaticTable.DimensionTables[index].Get(stringValue)
+		staticDimTables, memDimTables := db.insertionDimensionTables(intervalStart)
+		dimValueIndex, ok := staticDimTables[index].Get(stringValue)
 		if !ok {
-			dimValueIndex, _ = db.memTable.DimensionTables[index].GetAndMaybeSet(stringValue)
+			dimValueIndex, _ = memDimTables[index].GetAndMaybeSet(stringValue)
 			// The index in a MemTable's dimension table must be offset by the size of the StaticTable's dimension
 			// table (with which it will be later combined).
-			dimValueIndex += uint32(len(db.StaticTable.DimensionTables[index].Values))
+			dimValueIndex += uint32(len(staticDimTables[index].Values))
 		}
 		if float64(dimValueIndex) > typeMaxes[column.Type] {
 			return fmt.Errorf("adding a new value (%v) to dimension %s overflows the dimension table",
@@ -118,6 +123,15 @@ func (db *DB) setDimensionValue(dimensions DimensionBytes, index int, value Unty
 func (db *DB) setMetricValue(metrics MetricBytes, index int, value Untyped) error {
 	column := db.MetricColumns[index]
 
+	if column.Type == TypeHyperLogLog {
+		offset := db.MetricOffsets[index]
+		sketch := HyperLogLog(metrics[offset : offset+hllRegisters])
+		if err := sketch.addValue(value); err != nil {
+			return fmt.Errorf("bad value for metric %s: %s", column.Name, err)
+		}
+		return nil
+	}
+
 	if value == nil {
 		setRowValue(unsafe.Pointer(&metrics[db.MetricOffsets[index]]), column.Type, 0)
 		return nil
@@ -147,6 +161,7 @@ func (db *DB) serializeRowMap(rowMap RowMap) (*insertionRow, error) {
 	if !ok {
 		return nil, fmt.Errorf("timestamp column (%q) must have a numeric value", timestampColumnName)
 	}
+	intervalStart := time.Unix(int64(timestampUnix), 0).Truncate(db.IntervalDuration)
 	missingColumns := 0
 	dimensions := make(DimensionBytes, db.DimensionWidth)
 	for i, dimCol := range db.DimensionColumns {
@@ -155,7 +170,7 @@ func (db *DB) serializeRowMap(rowMap RowMap) (*insertionRow, error) {
 			missingColumns++
 			value = nil
 		}
-		if err := db.setDimensionValue(dimensions, i, value); err != nil {
+		if err := db.setDimensionValue(dimensions, i, value, intervalStart); err != nil {
 			return nil, err
 		}
 	}
@@ -164,7 +179,7 @@ func (db *DB) serializeRowMap(rowMap RowMap) (*insertionRow, error) {
 		value, ok := rowMap[metricCol.Name]
 		if !ok {
 			missingColumns++
-			value = 0.0
+			value = nil
 		}
 		if err := db.setMetricValue(metrics, i, value); err != nil {
 			return nil, err
@@ -192,6 +207,16 @@ type UnpackedRow struct {
 // DeserializeRow unpacks a serialized Row, including nil and string dimensions. Note that the timestamp
 // column is not present in the resulting RowMap.
 func (db *DB) DeserializeRow(row RowBytes) UnpackedRow {
+	return db.deserializeRow(row, db.StaticTable.DimensionTables)
+}
+
+// DeserializeIntervalRow is like DeserializeRow, but for a row of interval (which may have its own dimension
+// tables).
+func (db *DB) DeserializeIntervalRow(interval *Interval, row RowBytes) UnpackedRow {
+	return db.deserializeRow(row, db.StaticTable.DimensionTablesForInterval(interval))
+}
+
+func (db *DB) deserializeRow(row RowBytes, dimTables []*DimensionTable) UnpackedRow {
 	count := int(row.count(db.Schema))
 	rowMap := make(RowMap)
 
@@ -206,7 +231,7 @@ func (db *DB) DeserializeRow(row RowBytes) UnpackedRow {
 		value := NumericCellValue(cell, col.Type)
 		if col.String {
 			dimensionIndex := UntypedToInt(value)
-			value = db.StaticTable.DimensionTables[i].Values[dimensionIndex]
+			value = dimTables[i].Values[dimensionIndex]
 		}
 		rowMap[name] = value
 	}
@@ -214,9 +239,14 @@ func (db *DB) DeserializeRow(row RowBytes) UnpackedRow {
 	metrics := MetricBytes(row[db.MetricStartOffset:])
 	for i, col := range db.MetricColumns {
 		name := col.Name
-		cell := unsafe.Pointer(&metrics[db.MetricOffsets[i]])
-		value := NumericCellValue(cell, col.Type)
-		rowMap[name] = value
+		offset := db.MetricOffsets[i]
+		if col.Type == TypeHyperLogLog {
+			sketch := NewHyperLogLog()
+			copy(sketch, metrics[offset:])
+			rowMap[name] = sketch
+			continue
+		}
+		rowMap[name] = NumericCellValue(unsafe.Pointer(&metrics[offset]), col.Type)
 	}
 
 	return UnpackedRow{RowMap: rowMap, Count: count}
@@ -11,7 +11,7 @@ import (
 func TestSerializeRowMap(t *testing.T) {
 	db := &DB{
 		Schema: &Schema{
-			TimestampColumn:  Column(makeMetricColumn("at", "uint32")),
+			TimestampColumn:  makeMetricColumn("at", "uint32").Column,
 			DimensionColumns: []DimensionColumn{makeDimensionColumn("dim1", "uint8", false)},
 			MetricColumns:    []MetricColumn{makeMetricColumn("metric1", "uint8")},
 		},
@@ -1,6 +1,7 @@
 package gumshoe
 
 import (
+	"encoding/json"
 	"fmt"
 	"runtime"
 	"time"
@@ -14,14 +15,59 @@ type Column struct {
 	Width int
 }
 
-type MetricColumn Column
+type MetricColumn struct {
+	Column
+	Merge MergeFunc `json:",omitempty"`
+}
 
 func MakeMetricColumn(name, typeString string) (MetricColumn, error) {
 	typ, ok := NameToType[typeString]
 	if !ok {
 		return MetricColumn{}, fmt.Errorf("bad type: %s", typeString)
 	}
-	return MetricColumn{Type: typ, Name: name, Width: typeWidths[typ]}, nil
+	return MetricColumn{Column: Column{Type: typ, Name: name, Width: typeWidths[typ]}}, nil
+}
+
+// MergeFunc is how the values of a metric column are combined when rows collapse together.
+type MergeFunc int
+
+const (
+	MergeSum MergeFunc = iota
+	MergeMin
+	MergeMax
+)
+
+var mergeFuncNames = []string{
+	MergeSum: "sum",
+	MergeMin: "min",
+	MergeMax: "max",
+}
+
+// ParseMergeFunc returns the MergeFunc with the given name ("sum", "min", or "max").
+func ParseMergeFunc(name string) (MergeFunc, error) {
+	for i, mergeName := range mergeFuncNames {
+		if name == mergeName {
+			return MergeFunc(i), nil
+		}
+	}
+	return 0, fmt.Errorf("bad merge function: %q", name)
+}
+
+func (f MergeFunc) String() string { return mergeFuncNames[f] }
+
+func (f MergeFunc) MarshalJSON() ([]byte, error) { return []byte(fmt.Sprintf("%q", f.String())), nil }
+
+func (f *MergeFunc) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	merge, err := ParseMergeFunc(name)
+	if err != nil {
+		return err
+	}
+	*f = merge
+	return nil
 }
 
 type DimensionColumn struct {
@@ -31,7 +77,7 @@ type DimensionColumn struct {
 
 func MakeDimensionColumn(name, typeString string, isString bool) (DimensionColumn, error) {
 	typ, ok := NameToType[typeString]
-	if !ok {
+	if !ok || typ == TypeHyperLogLog {
 		return DimensionColumn{}, fmt.Errorf("bad type: %s", typeString)
 	}
 	return DimensionColumn{
@@ -41,11 +87,17 @@ func MakeDimensionColumn(name, typeString string, isString bool) (DimensionColum
 }
 
 type Schema struct {
-	TimestampColumn  Column
-	DimensionColumns []DimensionColumn
-	MetricColumns    []MetricColumn
-	SegmentSize      int
-	IntervalDuration time.Duration
+	TimestampColumn    Column
+	DimensionColumns   []DimensionColumn
+	MetricColumns      []MetricColumn
+	SegmentSize        int
+	IntervalDuration   time.Duration
+	SegmentFormat      SegmentFormat
+	SegmentCompression SegmentCompression
+	SortKey            []string `json:",omitempty"` // Names of dimension columns by which to order rows
+	// IntervalDimensionTables indicates that each interval has its own dimension tables for the string columns
+	// rather than all intervals sharing one set of tables.
+	IntervalDimensionTables bool `json:",omitempty"`
 
 	DiskBacked bool   `json:"-"`
 	Dir        string `json:"-"` // Path to persist a DB
@@ -57,6 +109,7 @@ type Schema struct {
 	// All other fields are reconstructed from persisted fields
 	DimensionNameToIndex map[string]int `json:"-"`
 	MetricNameToIndex    map[string]int `json:"-"`
+	SortKeyIndexes       []int          `json:"-"` // Dimension indexes corresponding to SortKey
 	// Row is: count | nil bytes | dim1 | dim2 | ... | dimN | metric1 | metric2 | ... | metricN
 	//                <----------- DimensionBytes ----------><--------- MetricBytes ---------->
 	DimensionStartOffset int   `json:"-"`
@@ -67,17 +120,43 @@ type Schema struct {
 	MetricWidth          int   `json:"-"`
 	NilBytes             int   `json:"-"`
 	RowSize              int   `json:"-"`
+
+	segmentCache *segmentCache // The open segment files of the DB (see segment_files.go)
 }
 
 type RunConfig struct {
 	FixedRetention   bool          // Whether to truncate old data
 	Retention        time.Duration // How long to save data if FixedRetention is true
 	QueryParallelism int
+	Rollups          []RollupPolicy // In order of increasing age
+	// VerifyChecksumsOnOpen indicates that all the segments are checked against their checksums when the DB is
+	// opened. Otherwise, each interval is verified the first time it is read.
+	VerifyChecksumsOnOpen bool
+	// IncrementalFlush indicates that flushes append new rows to existing intervals as separate runs rather
+	// than rewriting the intervals. Intervals with more than MaxIntervalRuns runs are merged in the
+	// background.
+	IncrementalFlush bool
+	MaxIntervalRuns  int
+	// CompactionParallelism is the number of goroutines which merge and roll up intervals in the background
+	// (see compaction.go). If it is zero, this work is done during flushes.
+	CompactionParallelism int
+	// ColdDir, if set, is a secondary directory (say, on larger and slower disks) to which the files of
+	// intervals which ended more than ColdAfter ago are moved (by the compaction goroutines if
+	// CompactionParallelism is set, and otherwise during flushes).
+	ColdDir   string
+	ColdAfter time.Duration
+	// MaxOpenSegments limits the number of segment files which are kept open (and mapped) at once. Segments
+	// are mapped when they are first read, and the least recently used ones are unmapped to stay under the
+	// limit. If it is zero, segments stay mapped once they have been read.
+	MaxOpenSegments int
 }
 
 // Initialize fills in the derived fields of s.
 func (s *Schema) Initialize() {
 	s.RunConfig.fillDefaults()
+	if s.segmentCache == nil {
+		s.segmentCache = newSegmentCache(s.MaxOpenSegments)
+	}
 
 	s.DimensionNameToIndex = make(map[string]int)
 	s.MetricNameToIndex = make(map[string]int)
@@ -106,6 +185,14 @@ func (s *Schema) Initialize() {
 		offset += col.Width
 	}
 
+	// Unknown sort key columns are left out here; a DB with such a schema fails to open (see checkSortKey).
+	s.SortKeyIndexes = nil
+	for _, name := range s.SortKey {
+		if index, ok := s.DimensionNameToIndex[name]; ok {
+			s.SortKeyIndexes = append(s.SortKeyIndexes, index)
+		}
+	}
+
 	// Total row width includes count byte, nil bytes, dimension columns, and metric columns.
 	s.RowSize = countColumnWidth + s.NilBytes
 	for _, col := range s.DimensionColumns {
@@ -125,6 +212,9 @@ func (c *RunConfig) fillDefaults() {
 	if c.QueryParallelism == 0 {
 		c.QueryParallelism = runtime.NumCPU()
 	}
+	if c.MaxIntervalRuns <= 0 {
+		c.MaxIntervalRuns = 8
+	}
 }
 
 // Equivalent returns an error describing a difference between the json-public fields of s and other or nil if
@@ -160,5 +250,24 @@ func (s *Schema) Equivalent(other *Schema) (err error) {
 		return fmt.Errorf("expected segment size of %s; got %s",
 			humanize.Bytes(uint64(s.SegmentSize)), humanize.Bytes(uint64(other.SegmentSize)))
 	}
+	if s.SegmentFormat != other.SegmentFormat {
+		return fmt.Errorf("expected %s segment format; got %s", s.SegmentFormat, other.SegmentFormat)
+	}
+	sortKeyErr := fmt.Errorf("expected sort key %v; got %v", s.SortKey, other.SortKey)
+	if len(s.SortKey) != len(other.SortKey) {
+		return sortKeyErr
+	}
+	for i, name := range s.SortKey {
+		if name != other.SortKey[i] {
+			return sortKeyErr
+		}
+	}
+	if s.SegmentCompression != other.SegmentCompression {
+		return fmt.Errorf("expected %s segment compression; got %s", s.SegmentCompression, other.SegmentCompression)
+	}
+	if s.IntervalDimensionTables != other.IntervalDimensionTables {
+		return fmt.Errorf("expected interval dimension tables setting of %t; got %t",
+			s.IntervalDimensionTables, other.IntervalDimensionTables)
+	}
 	return nil
 }
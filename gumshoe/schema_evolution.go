@@ -0,0 +1,121 @@
+// Support for opening a DB with a schema which extends the one it was written with.
+//
+// Additive changes to the schema (adding dimension or metric columns after the existing ones, or widening
+// integer columns) don't require rewriting the DB with gumtool migrate. Instead, the existing intervals keep
+// the schema they were written with (Interval.Schema) and their rows are converted to the current layout as
+// they are read, with nil for new dimensions and zero for new metrics. Whenever a flush rewrites such an
+// interval, it is written out in the current layout.
+
+package gumshoe
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// checkEvolution returns an error unless s can be used to open a DB written with the schema old: s must be
+// the same as old except that it may have additional dimension and metric columns after the existing ones and
+// integer columns may be widened (keeping the same signedness).
+func (s *Schema) checkEvolution(old *Schema) error {
+	if len(s.DimensionColumns) < len(old.DimensionColumns) {
+		return fmt.Errorf("dimension columns cannot be removed without migrating the DB")
+	}
+	for i, col := range old.DimensionColumns {
+		newCol := s.DimensionColumns[i]
+		if newCol.Name != col.Name || newCol.String != col.String || !canWiden(col.Type, newCol.Type) {
+			return fmt.Errorf("dimension column at index %d cannot be changed from %v to %v "+
+				"without migrating the DB", i, col, newCol)
+		}
+	}
+	if len(s.MetricColumns) < len(old.MetricColumns) {
+		return fmt.Errorf("metric columns cannot be removed without migrating the DB")
+	}
+	for i, col := range old.MetricColumns {
+		newCol := s.MetricColumns[i]
+		if newCol.Name != col.Name || newCol.Merge != col.Merge || !canWiden(col.Type, newCol.Type) {
+			return fmt.Errorf("metric column at index %d cannot be changed from %v to %v "+
+				"without migrating the DB", i, col, newCol)
+		}
+	}
+	// Everything else must be unchanged.
+	other := *old
+	other.DimensionColumns = s.DimensionColumns
+	other.MetricColumns = s.MetricColumns
+	return other.Equivalent(s)
+}
+
+// canWiden reports whether a column of type from may be read as type to. Integer types may be widened but
+// cannot change signedness.
+func canWiden(from, to Type) bool {
+	if from == to {
+		return true
+	}
+	bigType := TypeToBigType[from]
+	return bigType != TypeFloat64 && bigType == TypeToBigType[to] && typeWidths[to] > typeWidths[from]
+}
+
+// evolveSchema prepares s, which was written with the schema old, for use with schema (which must have
+// passed schema.checkEvolution(old)). It must be called before s is initialized.
+func (s *StaticTable) evolveSchema(old, schema *Schema) {
+	for _, interval := range s.Intervals {
+		for _, run := range interval.AllRuns() {
+			if run.Schema == nil {
+				run.Schema = old
+			}
+			if run.DimensionTables != nil {
+				run.DimensionTables = extendDimensionTables(run.DimensionTables, schema)
+			}
+		}
+	}
+	s.DimensionTables = extendDimensionTables(s.DimensionTables, schema)
+}
+
+// extendDimensionTables adds empty tables for any string columns of schema beyond the end of dimTables.
+func extendDimensionTables(dimTables []*DimensionTable, schema *Schema) []*DimensionTable {
+	extended := NewDimensionTablesForSchema(schema)
+	copy(extended, dimTables)
+	return extended
+}
+
+// upgradeRows converts rows, which are in the layout of the schema old, into the layout of s and writes them
+// to dst. Dimension columns missing from old are nil and metric columns missing from old are zero.
+func (s *Schema) upgradeRows(dst, rows []byte, old *Schema) {
+	for i, j := 0, 0; i < len(rows); i, j = i+old.RowSize, j+s.RowSize {
+		src := rows[i : i+old.RowSize]
+		row := dst[j : j+s.RowSize]
+		for k := range row {
+			row[k] = 0
+		}
+		copy(row[:countColumnWidth], src)
+
+		srcDimensions := DimensionBytes(src[old.DimensionStartOffset:old.MetricStartOffset])
+		dimensions := DimensionBytes(row[s.DimensionStartOffset:s.MetricStartOffset])
+		copy(dimensions[:old.NilBytes], srcDimensions)
+		for k, col := range s.DimensionColumns {
+			if k >= len(old.DimensionColumns) {
+				dimensions.setNil(k)
+				continue
+			}
+			convertCell(dimensions[s.DimensionOffsets[k]:], col.Type,
+				srcDimensions[old.DimensionOffsets[k]:], old.DimensionColumns[k].Type)
+		}
+
+		srcMetrics := MetricBytes(src[old.MetricStartOffset:])
+		metrics := MetricBytes(row[s.MetricStartOffset:])
+		for k, col := range old.MetricColumns {
+			convertCell(metrics[s.MetricOffsets[k]:], s.MetricColumns[k].Type,
+				srcMetrics[old.MetricOffsets[k]:], col.Type)
+		}
+	}
+}
+
+// convertCell sets the cell at the start of dst (of type dstType) to the value of the cell at the start of
+// src (of type srcType).
+func convertCell(dst []byte, dstType Type, src []byte, srcType Type) {
+	if dstType == srcType {
+		copy(dst[:typeWidths[dstType]], src)
+		return
+	}
+	// Widened integers are at most 32 bits wide, so they're represented exactly by a float64.
+	setRowValue(unsafe.Pointer(&dst[0]), dstType, cellFloat64(unsafe.Pointer(&src[0]), srcType))
+}
@@ -0,0 +1,91 @@
+package gumshoe
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func extendedSchemaFixture() *Schema {
+	schema := schemaFixture()
+	schema.DimensionColumns = append(schema.DimensionColumns, makeDimensionColumn("dim2", "uint8", true))
+	schema.MetricColumns = []MetricColumn{
+		makeMetricColumn("metric1", "uint64"),
+		makeMetricColumn("metric2", "int16"),
+	}
+	return schema
+}
+
+func TestSchemaCanBeExtendedWithoutMigrating(t *testing.T) {
+	for _, format := range []SegmentFormat{SegmentFormatRow, SegmentFormatColumn} {
+		db := makeTestPersistentDB(func(schema *Schema) { schema.SegmentFormat = format })
+		dir := db.Dir
+		defer os.RemoveAll(dir)
+		insertRows(db, []RowMap{
+			{"at": hour(0), "dim1": "a", "metric1": 1.0},
+			{"at": hour(1), "dim1": "b", "metric1": 2.0},
+		})
+		closeTestDB(db)
+
+		schema := extendedSchemaFixture()
+		schema.SegmentFormat = format
+		schema.DiskBacked = true
+		schema.Dir = dir
+		db, err := OpenDB(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The existing rows have nil and zero values for the new columns.
+		Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+			{RowMap: RowMap{"at": hour(0), "dim1": "a", "dim2": nil, "metric1": 1, "metric2": 0}, Count: 1},
+			{RowMap: RowMap{"at": hour(1), "dim1": "b", "dim2": nil, "metric1": 2, "metric2": 0}, Count: 1},
+		})
+		query := createQuery()
+		query.Aggregates = append(query.Aggregates, QueryAggregate{AggregateSum, "metric2", "metric2"})
+		query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim2", "dim2"}}
+		Assert(t, runQuery(db, query), util.DeepConvertibleEquals, []RowMap{
+			{"dim2": nil, "metric1": 3, "metric2": 0, "rowCount": 2},
+		})
+
+		// Inserting into an existing interval rewrites it with the new schema.
+		insertRow(db, RowMap{"at": hour(1), "dim1": "b", "dim2": "x", "metric1": 4.0, "metric2": -1.0})
+		resp := db.MakeRequest()
+		Assert(t, resp.StaticTable.Intervals[time.Unix(0, 0)].Schema, NotNil)
+		Assert(t, resp.StaticTable.Intervals[time.Unix(int64(hour(1)), 0)].Schema, IsNil)
+		resp.Done()
+
+		db = reopenTestDB(db)
+		Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+			{RowMap: RowMap{"at": hour(0), "dim1": "a", "dim2": nil, "metric1": 1, "metric2": 0}, Count: 1},
+			{RowMap: RowMap{"at": hour(1), "dim1": "b", "dim2": nil, "metric1": 2, "metric2": 0}, Count: 1},
+			{RowMap: RowMap{"at": hour(1), "dim1": "b", "dim2": "x", "metric1": 4, "metric2": -1}, Count: 1},
+		})
+		query.Filters = []QueryFilter{{FilterEqual, "dim2", nil}}
+		Assert(t, runQuery(db, query), util.DeepConvertibleEquals, []RowMap{
+			{"dim2": nil, "metric1": 3, "metric2": 0, "rowCount": 2},
+		})
+		closeTestDB(db)
+	}
+}
+
+func TestIncompatibleSchemaChangesAreRejected(t *testing.T) {
+	for _, change := range []func(schema *Schema){
+		func(schema *Schema) { schema.DimensionColumns = schema.DimensionColumns[:1] },
+		func(schema *Schema) { schema.MetricColumns = schema.MetricColumns[1:] },
+		func(schema *Schema) { schema.DimensionColumns[1].Name = "dim3" },
+		func(schema *Schema) { schema.MetricColumns[0] = makeMetricColumn("metric1", "uint32") },
+		func(schema *Schema) { schema.MetricColumns[1] = makeMetricColumn("metric2", "uint32") },
+		func(schema *Schema) { schema.MetricColumns[1] = makeMetricColumn("metric2", "float64") },
+		func(schema *Schema) { schema.SegmentSize *= 2 },
+	} {
+		schema := extendedSchemaFixture()
+		change(schema)
+		Assert(t, schema.checkEvolution(extendedSchemaFixture()), NotNil)
+	}
+	Assert(t, extendedSchemaFixture().checkEvolution(schemaFixture()), IsNil)
+}
@@ -0,0 +1,331 @@
+// Functions for encoding and decoding segments in the various on-disk formats.
+
+package gumshoe
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// SegmentFormat describes how the rows of a segment are laid out.
+//
+// In the row format, a segment is simply a sequence of rows (see Schema for the row layout).
+//
+// In the column format, a segment holding N rows has the same size as in the row format, but each field of
+// the row is stored contiguously for all N rows:
+//
+//	count x N | nil bytes x N | dim1 x N | ... | dimN x N | metric1 x N | ... | metricN x N
+//
+// Scans over columnar segments only need to touch the columns referenced by the query.
+type SegmentFormat int
+
+const (
+	SegmentFormatRow SegmentFormat = iota
+	SegmentFormatColumn
+)
+
+var segmentFormatNames = []string{
+	SegmentFormatRow:    "row",
+	SegmentFormatColumn: "column",
+}
+
+// ParseSegmentFormat returns the SegmentFormat with the given name ("row" or "column").
+func ParseSegmentFormat(name string) (SegmentFormat, error) {
+	for i, formatName := range segmentFormatNames {
+		if name == formatName {
+			return SegmentFormat(i), nil
+		}
+	}
+	return 0, fmt.Errorf("bad segment format: %q", name)
+}
+
+func (f SegmentFormat) String() string { return segmentFormatNames[f] }
+
+func (f SegmentFormat) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("%q", f.String())), nil
+}
+
+func (f *SegmentFormat) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	format, err := ParseSegmentFormat(name)
+	if err != nil {
+		return err
+	}
+	*f = format
+	return nil
+}
+
+// SegmentCompression describes how segments are compressed, if at all. Compression is applied on top of the
+// segment format (and works best with the column format, which groups similar values together). A compressed
+// segment is stored as:
+//
+//	uncompressed size (uint32) | compressed data
+//
+// Segments are decompressed by the scan workers as they are read.
+type SegmentCompression int
+
+const (
+	SegmentCompressionNone SegmentCompression = iota
+	SegmentCompressionDeflate
+)
+
+var segmentCompressionNames = []string{
+	SegmentCompressionNone:    "none",
+	SegmentCompressionDeflate: "deflate",
+}
+
+// ParseSegmentCompression returns the SegmentCompression with the given name ("none" or "deflate").
+func ParseSegmentCompression(name string) (SegmentCompression, error) {
+	for i, compressionName := range segmentCompressionNames {
+		if name == compressionName {
+			return SegmentCompression(i), nil
+		}
+	}
+	return 0, fmt.Errorf("bad segment compression: %q", name)
+}
+
+func (c SegmentCompression) String() string { return segmentCompressionNames[c] }
+
+func (c SegmentCompression) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("%q", c.String())), nil
+}
+
+func (c *SegmentCompression) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	compression, err := ParseSegmentCompression(name)
+	if err != nil {
+		return err
+	}
+	*c = compression
+	return nil
+}
+
+const compressedSegmentHeaderSize = 4
+
+// A rowField is a contiguous range of bytes within a row: the count, the nil bytes, or a single column.
+type rowField struct {
+	Offset int
+	Width  int
+}
+
+// allRowFields returns the fields that make up an entire row, in order.
+func (s *Schema) allRowFields() []rowField {
+	fields := []rowField{{0, countColumnWidth}, {s.DimensionStartOffset, s.NilBytes}}
+	for i, col := range s.DimensionColumns {
+		fields = append(fields, rowField{s.DimensionStartOffset + s.DimensionOffsets[i], col.Width})
+	}
+	for i, col := range s.MetricColumns {
+		fields = append(fields, rowField{s.MetricStartOffset + s.MetricOffsets[i], col.Width})
+	}
+	return fields
+}
+
+// rowFieldsForColumns returns the fields needed to read the given dimension and metric columns (by index).
+// The count is always included, as are the nil bytes if any dimension column is needed.
+func (s *Schema) rowFieldsForColumns(dimensions, metrics []int) []rowField {
+	fields := []rowField{{0, countColumnWidth}}
+	if len(dimensions) > 0 {
+		fields = append(fields, rowField{s.DimensionStartOffset, s.NilBytes})
+	}
+	seen := make(map[int]bool)
+	for _, i := range dimensions {
+		offset := s.DimensionStartOffset + s.DimensionOffsets[i]
+		if !seen[offset] {
+			seen[offset] = true
+			fields = append(fields, rowField{offset, s.DimensionColumns[i].Width})
+		}
+	}
+	for _, i := range metrics {
+		offset := s.MetricStartOffset + s.MetricOffsets[i]
+		if !seen[offset] {
+			seen[offset] = true
+			fields = append(fields, rowField{offset, s.MetricColumns[i].Width})
+		}
+	}
+	return fields
+}
+
+// encodeSegment converts rows (a sequence of whole rows) into the schema's segment format and compression.
+// rows may be reused by the result.
+func (s *Schema) encodeSegment(rows []byte) []byte {
+	encoded := rows
+	if s.SegmentFormat == SegmentFormatColumn {
+		n := len(rows) / s.RowSize
+		encoded = make([]byte, len(rows))
+		for _, field := range s.allRowFields() {
+			column := encoded[n*field.Offset : n*(field.Offset+field.Width)]
+			for i := 0; i < n; i++ {
+				copy(column[i*field.Width:(i+1)*field.Width], rows[i*s.RowSize+field.Offset:])
+			}
+		}
+	}
+	if s.SegmentCompression == SegmentCompressionNone {
+		return encoded
+	}
+
+	var buf bytes.Buffer
+	header := make([]byte, compressedSegmentHeaderSize)
+	binary.LittleEndian.PutUint32(header, uint32(len(encoded)))
+	buf.Write(header)
+	// Writes to a bytes.Buffer can't fail and BestSpeed is a valid level, so the errors here can be ignored.
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(encoded)
+	w.Close()
+	return buf.Bytes()
+}
+
+// A segmentBuffer holds scratch space for decoding segments. It may be reused for many segments (but the rows
+// returned by segmentRows are only valid until the next use).
+type segmentBuffer struct {
+	raw      []byte // Decompressed segment
+	rows     []byte // Decoded rows
+	upgraded []byte // Rows converted from an older schema
+	zr       io.ReadCloser
+}
+
+// decompress decompresses a segment into b.raw.
+func (b *segmentBuffer) decompress(compressed []byte) ([]byte, error) {
+	if len(compressed) < compressedSegmentHeaderSize {
+		return nil, errors.New("cannot decompress segment: missing header")
+	}
+	size := int(binary.LittleEndian.Uint32(compressed))
+	b.raw = growBuffer(b.raw, size)
+	r := bytes.NewReader(compressed[compressedSegmentHeaderSize:])
+	if b.zr == nil {
+		b.zr = flate.NewReader(r)
+	} else if err := b.zr.(flate.Resetter).Reset(r, nil); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(b.zr, b.raw); err != nil {
+		return nil, fmt.Errorf("cannot decompress segment: %s", err)
+	}
+	return b.raw, nil
+}
+
+func growBuffer(buf []byte, size int) []byte {
+	if cap(buf) < size {
+		return make([]byte, size)
+	}
+	return buf[:size]
+}
+
+// segmentRows returns the contents of segment as a sequence of rows. Only the given fields are guaranteed to
+// be filled in; if the segment isn't stored uncompressed in the row format, the rows are decoded into buf and
+// the remainder of each row has undefined contents. The segment must be acquired while the rows are in use.
+func (s *Schema) segmentRows(segment *Segment, fields []rowField, buf *segmentBuffer) ([]byte, error) {
+	data := []byte(segment.Bytes)
+	if s.SegmentCompression != SegmentCompressionNone {
+		var err error
+		if data, err = buf.decompress(data); err != nil {
+			return nil, err
+		}
+	}
+	if s.SegmentFormat == SegmentFormatRow {
+		return data, nil
+	}
+	size := len(data)
+	buf.rows = growBuffer(buf.rows, size)
+	n := size / s.RowSize
+	for _, field := range fields {
+		column := data[n*field.Offset : n*(field.Offset+field.Width)]
+		transposeColumn(buf.rows, s.RowSize, column, field, n)
+	}
+	return buf.rows, nil
+}
+
+// SegmentRows returns all the rows of segment (in the row layout described by Schema), decoding the segment
+// if necessary. The rows are a copy, so they remain valid after the segment is unmapped.
+func (s *Schema) SegmentRows(segment *Segment) ([]byte, error) {
+	if err := segment.acquire(); err != nil {
+		return nil, err
+	}
+	defer segment.release()
+	rows, err := s.segmentRows(segment, s.allRowFields(), new(segmentBuffer))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), rows...), nil
+}
+
+// layoutSegmentRows is like segmentRows for a segment written with the schema layout, which may be an older
+// version of s (see Schema.checkEvolution). In that case, the rows are converted into buf in the layout of s.
+// A nil layout means s.
+func (s *Schema) layoutSegmentRows(layout *Schema, segment *Segment, fields []rowField,
+	buf *segmentBuffer) ([]byte, error) {
+
+	if layout == nil || layout == s {
+		return s.segmentRows(segment, fields, buf)
+	}
+	rows, err := layout.segmentRows(segment, layout.allRowFields(), buf)
+	if err != nil {
+		return nil, err
+	}
+	buf.upgraded = growBuffer(buf.upgraded, len(rows)/layout.RowSize*s.RowSize)
+	s.upgradeRows(buf.upgraded, rows, layout)
+	return buf.upgraded, nil
+}
+
+// IntervalSegmentRows returns all the rows of segment, which belongs to interval, in the row layout of s. As
+// with SegmentRows, the rows are a copy.
+func (s *Schema) IntervalSegmentRows(interval *Interval, segment *Segment) ([]byte, error) {
+	if err := segment.acquire(); err != nil {
+		return nil, err
+	}
+	defer segment.release()
+	rows, err := s.layoutSegmentRows(interval.Schema, segment, s.allRowFields(), new(segmentBuffer))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), rows...), nil
+}
+
+// transposeColumn copies the n values of a single field from column (where they are contiguous) into their
+// positions in rows.
+func transposeColumn(rows []byte, rowSize int, column []byte, field rowField, n int) {
+	if n == 0 {
+		return
+	}
+	offset := field.Offset
+	switch field.Width {
+	case 1:
+		for i := 0; i < n; i++ {
+			rows[offset] = column[i]
+			offset += rowSize
+		}
+	case 2:
+		for i := 0; i < n; i++ {
+			*(*uint16)(unsafe.Pointer(&rows[offset])) = *(*uint16)(unsafe.Pointer(&column[i*2]))
+			offset += rowSize
+		}
+	case 4:
+		for i := 0; i < n; i++ {
+			*(*uint32)(unsafe.Pointer(&rows[offset])) = *(*uint32)(unsafe.Pointer(&column[i*4]))
+			offset += rowSize
+		}
+	case 8:
+		for i := 0; i < n; i++ {
+			*(*uint64)(unsafe.Pointer(&rows[offset])) = *(*uint64)(unsafe.Pointer(&column[i*8]))
+			offset += rowSize
+		}
+	default:
+		for i := 0; i < n; i++ {
+			copy(rows[i*rowSize+field.Offset:i*rowSize+field.Offset+field.Width], column[i*field.Width:])
+		}
+	}
+}
+
+// segmentBufferPool holds scratch buffers used by the scan workers for decoding segments.
+var segmentBufferPool = sync.Pool{New: func() interface{} { return new(segmentBuffer) }}
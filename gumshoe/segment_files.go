@@ -0,0 +1,146 @@
+// Lazy mapping of segment files (RunConfig.MaxOpenSegments).
+//
+// A segment backed by a file isn't opened until it is first read. Readers acquire the segment (which maps the
+// file if necessary) and release it when they are done with its bytes. Mapped segments which aren't in use
+// are kept in an LRU list, and the least recently used ones are unmapped and closed whenever there are more
+// than MaxOpenSegments open segment files. (Segments which are in use are never unmapped, so the limit may be
+// exceeded briefly by many concurrent readers.) A reader which cannot map a segment, say because the process
+// is out of file descriptors, fails with the error; a query fails rather than leaving the interval out.
+
+package gumshoe
+
+import (
+	"container/list"
+	"os"
+	"sync"
+
+	mmap "github.com/philc/gumshoedb/internal/github.com/edsrzf/mmap-go"
+)
+
+// segmentCache tracks the open segment files of a DB.
+type segmentCache struct {
+	maxOpen int // No limit if zero
+
+	mu     sync.Mutex
+	open   int        // The number of mapped segments
+	unused *list.List // Mapped segments which aren't in use, least recently used first
+}
+
+func newSegmentCache(maxOpen int) *segmentCache {
+	return &segmentCache{maxOpen: maxOpen, unused: list.New()}
+}
+
+// fileSegment returns a segment backed by filename, which is mapped the first time it is read.
+func (s *Schema) fileSegment(filename string) *Segment {
+	return &Segment{filename: filename, cache: s.segmentCache}
+}
+
+// storedSize returns the size of the segment as stored: the size of its file (which is not mapped to find
+// out), or the length of its bytes if it isn't backed by a file.
+func (seg *Segment) storedSize() (int, error) {
+	if seg.cache == nil {
+		return len(seg.Bytes), nil
+	}
+	info, err := os.Stat(seg.filename)
+	if err != nil {
+		return 0, err
+	}
+	return int(info.Size()), nil
+}
+
+// acquire makes the bytes of the segment available, mapping its file if necessary. They remain valid until
+// the matching call to release.
+func (seg *Segment) acquire() error {
+	if seg.cache == nil {
+		return nil
+	}
+	c := seg.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seg.Bytes == nil {
+		f, err := os.Open(seg.filename)
+		if err != nil {
+			return err
+		}
+		mapped, err := mmap.Map(f, mmap.RDONLY, 0)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		seg.File = f
+		seg.Bytes = mapped
+		c.open++
+		c.evict()
+	} else if seg.elem != nil {
+		c.unused.Remove(seg.elem)
+		seg.elem = nil
+	}
+	seg.refs++
+	return nil
+}
+
+// release indicates that the caller is done with the bytes of the segment.
+func (seg *Segment) release() {
+	if seg.cache == nil {
+		return
+	}
+	c := seg.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seg.refs--
+	if seg.refs == 0 {
+		seg.elem = c.unused.PushBack(seg)
+		c.evict()
+	}
+}
+
+// close unmaps the segment and closes its file, if it is open. The segment must not be used afterwards.
+func (seg *Segment) close() error {
+	if seg.cache == nil {
+		return seg.unmap()
+	}
+	c := seg.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seg.elem != nil {
+		c.unused.Remove(seg.elem)
+		seg.elem = nil
+	}
+	if seg.Bytes == nil {
+		return nil
+	}
+	c.open--
+	return seg.unmap()
+}
+
+func (seg *Segment) unmap() error {
+	if seg.File == nil {
+		return nil
+	}
+	err := seg.Bytes.Unmap()
+	if closeErr := seg.File.Close(); err == nil {
+		err = closeErr
+	}
+	seg.File = nil
+	seg.Bytes = nil
+	return err
+}
+
+// evict unmaps unused segments until no more than maxOpen are open. c.mu must be held.
+func (c *segmentCache) evict() {
+	for c.maxOpen > 0 && c.open > c.maxOpen && c.unused.Len() > 0 {
+		seg := c.unused.Remove(c.unused.Front()).(*Segment)
+		seg.elem = nil
+		if err := seg.unmap(); err != nil {
+			Log.Println("error unmapping segment file:", err)
+		}
+		c.open--
+	}
+}
+
+// openCount returns the number of mapped segments.
+func (c *segmentCache) openCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.open
+}
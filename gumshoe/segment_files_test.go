@@ -0,0 +1,72 @@
+package gumshoe
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestSegmentsAreMappedLazilyWithinTheOpenFileLimit(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	var rows []RowMap
+	for i := 0; i < 10; i++ {
+		rows = append(rows, RowMap{"at": hour(i), "dim1": strconv.Itoa(i), "metric1": 1.0})
+	}
+	insertRows(db, rows)
+	closeTestDB(db)
+
+	db.MaxOpenSegments = 3
+	db.segmentCache = nil
+	db, err := OpenDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+	Assert(t, db.segmentCache.openCount(), Equals, 0)
+
+	results := runQuery(db, createQuery())
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 10)
+	Assert(t, db.segmentCache.openCount(), Equals, 3)
+
+	// Evicted segments are mapped again as needed.
+	insertRow(db, RowMap{"at": hour(0), "dim1": "a", "metric1": 1.0})
+	results = runQuery(db, createQuery())
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 11)
+	Assert(t, db.segmentCache.openCount(), Equals, 3)
+	Assert(t, len(db.GetDebugRows()), Equals, 11)
+}
+
+func TestQueriesFailWhenSegmentsCannotBeMapped(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	var rows []RowMap
+	for i := 0; i < 10; i++ {
+		rows = append(rows, RowMap{"at": hour(i), "dim1": strconv.Itoa(i), "metric1": 1.0})
+	}
+	insertRows(db, rows)
+	closeTestDB(db)
+
+	db.MaxOpenSegments = 1
+	db.segmentCache = nil
+	db, err := OpenDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+	results := runQuery(db, createQuery())
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 10)
+
+	// The intervals have been verified, but most of their segments have to be mapped again.
+	for _, file := range segmentFiles(t, db.Dir) {
+		if err := os.Remove(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.GetQueryResult(createQuery())
+	Assert(t, err, NotNil)
+}
@@ -0,0 +1,134 @@
+package gumshoe
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func columnSchemaFixture() *Schema {
+	schema := schemaFixture()
+	useColumnSegments(schema)
+	return schema
+}
+
+// useColumnSegments switches schema to the column segment format and adds columns of other widths.
+func useColumnSegments(schema *Schema) {
+	schema.DimensionColumns = append(schema.DimensionColumns, makeDimensionColumn("dim2", "uint8", false))
+	schema.MetricColumns = append(schema.MetricColumns, makeMetricColumn("metric2", "float64"))
+	schema.SegmentFormat = SegmentFormatColumn
+}
+
+func TestColumnSegmentsRoundTrip(t *testing.T) {
+	schema := columnSchemaFixture()
+	schema.Initialize()
+	rows := make([]byte, 10*schema.RowSize)
+	for i := range rows {
+		rows[i] = byte(i * 7)
+	}
+	encoded := schema.encodeSegment(append([]byte(nil), rows...))
+	Assert(t, len(encoded), Equals, len(rows))
+	Assert(t, bytes.Equal(encoded, rows), IsFalse)
+	decoded, err := schema.SegmentRows(&Segment{Bytes: encoded})
+	Assert(t, err, IsNil)
+	Assert(t, decoded, DeepEquals, rows)
+}
+
+func TestCompressedSegmentsRoundTrip(t *testing.T) {
+	for _, format := range []SegmentFormat{SegmentFormatRow, SegmentFormatColumn} {
+		schema := columnSchemaFixture()
+		schema.SegmentFormat = format
+		schema.SegmentCompression = SegmentCompressionDeflate
+		schema.Initialize()
+		rows := make([]byte, 100*schema.RowSize)
+		for i := range rows {
+			rows[i] = byte(i % 3)
+		}
+		encoded := schema.encodeSegment(append([]byte(nil), rows...))
+		Assert(t, len(encoded) < len(rows), IsTrue)
+		decoded, err := schema.SegmentRows(&Segment{Bytes: encoded})
+		Assert(t, err, IsNil)
+		Assert(t, decoded, DeepEquals, rows)
+	}
+}
+
+func TestQueriesOverBadlyCompressedSegmentsFail(t *testing.T) {
+	db := makeTestDB(func(schema *Schema) { schema.SegmentCompression = SegmentCompressionDeflate })
+	defer closeTestDB(db)
+	insertRow(db, RowMap{"at": 0.0, "dim1": "a", "metric1": 1.0})
+
+	// Truncate the deflate stream of an interval without checksums (as if written by an older version).
+	resp := db.MakeRequest()
+	interval := resp.StaticTable.Intervals[time.Unix(0, 0)]
+	interval.Checksums = nil
+	segment := interval.Segments[0]
+	segment.Bytes = segment.Bytes[:len(segment.Bytes)/2]
+	resp.Done()
+
+	_, err := db.GetQueryResult(createQuery())
+	Assert(t, err, NotNil)
+}
+
+func TestQueriesOverColumnSegments(t *testing.T) {
+	db := makeTestDB(useColumnSegments)
+	defer closeTestDB(db)
+
+	var rows []RowMap
+	for i := 0; i < 100; i++ {
+		rows = append(rows, RowMap{"at": 0.0, "dim1": strconv.Itoa(i % 3), "dim2": nil, "metric1": 1.0, "metric2": 0.5})
+	}
+	rows = append(rows, RowMap{"at": 0.0, "dim1": nil, "dim2": 3.0, "metric1": 5.0, "metric2": 1.0})
+	insertRows(db, rows)
+	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{
+		{RowMap: RowMap{"at": uint32(0), "dim1": "0", "dim2": nil, "metric1": uint32(34), "metric2": 17.0}, Count: 34},
+		{RowMap: RowMap{"at": uint32(0), "dim1": "1", "dim2": nil, "metric1": uint32(33), "metric2": 16.5}, Count: 33},
+		{RowMap: RowMap{"at": uint32(0), "dim1": "2", "dim2": nil, "metric1": uint32(33), "metric2": 16.5}, Count: 33},
+		{RowMap: RowMap{"at": uint32(0), "dim1": nil, "dim2": uint8(3), "metric1": uint32(5), "metric2": 1.0}, Count: 1},
+	})
+
+	query := createQuery()
+	query.Filters = []QueryFilter{{Type: FilterNotEqual, Column: "dim1", Value: "1"}}
+	query.Groupings = []QueryGrouping{{Column: "dim2", Name: "dim2"}}
+	Assert(t, runQuery(db, query), util.DeepEqualsUnordered, []RowMap{
+		{"dim2": nil, "metric1": uint32(67), "rowCount": uint32(67)},
+		{"dim2": uint8(3), "metric1": uint32(5), "rowCount": uint32(1)},
+	})
+}
+
+func TestColumnSegmentsArePersisted(t *testing.T) {
+	db := makeTestPersistentDB(useColumnSegments)
+	defer os.RemoveAll(db.Dir)
+
+	var rows []RowMap
+	for i := 0; i < 1000; i++ {
+		rows = append(rows, RowMap{"at": 0.0, "dim1": strconv.Itoa(i % 100), "dim2": 1.0, "metric1": 1.0, "metric2": 1.0})
+	}
+	insertRows(db, rows)
+	db = reopenTestDB(db)
+	defer closeTestDB(db)
+	Assert(t, physicalRows(db), Equals, 100)
+	result := runQuery(db, createQuery())
+	Assert(t, result[0]["metric1"], util.DeepConvertibleEquals, 1000)
+}
+
+func TestCompressedSegmentStats(t *testing.T) {
+	db := makeTestDB(useColumnSegments, func(schema *Schema) { schema.SegmentCompression = SegmentCompressionDeflate })
+	defer closeTestDB(db)
+
+	var rows []RowMap
+	for i := 0; i < 1000; i++ {
+		rows = append(rows, RowMap{"at": 0.0, "dim1": strconv.Itoa(i), "dim2": 1.0, "metric1": 1.0, "metric2": 1.0})
+	}
+	insertRows(db, rows)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 1000)
+
+	stats := db.GetDebugStats()
+	Assert(t, stats.UncompressedBytes, Equals, 1000*db.RowSize)
+	Assert(t, stats.Bytes < stats.UncompressedBytes, IsTrue)
+}
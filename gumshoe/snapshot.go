@@ -0,0 +1,120 @@
+package gumshoe
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot writes a point-in-time copy of a disk-backed DB to dir, which must not already contain a DB. The
+// result is a complete DB directory which can be opened with OpenDBDir.
+//
+// The snapshot holds a request on the current StaticTable while it runs, so none of the files it uses are
+// deleted by a flush in the meantime. The segment and dimension table files are immutable once written, so
+// they are hard-linked into dir if possible (and copied otherwise). The files and dir are synced to disk
+// before the metadata is written. Rows which haven't been flushed yet are not included.
+func (db *DB) Snapshot(dir string) error {
+	if !db.DiskBacked {
+		return errors.New("only disk-backed DBs can be snapshotted")
+	}
+	start := time.Now()
+	resp := db.MakeRequest()
+	defer resp.Done()
+	staticTable := resp.StaticTable
+
+	if err := makeDBDir(dir); err != nil {
+		return err
+	}
+	var filenames []string
+	for i, dimTable := range staticTable.DimensionTables {
+		if dimTable != nil {
+			filenames = append(filenames, dimTable.Filename(db.Schema, i))
+		}
+	}
+	for _, interval := range staticTable.Intervals {
+		for _, run := range interval.AllRuns() {
+			for i := 0; i < run.NumSegments; i++ {
+				filenames = append(filenames, run.SegmentFilename(db.Schema, i))
+			}
+			for i, dimTable := range run.DimensionTables {
+				if dimTable != nil {
+					filenames = append(filenames, run.DimensionTableFilename(db.Schema, i))
+				}
+			}
+		}
+	}
+	for _, filename := range filenames {
+		snapshotFilename := filepath.Join(dir, filepath.Base(filename))
+		err := linkOrCopyFile(filename, snapshotFilename)
+		if os.IsNotExist(err) {
+			// Dimension tables without any values (say, for columns added by a schema change) may never have
+			// been written; they are loaded as empty tables.
+			continue
+		}
+		if err == nil {
+			err = SyncFile(snapshotFilename)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot snapshot %s: %s", filename, err)
+		}
+	}
+	if err := SyncFile(dir); err != nil {
+		return err
+	}
+	// All the files of the snapshot are in dir, including those of intervals in cold storage.
+	snapshotTable := NewStaticTable(db.Schema)
+	snapshotTable.DimensionTables = staticTable.DimensionTables
+	for t, interval := range staticTable.Intervals {
+		snapshotTable.Intervals[t] = interval.hotCopy()
+	}
+	// The metadata is written last, so a partial snapshot can't be opened.
+	if err := writeMetadata(dir, &DB{Schema: db.Schema, StaticTable: snapshotTable}); err != nil {
+		return err
+	}
+	Log.Printf("Snapshot of %d intervals (%d files) written to %s in %s",
+		len(staticTable.Intervals), len(filenames), dir, time.Since(start))
+	return nil
+}
+
+// linkOrCopyFile makes dst a hard link to src or, if that isn't possible (say, because they are on different
+// filesystems), a copy of src.
+func linkOrCopyFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil || os.IsNotExist(err) {
+		return err
+	}
+	return CopyFile(src, dst)
+}
+
+// CopyFile copies the file src to dst. The copy is not synced to disk (see SyncFile).
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// SyncFile flushes the file filename to disk. If filename is a directory, its entries are flushed.
+func SyncFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,57 @@
+package gumshoe
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestSnapshotCanBeOpened(t *testing.T) {
+	for _, intervalDimensionTables := range []bool{false, true} {
+		db := makeTestPersistentDB(func(schema *Schema) {
+			schema.IntervalDimensionTables = intervalDimensionTables
+			schema.IncrementalFlush = true
+		})
+		defer os.RemoveAll(db.Dir)
+		snapshotDir := filepath.Join(db.Dir, "snapshot")
+
+		insertRows(db, []RowMap{
+			{"at": hour(0), "dim1": "a", "metric1": 1.0},
+			{"at": hour(1), "dim1": "b", "metric1": 2.0},
+		})
+		insertRow(db, RowMap{"at": hour(0), "dim1": "c", "metric1": 4.0})
+		expected := db.GetDebugRows()
+		Assert(t, db.Snapshot(snapshotDir), IsNil)
+
+		// The files of the snapshot are unaffected by later changes to the DB.
+		db.IncrementalFlush = false
+		insertRow(db, RowMap{"at": hour(0), "dim1": "d", "metric1": 8.0})
+		if err := db.CompactDimensionTables(); err != nil {
+			t.Fatal(err)
+		}
+		closeTestDB(db)
+
+		snapshot, err := OpenDBDir(snapshotDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Assert(t, snapshot.GetDebugRows(), util.DeepEqualsUnordered, expected)
+		Assert(t, snapshot.GetCorruptedIntervals(), IsNil)
+		closeTestDB(snapshot)
+	}
+}
+
+func TestSnapshotRequiresAnEmptyDir(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	defer closeTestDB(db)
+
+	insertRow(db, RowMap{"at": hour(0), "dim1": "a", "metric1": 1.0})
+	Assert(t, db.Snapshot(db.Dir), NotNil)
+	_, err := os.Stat(filepath.Join(db.Dir, MetadataFilename))
+	Assert(t, err, IsNil)
+}
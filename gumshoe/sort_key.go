@@ -0,0 +1,283 @@
+// Functions for ordering rows by the schema's sort key and for using that order to narrow down scans.
+
+package gumshoe
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"unsafe"
+)
+
+// The rows of an interval are stored in key order. By default, this is simply the bytewise order of the
+// DimensionBytes, but if the schema has a sort key then rows are ordered by the values of the sort key
+// columns first (nils first, then in increasing order) and bytewise after that. This clusters the rows of an
+// interval by the sort key so that filters on it only need to look at a contiguous range of each segment.
+
+// checkSortKey checks that the sort key columns are distinct dimension columns.
+func (s *Schema) checkSortKey() error {
+	names := make(map[string]bool)
+	for _, name := range s.SortKey {
+		found := false
+		for _, col := range s.DimensionColumns {
+			if col.Name == name {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("sort key column %q is not a dimension column", name)
+		}
+		if names[name] {
+			return fmt.Errorf("duplicate sort key column %q", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// keyCompareFunc returns the function used to order the DimensionBytes of rows.
+func (s *Schema) keyCompareFunc() func(a, b []byte) int {
+	if len(s.SortKeyIndexes) == 0 {
+		return bytes.Compare
+	}
+	return s.compareKeys
+}
+
+func (s *Schema) compareKeys(a, b []byte) int {
+	for _, i := range s.SortKeyIndexes {
+		rankA, cellA := s.sortRank(DimensionBytes(a), i)
+		rankB, cellB := s.sortRank(DimensionBytes(b), i)
+		switch {
+		case rankA < rankB:
+			return -1
+		case rankA > rankB:
+			return 1
+		case rankA != sortRankValue:
+			continue
+		}
+		if c := compareCells(cellA, cellB, s.DimensionColumns[i].Type); c != 0 {
+			return c
+		}
+	}
+	return bytes.Compare(a, b)
+}
+
+// Sort ranks order the special (nil and NaN) values of a column before all the regular values.
+const (
+	sortRankNil = iota
+	sortRankNaN
+	sortRankValue
+)
+
+func (s *Schema) sortRank(dimensions DimensionBytes, index int) (rank int, cell unsafe.Pointer) {
+	if dimensions.IsNil(index) {
+		return sortRankNil, nil
+	}
+	cell = unsafe.Pointer(&dimensions[s.DimensionOffsets[index]])
+	switch s.DimensionColumns[index].Type {
+	case TypeFloat32:
+		if f := *(*float32)(cell); f != f {
+			return sortRankNaN, cell
+		}
+	case TypeFloat64:
+		if f := *(*float64)(cell); f != f {
+			return sortRankNaN, cell
+		}
+	}
+	return sortRankValue, cell
+}
+
+// compareCells compares two (non-NaN) numeric cells of type typ.
+func compareCells(a, b unsafe.Pointer, typ Type) int {
+	var less, greater bool
+	switch typ {
+	case TypeUint8:
+		less, greater = *(*uint8)(a) < *(*uint8)(b), *(*uint8)(a) > *(*uint8)(b)
+	case TypeInt8:
+		less, greater = *(*int8)(a) < *(*int8)(b), *(*int8)(a) > *(*int8)(b)
+	case TypeUint16:
+		less, greater = *(*uint16)(a) < *(*uint16)(b), *(*uint16)(a) > *(*uint16)(b)
+	case TypeInt16:
+		less, greater = *(*int16)(a) < *(*int16)(b), *(*int16)(a) > *(*int16)(b)
+	case TypeUint32:
+		less, greater = *(*uint32)(a) < *(*uint32)(b), *(*uint32)(a) > *(*uint32)(b)
+	case TypeInt32:
+		less, greater = *(*int32)(a) < *(*int32)(b), *(*int32)(a) > *(*int32)(b)
+	case TypeFloat32:
+		less, greater = *(*float32)(a) < *(*float32)(b), *(*float32)(a) > *(*float32)(b)
+	case TypeUint64:
+		less, greater = *(*uint64)(a) < *(*uint64)(b), *(*uint64)(a) > *(*uint64)(b)
+	case TypeInt64:
+		less, greater = *(*int64)(a) < *(*int64)(b), *(*int64)(a) > *(*int64)(b)
+	case TypeFloat64:
+		less, greater = *(*float64)(a) < *(*float64)(b), *(*float64)(a) > *(*float64)(b)
+	default:
+		panic("unexpected type")
+	}
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+// A sortKeyBound is the range of values allowed by a query's filters for one of the sort key columns.
+type sortKeyBound struct {
+	Index      int  // The dimension index
+	Nil        bool // Only nil values are allowed
+	Min, Max   float64
+	MinOpen    bool // Whether Min itself is excluded
+	MaxOpen    bool // Whether Max itself is excluded
+	Type       Type
+	nilOffset  int
+	nilMask    byte
+	cellOffset int
+}
+
+func (b *sortKeyBound) isEquality() bool {
+	return b.Nil || (b.Min == b.Max && !b.MinOpen && !b.MaxOpen)
+}
+
+// position returns -1 if the row is before the range allowed by b, 1 if it is after, and 0 if it is inside.
+func (b *sortKeyBound) position(row RowBytes) int {
+	if row[b.nilOffset]&b.nilMask > 0 {
+		if b.Nil {
+			return 0
+		}
+		return -1
+	}
+	if b.Nil {
+		return 1
+	}
+	v := cellFloat64(unsafe.Pointer(&row[b.cellOffset]), b.Type)
+	switch {
+	case v != v: // NaN
+		return -1
+	case v < b.Min || (v == b.Min && b.MinOpen):
+		return -1
+	case v > b.Max || (v == b.Max && b.MaxOpen):
+		return 1
+	}
+	return 0
+}
+
+// makeSortKeyBounds derives bounds on a prefix of the sort key columns from the (already validated) filters.
+// The prefix is made of sort key columns constrained to a single value followed by at most one column
+// constrained to a range. All rows matching the filters in a segment lie in the contiguous range of rows
+// within these bounds.
+func (s *StaticTable) makeSortKeyBounds(filters []QueryFilter) []*sortKeyBound {
+	var bounds []*sortKeyBound
+	for _, index := range s.SortKeyIndexes {
+		col := s.DimensionColumns[index]
+		// As with zone maps, 64-bit integer values can't all be compared exactly as float64s.
+		if col.Type == TypeUint64 || col.Type == TypeInt64 {
+			break
+		}
+		bound := &sortKeyBound{
+			Index:      index,
+			Min:        math.Inf(-1),
+			Max:        math.Inf(1),
+			Type:       col.Type,
+			nilOffset:  s.DimensionStartOffset + index>>3,
+			nilMask:    byte(1) << byte(index&7),
+			cellOffset: s.DimensionStartOffset + s.DimensionOffsets[index],
+		}
+		constrained := false
+		for _, filter := range filters {
+			if filter.Column != col.Name {
+				continue
+			}
+			if filter.Value == nil {
+				if filter.Type == FilterEqual {
+					bound.Nil = true
+					constrained = true
+				}
+				continue
+			}
+			var value float64
+			if col.String {
+				str, ok := filter.Value.(string)
+				if !ok {
+					continue
+				}
+				dimIndex, ok := s.DimensionTables[index].Get(str)
+				if !ok {
+					continue
+				}
+				value = float64(dimIndex)
+			} else {
+				float, ok := filter.Value.(float64)
+				if !ok {
+					continue
+				}
+				value = typedFloat64(float, col.Type)
+			}
+			if bound.restrict(filter.Type, value) {
+				constrained = true
+			}
+		}
+		if !constrained {
+			break
+		}
+		bounds = append(bounds, bound)
+		if !bound.isEquality() {
+			break
+		}
+	}
+	return bounds
+}
+
+// restrict narrows b according to a filter with a non-nil value. It returns whether the filter type could be
+// used.
+func (b *sortKeyBound) restrict(filter FilterType, value float64) bool {
+	raiseMin := func(min float64, open bool) {
+		if min > b.Min || (min == b.Min && open) {
+			b.Min, b.MinOpen = min, open
+		}
+	}
+	lowerMax := func(max float64, open bool) {
+		if max < b.Max || (max == b.Max && open) {
+			b.Max, b.MaxOpen = max, open
+		}
+	}
+	switch filter {
+	case FilterEqual:
+		raiseMin(value, false)
+		lowerMax(value, false)
+	case FilterGreaterThan:
+		raiseMin(value, true)
+	case FilterGreaterThenOrEqual:
+		raiseMin(value, false)
+	case FilterLessThan:
+		lowerMax(value, true)
+	case FilterLessThanOrEqual:
+		lowerMax(value, false)
+	default:
+		return false
+	}
+	return true
+}
+
+// sortKeyRange returns the contiguous range of rows (a sequence of rows from a segment) which lie within
+// bounds.
+func (s *Schema) sortKeyRange(rows []byte, bounds []*sortKeyBound) []byte {
+	if len(bounds) == 0 {
+		return rows
+	}
+	position := func(i int) int {
+		row := RowBytes(rows[i*s.RowSize : (i+1)*s.RowSize])
+		for _, bound := range bounds {
+			if p := bound.position(row); p != 0 {
+				return p
+			}
+		}
+		return 0
+	}
+	n := len(rows) / s.RowSize
+	lo := sort.Search(n, func(i int) bool { return position(i) >= 0 })
+	hi := lo + sort.Search(n-lo, func(i int) bool { return position(lo+i) > 0 })
+	return rows[lo*s.RowSize : hi*s.RowSize]
+}
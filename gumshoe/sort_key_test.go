@@ -0,0 +1,105 @@
+package gumshoe
+
+import (
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func makeSortKeyTestDB() *DB {
+	return makeTestDB(func(schema *Schema) {
+		schema.DimensionColumns = append(schema.DimensionColumns, makeDimensionColumn("dim2", "uint16", false))
+		schema.SortKey = []string{"dim2", "dim1"}
+	})
+}
+
+func debugRowValues(db *DB, column string) []Untyped {
+	var values []Untyped
+	for _, row := range db.GetDebugRows() {
+		values = append(values, row.RowMap[column])
+	}
+	return values
+}
+
+func TestBadSortKeysAreRejected(t *testing.T) {
+	for _, sortKey := range [][]string{
+		{"dim2"},
+		{"metric1"},
+		{"dim1", "dim1"},
+	} {
+		schema := schemaFixture()
+		schema.SortKey = sortKey
+		_, err := NewDB(schema)
+		Assert(t, err, NotNil)
+	}
+}
+
+func TestRowsAreOrderedBySortKey(t *testing.T) {
+	db := makeSortKeyTestDB()
+	defer closeTestDB(db)
+
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "dim2": 300.0, "metric1": 1.0},
+		{"at": 0.0, "dim1": "a", "dim2": 5.0, "metric1": 1.0},
+		{"at": 0.0, "dim1": "b", "dim2": 256.0, "metric1": 1.0},
+	})
+	// These rows are merged with the existing interval.
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "dim2": nil, "metric1": 1.0},
+		{"at": 0.0, "dim1": "b", "dim2": 5.0, "metric1": 1.0},
+		{"at": 0.0, "dim1": "a", "dim2": 5.0, "metric1": 1.0},
+		{"at": 0.0, "dim1": "b", "dim2": 299.0, "metric1": 1.0},
+	})
+
+	Assert(t, debugRowValues(db, "dim2"), DeepEquals,
+		[]Untyped{nil, uint16(5), uint16(5), uint16(256), uint16(299), uint16(300)})
+	Assert(t, debugRowValues(db, "dim1"), DeepEquals, []Untyped{"a", "a", "b", "b", "b", "a"})
+	Assert(t, debugRowValues(db, "metric1"), DeepEquals,
+		[]Untyped{uint32(1), uint32(2), uint32(1), uint32(1), uint32(1), uint32(1)})
+}
+
+func TestSortKeyFiltersOnlyScanMatchingRows(t *testing.T) {
+	db := makeSortKeyTestDB()
+	defer closeTestDB(db)
+
+	var rows []RowMap
+	for i := 0; i < 1000; i++ {
+		rows = append(rows, RowMap{
+			"at": 0.0, "dim1": []string{"a", "b", "c"}[i%3], "dim2": float64(i % 100), "metric1": 1.0,
+		})
+	}
+	rows = append(rows, RowMap{"at": 0.0, "dim1": "a", "dim2": nil, "metric1": 1.0})
+	insertRows(db, rows)
+
+	for _, testCase := range []struct {
+		filters     []QueryFilter
+		rowsScanned int
+		metric1     int
+	}{
+		{[]QueryFilter{{FilterEqual, "dim2", 7.0}}, 3, 10},
+		{[]QueryFilter{{FilterEqual, "dim2", 7.0}, {FilterEqual, "dim1", "b"}}, 1, 4},
+		{[]QueryFilter{{FilterEqual, "dim2", 7.0}, {FilterEqual, "dim1", "z"}}, 3, 0},
+		{[]QueryFilter{{FilterEqual, "dim2", nil}}, 1, 1},
+		{[]QueryFilter{{FilterGreaterThan, "dim2", 95.0}}, 12, 40},
+		{[]QueryFilter{{FilterGreaterThenOrEqual, "dim2", 10.0}, {FilterLessThan, "dim2", 12.0}}, 6, 20},
+		{[]QueryFilter{{FilterLessThanOrEqual, "dim2", 1.0}, {FilterEqual, "dim1", "a"}}, 6, 7},
+		{[]QueryFilter{{FilterEqual, "dim1", "a"}}, 301, 335},
+	} {
+		query := createQuery()
+		query.Filters = testCase.filters
+
+		resp := db.MakeRequest()
+		params, err := resp.StaticTable.makeScanParams(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, stats, err := resp.StaticTable.scan(params)
+		resp.Done()
+		Assert(t, err, IsNil)
+
+		Assert(t, stats.Get(statRowsScanned), Equals, testCase.rowsScanned)
+		Assert(t, runQuery(db, query)[0]["metric1"], util.DeepConvertibleEquals, testCase.metric1)
+	}
+}
@@ -3,12 +3,9 @@ package gumshoe
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 	"sort"
 	"sync"
 	"time"
-
-	mmap "github.com/philc/gumshoedb/internal/github.com/edsrzf/mmap-go"
 )
 
 // StaticTable is an immutable snapshot of the DB's data.
@@ -16,6 +13,7 @@ type StaticTable struct {
 	*Schema         `json:"-"`
 	Intervals       IntervalMap
 	DimensionTables []*DimensionTable // Same length as the number of dimensions; non-string columns are nil.
+	InsertLogSeq    uint64            // Sequence number of the last insertion log record included in the table
 	scanRequests    chan *scanRequest // Handle to DB's worker pool.
 	wg              *sync.WaitGroup   // For outstanding requests, to know when we can GC this StaticTable.
 }
@@ -65,7 +63,9 @@ func (m *IntervalMap) UnmarshalJSON(b []byte) error {
 		return err
 	}
 	for _, interval := range intervals {
-		(*m)[interval.Time] = interval.Interval
+		// Use the same location as the interval times created on insertion so that the keys can be looked up
+		// using those times.
+		(*m)[interval.Time.Local()] = interval.Interval
 	}
 	return nil
 }
@@ -83,6 +83,7 @@ func NewStaticTable(schema *Schema) *StaticTable {
 }
 
 func (s *StaticTable) initialize(schema *Schema) error {
+	schema.Initialize()
 	s.Schema = schema
 	s.wg = new(sync.WaitGroup)
 
@@ -98,21 +99,28 @@ func (s *StaticTable) initialize(schema *Schema) error {
 
 	// Load each interval/segment
 	for _, interval := range s.Intervals {
-		interval.Segments = make([]*Segment, interval.NumSegments)
-		for i := 0; i < interval.NumSegments; i++ {
-
-			f, err := os.Open(interval.SegmentFilename(schema, i))
-			if err != nil {
-				return err
+		for _, run := range interval.AllRuns() {
+			if run.Schema != nil {
+				run.Schema.Initialize()
+			}
+			if err := run.loadDimensionTables(schema); err != nil {
+				checksumErr, ok := err.(*ChecksumError)
+				if !ok {
+					return err
+				}
+				interval.markCorrupted(checksumErr)
 			}
-			mapped, err := mmap.Map(f, mmap.RDONLY, 0)
-			if err != nil {
-				return err
+			// The segment files are only opened when they are first read.
+			run.Segments = make([]*Segment, run.NumSegments)
+			for i := 0; i < run.NumSegments; i++ {
+				run.Segments[i] = schema.fileSegment(run.SegmentFilename(schema, i))
 			}
-			interval.Segments[i] = &Segment{File: f, Bytes: mapped}
 		}
 	}
 
+	if schema.VerifyChecksumsOnOpen {
+		s.verifyIntervals()
+	}
 	return nil
 }
 
@@ -130,26 +138,34 @@ func (s *StaticTable) debugPrint() {
 	fmt.Println("STATE DEBUG ----------------------------------")
 	for _, interval := range s.Intervals.sorted() {
 		fmt.Printf("Interval [start = %s]\n\n", interval.Start)
-		for i, segment := range interval.Segments {
-			fmt.Printf("  Segment %d\n", i)
-			for j := 0; j < len(segment.Bytes); j += s.RowSize {
-				fmt.Printf("  % x", segment.Bytes[j:j+countColumnWidth])
-				dimColumnStartOffset := j + s.DimensionStartOffset + s.NilBytes
-				fmt.Printf(" ][ % x", segment.Bytes[j+s.DimensionStartOffset:dimColumnStartOffset])
-				fmt.Printf(" | % x", segment.Bytes[dimColumnStartOffset:j+s.MetricStartOffset])
-				fmt.Printf(" ][ % x\n", segment.Bytes[j+s.MetricStartOffset:j+s.RowSize])
+		for r, run := range interval.AllRuns() {
+			for i, segment := range run.Segments {
+				fmt.Printf("  Run %d, segment %d\n", r, i)
+				rows, err := s.IntervalSegmentRows(run, segment)
+				if err != nil {
+					fmt.Printf("  Cannot read segment: %s\n\n", err)
+					continue
+				}
+				for j := 0; j < len(rows); j += s.RowSize {
+					fmt.Printf("  % x", rows[j:j+countColumnWidth])
+					dimColumnStartOffset := j + s.DimensionStartOffset + s.NilBytes
+					fmt.Printf(" ][ % x", rows[j+s.DimensionStartOffset:dimColumnStartOffset])
+					fmt.Printf(" | % x", rows[dimColumnStartOffset:j+s.MetricStartOffset])
+					fmt.Printf(" ][ % x\n", rows[j+s.MetricStartOffset:j+s.RowSize])
+				}
+				fmt.Println()
 			}
-			fmt.Println()
 		}
 	}
 	fmt.Println("----------------------------------------------")
 }
 
 type StaticTableStats struct {
-	Intervals int
-	Segments  int
-	Rows      int
-	Bytes     int
+	Intervals         int
+	Segments          int
+	Rows              int
+	Bytes             int // Stored (possibly compressed) size of the segments
+	UncompressedBytes int
 
 	// CompressionRatio is the ratio of logical rows in the table to the stored rows in this StaticTable. For
 	// instance, if the rows are completely uncollapsible, then the count is 1 for every row and the compression
@@ -161,12 +177,15 @@ type StaticTableStats struct {
 }
 
 type IntervalStats struct {
-	Segments int
-	Rows     int
-	Bytes    int
+	Segments          int
+	Rows              int
+	Bytes             int
+	UncompressedBytes int
 }
 
-// stats does a full table scan and returns various metrics about the table in the form of StaticTableStats.
+// stats returns various metrics about the table in the form of StaticTableStats. They come from the interval
+// metadata and the sizes of the segment files, so no segments are read. The compression ratio only covers
+// the intervals which record their logical row counts.
 func (s *StaticTable) stats() *StaticTableStats {
 	stats := &StaticTableStats{
 		Intervals:  len(s.Intervals),
@@ -174,23 +193,38 @@ func (s *StaticTable) stats() *StaticTableStats {
 	}
 
 	logicalRows := 0
-	physicalRows := 0
+	countedRows := 0 // The physical rows of the runs which record their logical rows
 	for t, interval := range s.Intervals {
-		stats.Segments += interval.NumSegments
-		physicalRows += interval.NumRows
-		intervalBytes := 0
-		for _, segment := range interval.Segments {
-			intervalBytes += len(segment.Bytes)
-			for cursor := 0; cursor < len(segment.Bytes); cursor += s.RowSize {
-				row := RowBytes(segment.Bytes[cursor : cursor+s.RowSize])
-				logicalRows += int(row.count(s.Schema))
+		intervalStats := new(IntervalStats)
+		for _, run := range interval.AllRuns() {
+			intervalStats.Segments += run.NumSegments
+			intervalStats.Rows += run.NumRows
+			// The rows are stored in the layout of the schema the run was written with.
+			layout := s.Schema
+			if run.Schema != nil {
+				layout = run.Schema
+			}
+			intervalStats.UncompressedBytes += run.NumRows * layout.RowSize
+			for i, segment := range run.Segments {
+				size, err := segment.storedSize()
+				if err != nil {
+					Log.Printf("Cannot get the size of %s: %s", run.SegmentFilename(s.Schema, i), err)
+					continue
+				}
+				intervalStats.Bytes += size
+			}
+			if run.LogicalRows > 0 {
+				logicalRows += run.LogicalRows
+				countedRows += run.NumRows
 			}
 		}
-		stats.Bytes += intervalBytes
-		stats.ByInterval[t] = &IntervalStats{interval.NumSegments, interval.NumRows, intervalBytes}
+		stats.Segments += intervalStats.Segments
+		stats.Rows += intervalStats.Rows
+		stats.Bytes += intervalStats.Bytes
+		stats.UncompressedBytes += intervalStats.UncompressedBytes
+		stats.ByInterval[t] = intervalStats
 	}
 
-	stats.Rows = physicalRows
-	stats.CompressionRatio = float64(logicalRows) / float64(physicalRows)
+	stats.CompressionRatio = float64(logicalRows) / float64(countedRows)
 	return stats
 }
@@ -1,6 +1,7 @@
 package gumshoe
 
 import (
+	"os"
 	"testing"
 
 	"github.com/philc/gumshoedb/internal/util"
@@ -19,3 +20,37 @@ func TestCompressionFactorWorks(t *testing.T) {
 	stats := db.GetDebugStats()
 	Assert(t, stats.CompressionRatio, Equals, 4.0)
 }
+
+func TestStatsDoNotReadSegments(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	for i := 0; i < 2; i++ {
+		insertRows(db, []RowMap{
+			{"at": hour(0), "dim1": "a", "metric1": 1.0},
+			{"at": hour(1), "dim1": "b", "metric1": 1.0},
+		})
+	}
+	db = reopenTestDB(db)
+	defer closeTestDB(db)
+
+	stats := db.GetDebugStats()
+	Assert(t, db.segmentCache.openCount(), Equals, 0)
+	Assert(t, stats.Rows, Equals, 2)
+	Assert(t, stats.CompressionRatio, Equals, 2.0)
+	Assert(t, stats.UncompressedBytes, Equals, 2*db.RowSize)
+	bytes := 0
+	for _, filename := range segmentFiles(t, db.Dir) {
+		info, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bytes += int(info.Size())
+	}
+	Assert(t, stats.Bytes, Equals, bytes)
+
+	// A missing segment file doesn't stop the stats from being reported.
+	if err := os.Remove(segmentFiles(t, db.Dir)[0]); err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, db.GetDebugStats().Rows, Equals, 2)
+}
@@ -21,19 +21,22 @@ const (
 	TypeUint64  Type = iota
 	TypeInt64   Type = iota
 	TypeFloat64 Type = iota
+	// TypeHyperLogLog is the type of metric columns holding a HyperLogLog sketch (see hyperloglog.go).
+	TypeHyperLogLog
 )
 
 var typeWidths = []int{
-	TypeUint8:   int(unsafe.Sizeof(uint8(0))),
-	TypeInt8:    int(unsafe.Sizeof(int8(0))),
-	TypeUint16:  int(unsafe.Sizeof(uint16(0))),
-	TypeInt16:   int(unsafe.Sizeof(int16(0))),
-	TypeUint32:  int(unsafe.Sizeof(uint32(0))),
-	TypeInt32:   int(unsafe.Sizeof(int32(0))),
-	TypeFloat32: int(unsafe.Sizeof(float32(0))),
-	TypeUint64:  int(unsafe.Sizeof(uint64(0))),
-	TypeInt64:   int(unsafe.Sizeof(int64(0))),
-	TypeFloat64: int(unsafe.Sizeof(float64(0))),
+	TypeUint8:       int(unsafe.Sizeof(uint8(0))),
+	TypeInt8:        int(unsafe.Sizeof(int8(0))),
+	TypeUint16:      int(unsafe.Sizeof(uint16(0))),
+	TypeInt16:       int(unsafe.Sizeof(int16(0))),
+	TypeUint32:      int(unsafe.Sizeof(uint32(0))),
+	TypeInt32:       int(unsafe.Sizeof(int32(0))),
+	TypeFloat32:     int(unsafe.Sizeof(float32(0))),
+	TypeUint64:      int(unsafe.Sizeof(uint64(0))),
+	TypeInt64:       int(unsafe.Sizeof(int64(0))),
+	TypeFloat64:     int(unsafe.Sizeof(float64(0))),
+	TypeHyperLogLog: hllRegisters,
 }
 
 var typeMaxes = []float64{
@@ -50,45 +53,49 @@ var typeMaxes = []float64{
 }
 
 var typeNames = []string{
-	TypeUint8:   "uint8",
-	TypeInt8:    "int8",
-	TypeUint16:  "uint16",
-	TypeInt16:   "int16",
-	TypeUint32:  "uint32",
-	TypeInt32:   "int32",
-	TypeFloat32: "float32",
-	TypeUint64:  "uint64",
-	TypeInt64:   "int64",
-	TypeFloat64: "float64",
+	TypeUint8:       "uint8",
+	TypeInt8:        "int8",
+	TypeUint16:      "uint16",
+	TypeInt16:       "int16",
+	TypeUint32:      "uint32",
+	TypeInt32:       "int32",
+	TypeFloat32:     "float32",
+	TypeUint64:      "uint64",
+	TypeInt64:       "int64",
+	TypeFloat64:     "float64",
+	TypeHyperLogLog: "hyperloglog",
 }
 
 var NameToType = map[string]Type{
-	"uint8":   TypeUint8,
-	"int8":    TypeInt8,
-	"uint16":  TypeUint16,
-	"int16":   TypeInt16,
-	"uint32":  TypeUint32,
-	"int32":   TypeInt32,
-	"float32": TypeFloat32,
-	"uint64":  TypeUint64,
-	"int64":   TypeInt64,
-	"float64": TypeFloat64,
+	"uint8":       TypeUint8,
+	"int8":        TypeInt8,
+	"uint16":      TypeUint16,
+	"int16":       TypeInt16,
+	"uint32":      TypeUint32,
+	"int32":       TypeInt32,
+	"float32":     TypeFloat32,
+	"uint64":      TypeUint64,
+	"int64":       TypeInt64,
+	"float64":     TypeFloat64,
+	"hyperloglog": TypeHyperLogLog,
 }
 
 var TypeToBigType = []Type{
-	TypeUint8:   TypeUint64,
-	TypeInt8:    TypeInt64,
-	TypeUint16:  TypeUint64,
-	TypeInt16:   TypeInt64,
-	TypeUint32:  TypeUint64,
-	TypeInt32:   TypeInt64,
-	TypeFloat32: TypeFloat64,
-	TypeUint64:  TypeUint64,
-	TypeInt64:   TypeInt64,
-	TypeFloat64: TypeFloat64,
+	TypeUint8:       TypeUint64,
+	TypeInt8:        TypeInt64,
+	TypeUint16:      TypeUint64,
+	TypeInt16:       TypeInt64,
+	TypeUint32:      TypeUint64,
+	TypeInt32:       TypeInt64,
+	TypeFloat32:     TypeFloat64,
+	TypeUint64:      TypeUint64,
+	TypeInt64:       TypeInt64,
+	TypeFloat64:     TypeFloat64,
+	TypeHyperLogLog: TypeHyperLogLog,
 }
 
-// add adds other to m (only m is modified).
+// add combines other into m (only m is modified) using the merge function of each column: the values are
+// summed, or the smaller or larger value is kept. HyperLogLog sketches are always merged.
 func (m MetricBytes) add(s *Schema, other MetricBytes) {
 	p1 := uintptr(unsafe.Pointer(&m[0]))
 	p2 := uintptr(unsafe.Pointer(&other[0]))
@@ -98,25 +105,147 @@ func (m MetricBytes) add(s *Schema, other MetricBytes) {
 		col2 := unsafe.Pointer(p2 + offset)
 		switch column.Type {
 		case TypeUint8:
-			*(*uint8)(col1) = *(*uint8)(col1) + (*(*uint8)(col2))
+			v1, v2 := (*uint8)(col1), *(*uint8)(col2)
+			switch column.Merge {
+			case MergeSum:
+				*v1 += v2
+			case MergeMin:
+				if v2 < *v1 {
+					*v1 = v2
+				}
+			case MergeMax:
+				if v2 > *v1 {
+					*v1 = v2
+				}
+			}
 		case TypeInt8:
-			*(*int8)(col1) = *(*int8)(col1) + (*(*int8)(col2))
+			v1, v2 := (*int8)(col1), *(*int8)(col2)
+			switch column.Merge {
+			case MergeSum:
+				*v1 += v2
+			case MergeMin:
+				if v2 < *v1 {
+					*v1 = v2
+				}
+			case MergeMax:
+				if v2 > *v1 {
+					*v1 = v2
+				}
+			}
 		case TypeUint16:
-			*(*uint16)(col1) = *(*uint16)(col1) + (*(*uint16)(col2))
+			v1, v2 := (*uint16)(col1), *(*uint16)(col2)
+			switch column.Merge {
+			case MergeSum:
+				*v1 += v2
+			case MergeMin:
+				if v2 < *v1 {
+					*v1 = v2
+				}
+			case MergeMax:
+				if v2 > *v1 {
+					*v1 = v2
+				}
+			}
 		case TypeInt16:
-			*(*int16)(col1) = *(*int16)(col1) + (*(*int16)(col2))
+			v1, v2 := (*int16)(col1), *(*int16)(col2)
+			switch column.Merge {
+			case MergeSum:
+				*v1 += v2
+			case MergeMin:
+				if v2 < *v1 {
+					*v1 = v2
+				}
+			case MergeMax:
+				if v2 > *v1 {
+					*v1 = v2
+				}
+			}
 		case TypeUint32:
-			*(*uint32)(col1) = *(*uint32)(col1) + (*(*uint32)(col2))
+			v1, v2 := (*uint32)(col1), *(*uint32)(col2)
+			switch column.Merge {
+			case MergeSum:
+				*v1 += v2
+			case MergeMin:
+				if v2 < *v1 {
+					*v1 = v2
+				}
+			case MergeMax:
+				if v2 > *v1 {
+					*v1 = v2
+				}
+			}
 		case TypeInt32:
-			*(*int32)(col1) = *(*int32)(col1) + (*(*int32)(col2))
+			v1, v2 := (*int32)(col1), *(*int32)(col2)
+			switch column.Merge {
+			case MergeSum:
+				*v1 += v2
+			case MergeMin:
+				if v2 < *v1 {
+					*v1 = v2
+				}
+			case MergeMax:
+				if v2 > *v1 {
+					*v1 = v2
+				}
+			}
 		case TypeFloat32:
-			*(*float32)(col1) = *(*float32)(col1) + (*(*float32)(col2))
+			v1, v2 := (*float32)(col1), *(*float32)(col2)
+			switch column.Merge {
+			case MergeSum:
+				*v1 += v2
+			case MergeMin:
+				if v2 < *v1 {
+					*v1 = v2
+				}
+			case MergeMax:
+				if v2 > *v1 {
+					*v1 = v2
+				}
+			}
 		case TypeUint64:
-			*(*uint64)(col1) = *(*uint64)(col1) + (*(*uint64)(col2))
+			v1, v2 := (*uint64)(col1), *(*uint64)(col2)
+			switch column.Merge {
+			case MergeSum:
+				*v1 += v2
+			case MergeMin:
+				if v2 < *v1 {
+					*v1 = v2
+				}
+			case MergeMax:
+				if v2 > *v1 {
+					*v1 = v2
+				}
+			}
 		case TypeInt64:
-			*(*int64)(col1) = *(*int64)(col1) + (*(*int64)(col2))
+			v1, v2 := (*int64)(col1), *(*int64)(col2)
+			switch column.Merge {
+			case MergeSum:
+				*v1 += v2
+			case MergeMin:
+				if v2 < *v1 {
+					*v1 = v2
+				}
+			case MergeMax:
+				if v2 > *v1 {
+					*v1 = v2
+				}
+			}
 		case TypeFloat64:
-			*(*float64)(col1) = *(*float64)(col1) + (*(*float64)(col2))
+			v1, v2 := (*float64)(col1), *(*float64)(col2)
+			switch column.Merge {
+			case MergeSum:
+				*v1 += v2
+			case MergeMin:
+				if v2 < *v1 {
+					*v1 = v2
+				}
+			case MergeMax:
+				if v2 > *v1 {
+					*v1 = v2
+				}
+			}
+		case TypeHyperLogLog:
+			HyperLogLog(m[offset:]).Merge(HyperLogLog(other[offset:]))
 		}
 	}
 }
@@ -226,6 +355,118 @@ func sumUntyped(u1, u2 Untyped, typ Type) Untyped {
 	panic("unexpected type")
 }
 
+func minUntyped(u1, u2 Untyped, typ Type) Untyped {
+	switch typ {
+	case TypeUint8:
+		if u2.(uint8) < u1.(uint8) {
+			return u2
+		}
+		return u1
+	case TypeInt8:
+		if u2.(int8) < u1.(int8) {
+			return u2
+		}
+		return u1
+	case TypeUint16:
+		if u2.(uint16) < u1.(uint16) {
+			return u2
+		}
+		return u1
+	case TypeInt16:
+		if u2.(int16) < u1.(int16) {
+			return u2
+		}
+		return u1
+	case TypeUint32:
+		if u2.(uint32) < u1.(uint32) {
+			return u2
+		}
+		return u1
+	case TypeInt32:
+		if u2.(int32) < u1.(int32) {
+			return u2
+		}
+		return u1
+	case TypeFloat32:
+		if u2.(float32) < u1.(float32) {
+			return u2
+		}
+		return u1
+	case TypeUint64:
+		if u2.(uint64) < u1.(uint64) {
+			return u2
+		}
+		return u1
+	case TypeInt64:
+		if u2.(int64) < u1.(int64) {
+			return u2
+		}
+		return u1
+	case TypeFloat64:
+		if u2.(float64) < u1.(float64) {
+			return u2
+		}
+		return u1
+	}
+	panic("unexpected type")
+}
+
+func maxUntyped(u1, u2 Untyped, typ Type) Untyped {
+	switch typ {
+	case TypeUint8:
+		if u2.(uint8) > u1.(uint8) {
+			return u2
+		}
+		return u1
+	case TypeInt8:
+		if u2.(int8) > u1.(int8) {
+			return u2
+		}
+		return u1
+	case TypeUint16:
+		if u2.(uint16) > u1.(uint16) {
+			return u2
+		}
+		return u1
+	case TypeInt16:
+		if u2.(int16) > u1.(int16) {
+			return u2
+		}
+		return u1
+	case TypeUint32:
+		if u2.(uint32) > u1.(uint32) {
+			return u2
+		}
+		return u1
+	case TypeInt32:
+		if u2.(int32) > u1.(int32) {
+			return u2
+		}
+		return u1
+	case TypeFloat32:
+		if u2.(float32) > u1.(float32) {
+			return u2
+		}
+		return u1
+	case TypeUint64:
+		if u2.(uint64) > u1.(uint64) {
+			return u2
+		}
+		return u1
+	case TypeInt64:
+		if u2.(int64) > u1.(int64) {
+			return u2
+		}
+		return u1
+	case TypeFloat64:
+		if u2.(float64) > u1.(float64) {
+			return u2
+		}
+		return u1
+	}
+	panic("unexpected type")
+}
+
 // Query helper functions
 
 type FilterType int
@@ -238,6 +479,13 @@ const (
 	FilterLessThan           FilterType = iota
 	FilterLessThanOrEqual    FilterType = iota
 	FilterIn                 FilterType = iota
+	FilterPrefix             FilterType = iota
+	FilterSuffix             FilterType = iota
+	FilterContains           FilterType = iota
+	FilterRegex              FilterType = iota
+	FilterAnd                FilterType = iota
+	FilterOr                 FilterType = iota
+	FilterNot                FilterType = iota
 )
 
 var filterTypeToName = []string{
@@ -248,16 +496,30 @@ var filterTypeToName = []string{
 	FilterLessThan:           "<",
 	FilterLessThanOrEqual:    "<=",
 	FilterIn:                 "in",
+	FilterPrefix:             "prefix",
+	FilterSuffix:             "suffix",
+	FilterContains:           "contains",
+	FilterRegex:              "regex",
+	FilterAnd:                "and",
+	FilterOr:                 "or",
+	FilterNot:                "not",
 }
 
 var filterNameToType = map[string]FilterType{
-	"=":  FilterEqual,
-	"!=": FilterNotEqual,
-	">":  FilterGreaterThan,
-	">=": FilterGreaterThenOrEqual,
-	"<":  FilterLessThan,
-	"<=": FilterLessThanOrEqual,
-	"in": FilterIn,
+	"=":        FilterEqual,
+	"!=":       FilterNotEqual,
+	">":        FilterGreaterThan,
+	">=":       FilterGreaterThenOrEqual,
+	"<":        FilterLessThan,
+	"<=":       FilterLessThanOrEqual,
+	"in":       FilterIn,
+	"prefix":   FilterPrefix,
+	"suffix":   FilterSuffix,
+	"contains": FilterContains,
+	"regex":    FilterRegex,
+	"and":      FilterAnd,
+	"or":       FilterOr,
+	"not":      FilterNot,
 }
 
 func makeSumFuncGen(typ Type) func(offset int) sumFunc {
@@ -335,6 +597,216 @@ func makeSumFuncGen(typ Type) func(offset int) sumFunc {
 	panic("unreached")
 }
 
+func makeMinFuncGen(typ Type) func(offset int) sumFunc {
+
+	if typ == TypeUint8 {
+		return func(offset int) sumFunc {
+			return func(min UntypedBytes, metrics MetricBytes) {
+				value := uint64(*(*uint8)(unsafe.Pointer(&metrics[offset])))
+				if p := (*uint64)(unsafe.Pointer(&min[0])); value < *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeInt8 {
+		return func(offset int) sumFunc {
+			return func(min UntypedBytes, metrics MetricBytes) {
+				value := int64(*(*int8)(unsafe.Pointer(&metrics[offset])))
+				if p := (*int64)(unsafe.Pointer(&min[0])); value < *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeUint16 {
+		return func(offset int) sumFunc {
+			return func(min UntypedBytes, metrics MetricBytes) {
+				value := uint64(*(*uint16)(unsafe.Pointer(&metrics[offset])))
+				if p := (*uint64)(unsafe.Pointer(&min[0])); value < *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeInt16 {
+		return func(offset int) sumFunc {
+			return func(min UntypedBytes, metrics MetricBytes) {
+				value := int64(*(*int16)(unsafe.Pointer(&metrics[offset])))
+				if p := (*int64)(unsafe.Pointer(&min[0])); value < *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeUint32 {
+		return func(offset int) sumFunc {
+			return func(min UntypedBytes, metrics MetricBytes) {
+				value := uint64(*(*uint32)(unsafe.Pointer(&metrics[offset])))
+				if p := (*uint64)(unsafe.Pointer(&min[0])); value < *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeInt32 {
+		return func(offset int) sumFunc {
+			return func(min UntypedBytes, metrics MetricBytes) {
+				value := int64(*(*int32)(unsafe.Pointer(&metrics[offset])))
+				if p := (*int64)(unsafe.Pointer(&min[0])); value < *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeFloat32 {
+		return func(offset int) sumFunc {
+			return func(min UntypedBytes, metrics MetricBytes) {
+				value := float64(*(*float32)(unsafe.Pointer(&metrics[offset])))
+				if p := (*float64)(unsafe.Pointer(&min[0])); value < *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeUint64 {
+		return func(offset int) sumFunc {
+			return func(min UntypedBytes, metrics MetricBytes) {
+				value := uint64(*(*uint64)(unsafe.Pointer(&metrics[offset])))
+				if p := (*uint64)(unsafe.Pointer(&min[0])); value < *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeInt64 {
+		return func(offset int) sumFunc {
+			return func(min UntypedBytes, metrics MetricBytes) {
+				value := int64(*(*int64)(unsafe.Pointer(&metrics[offset])))
+				if p := (*int64)(unsafe.Pointer(&min[0])); value < *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeFloat64 {
+		return func(offset int) sumFunc {
+			return func(min UntypedBytes, metrics MetricBytes) {
+				value := float64(*(*float64)(unsafe.Pointer(&metrics[offset])))
+				if p := (*float64)(unsafe.Pointer(&min[0])); value < *p {
+					*p = value
+				}
+			}
+		}
+	}
+	panic("unreached")
+}
+
+func makeMaxFuncGen(typ Type) func(offset int) sumFunc {
+
+	if typ == TypeUint8 {
+		return func(offset int) sumFunc {
+			return func(max UntypedBytes, metrics MetricBytes) {
+				value := uint64(*(*uint8)(unsafe.Pointer(&metrics[offset])))
+				if p := (*uint64)(unsafe.Pointer(&max[0])); value > *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeInt8 {
+		return func(offset int) sumFunc {
+			return func(max UntypedBytes, metrics MetricBytes) {
+				value := int64(*(*int8)(unsafe.Pointer(&metrics[offset])))
+				if p := (*int64)(unsafe.Pointer(&max[0])); value > *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeUint16 {
+		return func(offset int) sumFunc {
+			return func(max UntypedBytes, metrics MetricBytes) {
+				value := uint64(*(*uint16)(unsafe.Pointer(&metrics[offset])))
+				if p := (*uint64)(unsafe.Pointer(&max[0])); value > *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeInt16 {
+		return func(offset int) sumFunc {
+			return func(max UntypedBytes, metrics MetricBytes) {
+				value := int64(*(*int16)(unsafe.Pointer(&metrics[offset])))
+				if p := (*int64)(unsafe.Pointer(&max[0])); value > *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeUint32 {
+		return func(offset int) sumFunc {
+			return func(max UntypedBytes, metrics MetricBytes) {
+				value := uint64(*(*uint32)(unsafe.Pointer(&metrics[offset])))
+				if p := (*uint64)(unsafe.Pointer(&max[0])); value > *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeInt32 {
+		return func(offset int) sumFunc {
+			return func(max UntypedBytes, metrics MetricBytes) {
+				value := int64(*(*int32)(unsafe.Pointer(&metrics[offset])))
+				if p := (*int64)(unsafe.Pointer(&max[0])); value > *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeFloat32 {
+		return func(offset int) sumFunc {
+			return func(max UntypedBytes, metrics MetricBytes) {
+				value := float64(*(*float32)(unsafe.Pointer(&metrics[offset])))
+				if p := (*float64)(unsafe.Pointer(&max[0])); value > *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeUint64 {
+		return func(offset int) sumFunc {
+			return func(max UntypedBytes, metrics MetricBytes) {
+				value := uint64(*(*uint64)(unsafe.Pointer(&metrics[offset])))
+				if p := (*uint64)(unsafe.Pointer(&max[0])); value > *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeInt64 {
+		return func(offset int) sumFunc {
+			return func(max UntypedBytes, metrics MetricBytes) {
+				value := int64(*(*int64)(unsafe.Pointer(&metrics[offset])))
+				if p := (*int64)(unsafe.Pointer(&max[0])); value > *p {
+					*p = value
+				}
+			}
+		}
+	}
+	if typ == TypeFloat64 {
+		return func(offset int) sumFunc {
+			return func(max UntypedBytes, metrics MetricBytes) {
+				value := float64(*(*float64)(unsafe.Pointer(&metrics[offset])))
+				if p := (*float64)(unsafe.Pointer(&max[0])); value > *p {
+					*p = value
+				}
+			}
+		}
+	}
+	panic("unreached")
+}
+
 func makeGetDimensionValueFuncGen(typ Type) func(cell unsafe.Pointer) Untyped {
 
 	if typ == TypeUint8 {
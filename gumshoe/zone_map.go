@@ -0,0 +1,246 @@
+package gumshoe
+
+import (
+	"math"
+	"unsafe"
+)
+
+// A ZoneMap summarizes the values of each column within a single segment. Zone maps are stored in the
+// metadata alongside the intervals, and the scan uses them to skip segments which cannot contain any rows
+// matching the query's filters.
+type ZoneMap struct {
+	Dimensions []ColumnZone
+	Metrics    []ColumnZone
+}
+
+// A ColumnZone is the range of values taken by one column in a segment. For string dimension columns, the
+// range is over dimension table indexes.
+type ColumnZone struct {
+	Min float64 `json:",omitempty"`
+	Max float64 `json:",omitempty"`
+	// HasValue is whether any row has a non-nil value (if not, Min and Max are meaningless).
+	HasValue bool `json:",omitempty"`
+	HasNil   bool `json:",omitempty"`
+	// Unbounded is set if the column has NaN or infinite values. (These can't be stored in the JSON metadata,
+	// so such a column can't be used to skip the segment.)
+	Unbounded bool `json:",omitempty"`
+}
+
+func (z *ColumnZone) add(value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		z.Unbounded = true
+		return
+	}
+	if !z.HasValue {
+		z.Min, z.Max, z.HasValue = value, value, true
+		return
+	}
+	if value < z.Min {
+		z.Min = value
+	}
+	if value > z.Max {
+		z.Max = value
+	}
+}
+
+// makeZoneMap computes the zone map for rows (a sequence of whole rows in the row format).
+func (s *Schema) makeZoneMap(rows []byte) *ZoneMap {
+	zoneMap := &ZoneMap{
+		Dimensions: make([]ColumnZone, len(s.DimensionColumns)),
+		Metrics:    make([]ColumnZone, len(s.MetricColumns)),
+	}
+	for i := 0; i < len(rows); i += s.RowSize {
+		dimensions := DimensionBytes(rows[i+s.DimensionStartOffset : i+s.MetricStartOffset])
+		for j, col := range s.DimensionColumns {
+			if dimensions.IsNil(j) {
+				zoneMap.Dimensions[j].HasNil = true
+				continue
+			}
+			zoneMap.Dimensions[j].add(cellFloat64(unsafe.Pointer(&dimensions[s.DimensionOffsets[j]]), col.Type))
+		}
+		metrics := MetricBytes(rows[i+s.MetricStartOffset : i+s.RowSize])
+		for j, col := range s.MetricColumns {
+			if col.Type == TypeHyperLogLog {
+				continue // Sketches can't be filtered on
+			}
+			zoneMap.Metrics[j].add(cellFloat64(unsafe.Pointer(&metrics[s.MetricOffsets[j]]), col.Type))
+		}
+	}
+	return zoneMap
+}
+
+// cellFloat64 reads the numeric value in cell as a float64.
+func cellFloat64(cell unsafe.Pointer, typ Type) float64 {
+	switch typ {
+	case TypeUint8:
+		return float64(*(*uint8)(cell))
+	case TypeInt8:
+		return float64(*(*int8)(cell))
+	case TypeUint16:
+		return float64(*(*uint16)(cell))
+	case TypeInt16:
+		return float64(*(*int16)(cell))
+	case TypeUint32:
+		return float64(*(*uint32)(cell))
+	case TypeInt32:
+		return float64(*(*int32)(cell))
+	case TypeFloat32:
+		return float64(*(*float32)(cell))
+	case TypeUint64:
+		return float64(*(*uint64)(cell))
+	case TypeInt64:
+		return float64(*(*int64)(cell))
+	case TypeFloat64:
+		return *(*float64)(cell)
+	}
+	panic("unexpected type")
+}
+
+// typedFloat64 converts value to typ and back, giving the value that a filter on a column of type typ
+// actually compares against.
+func typedFloat64(value float64, typ Type) float64 {
+	var cell [8]byte
+	setRowValue(unsafe.Pointer(&cell[0]), typ, value)
+	return cellFloat64(unsafe.Pointer(&cell[0]), typ)
+}
+
+// A zoneFilterFunc reports whether a segment with the given zone map might contain rows that pass a filter.
+type zoneFilterFunc func(zoneMap *ZoneMap) bool
+
+// zoneFilterColumn describes which column's zone a zoneFilterFunc looks at.
+type zoneFilterColumn struct {
+	IsMetric bool
+	Index    int
+	Type     Type
+}
+
+// zone returns the column's zone in zoneMap. ok is false if the zone map doesn't have enough information to
+// rule anything out.
+func (c zoneFilterColumn) zone(zoneMap *ZoneMap) (zone ColumnZone, ok bool) {
+	zones := zoneMap.Dimensions
+	if c.IsMetric {
+		zones = zoneMap.Metrics
+	}
+	if c.Index >= len(zones) || zones[c.Index].Unbounded {
+		return ColumnZone{}, false
+	}
+	return zones[c.Index], true
+}
+
+// makeZoneFilterFunc returns a zoneFilterFunc corresponding to a filter on a dimension or metric column. It
+// returns nil if the filter cannot be used to skip segments. The filter should already have been validated
+// by compiling it with makeDimensionFilterFunc or makeMetricFilterFunc.
+func (s *StaticTable) makeZoneFilterFunc(filter QueryFilter) zoneFilterFunc {
+	if isPatternFilter(filter.Type) {
+		return nil
+	}
+	var column zoneFilterColumn
+	var isString bool
+	if index, ok := s.DimensionNameToIndex[filter.Column]; ok {
+		col := s.DimensionColumns[index]
+		column = zoneFilterColumn{Index: index, Type: col.Type}
+		isString = col.String
+	} else if index, ok := s.MetricNameToIndex[filter.Column]; ok {
+		column = zoneFilterColumn{IsMetric: true, Index: index, Type: s.MetricColumns[index].Type}
+	} else {
+		return nil
+	}
+	// Values of 64-bit integer columns can't all be represented exactly as float64s.
+	if column.Type == TypeUint64 || column.Type == TypeInt64 {
+		return nil
+	}
+
+	// toValue converts a filter value to the float64 the column is compared against. ok is false if the value
+	// is a string that isn't in the dimension table (so no row can match it).
+	toValue := func(v interface{}) (value float64, ok bool) {
+		if isString {
+			dimIndex, ok := s.DimensionTables[column.Index].Get(v.(string))
+			return float64(dimIndex), ok
+		}
+		return typedFloat64(v.(float64), column.Type), true
+	}
+
+	if filter.Type == FilterIn {
+		values, ok := filter.Value.([]interface{})
+		if !ok {
+			return nil
+		}
+		acceptNil := false
+		var floats []float64
+		for _, v := range values {
+			if v == nil {
+				acceptNil = true
+				continue
+			}
+			if value, ok := toValue(v); ok {
+				floats = append(floats, value)
+			}
+		}
+		return func(zoneMap *ZoneMap) bool {
+			zone, ok := column.zone(zoneMap)
+			if !ok {
+				return true
+			}
+			if acceptNil && zone.HasNil {
+				return true
+			}
+			if !zone.HasValue {
+				return false
+			}
+			for _, value := range floats {
+				if zone.Min <= value && value <= zone.Max {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	// See the comparison table in makeDimensionFilterFunc for how nils are handled.
+	if filter.Value == nil {
+		return func(zoneMap *ZoneMap) bool {
+			zone, ok := column.zone(zoneMap)
+			if !ok {
+				return true
+			}
+			switch filter.Type {
+			case FilterEqual:
+				return zone.HasNil
+			case FilterNotEqual:
+				return zone.HasValue
+			}
+			return false
+		}
+	}
+	value, ok := toValue(filter.Value)
+	if !ok {
+		return nil
+	}
+	return func(zoneMap *ZoneMap) bool {
+		zone, ok := column.zone(zoneMap)
+		if !ok {
+			return true
+		}
+		if filter.Type == FilterNotEqual && zone.HasNil {
+			return true
+		}
+		if !zone.HasValue {
+			return false
+		}
+		switch filter.Type {
+		case FilterEqual:
+			return zone.Min <= value && value <= zone.Max
+		case FilterNotEqual:
+			return zone.Min != value || zone.Max != value
+		case FilterGreaterThan:
+			return zone.Max > value
+		case FilterGreaterThenOrEqual:
+			return zone.Max >= value
+		case FilterLessThan:
+			return zone.Min < value
+		case FilterLessThanOrEqual:
+			return zone.Min <= value
+		}
+		return true
+	}
+}
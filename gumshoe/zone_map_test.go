@@ -0,0 +1,113 @@
+package gumshoe
+
+import (
+	"os"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+// makeZoneMapTestDB makes a DB with three segments in a single interval. dim2 takes the values 0-49 in the
+// first segment, 50-99 in the second, and 100-149 in the third; it is nil in a fourth segment.
+func makeZoneMapTestDB() *DB {
+	db := makeTestDB(func(schema *Schema) {
+		schema.DimensionColumns = []DimensionColumn{makeDimensionColumn("dim2", "uint16", false)}
+		schema.Initialize()
+		schema.SegmentSize = 50 * schema.RowSize
+	})
+	var rows []RowMap
+	for i := 0; i < 150; i++ {
+		rows = append(rows, RowMap{"at": 0.0, "dim2": float64(i), "metric1": float64(i)})
+	}
+	rows = append(rows, RowMap{"at": 0.0, "dim2": nil, "metric1": 1000.0})
+	insertRows(db, rows)
+	return db
+}
+
+func TestZoneMapsAreRecorded(t *testing.T) {
+	db := makeZoneMapTestDB()
+	defer closeTestDB(db)
+
+	resp := db.MakeRequest()
+	defer resp.Done()
+	Assert(t, len(resp.StaticTable.Intervals), Equals, 1)
+	for _, interval := range resp.StaticTable.Intervals {
+		Assert(t, interval.ZoneMaps, DeepEquals, []*ZoneMap{
+			{
+				Dimensions: []ColumnZone{{Min: 0, Max: 49, HasValue: true}},
+				Metrics:    []ColumnZone{{Min: 0, Max: 49, HasValue: true}},
+			},
+			{
+				Dimensions: []ColumnZone{{Min: 50, Max: 99, HasValue: true}},
+				Metrics:    []ColumnZone{{Min: 50, Max: 99, HasValue: true}},
+			},
+			{
+				Dimensions: []ColumnZone{{Min: 100, Max: 149, HasValue: true}},
+				Metrics:    []ColumnZone{{Min: 100, Max: 149, HasValue: true}},
+			},
+			{
+				Dimensions: []ColumnZone{{HasNil: true}},
+				Metrics:    []ColumnZone{{Min: 1000, Max: 1000, HasValue: true}},
+			},
+		})
+	}
+}
+
+func TestSegmentsAreSkippedUsingZoneMaps(t *testing.T) {
+	db := makeZoneMapTestDB()
+	defer closeTestDB(db)
+
+	for _, testCase := range []struct {
+		filter          QueryFilter
+		segmentsSkipped int
+		metric1         int
+	}{
+		{QueryFilter{FilterEqual, "dim2", 60.0}, 3, 60},
+		{QueryFilter{FilterEqual, "dim2", 500.0}, 4, 0},
+		{QueryFilter{FilterEqual, "dim2", nil}, 3, 1000},
+		{QueryFilter{FilterNotEqual, "dim2", nil}, 1, 149 * 150 / 2},
+		{QueryFilter{FilterNotEqual, "dim2", 3.0}, 0, 149*150/2 - 3 + 1000},
+		{QueryFilter{FilterGreaterThan, "dim2", 99.0}, 3, (100 + 149) * 50 / 2},
+		{QueryFilter{FilterGreaterThenOrEqual, "dim2", 99.0}, 2, (99 + 149) * 51 / 2},
+		{QueryFilter{FilterLessThan, "dim2", 50.0}, 3, 49 * 50 / 2},
+		{QueryFilter{FilterLessThanOrEqual, "dim2", 50.0}, 2, 50 * 51 / 2},
+		{QueryFilter{FilterIn, "dim2", []interface{}{1.0, 120.0}}, 2, 121},
+		{QueryFilter{FilterIn, "dim2", []interface{}{nil}}, 3, 1000},
+		{QueryFilter{FilterGreaterThan, "metric1", 500.0}, 3, 1000},
+	} {
+		query := createQuery()
+		query.Filters = []QueryFilter{testCase.filter}
+
+		resp := db.MakeRequest()
+		params, err := resp.StaticTable.makeScanParams(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, stats, err := resp.StaticTable.scan(params)
+		resp.Done()
+		Assert(t, err, IsNil)
+
+		Assert(t, stats.Get(statSegmentsSkipped), Equals, testCase.segmentsSkipped)
+		Assert(t, rows[0].Sums[0], util.DeepConvertibleEquals, testCase.metric1)
+		Assert(t, runQuery(db, query)[0]["metric1"], util.DeepConvertibleEquals, testCase.metric1)
+	}
+}
+
+func TestZoneMapsArePersisted(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	insertRow(db, RowMap{"at": 0.0, "dim1": "a", "metric1": 3.0})
+	db = reopenTestDB(db)
+	defer closeTestDB(db)
+
+	resp := db.MakeRequest()
+	defer resp.Done()
+	for _, interval := range resp.StaticTable.Intervals {
+		Assert(t, interval.ZoneMaps, DeepEquals, []*ZoneMap{{
+			Dimensions: []ColumnZone{{Min: 0, Max: 0, HasValue: true}},
+			Metrics:    []ColumnZone{{Min: 3, Max: 3, HasValue: true}},
+		}})
+	}
+}
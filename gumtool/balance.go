@@ -212,10 +212,21 @@ func PreparePartials(source balanceSource, dests []balanceDest, db *gumshoe.DB,
 			return nil, err
 		}
 		for _, interval := range partial.StaticTable.Intervals {
-			for i := 0; i < interval.NumSegments; i++ {
-				segmentFile := path.Join(source.dbDir, interval.SegmentFilename(db.Schema, i))
-				if err := s.runCmd(source.host, fmt.Sprintf("cp %s %s", segmentFile, dir)); err != nil {
-					return nil, err
+			for _, run := range interval.AllRuns() {
+				for i := 0; i < run.NumSegments; i++ {
+					segmentFile := path.Join(source.dbDir, run.SegmentFilename(db.Schema, i))
+					if err := s.runCmd(source.host, fmt.Sprintf("cp %s %s", segmentFile, dir)); err != nil {
+						return nil, err
+					}
+				}
+				for i, dimTable := range run.DimensionTables {
+					if dimTable == nil || dimTable.Size == 0 {
+						continue
+					}
+					dimTableFile := path.Join(source.dbDir, run.DimensionTableFilename(db.Schema, i))
+					if err := s.runCmd(source.host, fmt.Sprintf("cp %s %s", dimTableFile, dir)); err != nil {
+						return nil, err
+					}
 				}
 			}
 		}
@@ -26,35 +26,53 @@ func clean(args []string) {
 		fatalln("-dir must be provided")
 	}
 
-	filename := filepath.Join(*dir, gumshoe.MetadataFilename)
-	f, err := os.Open(filename)
+	db, err := readMetadata(*dir)
 	if err != nil {
 		fatalln(err)
 	}
+	expectedDimensionFiles, expectedIntervalFiles := expectedFiles(db)
+	warnMissingAndRemoveExtras(expectedDimensionFiles, "dimension table", *dir, "dimension.*.gob.gz")
+	warnMissingAndRemoveExtras(expectedIntervalFiles, "interval", *dir, "interval.*.dat")
+}
+
+// readMetadata decodes the metadata file of the DB in dir (without opening the DB).
+func readMetadata(dir string) (*gumshoe.DB, error) {
+	f, err := os.Open(filepath.Join(dir, gumshoe.MetadataFilename))
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
 	decoder := json.NewDecoder(f)
 	db := new(gumshoe.DB)
 	if err := decoder.Decode(db); err != nil {
-		fatalln(err)
+		return nil, err
 	}
+	return db, nil
+}
 
-	var expectedDimensionFiles []string
+// expectedFiles returns the names (relative to the DB directory) of the dimension table and interval segment
+// files referenced by the metadata of db.
+func expectedFiles(db *gumshoe.DB) (dimensionFiles, intervalFiles []string) {
 	for i, dimTable := range db.StaticTable.DimensionTables {
 		if dimTable == nil || dimTable.Generation == 0 {
 			continue
 		}
-		expectedDimensionFiles = append(expectedDimensionFiles, dimTable.Filename(db.Schema, i))
+		dimensionFiles = append(dimensionFiles, dimTable.Filename(db.Schema, i))
 	}
-
-	var expectedIntervalFiles []string
 	for _, interval := range db.StaticTable.Intervals {
-		for i := 0; i < interval.NumSegments; i++ {
-			expectedIntervalFiles = append(expectedIntervalFiles, interval.SegmentFilename(db.Schema, i))
+		for _, run := range interval.AllRuns() {
+			for i := 0; i < run.NumSegments; i++ {
+				intervalFiles = append(intervalFiles, run.SegmentFilename(db.Schema, i))
+			}
+			for i, dimTable := range run.DimensionTables {
+				// Empty tables may not have been written (see gumshoe.StaticTable.evolveSchema).
+				if dimTable != nil && dimTable.Size > 0 {
+					dimensionFiles = append(dimensionFiles, run.DimensionTableFilename(db.Schema, i))
+				}
+			}
 		}
 	}
-
-	warnMissingAndRemoveExtras(expectedDimensionFiles, "dimension table", *dir, "dimension.*.gob.gz")
-	warnMissingAndRemoveExtras(expectedIntervalFiles, "interval", *dir, "interval.*.dat")
+	return dimensionFiles, intervalFiles
 }
 
 func warnMissingAndRemoveExtras(expected []string, typeDescription, dir, glob string) {
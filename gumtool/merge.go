@@ -139,10 +139,14 @@ func mergeDB(newDB, db *gumshoe.DB, parallelism, flushSegments int) error {
 func mergeSegment(newDB, db *gumshoe.DB, segment *timestampSegment) error {
 	// NOTE(caleb): Have to do more nasty float conversion in this function. See NOTE(caleb) in migrate.go.
 	at := float64(segment.at.Unix())
-	rows := make([]gumshoe.UnpackedRow, 0, len(segment.Bytes)/db.RowSize)
-	for i := 0; i < len(segment.Bytes); i += db.RowSize {
-		row := gumshoe.RowBytes(segment.Bytes[i : i+db.RowSize])
-		unpacked := db.DeserializeRow(row)
+	segmentRows, err := db.IntervalSegmentRows(segment.interval, segment.Segment)
+	if err != nil {
+		return err
+	}
+	rows := make([]gumshoe.UnpackedRow, 0, len(segmentRows)/db.RowSize)
+	for i := 0; i < len(segmentRows); i += db.RowSize {
+		row := gumshoe.RowBytes(segmentRows[i : i+db.RowSize])
+		unpacked := db.DeserializeIntervalRow(segment.interval, row)
 		unpacked.RowMap[db.TimestampColumn.Name] = at
 		for _, dim := range db.Schema.DimensionColumns {
 			if dim.String {
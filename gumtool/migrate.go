@@ -65,7 +65,8 @@ func migrate(args []string) {
 
 type timestampSegment struct {
 	*gumshoe.Segment
-	at time.Time
+	at       time.Time
+	interval *gumshoe.Interval
 }
 
 func migrateDBs(newDB, oldDB *gumshoe.DB, parallelism, flushSegments int) error {
@@ -144,8 +145,15 @@ outer:
 func findSegments(staticTable *gumshoe.StaticTable) []*timestampSegment {
 	var segments []*timestampSegment
 	for t, interval := range staticTable.Intervals {
-		for _, segment := range interval.Segments {
-			segments = append(segments, &timestampSegment{segment, t})
+		if err := interval.Verify(staticTable.Schema); err != nil {
+			log.Printf("Skipping corrupted interval at %s: %s", t, err)
+			continue
+		}
+		// Each run's rows use the run's own layout and dimension tables.
+		for _, run := range interval.AllRuns() {
+			for _, segment := range run.Segments {
+				segments = append(segments, &timestampSegment{segment, t, run})
+			}
 		}
 	}
 	return segments
@@ -155,10 +163,14 @@ func migrateSegment(newDB, oldDB *gumshoe.DB, segment *timestampSegment,
 	convert func(gumshoe.UnpackedRow)) error {
 
 	at := uint32(segment.at.Unix())
-	rows := make([]gumshoe.UnpackedRow, 0, len(segment.Bytes)/oldDB.RowSize)
-	for i := 0; i < len(segment.Bytes); i += oldDB.RowSize {
-		row := gumshoe.RowBytes(segment.Bytes[i : i+oldDB.RowSize])
-		unpacked := oldDB.DeserializeRow(row)
+	segmentRows, err := oldDB.IntervalSegmentRows(segment.interval, segment.Segment)
+	if err != nil {
+		return err
+	}
+	rows := make([]gumshoe.UnpackedRow, 0, len(segmentRows)/oldDB.RowSize)
+	for i := 0; i < len(segmentRows); i += oldDB.RowSize {
+		row := gumshoe.RowBytes(segmentRows[i : i+oldDB.RowSize])
+		unpacked := oldDB.DeserializeIntervalRow(segment.interval, row)
 		// Attach a timestamp
 		unpacked.RowMap[oldDB.TimestampColumn.Name] = at
 		convert(unpacked)
@@ -238,6 +250,9 @@ func makeConversionFunc(newDB, oldDB *gumshoe.DB) (func(gumshoe.UnpackedRow), er
 }
 
 func conversionAllowable(to, from gumshoe.Type) error {
+	if (to == gumshoe.TypeHyperLogLog) != (from == gumshoe.TypeHyperLogLog) {
+		return fmt.Errorf("conversion between hyperloglog and numeric types is not allowed")
+	}
 	if gumshoe.TypeToBigType[to] != gumshoe.TypeToBigType[from] {
 		return fmt.Errorf("conversion from int to float types and vice versa are not allowed")
 	}
@@ -247,6 +262,9 @@ func conversionAllowable(to, from gumshoe.Type) error {
 var float64Type = reflect.TypeOf(float64(0))
 
 func convertValueToFloat64(rowMap gumshoe.RowMap, name string) {
+	if _, ok := rowMap[name].(gumshoe.HyperLogLog); ok {
+		return // Inserted as is
+	}
 	rv := reflect.ValueOf(rowMap[name])
 	rowMap[name] = rv.Convert(float64Type).Interface()
 }
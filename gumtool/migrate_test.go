@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strconv"
 	"testing"
 	"time"
 
@@ -53,6 +54,28 @@ func TestMigrateAddRemoveColumns(t *testing.T) {
 	})
 }
 
+func TestMigrateToColumnSegmentFormat(t *testing.T) {
+	schema := &migrateTestSchema{
+		[]migrateTestDimensions{{"dim1", "uint32", false}, {"dim2", "uint8", true}},
+		[]migrateTestMetrics{{"metric1", "uint32"}, {"metric2", "uint16"}},
+	}
+
+	var rows []gumshoe.RowMap
+	for i := 0; i < 20; i++ {
+		rows = append(rows, gumshoe.RowMap{
+			"at": 0.0, "dim1": float64(i), "dim2": "s" + strconv.Itoa(i%3), "metric1": float64(i), "metric2": 7.0,
+		})
+	}
+
+	runMigrateTestCase(t, &migrateTestCase{
+		OldSchema:        schema,
+		NewSchema:        schema,
+		NewSegmentFormat: gumshoe.SegmentFormatColumn,
+		InsertRows:       rows,
+		ExpectedRows:     makeUnpackedSingleRows(rows),
+	})
+}
+
 type migrateTestDimensions struct {
 	Name   string
 	Type   string
@@ -70,10 +93,11 @@ type migrateTestSchema struct {
 }
 
 type migrateTestCase struct {
-	OldSchema    *migrateTestSchema
-	NewSchema    *migrateTestSchema
-	InsertRows   []gumshoe.RowMap
-	ExpectedRows []gumshoe.UnpackedRow
+	OldSchema        *migrateTestSchema
+	NewSchema        *migrateTestSchema
+	NewSegmentFormat gumshoe.SegmentFormat
+	InsertRows       []gumshoe.RowMap
+	ExpectedRows     []gumshoe.UnpackedRow
 }
 
 func makeUnpackedSingleRows(rows []gumshoe.RowMap) []gumshoe.UnpackedRow {
@@ -90,7 +114,9 @@ func runMigrateTestCase(t *testing.T, testCase *migrateTestCase) {
 		t.Fatal(err)
 	}
 	defer oldDB.Close()
-	newDB, err := gumshoe.NewDB(schemaFixture(testCase.NewSchema))
+	newSchema := schemaFixture(testCase.NewSchema)
+	newSchema.SegmentFormat = testCase.NewSegmentFormat
+	newDB, err := gumshoe.NewDB(newSchema)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -116,7 +142,7 @@ func schemaFixture(testSchema *migrateTestSchema) *gumshoe.Schema {
 		panic(err)
 	}
 	schema := &gumshoe.Schema{
-		TimestampColumn:  gumshoe.Column(atColumn),
+		TimestampColumn:  atColumn.Column,
 		SegmentSize:      100,
 		IntervalDuration: time.Hour,
 	}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+func init() {
+	commandsByName["restore"] = command{
+		description: "verify a snapshot of a GumshoeDB database and install it as a new database",
+		fn:          restore,
+	}
+}
+
+func restore(args []string) {
+	flags := flag.NewFlagSet("gumtool restore", flag.ExitOnError)
+	snapshotDir := flags.String("snapshot-dir", "", "the snapshot directory to restore")
+	dir := flags.String("dir", "", "the directory in which to install the restored database")
+	start := flags.Int64("start", 0, "if non-zero, only restore intervals starting at or after this time")
+	end := flags.Int64("end", 0, "if non-zero, only restore intervals starting before this time")
+	verifyOnly := flags.Bool("verify-only", false, "verify the snapshot without installing it")
+	flags.Parse(args)
+
+	if *snapshotDir == "" {
+		fatalln("-snapshot-dir must be provided")
+	}
+	if *dir == "" && !*verifyOnly {
+		fatalln("-dir must be provided")
+	}
+
+	db, err := readMetadata(*snapshotDir)
+	if err != nil {
+		fatalln(err)
+	}
+	var startTime, endTime time.Time
+	if *start != 0 {
+		startTime = time.Unix(*start, 0)
+	}
+	if *end != 0 {
+		endTime = time.Unix(*end, 0)
+	}
+	restrictToTimeRange(db, startTime, endTime)
+
+	if problems := verifySnapshot(*snapshotDir, db); len(problems) > 0 {
+		fmt.Printf("Found %d problem(s) with the snapshot:\n", len(problems))
+		for _, problem := range problems {
+			fmt.Printf("  %s\n", problem)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("Snapshot verified (%d intervals).\n", len(db.StaticTable.Intervals))
+	if *verifyOnly {
+		return
+	}
+
+	if err := installSnapshot(*snapshotDir, *dir, db); err != nil {
+		fatalln(err)
+	}
+	fmt.Printf("Database restored to %s.\n", *dir)
+}
+
+// restrictToTimeRange removes the intervals of db which start before start or at or after end (either of
+// which may be zero, for no bound).
+func restrictToTimeRange(db *gumshoe.DB, start, end time.Time) {
+	for t := range db.StaticTable.Intervals {
+		if (!start.IsZero() && t.Before(start)) || (!end.IsZero() && !t.Before(end)) {
+			delete(db.StaticTable.Intervals, t)
+		}
+	}
+}
+
+// verifySnapshot checks that all the files referenced by the metadata of db (which was read from dir) are
+// present in dir, that they match the checksums recorded in the metadata (if any), and that the segments of
+// each interval hold the number of rows recorded in the metadata. It returns a description of each problem
+// found.
+func verifySnapshot(dir string, db *gumshoe.DB) []string {
+	db.Schema.Initialize()
+	var problems []string
+	dimensionFiles, _ := expectedFiles(db)
+	checksums := dimensionTableChecksums(db)
+	for _, filename := range dimensionFiles {
+		if _, err := os.Stat(filepath.Join(dir, filename)); err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if sum, ok := checksums[filename]; ok {
+			if err := gumshoe.VerifyFileChecksum(filepath.Join(dir, filename), sum); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	for _, interval := range db.StaticTable.Intervals {
+		for _, run := range interval.AllRuns() {
+			// Intervals written before an additive schema change keep their old layout.
+			layout := db.Schema
+			if run.Schema != nil {
+				run.Schema.Initialize()
+				layout = run.Schema
+			}
+			size := 0
+			missing := false
+			for i := 0; i < run.NumSegments; i++ {
+				n, err := segmentSize(filepath.Join(dir, run.SegmentFilename(db.Schema, i)), layout)
+				if err != nil {
+					problems = append(problems, err.Error())
+					missing = true
+					continue
+				}
+				size += n
+			}
+			if missing {
+				continue
+			}
+			if expected := run.NumRows * layout.RowSize; size != expected {
+				problems = append(problems, fmt.Sprintf("interval at %s (generation %d) has %d bytes of "+
+					"rows; expected %d (%d rows)", run.Start, run.Generation, size, expected, run.NumRows))
+				continue
+			}
+			// Runs written before checksums were recorded can't be checked any further.
+			if len(run.Checksums) != run.NumSegments {
+				continue
+			}
+			for i, sum := range run.Checksums {
+				filename := filepath.Join(dir, run.SegmentFilename(db.Schema, i))
+				if err := gumshoe.VerifyFileChecksum(filename, sum); err != nil {
+					problems = append(problems, err.Error())
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// dimensionTableChecksums returns the checksums recorded in the metadata of db for its dimension table files
+// (shared and per-interval), keyed by filename as returned by expectedFiles. Tables written before checksums
+// were recorded are left out.
+func dimensionTableChecksums(db *gumshoe.DB) map[string]uint32 {
+	checksums := make(map[string]uint32)
+	for i, dimTable := range db.StaticTable.DimensionTables {
+		if dimTable != nil && dimTable.Checksum != 0 {
+			checksums[dimTable.Filename(db.Schema, i)] = dimTable.Checksum
+		}
+	}
+	for _, interval := range db.StaticTable.Intervals {
+		for _, run := range interval.AllRuns() {
+			for i, dimTable := range run.DimensionTables {
+				if dimTable != nil && dimTable.Checksum != 0 {
+					checksums[run.DimensionTableFilename(db.Schema, i)] = dimTable.Checksum
+				}
+			}
+		}
+	}
+	return checksums
+}
+
+// segmentSize returns the (uncompressed) size of the rows in the segment file filename.
+func segmentSize(filename string, layout *gumshoe.Schema) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if layout.SegmentCompression == gumshoe.SegmentCompressionNone {
+		stat, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return int(stat.Size()), nil
+	}
+	// A compressed segment starts with its uncompressed size.
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, fmt.Errorf("cannot read segment header of %s: %s", filename, err)
+	}
+	return int(binary.LittleEndian.Uint32(header)), nil
+}
+
+// installSnapshot copies the files referenced by the metadata of db from snapshotDir into dir, which must not
+// already contain a DB, syncs them to disk, and then writes the metadata.
+func installSnapshot(snapshotDir, dir string, db *gumshoe.DB) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, glob := range []string{"*.json", "*.dat", "*.gob.gz"} {
+		matches, err := filepath.Glob(filepath.Join(dir, glob))
+		if err != nil {
+			return err
+		}
+		if len(matches) > 0 {
+			return fmt.Errorf("directory %s may already have a GumshoeDB database", dir)
+		}
+	}
+
+	dimensionFiles, intervalFiles := expectedFiles(db)
+	for _, filename := range append(dimensionFiles, intervalFiles...) {
+		dst := filepath.Join(dir, filename)
+		if err := gumshoe.CopyFile(filepath.Join(snapshotDir, filename), dst); err != nil {
+			return err
+		}
+		if err := gumshoe.SyncFile(dst); err != nil {
+			return err
+		}
+	}
+	if err := gumshoe.SyncFile(dir); err != nil {
+		return err
+	}
+	// The metadata is written last so that the DB can't be opened until all its files are in place.
+	b, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(dir, gumshoe.MetadataFilename)
+	if err := ioutil.WriteFile(filename+".tmp", b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/util"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func makeRestoreTestSnapshot(t *testing.T, tempDir string) string {
+	schema := schemaFixture(&migrateTestSchema{
+		[]migrateTestDimensions{{"dim1", "uint32", true}},
+		[]migrateTestMetrics{{"metric1", "uint32"}},
+	})
+	schema.DiskBacked = true
+	schema.Dir = filepath.Join(tempDir, "db")
+	db, err := gumshoe.NewDB(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var rows []gumshoe.RowMap
+	for _, at := range []float64{0, 3600, 7200} {
+		for i := 0; i < 10; i++ {
+			rows = append(rows, gumshoe.RowMap{"at": at, "dim1": strconv.Itoa(i), "metric1": 1.0})
+		}
+	}
+	if err := db.Insert(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	snapshotDir := filepath.Join(tempDir, "snapshot")
+	if err := db.Snapshot(snapshotDir); err != nil {
+		t.Fatal(err)
+	}
+	return snapshotDir
+}
+
+func TestRestoreTimeRangeFromSnapshot(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gumtool-restore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	snapshotDir := makeRestoreTestSnapshot(t, tempDir)
+
+	db, err := readMetadata(snapshotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restrictToTimeRange(db, time.Unix(3600, 0), time.Unix(7200, 0))
+	a.Assert(t, verifySnapshot(snapshotDir, db), a.IsNil)
+	dir := filepath.Join(tempDir, "restored")
+	if err := installSnapshot(snapshotDir, dir, db); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := gumshoe.OpenDBDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	var expected []gumshoe.UnpackedRow
+	for i := 0; i < 10; i++ {
+		expected = append(expected, gumshoe.UnpackedRow{
+			RowMap: gumshoe.RowMap{"at": 3600.0, "dim1": strconv.Itoa(i), "metric1": 1.0},
+			Count:  1,
+		})
+	}
+	a.Assert(t, restored.GetDebugRows(), util.DeepConvertibleEquals, expected)
+
+	// A restore never overwrites an existing DB.
+	a.Assert(t, installSnapshot(snapshotDir, dir, db), a.NotNil)
+}
+
+func TestVerifySnapshotFindsMissingAndTruncatedFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gumtool-restore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	snapshotDir := makeRestoreTestSnapshot(t, tempDir)
+
+	segments, err := filepath.Glob(filepath.Join(snapshotDir, "interval.*.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(segments[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segments[len(segments)-1], 10); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := readMetadata(snapshotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := verifySnapshot(snapshotDir, db)
+	a.Assert(t, len(problems), a.Equals, 2)
+	a.Assert(t, problems[0]+problems[1], a.StringContains, "no such file")
+	a.Assert(t, problems[0]+problems[1], a.StringContains, "expected")
+}
+
+func TestVerifySnapshotChecksChecksums(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gumtool-restore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	snapshotDir := makeRestoreTestSnapshot(t, tempDir)
+
+	// Flip a byte of a segment and of the dimension table, leaving their sizes unchanged.
+	segments, err := filepath.Glob(filepath.Join(snapshotDir, "interval.*.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dimensionTables, err := filepath.Glob(filepath.Join(snapshotDir, "dimension.*.gob.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{segments[0], dimensionTables[0]} {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[len(b)-1] ^= 0xff
+		if err := ioutil.WriteFile(filename, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := readMetadata(snapshotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := verifySnapshot(snapshotDir, db)
+	a.Assert(t, len(problems), a.Equals, 2)
+	for _, problem := range problems {
+		a.Assert(t, problem, a.StringContains, "checksum mismatch")
+	}
+}
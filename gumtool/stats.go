@@ -81,8 +81,12 @@ func getColumnExtrema(db *gumshoe.DB, parallelism int) (mins, maxes []gumshoe.Un
 			}
 
 			for segment := range segments {
-				for j := 0; j < len(segment.Bytes); j += db.RowSize {
-					dimensions := gumshoe.DimensionBytes(segment.Bytes[j+db.DimensionStartOffset : j+db.MetricStartOffset])
+				rows, err := db.IntervalSegmentRows(segment.interval, segment.Segment)
+				if err != nil {
+					log.Fatal(err)
+				}
+				for j := 0; j < len(rows); j += db.RowSize {
+					dimensions := gumshoe.DimensionBytes(rows[j+db.DimensionStartOffset : j+db.MetricStartOffset])
 					for k, col := range db.DimensionColumns {
 						if dimensions.IsNil(k) {
 							continue
@@ -90,8 +94,11 @@ func getColumnExtrema(db *gumshoe.DB, parallelism int) (mins, maxes []gumshoe.Un
 						value := gumshoe.NumericCellValue(unsafe.Pointer(&dimensions[db.DimensionOffsets[k]]), col.Type)
 						partial.update(value, k)
 					}
-					metrics := gumshoe.MetricBytes(segment.Bytes[j+db.MetricStartOffset : j+db.RowSize])
+					metrics := gumshoe.MetricBytes(rows[j+db.MetricStartOffset : j+db.RowSize])
 					for k, col := range db.MetricColumns {
+						if col.Type == gumshoe.TypeHyperLogLog {
+							continue
+						}
 						value := gumshoe.NumericCellValue(unsafe.Pointer(&metrics[db.MetricOffsets[k]]), col.Type)
 						partial.update(value, k+len(db.DimensionColumns))
 					}
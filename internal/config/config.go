@@ -13,14 +13,19 @@ import (
 	"github.com/philc/gumshoedb/internal/github.com/dustin/go-humanize"
 )
 
-// All struct fields with a toml tag are required (see checkUndefinedFields).
+// All struct fields with a toml tag are required (see checkUndefinedFields) unless they are also tagged with
+// optional:"true".
 
 type Schema struct {
-	SegmentSize      string      `toml:"segment_size"`
-	IntervalDuration Duration    `toml:"interval_duration"`
-	TimestampColumn  [2]string   `toml:"timestamp_column"`
-	DimensionColumns [][2]string `toml:"dimension_columns"`
-	MetricColumns    [][2]string `toml:"metric_columns"`
+	SegmentSize             string      `toml:"segment_size"`
+	IntervalDuration        Duration    `toml:"interval_duration"`
+	TimestampColumn         [2]string   `toml:"timestamp_column"`
+	DimensionColumns        [][2]string `toml:"dimension_columns"`
+	MetricColumns           [][2]string `toml:"metric_columns"`
+	SegmentFormat           string      `toml:"segment_format" optional:"true"`
+	SegmentCompression      string      `toml:"segment_compression" optional:"true"`
+	SortKey                 []string    `toml:"sort_key" optional:"true"`
+	IntervalDimensionTables bool        `toml:"interval_dimension_tables" optional:"true"`
 }
 
 type Config struct {
@@ -31,7 +36,30 @@ type Config struct {
 	FlushInterval    Duration `toml:"flush_interval"`
 	QueryParallelism int      `toml:"query_parallelism"`
 	RetentionDays    int      `toml:"retention_days"`
-	Schema           Schema   `toml:"schema"`
+	// Verify all segment checksums at startup rather than as each interval is first read.
+	VerifyChecksumsOnOpen bool `toml:"verify_checksums_on_open" optional:"true"`
+	// Append new rows to existing intervals as separate runs during flushes (see gumshoe.RunConfig).
+	IncrementalFlush bool `toml:"incremental_flush" optional:"true"`
+	MaxIntervalRuns  int  `toml:"max_interval_runs" optional:"true"`
+	// Merge and roll up intervals on this many background goroutines rather than during flushes.
+	CompactionParallelism int `toml:"compaction_parallelism" optional:"true"`
+	// Move intervals older than ColdAfterDays to ColdDir during flushes.
+	ColdDir       string `toml:"cold_dir" optional:"true"`
+	ColdAfterDays int    `toml:"cold_after_days" optional:"true"`
+	// Allow snapshots (POST /admin/snapshot) to be written to directories within SnapshotDir.
+	SnapshotDir string `toml:"snapshot_dir" optional:"true"`
+	// Keep at most this many segment files open (and mapped) at once.
+	MaxOpenSegments int      `toml:"max_open_segments" optional:"true"`
+	Schema          Schema   `toml:"schema"`
+	Rollups         []Rollup `toml:"rollup" optional:"true"`
+}
+
+// A Rollup configures the rolling up of intervals older than After into coarser intervals of length
+// IntervalDuration. (See gumshoe.RollupPolicy.)
+type Rollup struct {
+	After            Duration `toml:"after"`
+	IntervalDuration Duration `toml:"interval_duration"`
+	DropDimensions   []string `toml:"drop_dimensions" optional:"true"`
 }
 
 // Produces a gumshoe Schema based on a Config's values.
@@ -52,6 +80,21 @@ func (c *Config) makeSchema() (*gumshoe.Schema, error) {
 		return nil, err
 	}
 
+	segmentFormat := gumshoe.SegmentFormatRow
+	if c.Schema.SegmentFormat != "" {
+		segmentFormat, err = gumshoe.ParseSegmentFormat(c.Schema.SegmentFormat)
+		if err != nil {
+			return nil, err
+		}
+	}
+	segmentCompression := gumshoe.SegmentCompressionNone
+	if c.Schema.SegmentCompression != "" {
+		segmentCompression, err = gumshoe.ParseSegmentCompression(c.Schema.SegmentCompression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	name, typ, isString := parseColumn(c.Schema.TimestampColumn)
 	if typ != "uint32" {
 		return nil, fmt.Errorf("timestamp column (%q) must be uint32", name)
@@ -90,10 +133,23 @@ func (c *Config) makeSchema() (*gumshoe.Schema, error) {
 		if isString {
 			return nil, fmt.Errorf("metric column (%q) has string type; not allowed for metric columns", name)
 		}
+		merge := gumshoe.MergeSum
+		if j := strings.Index(typ, ":"); j >= 0 {
+			merge, err = gumshoe.ParseMergeFunc(typ[:j])
+			if err != nil {
+				return nil, fmt.Errorf("metric column (%q) has a bad type: %s", name, err)
+			}
+			typ = typ[j+1:]
+		}
 		col, err := gumshoe.MakeMetricColumn(name, typ)
 		if err != nil {
 			return nil, err
 		}
+		if merge != gumshoe.MergeSum && col.Type == gumshoe.TypeHyperLogLog {
+			return nil, fmt.Errorf("metric column (%q) is a hyperloglog column; it cannot have a %s merge",
+				name, merge)
+		}
+		col.Merge = merge
 		metrics[i] = col
 	}
 
@@ -112,6 +168,24 @@ func (c *Config) makeSchema() (*gumshoe.Schema, error) {
 		names[col.Name] = true
 	}
 
+	sortKey := c.Schema.SortKey
+	sortKeyNames := make(map[string]bool)
+	for _, name := range sortKey {
+		found := false
+		for _, col := range dimensions {
+			if col.Name == name {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("sort key column %q is not a dimension column", name)
+		}
+		if sortKeyNames[name] {
+			return nil, fmt.Errorf("duplicate sort key column %q", name)
+		}
+		sortKeyNames[name] = true
+	}
+
 	// Sanity checks
 	if c.FlushInterval.Duration < time.Second {
 		return nil, fmt.Errorf("flush interval is too small: %s", c.FlushInterval)
@@ -122,6 +196,21 @@ func (c *Config) makeSchema() (*gumshoe.Schema, error) {
 	if c.RetentionDays < 1 {
 		return nil, fmt.Errorf("retention days is too small: %d", c.RetentionDays)
 	}
+	if c.ColdDir != "" {
+		if !diskBacked {
+			return nil, errors.New("cold storage requires a disk-backed database")
+		}
+		if c.ColdAfterDays < 1 {
+			return nil, fmt.Errorf("cold after days is too small: %d", c.ColdAfterDays)
+		}
+	}
+	if c.SnapshotDir != "" && !diskBacked {
+		return nil, errors.New("snapshots require a disk-backed database")
+	}
+	if c.MaxOpenSegments < 0 || (c.MaxOpenSegments > 0 && c.MaxOpenSegments >= c.OpenFileLimit) {
+		return nil, fmt.Errorf("bad max open segments (must be less than the open file limit): %d",
+			c.MaxOpenSegments)
+	}
 	if segmentSize < 100 {
 		return nil, fmt.Errorf("segment size seems too small: %s", c.Schema.SegmentSize)
 	}
@@ -129,17 +218,41 @@ func (c *Config) makeSchema() (*gumshoe.Schema, error) {
 		return nil, fmt.Errorf("interval duration is too short: %s", c.Schema.IntervalDuration)
 	}
 
+	rollups := make([]gumshoe.RollupPolicy, len(c.Rollups))
+	for i, rollup := range c.Rollups {
+		if rollup.After.Duration <= 0 || rollup.IntervalDuration.Duration <= 0 {
+			return nil, errors.New("rollups must have positive 'after' and 'interval_duration' values")
+		}
+		rollups[i] = gumshoe.RollupPolicy{
+			After:            rollup.After.Duration,
+			IntervalDuration: rollup.IntervalDuration.Duration,
+			DropDimensions:   rollup.DropDimensions,
+		}
+	}
+
 	return &gumshoe.Schema{
-		TimestampColumn:  timestampColumn.Column,
-		DimensionColumns: dimensions,
-		MetricColumns:    metrics,
-		SegmentSize:      int(segmentSize),
-		IntervalDuration: c.Schema.IntervalDuration.Duration,
-		DiskBacked:       diskBacked,
-		Dir:              dir,
+		TimestampColumn:         timestampColumn.Column,
+		DimensionColumns:        dimensions,
+		MetricColumns:           metrics,
+		SegmentSize:             int(segmentSize),
+		IntervalDuration:        c.Schema.IntervalDuration.Duration,
+		SegmentFormat:           segmentFormat,
+		SegmentCompression:      segmentCompression,
+		SortKey:                 sortKey,
+		IntervalDimensionTables: c.Schema.IntervalDimensionTables,
+		DiskBacked:              diskBacked,
+		Dir:                     dir,
 		RunConfig: gumshoe.RunConfig{
-			FixedRetention: true,
-			Retention:      time.Duration(c.RetentionDays) * 24 * time.Hour,
+			FixedRetention:        true,
+			Retention:             time.Duration(c.RetentionDays) * 24 * time.Hour,
+			Rollups:               rollups,
+			VerifyChecksumsOnOpen: c.VerifyChecksumsOnOpen,
+			IncrementalFlush:      c.IncrementalFlush,
+			MaxIntervalRuns:       c.MaxIntervalRuns,
+			CompactionParallelism: c.CompactionParallelism,
+			ColdDir:               c.ColdDir,
+			ColdAfter:             time.Duration(c.ColdAfterDays) * 24 * time.Hour,
+			MaxOpenSegments:       c.MaxOpenSegments,
 		},
 	}, nil
 }
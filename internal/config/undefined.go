@@ -17,7 +17,7 @@ func checkUndefinedFields(meta toml.MetaData, v interface{}) error {
 }
 
 // nestedTOMLFields accepts a pointer to a struct type and returns nested list of toml field names (names
-// given in the "toml" struct tag).
+// given in the "toml" struct tag). Fields tagged with optional:"true" are skipped.
 //
 // Example:
 //
@@ -45,8 +45,9 @@ func nestedTOMLFields(v reflect.Value, prefix []string) [][]string {
 			if !field.CanSet() {
 				continue
 			}
-			tag := v.Type().Field(i).Tag.Get("toml")
-			if tag == "" || tag == "-" {
+			structField := v.Type().Field(i)
+			tag := structField.Tag.Get("toml")
+			if tag == "" || tag == "-" || structField.Tag.Get("optional") == "true" {
 				continue
 			}
 			prefixCopy := make([]string, len(prefix))
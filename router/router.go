@@ -147,12 +147,30 @@ func (r *Router) HandleQuery(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 	for _, filter := range query.Filters {
-		if !r.validColumnName(filter.Column) {
-			writeInvalidColumnError(w, filter.Column)
-			return
+		for _, leaf := range filter.Leaves() {
+			if !r.validColumnName(leaf.Column) {
+				writeInvalidColumnError(w, leaf.Column)
+				return
+			}
 		}
 	}
-	b, err := json.Marshal(query)
+	// The shards return the sketches for cardinality aggregates, which are merged and then estimated here.
+	shardQuery := *query
+	shardQuery.Aggregates = make([]gumshoe.QueryAggregate, len(query.Aggregates))
+	for i, agg := range query.Aggregates {
+		if agg.Type == gumshoe.AggregateCardinality {
+			agg.Type = gumshoe.AggregateSketch
+		}
+		shardQuery.Aggregates[i] = agg
+	}
+	// A group's aggregates are only known once the results of all the shards are merged, so the having
+	// filters, the ordering, and the limit are usually applied here.
+	if !shardsCanLimit(query) {
+		shardQuery.Having = nil
+		shardQuery.OrderBy = nil
+		shardQuery.Limit = 0
+	}
+	b, err := json.Marshal(&shardQuery)
 	if err != nil {
 		panic("unexpected marshal error")
 	}
@@ -161,14 +179,8 @@ func (r *Router) HandleQuery(w http.ResponseWriter, req *http.Request) {
 		mu     sync.Mutex // protects result, resultMap
 		result []gumshoe.RowMap
 		// rest only for grouping case
-		groupingCol        string
-		groupingColIntConv bool
-		resultMap          = make(map[interface{}]*lockedRowMap)
+		resultMap = make(map[string]*lockedRowMap)
 	)
-	if len(query.Groupings) > 0 {
-		groupingCol = query.Groupings[0].Name
-		groupingColIntConv = r.convertColumnToIntegral(query.Groupings[0].Column)
-	}
 	for i := range r.Shards {
 		i := i
 		wg.Go(func(_ <-chan struct{}) error {
@@ -195,6 +207,9 @@ func (r *Router) HandleQuery(w http.ResponseWriter, req *http.Request) {
 				if err := decoder.Decode(&row); err != nil {
 					return err
 				}
+				if err := parseSketches(row, query); err != nil {
+					return err
+				}
 				mu.Lock()
 				if len(result) == 0 {
 					result = []gumshoe.RowMap{row}
@@ -222,14 +237,14 @@ func (r *Router) HandleQuery(w http.ResponseWriter, req *http.Request) {
 					return err
 				}
 				rowSize = len(row)
-				groupByValue := row[groupingCol]
-				if groupingColIntConv && groupByValue != nil {
-					groupByValue = int64(groupByValue.(float64))
+				if err := parseSketches(row, query); err != nil {
+					return err
 				}
+				key := groupKey(row, query)
 				mu.Lock()
-				cur := resultMap[groupByValue]
+				cur := resultMap[key]
 				if cur == nil {
-					resultMap[groupByValue] = &lockedRowMap{row: row}
+					resultMap[key] = &lockedRowMap{row: row}
 					mu.Unlock()
 					continue
 				}
@@ -253,6 +268,18 @@ func (r *Router) HandleQuery(w http.ResponseWriter, req *http.Request) {
 			result = append(result, lr.row)
 		}
 	}
+	for _, row := range result {
+		for _, agg := range query.Aggregates {
+			if agg.Type == gumshoe.AggregateCardinality {
+				row[agg.Name] = row[agg.Name].(gumshoe.HyperLogLog).Estimate()
+			}
+		}
+	}
+	result = gumshoe.FilterRowMaps(result, query.Having)
+	gumshoe.SortRowMaps(result, query.OrderBy)
+	if query.Limit > 0 && len(result) > query.Limit {
+		result = result[:query.Limit]
+	}
 
 	Log.Printf("[%s] fetched and merged query results from %d shards in %s (%d combined rows)",
 		queryID, len(r.Shards), time.Since(start), len(result))
@@ -263,37 +290,80 @@ func (r *Router) HandleQuery(w http.ResponseWriter, req *http.Request) {
 	})
 }
 
+// shardsCanLimit reports whether the shards can apply the having filters, ordering, and limit of q
+// themselves without changing the merged result. For a grouped query, this requires that q have no having
+// filters and be ordered by all of its groupings and nothing else. Then the ordering is total, so each
+// shard's first groups include every group among the overall first groups, with all of its rows. (If some
+// grouping were left out, each shard would break ties on the others arbitrarily and could cut off rows of a
+// group that another shard keeps.)
+func shardsCanLimit(q *gumshoe.Query) bool {
+	if len(q.Having) > 0 {
+		return false
+	}
+	if len(q.Groupings) == 0 || q.Limit == 0 {
+		return true
+	}
+	if len(q.OrderBy) == 0 {
+		return false
+	}
+	groupings := make(map[string]bool)
+	for _, grouping := range q.Groupings {
+		groupings[grouping.Name] = true
+	}
+	ordered := make(map[string]bool)
+	for _, ordering := range q.OrderBy {
+		if !groupings[ordering.Name] {
+			return false
+		}
+		ordered[ordering.Name] = true
+	}
+	return len(ordered) == len(groupings)
+}
+
 type lockedRowMap struct {
 	mu  sync.Mutex
 	row gumshoe.RowMap
 }
 
-func (r *Router) convertColumnToIntegral(name string) bool {
-	var col gumshoe.Column
-	i, ok := r.Schema.DimensionNameToIndex[name]
-	switch {
-	case ok:
-		dimCol := r.Schema.DimensionColumns[i]
-		if dimCol.String {
-			return false
-		}
-		col = dimCol.Column
-	case name == r.Schema.TimestampColumn.Name:
-		col = r.Schema.TimestampColumn
-	default:
-		panic("grouping column doesn't exist")
+// groupKey identifies the group of row, a result of the grouped query q.
+func groupKey(row gumshoe.RowMap, q *gumshoe.Query) string {
+	values := make([]interface{}, len(q.Groupings))
+	for i, grouping := range q.Groupings {
+		values[i] = row[grouping.Name]
 	}
-	switch col.Type {
-	case gumshoe.TypeUint8, gumshoe.TypeInt8, gumshoe.TypeUint16, gumshoe.TypeInt16,
-		gumshoe.TypeUint32, gumshoe.TypeInt32, gumshoe.TypeUint64, gumshoe.TypeInt64:
-		return true
+	b, err := json.Marshal(values)
+	if err != nil {
+		panic("unexpected marshal error")
+	}
+	return string(b)
+}
+
+// parseSketches converts the serialized sketches returned by a shard for the cardinality aggregates of q.
+func parseSketches(row gumshoe.RowMap, q *gumshoe.Query) error {
+	for _, agg := range q.Aggregates {
+		if agg.Type != gumshoe.AggregateCardinality {
+			continue
+		}
+		sketch, err := gumshoe.ParseHyperLogLog(row[agg.Name])
+		if err != nil {
+			return err
+		}
+		row[agg.Name] = sketch
 	}
-	return false
+	return nil
 }
 
 // mergeRows merges row2 into row1.
 func (r *Router) mergeRows(row1, row2 gumshoe.RowMap, q *gumshoe.Query) {
 	for _, agg := range q.Aggregates {
+		if agg.Type == gumshoe.AggregateCardinality {
+			row1[agg.Name].(gumshoe.HyperLogLog).Merge(row2[agg.Name].(gumshoe.HyperLogLog))
+			continue
+		}
+		if agg.Type == gumshoe.AggregateMin || agg.Type == gumshoe.AggregateMax {
+			row1[agg.Name] = extremeColumn(row1, row2, agg.Name, agg.Type == gumshoe.AggregateMax)
+			continue
+		}
 		row1[agg.Name] = r.sumColumn(row1, row2, agg.Name, r.typeForCol(agg.Column))
 	}
 	row1["rowCount"] = r.sumColumn(row1, row2, "rowCount", gumshoe.TypeInt64)
@@ -338,6 +408,22 @@ func (r *Router) sumColumn(row1, row2 gumshoe.RowMap, col string, typ gumshoe.Ty
 	panic("unexpected type")
 }
 
+// extremeColumn returns the smaller (or, if max is set, the larger) value of the column from row1 and row2. A
+// shard with no matching rows has a nil value.
+func extremeColumn(row1, row2 gumshoe.RowMap, col string, max bool) interface{} {
+	val1, val2 := row1[col], row2[col]
+	if val1 == nil {
+		return val2
+	}
+	if val2 == nil {
+		return val1
+	}
+	if (val2.(float64) > val1.(float64)) == max {
+		return val2
+	}
+	return val1
+}
+
 func (r *Router) HandleSingleDimension(w http.ResponseWriter, req *http.Request) {
 	name := req.URL.Query().Get(":name")
 	if name == "" {
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+// fakeShard serves rows as the grouped results of any query, applying the query's ordering and limit as a
+// real shard would. It records the last query it received.
+type fakeShard struct {
+	*httptest.Server
+	rows  []gumshoe.RowMap
+	query *gumshoe.Query
+}
+
+func newFakeShard(rows []gumshoe.RowMap) *fakeShard {
+	s := &fakeShard{rows: rows}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query, err := gumshoe.ParseJSONQuery(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.query = query
+		rows := append([]gumshoe.RowMap(nil), s.rows...)
+		gumshoe.SortRowMaps(rows, query.OrderBy)
+		if query.Limit > 0 && len(rows) > query.Limit {
+			rows = rows[:query.Limit]
+		}
+		encoder := json.NewEncoder(w)
+		encoder.Encode(map[string]int{"duration_ms": 0, "num_rows": len(rows)})
+		for _, row := range rows {
+			encoder.Encode(row)
+		}
+	}))
+	return s
+}
+
+func makeTestRouter(shards ...*fakeShard) *Router {
+	at, err := gumshoe.MakeMetricColumn("at", "uint32")
+	if err != nil {
+		panic(err)
+	}
+	country, err := gumshoe.MakeDimensionColumn("country", "uint8", true)
+	if err != nil {
+		panic(err)
+	}
+	platform, err := gumshoe.MakeDimensionColumn("platform", "uint8", true)
+	if err != nil {
+		panic(err)
+	}
+	clicks, err := gumshoe.MakeMetricColumn("clicks", "uint32")
+	if err != nil {
+		panic(err)
+	}
+	schema := &gumshoe.Schema{
+		TimestampColumn:  at.Column,
+		DimensionColumns: []gumshoe.DimensionColumn{country, platform},
+		MetricColumns:    []gumshoe.MetricColumn{clicks},
+	}
+	schema.Initialize()
+	var addrs []string
+	for _, shard := range shards {
+		addrs = append(addrs, strings.TrimPrefix(shard.URL, "http://"))
+	}
+	return NewRouter(addrs, schema)
+}
+
+func runRouterQuery(t *testing.T, r *Router, query string) []gumshoe.RowMap {
+	w := httptest.NewRecorder()
+	r.HandleQuery(w, httptest.NewRequest("POST", "/query", strings.NewReader(query)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("query failed (%d): %s", w.Code, w.Body)
+	}
+	var result Result
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result.Results
+}
+
+func TestLimitWithTiedOrderingIsAppliedAfterMerging(t *testing.T) {
+	// Both shards hold both groups, listed in opposite orders, so a shard that applied the limit would keep a
+	// different group on each.
+	shard1 := newFakeShard([]gumshoe.RowMap{
+		{"country": "US", "platform": "android", "clicks": 1.0, "rowCount": 1.0},
+		{"country": "US", "platform": "ios", "clicks": 1.0, "rowCount": 1.0},
+	})
+	defer shard1.Close()
+	shard2 := newFakeShard([]gumshoe.RowMap{
+		{"country": "US", "platform": "ios", "clicks": 2.0, "rowCount": 1.0},
+		{"country": "US", "platform": "android", "clicks": 2.0, "rowCount": 1.0},
+	})
+	defer shard2.Close()
+	r := makeTestRouter(shard1, shard2)
+
+	results := runRouterQuery(t, r, `{
+		"aggregates": [{"type": "sum", "name": "clicks", "column": "clicks"}],
+		"groupings": [{"column": "country", "name": "country"}, {"column": "platform", "name": "platform"}],
+		"orderBy": ["country"],
+		"limit": 1
+	}`)
+	Assert(t, shard1.query.Limit, Equals, 0)
+	Assert(t, len(results), Equals, 1)
+	Assert(t, results[0]["clicks"], util.DeepConvertibleEquals, 3)
+	Assert(t, results[0]["rowCount"], util.DeepConvertibleEquals, 2)
+
+	// Ordering by every grouping is a total order, so the shards can apply the limit themselves.
+	results = runRouterQuery(t, r, `{
+		"aggregates": [{"type": "sum", "name": "clicks", "column": "clicks"}],
+		"groupings": [{"column": "country", "name": "country"}, {"column": "platform", "name": "platform"}],
+		"orderBy": ["country", "platform"],
+		"limit": 1
+	}`)
+	Assert(t, shard1.query.Limit, Equals, 1)
+	Assert(t, results, util.DeepConvertibleEquals, []gumshoe.RowMap{
+		{"country": "US", "platform": "android", "clicks": 3, "rowCount": 2},
+	})
+}
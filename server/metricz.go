@@ -31,6 +31,7 @@ type Metricz struct {
 	Config               string
 	DimensionTableCounts []NameAndCount
 	Stats                *gumshoe.StaticTableStats
+	Compactions          gumshoe.CompactionStats
 	// Use a slice here so we can show the intervals in order (recent first).
 	IntervalStats []IntervalStatsAndTime
 }
@@ -48,14 +49,11 @@ func (s *Server) makeMetricz() (*Metricz, error) {
 	}
 	sort.Sort(sort.Reverse(byTime(intervalStats)))
 
-	resp := s.DB.MakeRequest()
-	defer resp.Done()
-
+	dimTables := s.DB.GetDimensionTables()
 	var dimTableCounts []NameAndCount
-	for i, col := range s.DB.Schema.DimensionColumns {
+	for _, col := range s.DB.Schema.DimensionColumns {
 		if col.String {
-			count := len(resp.StaticTable.DimensionTables[i].Values)
-			dimTableCounts = append(dimTableCounts, NameAndCount{col.Name, count})
+			dimTableCounts = append(dimTableCounts, NameAndCount{col.Name, len(dimTables[col.Name])})
 		}
 	}
 
@@ -63,6 +61,7 @@ func (s *Server) makeMetricz() (*Metricz, error) {
 		Config:               string(configBytes),
 		DimensionTableCounts: dimTableCounts,
 		Stats:                stats,
+		Compactions:          s.DB.GetCompactionStats(),
 		IntervalStats:        intervalStats,
 	}, nil
 }
@@ -150,16 +149,24 @@ th:last-child,td:last-child { text-align: right; }
 <h2>Stat totals</h2>
 {{with .Stats}}
 <table>
-<tr><th>Segments</th><th>Rows</th><th>Size</th><th>Compression Ratio</th></tr>
-<tr><td>{{.Segments}}</td><td>{{.Rows}}</td><td>{{.Bytes | humanize}}</td><td>{{.CompressionRatio | printf "%.2f"}}</td></tr>
+<tr><th>Segments</th><th>Rows</th><th>Size</th><th>Uncompressed Size</th><th>Compression Ratio</th></tr>
+<tr><td>{{.Segments}}</td><td>{{.Rows}}</td><td>{{.Bytes | humanize}}</td><td>{{.UncompressedBytes | humanize}}</td><td>{{.CompressionRatio | printf "%.2f"}}</td></tr>
+</table>
+{{end}}
+
+<h2>Compactions</h2>
+{{with .Compactions}}
+<table>
+<tr><th>Queued</th><th>Running</th><th>Completed</th><th>Failed</th><th>Abandoned</th></tr>
+<tr><td>{{.Queued}}</td><td>{{.Running}}</td><td>{{.Completed}}</td><td>{{.Failed}}</td><td>{{.Abandoned}}</td></tr>
 </table>
 {{end}}
 
 <h2>Intervals ({{.IntervalStats | len}})</h2>
 <table>
-<tr><th>Start</th><th>Segments</th><th>Rows</th><th>Size</th></tr>
+<tr><th>Start</th><th>Segments</th><th>Rows</th><th>Size</th><th>Uncompressed Size</th></tr>
 {{range $stats := .IntervalStats}}
-<tr><td>{{$stats.Time | date}}</td><td>{{$stats.Segments}}</td><td>{{$stats.Rows}}</td><td>{{$stats.Bytes | humanize}}</td></tr>
+<tr><td>{{$stats.Time | date}}</td><td>{{$stats.Segments}}</td><td>{{$stats.Rows}}</td><td>{{$stats.Bytes | humanize}}</td><td>{{$stats.UncompressedBytes | humanize}}</td></tr>
 {{end}}
 </table>
 </section>
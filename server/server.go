@@ -5,6 +5,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -12,6 +13,9 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -92,6 +96,53 @@ func (s *Server) HandleInsert(w http.ResponseWriter, r *http.Request) {
 	statsd.Count("gumshoedb.insert.failure", failure, 1)
 }
 
+// HandleReplace decodes an array of JSON-formatted row maps from the request body and replaces the contents
+// of the intervals in the time range given by the start and end query parameters (Unix times) with them.
+func (s *Server) HandleReplace(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	var timeRange gumshoe.TimeRange
+	var err error
+	if timeRange.Start, err = unixTimeParam(r, "start"); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if timeRange.End, err = unixTimeParam(r, "end"); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	decoder := json.NewDecoder(r.Body)
+	var rows []gumshoe.RowMap
+	if err := decoder.Decode(&rows); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	Log.Printf("Replacing intervals from %s to %s with %d rows", timeRange.Start, timeRange.End, len(rows))
+	if err := s.DB.Replace(timeRange, rows); err != nil {
+		exitOnWriteError("REPLACE", err)
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	statsd.Time("gumshoedb.replace", time.Since(start))
+}
+
+// exitOnWriteError crashes the server if err is a gumshoe.WriteError. As with a flush error (see Flush), the
+// database state is not well-defined after one; other errors mean the request was rejected.
+func exitOnWriteError(op string, err error) {
+	if _, ok := err.(*gumshoe.WriteError); ok {
+		Log.Printf(">>> FATAL ERROR ON %s: %s", op, err)
+		os.Exit(1)
+	}
+}
+
+// unixTimeParam parses the query parameter name of r as a Unix time.
+func unixTimeParam(r *http.Request, name string) (time.Time, error) {
+	unix, err := strconv.ParseInt(r.URL.Query().Get(name), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad or missing %s parameter", name)
+	}
+	return time.Unix(unix, 0), nil
+}
+
 // HandleDebugRows responds to the client with a JSON representation of the physical rows. It returns up to
 // the first 100 rows in the database.
 func (s *Server) HandleDebugRows(w http.ResponseWriter, r *http.Request) {
@@ -118,6 +169,23 @@ func (s *Server) HandleSingleDimension(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "No such dimension: "+name, http.StatusBadRequest)
 }
 
+// HandleCompactDimensionTables flushes the database, dropping values which are no longer referenced by any
+// interval from the dimension tables. It responds with the new size of each dimension table.
+func (s *Server) HandleCompactDimensionTables(w http.ResponseWriter, r *http.Request) {
+	// As with a regular flush, the database state is not well-defined after an error (see Flush).
+	start := time.Now()
+	if err := s.DB.CompactDimensionTables(); err != nil {
+		Log.Printf(">>> FATAL ERROR ON DIMENSION TABLE COMPACTION: %s", err)
+		os.Exit(1)
+	}
+	statsd.Time("gumshoedb.compact-dimension-tables", time.Since(start))
+	sizes := make(map[string]int)
+	for name, values := range s.DB.GetDimensionTables() {
+		sizes[name] = len(values)
+	}
+	WriteJSONResponse(w, sizes)
+}
+
 // HandleQuery evaluates a query and returns an aggregated result set.
 // See the README for the query JSON structure and the structure of the results.
 func (s *Server) HandleQuery(w http.ResponseWriter, r *http.Request) {
@@ -169,6 +237,93 @@ func (s *Server) HandleQuery(w http.ResponseWriter, r *http.Request) {
 	WriteJSONResponse(w, results)
 }
 
+// DeleteRequest is the JSON body of a DELETE /data request. Start and End are Unix times bounding the
+// timestamps of the rows to delete (Start inclusive, End exclusive); either may be omitted.
+type DeleteRequest struct {
+	Filters    []gumshoe.QueryFilter
+	Start, End *int64
+}
+
+// HandleDelete deletes the rows matching the filters and time range in the request body and responds with
+// the number of (inserted) rows deleted.
+func (s *Server) HandleDelete(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	decoder := json.NewDecoder(r.Body)
+	var req DeleteRequest
+	if err := decoder.Decode(&req); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if len(req.Filters) == 0 && req.Start == nil && req.End == nil {
+		WriteError(w, errors.New("a delete requires filters or a time range"), http.StatusBadRequest)
+		return
+	}
+	var timeRange gumshoe.TimeRange
+	if req.Start != nil {
+		timeRange.Start = time.Unix(*req.Start, 0)
+	}
+	if req.End != nil {
+		timeRange.End = time.Unix(*req.End, 0)
+	}
+	rows, err := s.DB.Delete(req.Filters, timeRange)
+	if err != nil {
+		exitOnWriteError("DELETE", err)
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	elapsed := time.Since(start)
+	statsd.Time("gumshoedb.delete", elapsed)
+	statsd.Count("gumshoedb.delete.rows", float64(rows), 1)
+	WriteJSONResponse(w, map[string]int{
+		"rows":        rows,
+		"duration_ms": int(elapsed.Seconds() * 1000),
+	})
+}
+
+// HandleSnapshot writes a snapshot of the database to the directory given by the dir query parameter, which
+// must be within the configured snapshot dir (see gumshoe.DB.Snapshot).
+func (s *Server) HandleSnapshot(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if s.Config.SnapshotDir == "" {
+		http.Error(w, "Snapshots are not enabled (no snapshot_dir is configured)", http.StatusForbidden)
+		return
+	}
+	dir := r.URL.Query().Get("dir")
+	if dir == "" {
+		http.Error(w, "Must provide a snapshot dir", http.StatusBadRequest)
+		return
+	}
+	dir, err := snapshotPath(s.Config.SnapshotDir, dir)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := s.DB.Snapshot(dir); err != nil {
+		WriteError(w, err, 500)
+		return
+	}
+	elapsed := time.Since(start)
+	statsd.Time("gumshoedb.snapshot", elapsed)
+	WriteJSONResponse(w, map[string]interface{}{
+		"dir":         dir,
+		"duration_ms": int(elapsed.Seconds() * 1000),
+	})
+}
+
+// snapshotPath resolves dir (relative to root, unless it is absolute) to a directory for a snapshot. The
+// result must be a directory inside root.
+func snapshotPath(root, dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	dir = filepath.Clean(dir)
+	rel, err := filepath.Rel(filepath.Clean(root), dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("snapshot dir %s is not within %s", dir, root)
+	}
+	return dir, nil
+}
+
 // HandleMetricz writes a metricz page.
 func (s *Server) HandleMetricz(w http.ResponseWriter, r *http.Request) {
 	metricz, err := s.makeMetricz()
@@ -190,6 +345,13 @@ type Statusz struct {
 	// Unix times, nullable
 	LastUpdated    *int64
 	OldestInterval *int64
+	// Intervals which failed checksum verification (and are excluded from query results)
+	CorruptedIntervals []CorruptedInterval `json:",omitempty"`
+}
+
+type CorruptedInterval struct {
+	Start int64 // Unix time
+	Error string
 }
 
 func (s *Server) HandleStatusz(w http.ResponseWriter, r *http.Request) {
@@ -204,6 +366,10 @@ func (s *Server) HandleStatusz(w http.ResponseWriter, r *http.Request) {
 	if !oldestInterval.IsZero() {
 		statusz.OldestInterval = &oldest
 	}
+	for _, interval := range s.DB.GetCorruptedIntervals() {
+		statusz.CorruptedIntervals = append(statusz.CorruptedIntervals,
+			CorruptedInterval{interval.Start.Unix(), interval.Error})
+	}
 	WriteJSONResponse(w, statusz)
 }
 
@@ -215,9 +381,13 @@ func NewServer(conf *config.Config, schema *gumshoe.Schema) *Server {
 	mux := pat.New()
 
 	mux.Put("/insert", s.HandleInsert)
+	mux.Put("/replace", s.HandleReplace)
 	mux.Get("/dimension_tables/{name}", s.HandleSingleDimension)
 	mux.Get("/dimension_tables", s.HandleDimensionTables)
+	mux.Post("/dimension_tables/compact", s.HandleCompactDimensionTables)
 	mux.Post("/query", s.HandleQuery)
+	mux.Delete("/data", s.HandleDelete)
+	mux.Post("/admin/snapshot", s.HandleSnapshot)
 
 	mux.Get("/metricz", s.HandleMetricz)
 	mux.Get("/debug/rows", s.HandleDebugRows)
@@ -269,13 +439,26 @@ func (s *Server) RunPeriodicFlushes() {
 
 func (s *Server) RunPeriodicStatsChecks() {
 	// NOTE(caleb): For now, hardcode the interval. We can adjust it or make it a configuration option later.
+	var prevCompactions gumshoe.CompactionStats
 	for range time.Tick(time.Minute) {
 		stats := s.DB.GetDebugStats()
 		statsd.Gauge("gumshoedb.static-table.intervals", float64(stats.Intervals))
 		statsd.Gauge("gumshoedb.static-table.segments", float64(stats.Segments))
 		statsd.Gauge("gumshoedb.static-table.rows", float64(stats.Rows))
 		statsd.Gauge("gumshoedb.static-table.bytes", float64(stats.Bytes))
+		statsd.Gauge("gumshoedb.static-table.uncompressed-bytes", float64(stats.UncompressedBytes))
 		statsd.Gauge("gumshoedb.static-table.compression-ratio", stats.CompressionRatio)
+
+		compactions := s.DB.GetCompactionStats()
+		statsd.Gauge("gumshoedb.compaction.queued", float64(compactions.Queued))
+		statsd.Gauge("gumshoedb.compaction.running", float64(compactions.Running))
+		completed := compactions.Completed - prevCompactions.Completed
+		failed := compactions.Failed - prevCompactions.Failed
+		abandoned := compactions.Abandoned - prevCompactions.Abandoned
+		statsd.Count("gumshoedb.compaction.completed", float64(completed), 1)
+		statsd.Count("gumshoedb.compaction.failed", float64(failed), 1)
+		statsd.Count("gumshoedb.compaction.abandoned", float64(abandoned), 1)
+		prevCompactions = compactions
 	}
 }
 
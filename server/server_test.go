@@ -42,3 +42,37 @@ metric_columns = [["metric1", "uint32"]]
 	}
 	resp.Body.Close()
 }
+
+func TestSnapshotPath(t *testing.T) {
+	for _, tt := range []struct {
+		dir  string
+		want string // Empty if dir should be rejected
+	}{
+		{"db-20140513", "/backups/db-20140513"},
+		{"daily/db-20140513", "/backups/daily/db-20140513"},
+		{"/backups/db-20140513", "/backups/db-20140513"},
+		{"daily/../db-20140513", "/backups/db-20140513"},
+		{"..db", "/backups/..db"},
+		{".", ""},
+		{"..", ""},
+		{"../db", ""},
+		{"daily/../../db", ""},
+		{"/var/lib/db", ""},
+		{"/backups2/db", ""},
+	} {
+		got, err := snapshotPath("/backups", tt.dir)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("snapshotPath(%q): got %q; want an error", tt.dir, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("snapshotPath(%q): %s", tt.dir, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("snapshotPath(%q): got %q; want %q", tt.dir, got, tt.want)
+		}
+	}
+}